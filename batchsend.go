@@ -0,0 +1,248 @@
+// mautrix-whatsapp - A Matrix-WhatsApp puppeting bridge.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/appservice"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+const pendingEventIDPrefix = "net.maunium.whatsapp.pending::"
+
+var eventPortalCreated = event.Type{Type: "net.maunium.whatsapp.dummy.portal_created", Class: event.MessageEventType}
+
+func isPendingEventID(evtID id.EventID) bool {
+	return strings.HasPrefix(string(evtID), pendingEventIDPrefix)
+}
+
+type batchSendEvent struct {
+	Type      event.Type     `json:"type"`
+	Sender    id.UserID      `json:"sender"`
+	StateKey  *string        `json:"state_key,omitempty"`
+	Timestamp int64          `json:"origin_server_ts"`
+	Content   *event.Content `json:"content"`
+}
+
+type ReqBatchSend struct {
+	StateEventsAtStart []*batchSendEvent `json:"state_events_at_start"`
+	Events             []*batchSendEvent `json:"events"`
+}
+
+type RespBatchSend struct {
+	StateEventIDs []id.EventID `json:"state_event_ids"`
+	EventIDs      []id.EventID `json:"event_ids"`
+	NextBatchID   string       `json:"next_batch_id"`
+}
+
+type pendingHistoryEvent struct {
+	intent      *appservice.IntentAPI
+	eventType   event.Type
+	content     *event.Content
+	timestamp   int64
+	placeholder id.EventID
+}
+
+type historyBatch struct {
+	prevEventID id.EventID
+	batchID     string
+	events      []*pendingHistoryEvent
+}
+
+func (portal *Portal) canBatchSend() bool {
+	return portal.bridge.Config.Bridge.HistoryMethod == "batch" && atomic.LoadInt32(&portal.bridge.batchSendUnsupported) == 0
+}
+
+// ensureFirstEventID sends an invisible event to anchor MSC2716 batches to if the portal doesn't have one yet.
+func (portal *Portal) ensureFirstEventID() id.EventID {
+	if len(portal.FirstEventID) == 0 && portal.canBatchSend() {
+		resp, err := portal.MainIntent().SendMessageEvent(portal.MXID, eventPortalCreated, struct{}{})
+		if err != nil {
+			portal.log.Warnln("Failed to send dummy event to anchor history batches to:", err)
+			return ""
+		}
+		portal.FirstEventID = resp.EventID
+		portal.Update()
+	}
+	return portal.FirstEventID
+}
+
+// startHistoryBatch makes sendMessage collect backfilled events instead of sending them one by one.
+// The collected events are inserted after prevEventID when endHistoryBatch is called.
+//
+// MSC2716 batches are only used for history older than everything bridged so far, so prevEventID must be the
+// first event of the portal. Newer messages, like ones missed during downtime, would end up in the wrong place
+// in the timeline and must be sent normally.
+func (portal *Portal) startHistoryBatch(prevEventID id.EventID, batchID string) bool {
+	if !portal.canBatchSend() || len(prevEventID) == 0 || prevEventID != portal.FirstEventID {
+		return false
+	}
+	portal.historyBatchLock.Lock()
+	portal.historyBatch = &historyBatch{prevEventID: prevEventID, batchID: batchID}
+	portal.historyBatchLock.Unlock()
+	return true
+}
+
+// queueHistoryEvent adds the event to the current history batch. It returns nil if there's no batch in progress.
+func (portal *Portal) queueHistoryEvent(intent *appservice.IntentAPI, eventType event.Type, content *event.Content, timestamp int64) *mautrix.RespSendEvent {
+	portal.historyBatchLock.Lock()
+	defer portal.historyBatchLock.Unlock()
+	batch := portal.historyBatch
+	if batch == nil {
+		return nil
+	}
+	evt := &pendingHistoryEvent{
+		intent:    intent,
+		eventType: eventType,
+		content:   content,
+		timestamp: timestamp,
+		// message.mxid is unique and placeholders can outlive their batch, so they must be unique across batches too
+		placeholder: id.EventID(fmt.Sprintf("%s%s::%s", pendingEventIDPrefix, portal.MXID, *makeMessageID())),
+	}
+	batch.events = append(batch.events, evt)
+	return &mautrix.RespSendEvent{EventID: evt.placeholder}
+}
+
+// endHistoryBatch sends all collected events and returns the batch ID that can be used to insert even older history.
+func (portal *Portal) endHistoryBatch() string {
+	portal.historyBatchLock.Lock()
+	batch := portal.historyBatch
+	portal.historyBatch = nil
+	portal.historyBatchLock.Unlock()
+	if batch == nil || len(batch.events) == 0 {
+		return ""
+	}
+	var nextBatchID string
+	batchSize := portal.bridge.Config.Bridge.HistoryBatchSize
+	if batchSize <= 0 {
+		batchSize = 100
+	}
+	prevEventID := batch.prevEventID
+	batchID := batch.batchID
+	for start := 0; start < len(batch.events); start += batchSize {
+		end := start + batchSize
+		if end > len(batch.events) {
+			end = len(batch.events)
+		}
+		events := batch.events[start:end]
+		resp, err := portal.sendHistoryBatch(prevEventID, batchID, events)
+		if err != nil {
+			portal.log.Warnfln("Failed to batch send %d history events, falling back to sending them individually: %v", len(events), err)
+			portal.sendHistoryIndividually(events)
+			continue
+		}
+		for i, evt := range events {
+			if i < len(resp.EventIDs) {
+				portal.bridge.DB.Message.UpdateMXID(evt.placeholder, resp.EventIDs[i])
+			} else {
+				portal.dropHistoryPlaceholder(evt)
+			}
+		}
+		if start == 0 {
+			nextBatchID = resp.NextBatchID
+		}
+		// Later chunks are newer, so they're attached after the end of the previous chunk instead of threading batch IDs.
+		if len(resp.EventIDs) > 0 {
+			prevEventID = resp.EventIDs[len(resp.EventIDs)-1]
+			batchID = ""
+		}
+	}
+	return nextBatchID
+}
+
+func (portal *Portal) sendHistoryBatch(prevEventID id.EventID, batchID string, events []*pendingHistoryEvent) (*RespBatchSend, error) {
+	req := ReqBatchSend{
+		StateEventsAtStart: []*batchSendEvent{},
+		Events:             make([]*batchSendEvent, len(events)),
+	}
+	addedMembers := make(map[id.UserID]bool)
+	for i, evt := range events {
+		sender := evt.intent.UserID
+		if !addedMembers[sender] {
+			addedMembers[sender] = true
+			req.StateEventsAtStart = append(req.StateEventsAtStart, portal.historyMemberEvent(sender, evt.timestamp))
+		}
+		req.Events[i] = &batchSendEvent{
+			Type:      evt.eventType,
+			Sender:    sender,
+			Timestamp: evt.timestamp,
+			Content:   evt.content,
+		}
+	}
+	bot := portal.bridge.Bot
+	reqURL, _ := url.Parse(bot.BuildBaseURL("_matrix", "client", "unstable", "org.matrix.msc2716", "rooms", portal.MXID, "batch_send"))
+	query := reqURL.Query()
+	query.Set("prev_event_id", prevEventID.String())
+	if len(batchID) > 0 {
+		query.Set("batch_id", batchID)
+	}
+	reqURL.RawQuery = query.Encode()
+	var resp RespBatchSend
+	_, err := bot.MakeRequest(http.MethodPost, reqURL.String(), &req, &resp)
+	if err != nil {
+		var httpErr mautrix.HTTPError
+		if errors.As(err, &httpErr) && (httpErr.IsStatus(http.StatusNotFound) || (httpErr.RespError != nil && httpErr.RespError.ErrCode == "M_UNRECOGNIZED")) {
+			portal.log.Warnln("Homeserver doesn't seem to support MSC2716 batch sending, disabling it until restart")
+			atomic.StoreInt32(&portal.bridge.batchSendUnsupported, 1)
+		}
+		return nil, err
+	}
+	return &resp, nil
+}
+
+func (portal *Portal) historyMemberEvent(userID id.UserID, timestamp int64) *batchSendEvent {
+	content := event.MemberEventContent{Membership: event.MembershipJoin}
+	if puppet := portal.bridge.GetPuppetByMXID(userID); puppet != nil {
+		content.Displayname = puppet.Displayname
+		content.AvatarURL = puppet.AvatarURL.CUString()
+	}
+	stateKey := userID.String()
+	return &batchSendEvent{
+		Type:      event.StateMember,
+		Sender:    userID,
+		StateKey:  &stateKey,
+		Timestamp: timestamp,
+		Content:   &event.Content{Parsed: &content},
+	}
+}
+
+func (portal *Portal) sendHistoryIndividually(events []*pendingHistoryEvent) {
+	for _, evt := range events {
+		resp, err := evt.intent.SendMassagedMessageEvent(portal.MXID, evt.eventType, evt.content, evt.timestamp)
+		if err != nil {
+			portal.log.Errorfln("Failed to send backfilled event: %v", err)
+			portal.dropHistoryPlaceholder(evt)
+			continue
+		}
+		portal.bridge.DB.Message.UpdateMXID(evt.placeholder, resp.EventID)
+	}
+}
+
+// dropHistoryPlaceholder deletes the message row of a queued event that never got a real event ID,
+// so that the message isn't considered bridged and doesn't point at a nonexistent event.
+func (portal *Portal) dropHistoryPlaceholder(evt *pendingHistoryEvent) {
+	portal.log.Warnfln("Backfilled event %s wasn't sent, removing its message row", evt.placeholder)
+	portal.bridge.DB.Message.DeleteByMXID(evt.placeholder)
+}
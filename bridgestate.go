@@ -43,6 +43,7 @@ const (
 	WAServerTimeout BridgeErrorCode = "wa-server-timeout"
 	WAPingFalse     BridgeErrorCode = "wa-ping-false"
 	WAPingError     BridgeErrorCode = "wa-ping-error"
+	WAPhoneOffline  BridgeErrorCode = "wa-phone-offline"
 )
 
 var bridgeHumanErrors = map[BridgeErrorCode]string{
@@ -53,6 +54,7 @@ var bridgeHumanErrors = map[BridgeErrorCode]string{
 	WAServerTimeout: "The WhatsApp web servers are not responding. The bridge will try to reconnect.",
 	WAPingFalse:     "WhatsApp returned an error, reconnecting. Please make sure WhatsApp is running on your phone and connected to the internet.",
 	WAPingError:     "WhatsApp returned an unknown error",
+	WAPhoneOffline:  "Your phone appears to be offline. Messages will be bridged once it's connected to the internet again.",
 }
 
 type BridgeState struct {
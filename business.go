@@ -0,0 +1,207 @@
+// mautrix-whatsapp - A Matrix-WhatsApp puppeting bridge.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"image"
+	"net/http"
+	"strings"
+
+	"github.com/Rhymen/go-whatsapp"
+	waProto "github.com/Rhymen/go-whatsapp/binary/proto"
+
+	"maunium.net/go/mautrix/appservice"
+	"maunium.net/go/mautrix/event"
+)
+
+// ProductMessage is a product shared from a WhatsApp Business catalog. go-whatsapp doesn't parse these,
+// so they're parsed from the raw WebMessageInfo by parseProductMessage.
+type ProductMessage struct {
+	Info             whatsapp.MessageInfo
+	ContextInfo      whatsapp.ContextInfo
+	BusinessOwnerJID whatsapp.JID
+	Product          *waProto.ProductSnapshot
+	Catalog          *waProto.CatalogSnapshot
+}
+
+func (msg ProductMessage) GetInfo() whatsapp.MessageInfo {
+	return msg.Info
+}
+
+// parseProductMessage returns nil if the message isn't a product message.
+func parseProductMessage(msg *waProto.WebMessageInfo) *ProductMessage {
+	product := msg.GetMessage().GetProductMessage()
+	if product == nil || product.GetProduct() == nil {
+		return nil
+	}
+	contextInfo := product.GetContextInfo()
+	return &ProductMessage{
+		Info: whatsapp.MessageInfo{
+			Id:        msg.GetKey().GetId(),
+			RemoteJid: msg.GetKey().GetRemoteJid(),
+			SenderJid: msg.GetParticipant(),
+			FromMe:    msg.GetKey().GetFromMe(),
+			Timestamp: msg.GetMessageTimestamp(),
+			Status:    whatsapp.MessageStatus(msg.GetStatus()),
+			PushName:  msg.GetPushName(),
+			Source:    msg,
+		},
+		ContextInfo: whatsapp.ContextInfo{
+			QuotedMessageID: contextInfo.GetStanzaId(),
+			QuotedMessage:   contextInfo.GetQuotedMessage(),
+			Participant:     contextInfo.GetParticipant(),
+			IsForwarded:     contextInfo.GetIsForwarded(),
+			MentionedJID:    contextInfo.GetMentionedJid(),
+		},
+		BusinessOwnerJID: product.GetBusinessOwnerJid(),
+		Product:          product.GetProduct(),
+		Catalog:          product.GetCatalog(),
+	}
+}
+
+func formatProductPrice(currency string, amount1000 int64) string {
+	price := fmt.Sprintf("%d.%02d", amount1000/1000, (amount1000%1000)/10)
+	if len(currency) > 0 {
+		return fmt.Sprintf("%s %s", price, currency)
+	}
+	return price
+}
+
+// getCatalogURL returns the public link to the catalog of the business that owns the product.
+func (msg ProductMessage) getCatalogURL() string {
+	if len(msg.BusinessOwnerJID) == 0 || GetJIDType(msg.BusinessOwnerJID) != JIDTypeUser {
+		return ""
+	}
+	return fmt.Sprintf("https://wa.me/c/%s", JIDToPhoneNumber(msg.BusinessOwnerJID))
+}
+
+func (msg ProductMessage) formatContent() *event.MessageEventContent {
+	product := msg.Product
+	title := product.GetTitle()
+	if len(title) == 0 {
+		title = "Unnamed product"
+	}
+	var plain, formatted []string
+	plain = append(plain, fmt.Sprintf("Product: %s", title))
+	formatted = append(formatted, fmt.Sprintf("<strong>Product: %s</strong>", html.EscapeString(title)))
+	if product.PriceAmount1000 != nil {
+		price := formatProductPrice(product.GetCurrencyCode(), product.GetPriceAmount1000())
+		if product.SalePriceAmount1000 != nil {
+			salePrice := formatProductPrice(product.GetCurrencyCode(), product.GetSalePriceAmount1000())
+			plain = append(plain, fmt.Sprintf("Price: %s (was %s)", salePrice, price))
+			formatted = append(formatted, fmt.Sprintf("Price: %s <del>%s</del>", html.EscapeString(salePrice), html.EscapeString(price)))
+		} else {
+			plain = append(plain, fmt.Sprintf("Price: %s", price))
+			formatted = append(formatted, fmt.Sprintf("Price: %s", html.EscapeString(price)))
+		}
+	}
+	if description := product.GetDescription(); len(description) > 0 {
+		plain = append(plain, description)
+		formatted = append(formatted, strings.ReplaceAll(html.EscapeString(description), "\n", "<br/>"))
+	}
+	if url := product.GetUrl(); len(url) > 0 {
+		plain = append(plain, url)
+		formatted = append(formatted, fmt.Sprintf("<a href=\"%s\">%s</a>", html.EscapeString(url), html.EscapeString(url)))
+	}
+	if catalogURL := msg.getCatalogURL(); len(catalogURL) > 0 {
+		catalogName := msg.Catalog.GetTitle()
+		if len(catalogName) == 0 {
+			catalogName = "catalog"
+		}
+		plain = append(plain, fmt.Sprintf("View %s: %s", catalogName, catalogURL))
+		formatted = append(formatted, fmt.Sprintf("<a href=\"%s\">View %s</a>", catalogURL, html.EscapeString(catalogName)))
+	}
+	return &event.MessageEventContent{
+		MsgType:       event.MsgText,
+		Body:          strings.Join(plain, "\n"),
+		Format:        event.FormatHTML,
+		FormattedBody: strings.Join(formatted, "<br/>"),
+	}
+}
+
+// sendProductImage bridges the product image as a separate image event. If the full image can't be downloaded,
+// the thumbnail is used instead. Returns false if neither is available, in which case only the text is bridged.
+func (portal *Portal) sendProductImage(intent *appservice.IntentAPI, msg ProductMessage) bool {
+	img := msg.Product.GetProductImage()
+	if img == nil {
+		return false
+	}
+	data, err := whatsapp.Download(img.GetUrl(), img.GetMediaKey(), whatsapp.MediaImage, int(img.GetFileLength()))
+	mimeType := img.GetMimetype()
+	if err != nil {
+		portal.log.Warnfln("Failed to download product image of %s: %v", msg.Info.Id, err)
+		data = img.GetJpegThumbnail()
+		if len(data) == 0 {
+			return false
+		}
+		mimeType = http.DetectContentType(data)
+	} else if len(mimeType) == 0 {
+		mimeType = http.DetectContentType(data)
+	}
+	cfg, _, _ := image.DecodeConfig(bytes.NewReader(data))
+	size := len(data)
+	data, uploadMimeType, file := portal.encryptFile(data, mimeType)
+	uploaded, err := intent.UploadBytes(data, uploadMimeType)
+	if err != nil {
+		portal.log.Warnfln("Failed to upload product image of %s: %v", msg.Info.Id, err)
+		return false
+	}
+	content := &event.MessageEventContent{
+		MsgType: event.MsgImage,
+		Body:    msg.Product.GetTitle(),
+		File:    file,
+		Info: &event.FileInfo{
+			Size:     size,
+			MimeType: mimeType,
+			Width:    cfg.Width,
+			Height:   cfg.Height,
+		},
+	}
+	if content.File != nil {
+		content.File.URL = uploaded.ContentURI.CUString()
+	} else {
+		content.URL = uploaded.ContentURI.CUString()
+	}
+	_, err = portal.sendMessage(intent, event.EventMessage, content, int64(msg.Info.Timestamp*1000))
+	if err != nil {
+		portal.log.Warnfln("Failed to send product image of %s: %v", msg.Info.Id, err)
+		return false
+	}
+	return true
+}
+
+func (portal *Portal) HandleProductMessage(source *User, msg ProductMessage) bool {
+	intent := portal.startHandling(source, msg.Info, "product")
+	if intent == nil {
+		return false
+	}
+	portal.sendProductImage(intent, msg)
+
+	content := msg.formatContent()
+	addForwardedLabel(content, msg.Info)
+	portal.SetReply(content, msg.ContextInfo)
+	resp, err := portal.sendMessage(intent, event.EventMessage, content, int64(msg.Info.Timestamp*1000))
+	if err != nil {
+		portal.log.Errorfln("Failed to handle message %s: %v", msg.Info.Id, err)
+	} else {
+		portal.finishHandling(source, msg.Info.Source, resp.EventID)
+	}
+	return true
+}
@@ -18,12 +18,16 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"math"
+	"regexp"
 	"sort"
 	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/Rhymen/go-whatsapp"
 
@@ -61,6 +65,8 @@ type CommandEvent struct {
 	User    *User
 	Command string
 	Args    []string
+	// ReplyTo is the event the command message replied to, if any.
+	ReplyTo id.EventID
 }
 
 // Reply sends a reply to command as notice
@@ -78,7 +84,7 @@ func (ce *CommandEvent) Reply(msg string, args ...interface{}) {
 }
 
 // Handle handles messages to the bridge
-func (handler *CommandHandler) Handle(roomID id.RoomID, user *User, message string) {
+func (handler *CommandHandler) Handle(roomID id.RoomID, user *User, message string, replyTo id.EventID) {
 	args := strings.Fields(message)
 	if len(args) == 0 {
 		args = []string{"unknown-command"}
@@ -92,6 +98,7 @@ func (handler *CommandHandler) Handle(roomID id.RoomID, user *User, message stri
 		User:    user,
 		Command: strings.ToLower(args[0]),
 		Args:    args[1:],
+		ReplyTo: replyTo,
 	}
 	handler.log.Debugfln("%s sent '%s' in %s", user.MXID, message, roomID)
 	if roomID == handler.bridge.Config.Bridge.Relaybot.ManagementRoom {
@@ -101,74 +108,119 @@ func (handler *CommandHandler) Handle(roomID id.RoomID, user *User, message stri
 	}
 }
 
-func (handler *CommandHandler) CommandMux(ce *CommandEvent) {
-	switch ce.Command {
-	case "relaybot":
-		handler.CommandRelaybot(ce)
-	case "login":
-		handler.CommandLogin(ce)
-	case "logout-matrix":
-		handler.CommandLogoutMatrix(ce)
-	case "help":
-		handler.CommandHelp(ce)
-	case "version":
-		handler.CommandVersion(ce)
-	case "reconnect", "connect":
-		handler.CommandReconnect(ce)
-	case "disconnect":
-		handler.CommandDisconnect(ce)
-	case "ping":
-		handler.CommandPing(ce)
-	case "delete-connection":
-		handler.CommandDeleteConnection(ce)
-	case "delete-session":
-		handler.CommandDeleteSession(ce)
-	case "delete-portal":
-		handler.CommandDeletePortal(ce)
-	case "delete-all-portals":
-		handler.CommandDeleteAllPortals(ce)
-	case "discard-megolm-session", "discard-session":
-		handler.CommandDiscardMegolmSession(ce)
-	case "dev-test":
-		handler.CommandDevTest(ce)
-	case "set-pl":
-		handler.CommandSetPowerLevel(ce)
-	case "logout":
-		handler.CommandLogout(ce)
-	case "toggle":
-		handler.CommandToggle(ce)
-	case "login-matrix", "sync", "list", "open", "pm", "invite-link", "join", "create":
+type commandPermission int
+
+const (
+	// permissionUser commands can be used by any whitelisted user.
+	permissionUser commandPermission = iota
+	// permissionLoggedIn commands require an active WhatsApp connection.
+	permissionLoggedIn
+	// permissionAdmin commands can only be used by bridge admins.
+	permissionAdmin
+)
+
+type commandInfo struct {
+	Name       string
+	Aliases    []string
+	Help       string
+	Permission commandPermission
+	Handler    func(*CommandHandler, *CommandEvent)
+	// Hidden commands aren't listed in the help, e.g. because they're only meant for debugging.
+	Hidden bool
+}
+
+var commands []*commandInfo
+var commandsByName map[string]*commandInfo
+
+func init() {
+	commands = []*commandInfo{
+		{Name: "help", Help: cmdHelpHelp, Handler: (*CommandHandler).CommandHelp},
+		{Name: "version", Help: cmdVersionHelp, Handler: (*CommandHandler).CommandVersion},
+		{Name: "login", Help: cmdLoginHelp, Handler: (*CommandHandler).CommandLogin},
+		{Name: "logout", Help: cmdLogoutHelp, Handler: (*CommandHandler).CommandLogout},
+		{Name: "delete-session", Help: cmdDeleteSessionHelp, Handler: (*CommandHandler).CommandDeleteSession},
+		{Name: "reconnect", Aliases: []string{"connect"}, Help: cmdReconnectHelp, Handler: (*CommandHandler).CommandReconnect},
+		{Name: "disconnect", Help: cmdDisconnectHelp, Handler: (*CommandHandler).CommandDisconnect},
+		{Name: "delete-connection", Help: cmdDeleteConnectionHelp, Handler: (*CommandHandler).CommandDeleteConnection},
+		{Name: "ping", Help: cmdPingHelp, Handler: (*CommandHandler).CommandPing},
+		{Name: "login-matrix", Help: cmdLoginMatrixHelp, Permission: permissionLoggedIn, Handler: (*CommandHandler).CommandLoginMatrix},
+		{Name: "logout-matrix", Help: cmdLogoutMatrixHelp, Handler: (*CommandHandler).CommandLogoutMatrix},
+		{Name: "settings", Help: cmdSettingsHelp, Handler: (*CommandHandler).CommandSettings},
+		{Name: "toggle", Help: cmdToggleHelp, Handler: (*CommandHandler).CommandToggle},
+		{Name: "set", Help: cmdSetHelp, Handler: (*CommandHandler).CommandSet},
+		{Name: "notices", Help: cmdNoticesHelp, Handler: (*CommandHandler).CommandNotices},
+		{Name: "backfill", Help: cmdBackfillHelp, Permission: permissionLoggedIn, Handler: (*CommandHandler).CommandBackfill},
+		{Name: "redownload", Help: cmdRedownloadHelp, Permission: permissionLoggedIn, Handler: (*CommandHandler).CommandRedownload},
+		{Name: "backfill-limit", Help: cmdBackfillLimitHelp, Handler: (*CommandHandler).CommandBackfillLimit},
+		{Name: "disappearing", Aliases: []string{"disappearing-timer"}, Help: cmdDisappearingHelp, Permission: permissionLoggedIn, Handler: (*CommandHandler).CommandDisappearing},
+		{Name: "sync", Help: cmdSyncHelp, Permission: permissionLoggedIn, Handler: (*CommandHandler).CommandSync},
+		{Name: "list", Help: cmdListHelp, Permission: permissionLoggedIn, Handler: (*CommandHandler).CommandList},
+		{Name: "whois", Help: cmdWhoisHelp, Permission: permissionLoggedIn, Handler: (*CommandHandler).CommandWhois},
+		{Name: "search", Help: cmdSearchHelp, Permission: permissionLoggedIn, Handler: (*CommandHandler).CommandSearch},
+		{Name: "open", Help: cmdOpenHelp, Permission: permissionLoggedIn, Handler: (*CommandHandler).CommandOpen},
+		{Name: "pm", Help: cmdPMHelp, Permission: permissionLoggedIn, Handler: (*CommandHandler).CommandPM},
+		{Name: "invite-link", Help: cmdInviteLinkHelp, Permission: permissionLoggedIn, Handler: (*CommandHandler).CommandInviteLink},
+		{Name: "join", Help: cmdJoinHelp, Permission: permissionLoggedIn, Handler: (*CommandHandler).CommandJoin},
+		{Name: "create", Aliases: []string{"create-group"}, Help: cmdCreateHelp, Permission: permissionLoggedIn, Handler: (*CommandHandler).CommandCreate},
+		{Name: "set-pl", Help: cmdSetPowerLevelHelp, Permission: permissionAdmin, Handler: (*CommandHandler).CommandSetPowerLevel},
+		{Name: "delete-portal", Help: cmdDeletePortalHelp, Handler: (*CommandHandler).CommandDeletePortal},
+		{Name: "delete-all-portals", Help: cmdDeleteAllPortalsHelp, Permission: permissionAdmin, Handler: (*CommandHandler).CommandDeleteAllPortals},
+		{Name: "prune-messages", Help: cmdPruneMessagesHelp, Permission: permissionAdmin, Handler: (*CommandHandler).CommandPruneMessages},
+		{Name: "clean-rooms", Help: cmdCleanRoomsHelp, Permission: permissionAdmin, Handler: (*CommandHandler).CommandCleanRooms},
+		{Name: "relay", Help: cmdRelayHelp, Handler: (*CommandHandler).CommandRelay},
+		{Name: "set-relay", Help: cmdSetRelayHelp, Permission: permissionLoggedIn, Handler: (*CommandHandler).CommandSetRelay},
+		{Name: "unset-relay", Help: cmdUnsetRelayHelp, Handler: (*CommandHandler).CommandUnsetRelay},
+		{Name: "relaybot", Help: cmdRelaybotHelp, Permission: permissionAdmin, Handler: (*CommandHandler).CommandRelaybot},
+		{Name: "discard-megolm-session", Aliases: []string{"discard-session"}, Help: cmdDiscardMegolmSessionHelp, Permission: permissionAdmin, Handler: (*CommandHandler).CommandDiscardMegolmSession},
+		{Name: "dev-test", Permission: permissionAdmin, Handler: (*CommandHandler).CommandDevTest, Hidden: true},
+	}
+	commandsByName = make(map[string]*commandInfo)
+	for _, cmd := range commands {
+		commandsByName[cmd.Name] = cmd
+		for _, alias := range cmd.Aliases {
+			commandsByName[alias] = cmd
+		}
+	}
+}
+
+// checkPermission makes sure the user is allowed to run the command and replies with the reason if not.
+func (ce *CommandEvent) checkPermission(cmd *commandInfo) bool {
+	switch cmd.Permission {
+	case permissionAdmin:
+		// The relaybot can only be controlled by admins in the first place
+		if !ce.User.Admin && !ce.User.IsRelaybot {
+			ce.Reply("That command is limited to bridge administrators.")
+			return false
+		}
+	case permissionLoggedIn:
 		if !ce.User.HasSession() {
 			ce.Reply("You are not logged in. Use the `login` command to log into WhatsApp.")
-			return
+			return false
 		} else if !ce.User.IsConnected() {
 			ce.Reply("You are not connected to WhatsApp. Use the `reconnect` command to reconnect.")
-			return
+			return false
 		}
+	}
+	return true
+}
 
-		switch ce.Command {
-		case "login-matrix":
-			handler.CommandLoginMatrix(ce)
-		case "sync":
-			handler.CommandSync(ce)
-		case "list":
-			handler.CommandList(ce)
-		case "open":
-			handler.CommandOpen(ce)
-		case "pm":
-			handler.CommandPM(ce)
-		case "invite-link":
-			handler.CommandInviteLink(ce)
-		case "join":
-			handler.CommandJoin(ce)
-		case "create":
-			handler.CommandCreate(ce)
+func (handler *CommandHandler) CommandMux(ce *CommandEvent) {
+	cmd, ok := commandsByName[ce.Command]
+	if !ok {
+		if ce.RoomID == ce.User.ManagementRoom && !ce.User.IsRelaybot {
+			ce.Reply("Unknown command. These are the commands you can use:\n\n%s", handler.renderHelp(ce))
+		} else {
+			ce.Reply("Unknown command, use the `help` command for help.")
 		}
-	default:
-		ce.Reply("Unknown command, use the `help` command for help.")
+		return
+	} else if !ce.checkPermission(cmd) {
+		return
 	}
+	cmd.Handler(handler, ce)
 }
 
+const cmdDiscardMegolmSessionHelp = `discard-megolm-session - Discard the Megolm session in the current room, so that a new one is created for the next message from WhatsApp.`
+
 func (handler *CommandHandler) CommandDiscardMegolmSession(ce *CommandEvent) {
 	if handler.bridge.Crypto == nil {
 		ce.Reply("This bridge instance doesn't have end-to-bridge encryption enabled")
@@ -180,6 +232,121 @@ func (handler *CommandHandler) CommandDiscardMegolmSession(ce *CommandEvent) {
 	}
 }
 
+const cmdRelayHelp = `relay [on|off] - Allow Matrix users without WhatsApp accounts to send messages in the current portal through a logged-in user's connection.`
+
+func (handler *CommandHandler) CommandRelay(ce *CommandEvent) {
+	portal := ce.Portal
+	if portal == nil {
+		ce.Reply("This is not a portal room")
+		return
+	} else if !handler.bridge.Config.Bridge.Relay.Enabled {
+		ce.Reply("Relay mode is not enabled on this bridge")
+		return
+	} else if len(ce.Args) == 0 {
+		if !portal.RelayEnabled {
+			ce.Reply("Relay mode is off in this portal")
+		} else if len(portal.RelayUserID) > 0 && portal.GetRelayUser() == nil {
+			ce.Reply("Relay mode is on, but the relay user [%[1]s](https://matrix.to/#/%[1]s) is not connected", portal.RelayUserID)
+		} else if relayUser := portal.GetRelayUser(); relayUser != nil {
+			ce.Reply("Relay mode is on, messages are currently relayed through [%[1]s](https://matrix.to/#/%[1]s)", relayUser.MXID)
+		} else {
+			ce.Reply("Relay mode is on, but none of the logged-in users in this portal are connected")
+		}
+		return
+	}
+	if handler.bridge.Config.Bridge.Relay.AdminOnly && !ce.User.Admin {
+		ce.Reply("Only bridge admins can change relay mode")
+		return
+	} else if !ce.User.Admin && (!ce.User.HasSession() || !ce.User.IsInPortal(portal.Key)) {
+		ce.Reply("You must be logged in and in the WhatsApp chat to change relay mode")
+		return
+	}
+	switch strings.ToLower(ce.Args[0]) {
+	case "on", "true", "yes", "enable":
+		portal.RelayEnabled = true
+	case "off", "false", "no", "disable":
+		portal.RelayEnabled = false
+	default:
+		ce.Reply("**Usage:** `relay [on|off]`")
+		return
+	}
+	portal.Update()
+	portal.log.Infofln("%s turned relay mode %s", ce.User.MXID, formatOnOff(portal.RelayEnabled))
+	ce.Reply("Relay mode turned %s", formatOnOff(portal.RelayEnabled))
+}
+
+const cmdSetRelayHelp = `set-relay [<_Matrix user ID_>] - Relay messages in the current portal only through the given user's connection (defaults to you). Also turns on relay mode.`
+
+// CommandSetRelay handles set-relay command
+func (handler *CommandHandler) CommandSetRelay(ce *CommandEvent) {
+	portal := ce.Portal
+	if portal == nil {
+		ce.Reply("This is not a portal room")
+		return
+	} else if !handler.bridge.Config.Bridge.Relay.Enabled {
+		ce.Reply("Relay mode is not enabled on this bridge")
+		return
+	} else if handler.bridge.Config.Bridge.Relay.AdminOnly && !ce.User.Admin {
+		ce.Reply("Only bridge admins can change relay mode")
+		return
+	}
+	relayUser := ce.User
+	if len(ce.Args) > 0 {
+		userID := id.UserID(ce.Args[0])
+		if _, _, err := userID.Parse(); err != nil {
+			ce.Reply("**Usage:** `set-relay [<Matrix user ID>]`")
+			return
+		} else if userID != ce.User.MXID && !ce.User.Admin {
+			ce.Reply("Only bridge admins can make other users the relay")
+			return
+		}
+		relayUser = handler.bridge.GetUserByMXID(userID)
+		if relayUser == nil {
+			ce.Reply("%s can't be used as a relay", userID)
+			return
+		}
+	}
+	if !relayUser.IsConnected() {
+		ce.Reply("[%[1]s](https://matrix.to/#/%[1]s) is not connected to WhatsApp", relayUser.MXID)
+		return
+	} else if !relayUser.IsInPortal(portal.Key) {
+		ce.Reply("[%[1]s](https://matrix.to/#/%[1]s) is not in the WhatsApp chat of this portal", relayUser.MXID)
+		return
+	} else if !handler.bridge.StateStore.IsInRoom(portal.MXID, relayUser.MXID) {
+		ce.Reply("[%[1]s](https://matrix.to/#/%[1]s) is not in this room", relayUser.MXID)
+		return
+	}
+	portal.RelayUserID = relayUser.MXID
+	portal.RelayEnabled = true
+	portal.Update()
+	portal.log.Infofln("%s set the relay user to %s", ce.User.MXID, relayUser.MXID)
+	ce.Reply("Messages in this portal will now be relayed through [%[1]s](https://matrix.to/#/%[1]s)", relayUser.MXID)
+}
+
+const cmdUnsetRelayHelp = `unset-relay - Stop using a specific user as the relay in the current portal. Relay mode stays on with any connected user as the relay.`
+
+// CommandUnsetRelay handles unset-relay command
+func (handler *CommandHandler) CommandUnsetRelay(ce *CommandEvent) {
+	portal := ce.Portal
+	if portal == nil {
+		ce.Reply("This is not a portal room")
+		return
+	} else if len(portal.RelayUserID) == 0 {
+		ce.Reply("This portal doesn't have a relay user set")
+		return
+	} else if portal.RelayUserID != ce.User.MXID && !ce.User.Admin &&
+		(handler.bridge.Config.Bridge.Relay.AdminOnly || !ce.User.HasSession() || !ce.User.IsInPortal(portal.Key)) {
+		ce.Reply("You must be a bridge admin or the relay user to unset the relay")
+		return
+	}
+	portal.log.Infofln("%s unset the relay user %s", ce.User.MXID, portal.RelayUserID)
+	portal.RelayUserID = ""
+	portal.Update()
+	ce.Reply("Relay user unset. Use `relay off` to turn off relay mode completely.")
+}
+
+const cmdRelaybotHelp = `relaybot <_command_> - Run a command as the relaybot.`
+
 func (handler *CommandHandler) CommandRelaybot(ce *CommandEvent) {
 	if handler.bridge.Relaybot == nil {
 		ce.Reply("The relaybot is disabled")
@@ -215,19 +382,59 @@ func (handler *CommandHandler) CommandVersion(ce *CommandEvent) {
 	ce.Reply(fmt.Sprintf("[%s](%s) %s (%s)", Name, URL, linkifiedVersion, BuildTime))
 }
 
-const cmdInviteLinkHelp = `invite-link - Get an invite link to the current group chat.`
+const cmdInviteLinkHelp = `invite-link [_group JID or room ID_] - Get an invite link to the current group chat or the given group.`
+
+// getTargetGroupPortal finds the group portal a command is targeting,
+// either from the first argument (as a group JID or room ID) or from the room the command was sent in.
+func (handler *CommandHandler) getTargetGroupPortal(ce *CommandEvent) *Portal {
+	portal := ce.Portal
+	if len(ce.Args) > 0 {
+		if GetJIDType(ce.Args[0]) == JIDTypeGroup {
+			// Don't create portal rows for arbitrary input, only known groups can be targeted
+			portal = handler.bridge.GetExistingPortalByJID(database.GroupPortalKey(ce.Args[0]))
+			if portal == nil {
+				ce.Reply("Unknown group %s", ce.Args[0])
+				return nil
+			}
+		} else {
+			portal = handler.bridge.GetPortalByMXID(id.RoomID(ce.Args[0]))
+			if portal == nil {
+				ce.Reply("That room is not a portal room")
+				return nil
+			}
+		}
+	}
+	if portal == nil {
+		ce.Reply("**Usage:** `%s <group JID or room ID>`", ce.Command)
+		return nil
+	} else if portal.IsPrivateChat() || portal.IsBroadcastList() {
+		ce.Reply("That command can only be used for group chats")
+		return nil
+	}
+	return portal
+}
 
+// TODO add a revoke-invite-link command once go-whatsapp can reset invite codes.
+// The web protocol query for it (["action", "inviteReset", jid]) can only be sent with the unexported writeJSON.
 func (handler *CommandHandler) CommandInviteLink(ce *CommandEvent) {
-	if ce.Portal == nil {
-		ce.Reply("Not a portal room")
-		return
-	} else if ce.Portal.IsPrivateChat() {
-		ce.Reply("Can't get invite link to private chat")
+	portal := handler.getTargetGroupPortal(ce)
+	if portal == nil {
 		return
 	}
 
-	link, err := ce.User.Conn.GroupInviteLink(ce.Portal.Key.JID)
+	isParticipant, isAdmin, err := portal.getGroupParticipantStatus(ce.User)
 	if err != nil {
+		ce.Reply("Failed to get group info: %v", err)
+		return
+	} else if !isParticipant {
+		ce.Reply("You're not a participant of that group")
+		return
+	}
+	link, err := ce.User.Conn.GroupInviteLink(portal.Key.JID)
+	if errors.Is(err, whatsapp.ErrCantGetInviteLink) && !isAdmin {
+		ce.Reply("Failed to get invite link: only admins can get the invite link to this group")
+		return
+	} else if err != nil {
 		ce.Reply("Failed to get invite link: %v", err)
 		return
 	}
@@ -237,24 +444,38 @@ func (handler *CommandHandler) CommandInviteLink(ce *CommandEvent) {
 const cmdJoinHelp = `join <invite link> - Join a group chat with an invite link.`
 const inviteLinkPrefix = "https://chat.whatsapp.com/"
 
+var inviteCodeRegex = regexp.MustCompile("^[0-9A-Za-z]+$")
+
 func (handler *CommandHandler) CommandJoin(ce *CommandEvent) {
 	if len(ce.Args) == 0 {
 		ce.Reply("**Usage:** `join <invite link>`")
 		return
-	} else if len(ce.Args[0]) <= len(inviteLinkPrefix) || ce.Args[0][:len(inviteLinkPrefix)] != inviteLinkPrefix {
+	} else if !strings.HasPrefix(ce.Args[0], inviteLinkPrefix) {
 		ce.Reply("That doesn't look like a WhatsApp invite link")
 		return
 	}
+	code := strings.TrimSuffix(ce.Args[0][len(inviteLinkPrefix):], "/")
+	if !inviteCodeRegex.MatchString(code) {
+		ce.Reply("That doesn't look like a valid WhatsApp invite code")
+		return
+	}
 
-	jid, err := ce.User.Conn.GroupAcceptInviteCode(ce.Args[0][len(inviteLinkPrefix):])
+	jid, err := ce.User.Conn.GroupAcceptInviteCode(code)
 	if err != nil {
-		ce.Reply("Failed to join group: %v", err)
+		ce.Reply("Failed to join group: %s", describeJoinError(err))
 		return
 	}
 
-	handler.log.Debugln("%s successfully joined group %s", ce.User.MXID, jid)
+	handler.log.Debugfln("%s successfully joined group %s", ce.User.MXID, jid)
+	if GetJIDType(jid) != JIDTypeGroup {
+		ce.Reply("Joined unknown group %s, not creating a portal for it", jid)
+		return
+	}
 	portal := handler.bridge.GetPortalByJID(database.GroupPortalKey(jid))
-	if len(portal.MXID) > 0 {
+	if len(portal.MXID) > 0 && ce.User.IsInPortal(portal.Key) {
+		portal.Sync(ce.User, whatsapp.Contact{JID: portal.Key.JID})
+		ce.Reply("You're already in the group \"%s\": [%s](https://matrix.to/#/%s)", portal.Name, portal.Name, portal.MXID)
+	} else if len(portal.MXID) > 0 {
 		portal.Sync(ce.User, whatsapp.Contact{JID: portal.Key.JID})
 		ce.Reply("Successfully joined group \"%s\" and synced portal room: [%s](https://matrix.to/#/%s)", portal.Name, portal.Name, portal.MXID)
 	} else {
@@ -268,7 +489,29 @@ func (handler *CommandHandler) CommandJoin(ce *CommandEvent) {
 	}
 }
 
-const cmdCreateHelp = `create - Create a group chat.`
+// describeJoinError converts the errors returned when accepting an invite code into something more readable.
+func describeJoinError(err error) string {
+	var status int
+	if errors.Is(err, whatsapp.ErrJoinUnauthorized) {
+		return "you're not allowed to join that group (you may have been removed from it)"
+	} else if _, scanErr := fmt.Sscanf(err.Error(), "request responded with %d", &status); scanErr != nil {
+		return err.Error()
+	}
+	switch status {
+	case 404:
+		return "the invite link is invalid"
+	case 406, 410:
+		return "the invite link has expired or was revoked"
+	case 409:
+		return "you're already in that group"
+	case 419:
+		return "the group is full"
+	default:
+		return err.Error()
+	}
+}
+
+const cmdCreateHelp = `create [_name_] [_phone numbers..._] - Create a WhatsApp group from the current Matrix room, including WhatsApp users already in the room and the given phone numbers. The room name is used if a name isn't given.`
 
 func (handler *CommandHandler) CommandCreate(ce *CommandEvent) {
 	if ce.Portal != nil {
@@ -282,14 +525,36 @@ func (handler *CommandHandler) CommandCreate(ce *CommandEvent) {
 		return
 	}
 
+	var nameParts []string
+	var numbers []whatsapp.JID
+	for _, arg := range ce.Args {
+		jid, ok := ParsePhoneNumberJID(arg)
+		if ok {
+			numbers = append(numbers, jid)
+		} else if len(numbers) == 0 {
+			nameParts = append(nameParts, arg)
+		} else {
+			ce.Reply("Invalid phone number: %s", arg)
+			return
+		}
+	}
+
 	var roomNameEvent event.RoomNameEventContent
-	err = ce.Bot.StateEvent(ce.RoomID, event.StateRoomName, "", &roomNameEvent)
-	if err != nil && !errors.Is(err, mautrix.MNotFound) {
-		ce.Reply("Failed to get room name")
-		return
-	} else if len(roomNameEvent.Name) == 0 {
-		ce.Reply("Please set a name for the room first")
-		return
+	if len(nameParts) > 0 {
+		roomNameEvent.Name = strings.Join(nameParts, " ")
+		_, err = ce.Bot.SendStateEvent(ce.RoomID, event.StateRoomName, "", &roomNameEvent)
+		if err != nil {
+			handler.log.Warnfln("Failed to set name of %s to the new group name: %v", ce.RoomID, err)
+		}
+	} else {
+		err = ce.Bot.StateEvent(ce.RoomID, event.StateRoomName, "", &roomNameEvent)
+		if err != nil && !errors.Is(err, mautrix.MNotFound) {
+			ce.Reply("Failed to get room name")
+			return
+		} else if len(roomNameEvent.Name) == 0 {
+			ce.Reply("Please set a name for the room first or give one as the first argument")
+			return
+		}
 	}
 
 	var encryptionEvent event.EncryptionEventContent
@@ -300,24 +565,68 @@ func (handler *CommandHandler) CommandCreate(ce *CommandEvent) {
 	}
 
 	participants := []string{ce.User.JID}
+	addParticipant := func(jid whatsapp.JID) {
+		for _, existing := range participants {
+			if existing == jid {
+				return
+			}
+		}
+		participants = append(participants, jid)
+	}
 	for userID := range members.Joined {
 		jid, ok := handler.bridge.ParsePuppetMXID(userID)
-		if ok && jid != ce.User.JID {
-			participants = append(participants, jid)
+		if ok {
+			addParticipant(jid)
+		}
+	}
+	var unreachable []string
+	for _, jid := range numbers {
+		ce.User.Conn.Store.ContactsLock.RLock()
+		_, isContact := ce.User.Conn.Store.Contacts[jid]
+		ce.User.Conn.Store.ContactsLock.RUnlock()
+		if !isContact {
+			existingJID, exists, err := checkExists(ce.User, jid)
+			if err != nil {
+				ce.Reply("Failed to check if %s is on WhatsApp: %v", JIDToPhoneNumber(jid), err)
+				return
+			} else if !exists {
+				unreachable = append(unreachable, "+"+JIDToPhoneNumber(jid))
+				continue
+			}
+			jid = existingJID
 		}
+		addParticipant(jid)
+	}
+	if len(unreachable) > 0 {
+		ce.Reply("Not adding %s to the group: not on WhatsApp", strings.Join(unreachable, ", "))
+	}
+	if len(participants) < 2 {
+		ce.Reply("Can't create a group without any other participants")
+		return
 	}
 
 	resp, err := ce.User.Conn.CreateGroup(roomNameEvent.Name, participants)
 	if err != nil {
 		ce.Reply("Failed to create group: %v", err)
 		return
+	} else if resp.Status != 0 && resp.Status != 200 {
+		ce.Reply("Failed to create group: %s", describeGroupActionCode(strconv.Itoa(resp.Status)))
+		return
+	}
+	if GetJIDType(resp.GroupID) != JIDTypeGroup {
+		ce.Reply("Failed to create group: WhatsApp returned an unknown group ID %s", resp.GroupID)
+		return
 	}
 	portal := handler.bridge.GetPortalByJID(database.GroupPortalKey(resp.GroupID))
 	portal.roomCreateLock.Lock()
 	defer portal.roomCreateLock.Unlock()
 	if len(portal.MXID) != 0 {
-		portal.log.Warnln("Detected race condition in room creation")
-		// TODO race condition, clean up the old room
+		// The group creation notification from WhatsApp got handled before we got here
+		portal.log.Warnln("Detected race condition in room creation, replacing", portal.MXID, "with", ce.RoomID)
+		portal.bridge.portalsLock.Lock()
+		delete(portal.bridge.portalsByMXID, portal.MXID)
+		portal.bridge.portalsLock.Unlock()
+		portal.Cleanup(false)
 	}
 	portal.MXID = ce.RoomID
 	portal.Name = roomNameEvent.Name
@@ -330,10 +639,22 @@ func (handler *CommandHandler) CommandCreate(ce *CommandEvent) {
 		portal.Encrypted = true
 	}
 
+	portal.Unbridged = false
 	portal.Update()
+	portal.bridge.portalsLock.Lock()
+	portal.bridge.portalsByMXID[portal.MXID] = portal
+	portal.bridge.portalsLock.Unlock()
 	portal.UpdateBridgeInfo()
+	if portal.UpdateMetadata(ce.User) {
+		portal.Update()
+	}
 
-	ce.Reply("Successfully created WhatsApp group %s", portal.Key.JID)
+	ce.Reply("Successfully created WhatsApp group `%s`", portal.Key.JID)
+	for jid, result := range resp.Participants {
+		if len(result.Code) > 0 && result.Code != "200" {
+			ce.Reply("Failed to add %s to the group: %s", JIDToPhoneNumber(jid), describeGroupActionCode(result.Code))
+		}
+	}
 	inCommunity := ce.User.addPortalToCommunity(portal)
 	ce.User.CreateUserPortal(database.PortalKeyWithMeta{PortalKey: portal.Key, InCommunity: inCommunity})
 }
@@ -382,8 +703,17 @@ const cmdLoginHelp = `login - Authenticate this Bridge as WhatsApp Web Client`
 
 // CommandLogin handles login command
 func (handler *CommandHandler) CommandLogin(ce *CommandEvent) {
+	if len(ce.Args) > 0 {
+		// Pairing codes are only available for multi-device clients, the web protocol only supports QR codes.
+		ce.Reply("Logging in with a pairing code is not supported by the WhatsApp Web protocol the bridge uses. " +
+			"Falling back to QR code login.")
+	}
 	if !ce.User.Connect(true) {
 		ce.User.log.Debugln("Connect() returned false, assuming error was logged elsewhere and canceling login.")
+		if ce.User.Session != nil {
+			ce.Reply("Failed to connect with your existing session. If the session is broken, " +
+				"use `delete-session` to forget it and then try logging in again.")
+		}
 		return
 	}
 	ce.User.Login(ce)
@@ -396,9 +726,6 @@ func (handler *CommandHandler) CommandLogout(ce *CommandEvent) {
 	if ce.User.Session == nil {
 		ce.Reply("You're not logged in.")
 		return
-	} else if !ce.User.IsConnected() {
-		ce.Reply("You are not connected to WhatsApp. Use the `reconnect` command to reconnect, or `delete-session` to forget all login information.")
-		return
 	}
 	puppet := handler.bridge.GetPuppetByJID(ce.User.JID)
 	if puppet.CustomMXID != "" {
@@ -407,62 +734,175 @@ func (handler *CommandHandler) CommandLogout(ce *CommandEvent) {
 			ce.User.log.Warnln("Failed to logout-matrix while logging out of WhatsApp:", err)
 		}
 	}
+	if !ce.User.IsConnected() {
+		// There's no connection to send the logout request through, so just forget the session locally.
+		ce.User.clearLocalSession()
+		ce.Reply("You were not connected to WhatsApp, so the session was only deleted from the bridge. " +
+			"You may also want to remove the bridge from the linked devices list on your phone.")
+		return
+	}
 	err := ce.User.Conn.Logout()
 	if err != nil {
 		ce.User.log.Warnln("Error while logging out:", err)
 		ce.Reply("Unknown error while logging out: %v", err)
 		return
 	}
-	ce.User.removeFromJIDMap()
-	// TODO this causes a foreign key violation, which should be fixed
-	//ce.User.JID = ""
-	ce.User.SetSession(nil)
-	ce.User.DeleteConnection()
+	ce.User.clearLocalSession()
 	ce.Reply("Logged out successfully.")
 }
 
-const cmdToggleHelp = `toggle <presence|receipts|all> - Toggle bridging of presence or read receipts`
+const cmdNoticesHelp = `notices [silent|errors|verbose] - View or change which connection status notices are sent to this room.`
 
-func (handler *CommandHandler) CommandToggle(ce *CommandEvent) {
-	if len(ce.Args) == 0 || (ce.Args[0] != "presence" && ce.Args[0] != "receipts" && ce.Args[0] != "all") {
-		ce.Reply("**Usage:** `toggle <presence|receipts|all>`")
+func (handler *CommandHandler) CommandNotices(ce *CommandEvent) {
+	if len(ce.Args) == 0 {
+		ce.Reply("Your notice level is `%s`. Use `notices <silent|errors|verbose>` to change it.", ce.User.GetNoticeLevel())
 		return
 	}
-	if ce.User.Session == nil {
-		ce.Reply("You're not logged in.")
+	level := NoticeLevel(strings.ToLower(ce.Args[0]))
+	switch level {
+	case NoticeLevelSilent, NoticeLevelErrors, NoticeLevelVerbose:
+	default:
+		ce.Reply("**Usage:** `notices <silent|errors|verbose>`")
 		return
 	}
-	customPuppet := handler.bridge.GetPuppetByCustomMXID(ce.User.MXID)
-	if customPuppet == nil {
-		ce.Reply("You're not logged in with your Matrix account.")
-		return
+	ce.User.NoticeLevel = string(level)
+	ce.User.Update()
+	switch level {
+	case NoticeLevelSilent:
+		ce.Reply("You'll now only get notices about logouts and problems that need your action.")
+	case NoticeLevelErrors:
+		ce.Reply("You'll now get notices about connection errors, but not about successful reconnections.")
+	case NoticeLevelVerbose:
+		ce.Reply("You'll now get notices about all connection state changes.")
 	}
-	if ce.Args[0] == "presence" || ce.Args[0] == "all" {
-		customPuppet.EnablePresence = !customPuppet.EnablePresence
-		var newPresence whatsapp.Presence
-		if customPuppet.EnablePresence {
-			newPresence = whatsapp.PresenceAvailable
-			ce.Reply("Enabled presence bridging")
-		} else {
-			newPresence = whatsapp.PresenceUnavailable
-			ce.Reply("Disabled presence bridging")
-		}
-		if ce.User.IsConnected() {
-			_, err := ce.User.Conn.Presence("", newPresence)
+}
+
+const cmdSettingsHelp = `settings - View your presence, read receipt, typing notification and connection notice settings.`
+
+const cmdToggleHelp = `toggle [<setting>|all] - Toggle bridging of presence, read receipts or typing notifications, or connection status notices. Shows the current settings if no setting is given.`
+
+const cmdSetHelp = `set <setting|all> <on|off> - Enable or disable bridging of presence, read receipts or typing notifications, or connection status notices.`
+
+const userSettingNames = "presence|receipts|typing|incoming-presence|incoming-typing|notices"
+
+func formatOnOff(value bool) string {
+	if value {
+		return "on"
+	}
+	return "off"
+}
+
+func (handler *CommandHandler) replyUserSettings(ce *CommandEvent) {
+	settings := fmt.Sprintf("* Read receipts (`receipts`): %s\n* Presence (`presence`): %s\n* Typing notifications (`typing`): %s\n"+
+		"* Presence from WhatsApp (`incoming-presence`): %s\n* Typing notifications from WhatsApp (`incoming-typing`): %s\n"+
+		"* Connection notices (`notices`): %s",
+		formatOnOff(ce.User.BridgeReceipts), formatOnOff(ce.User.BridgePresence), formatOnOff(ce.User.BridgeTyping),
+		formatOnOff(ce.User.IncomingPresence), formatOnOff(ce.User.IncomingTyping), ce.User.GetNoticeLevel())
+	if handler.bridge.GetPuppetByCustomMXID(ce.User.MXID) == nil {
+		settings += "\n\nRead receipts, presence and typing notifications are only bridged to WhatsApp when you're logged in with your Matrix account."
+	}
+	if !handler.bridge.Config.Bridge.Presence || !handler.bridge.Config.Bridge.TypingNotifications {
+		settings += "\n\nSome bridging from WhatsApp has been disabled by the bridge administrator."
+	}
+	ce.Reply("%s", settings)
+}
+
+func (handler *CommandHandler) setUserSetting(ce *CommandEvent, setting string, value func(current bool) bool) bool {
+	user := ce.User
+	switch setting {
+	case "presence", "all":
+		user.BridgePresence = value(user.BridgePresence)
+		// Going unavailable doesn't need double puppeting, otherwise the user would be left online
+		if user.IsConnected() && (!user.BridgePresence || handler.bridge.GetPuppetByCustomMXID(user.MXID) != nil) {
+			newPresence := whatsapp.PresenceUnavailable
+			if user.BridgePresence {
+				newPresence = whatsapp.PresenceAvailable
+			}
+			_, err := user.Conn.Presence("", newPresence)
 			if err != nil {
-				ce.User.log.Warnln("Failed to set presence:", err)
+				user.log.Warnln("Failed to set presence:", err)
 			}
 		}
-	}
-	if ce.Args[0] == "receipts" || ce.Args[0] == "all" {
-		customPuppet.EnableReceipts = !customPuppet.EnableReceipts
-		if customPuppet.EnableReceipts {
-			ce.Reply("Enabled read receipt bridging")
+		if setting != "all" {
+			break
+		}
+		fallthrough
+	case "receipts":
+		user.BridgeReceipts = value(user.BridgeReceipts)
+		if setting != "all" {
+			break
+		}
+		fallthrough
+	case "typing":
+		user.BridgeTyping = value(user.BridgeTyping)
+		if setting != "all" {
+			break
+		}
+		fallthrough
+	case "incoming-presence":
+		user.IncomingPresence = value(user.IncomingPresence)
+		if setting != "all" {
+			break
+		}
+		fallthrough
+	case "incoming-typing":
+		user.IncomingTyping = value(user.IncomingTyping)
+		if setting != "all" {
+			break
+		}
+		fallthrough
+	case "notices":
+		// Turning notices on restores the default level rather than a specific one
+		if value(user.GetNoticeLevel() != NoticeLevelSilent) {
+			if user.GetNoticeLevel() == NoticeLevelSilent {
+				user.NoticeLevel = ""
+			}
 		} else {
-			ce.Reply("Disabled read receipt bridging")
+			user.NoticeLevel = string(NoticeLevelSilent)
 		}
+	default:
+		return false
+	}
+	user.Update()
+	return true
+}
+
+func (handler *CommandHandler) CommandSettings(ce *CommandEvent) {
+	handler.replyUserSettings(ce)
+}
+
+func (handler *CommandHandler) CommandToggle(ce *CommandEvent) {
+	if len(ce.Args) == 0 {
+		handler.replyUserSettings(ce)
+		return
+	}
+	if !handler.setUserSetting(ce, strings.ToLower(ce.Args[0]), func(current bool) bool { return !current }) {
+		ce.Reply("**Usage:** `toggle [%s|all]`", userSettingNames)
+		return
+	}
+	handler.replyUserSettings(ce)
+}
+
+func (handler *CommandHandler) CommandSet(ce *CommandEvent) {
+	if len(ce.Args) < 2 {
+		ce.Reply("**Usage:** `set <%s|all> <on|off>`", userSettingNames)
+		return
+	}
+	var newValue bool
+	switch strings.ToLower(ce.Args[1]) {
+	case "on", "true", "yes", "enable":
+		newValue = true
+	case "off", "false", "no", "disable":
+		newValue = false
+	default:
+		ce.Reply("**Usage:** `set <%s|all> <on|off>`", userSettingNames)
+		return
+	}
+	if !handler.setUserSetting(ce, strings.ToLower(ce.Args[0]), func(bool) bool { return newValue }) {
+		ce.Reply("**Usage:** `set <%s|all> <on|off>`", userSettingNames)
+		return
 	}
-	customPuppet.Update()
+	handler.replyUserSettings(ce)
 }
 
 const cmdDeleteSessionHelp = `delete-session - Delete session information and disconnect from WhatsApp without sending a logout request`
@@ -472,10 +912,7 @@ func (handler *CommandHandler) CommandDeleteSession(ce *CommandEvent) {
 		ce.Reply("Nothing to purge: no session information stored and no active connection.")
 		return
 	}
-	//ce.User.JID = ""
-	ce.User.removeFromJIDMap()
-	ce.User.SetSession(nil)
-	ce.User.DeleteConnection()
+	ce.User.clearLocalSession()
 	ce.Reply("Session information purged")
 }
 
@@ -487,12 +924,20 @@ func (handler *CommandHandler) CommandReconnect(ce *CommandEvent) {
 			ce.Reply("No existing connection and no session. Did you mean `login`?")
 		} else {
 			ce.Reply("No existing connection, creating one...")
-			ce.User.Connect(false)
+			start := time.Now()
+			if ce.User.Connect(false) {
+				ce.Reply("Connected successfully in %s.%s", time.Since(start).Round(time.Millisecond), ce.User.describePushName())
+			} else {
+				ce.Reply("Failed to connect, check the management room for details.")
+			}
 		}
 		return
 	}
 
+	start := time.Now()
 	wasConnected := true
+	// A manual reconnect replaces any automatic reconnection attempts
+	ce.User.resetReconnectBackoff()
 	err := ce.User.Conn.Disconnect()
 	if err == whatsapp.ErrNotConnected {
 		wasConnected = false
@@ -533,11 +978,11 @@ func (handler *CommandHandler) CommandReconnect(ce *CommandEvent) {
 
 	var msg string
 	if wasConnected {
-		msg = "Reconnected successfully."
+		msg = "Reconnected successfully"
 	} else {
-		msg = "Connected successfully."
+		msg = "Connected successfully"
 	}
-	ce.Reply(msg)
+	ce.Reply("%s in %s.%s", msg, time.Since(start).Round(time.Millisecond), ce.User.describePushName())
 	ce.User.PostLogin()
 }
 
@@ -568,6 +1013,7 @@ func (handler *CommandHandler) CommandDisconnect(ce *CommandEvent) {
 		ce.Reply("Unknown error while disconnecting: %v", err)
 		return
 	}
+	ce.User.stopKeepalive()
 	ce.User.bridge.Metrics.TrackConnectionState(ce.User.JID, false)
 	ce.User.sendBridgeState(BridgeState{Error: WANotConnected})
 	ce.Reply("Successfully disconnected. Use the `reconnect` command to reconnect.")
@@ -576,92 +1022,301 @@ func (handler *CommandHandler) CommandDisconnect(ce *CommandEvent) {
 const cmdPingHelp = `ping - Check your connection to WhatsApp.`
 
 func (handler *CommandHandler) CommandPing(ce *CommandEvent) {
-	if ce.User.Session == nil {
-		if ce.User.IsLoginInProgress() {
-			ce.Reply("You're not logged into WhatsApp, but there's a login in progress.")
+	user := ce.User
+	var status string
+	if user.Session == nil {
+		if user.IsLoginInProgress() {
+			status = "You're not logged into WhatsApp, but there's a login in progress."
 		} else {
-			ce.Reply("You're not logged into WhatsApp.")
+			status = "You're not logged into WhatsApp."
 		}
-	} else if ce.User.Conn == nil {
-		ce.Reply("You don't have a WhatsApp connection.")
-	} else if err := ce.User.Conn.AdminTest(); err != nil {
-		if ce.User.IsLoginInProgress() {
-			ce.Reply("Connection not OK: %v, but login in progress", err)
+	} else if user.Conn == nil {
+		status = "You don't have a WhatsApp connection."
+	} else if err := user.Conn.AdminTest(); err != nil {
+		if user.IsLoginInProgress() {
+			status = fmt.Sprintf("Connection not OK: %v, but login in progress", err)
 		} else {
-			ce.Reply("Connection not OK: %v", err)
+			status = fmt.Sprintf("Connection not OK: %v", err)
 		}
 	} else {
-		ce.Reply("Connection to WhatsApp OK")
+		status = "Connection to WhatsApp OK"
+		// A successful admin test means the connection is alive, so count it as activity
+		atomic.StoreInt64(&user.lastActivity, time.Now().Unix())
+	}
+
+	lines := []string{
+		status,
+		"",
+		fmt.Sprintf("* Websocket connected: %t", user.Conn != nil && user.Conn.IsConnected()),
+		fmt.Sprintf("* Session stored: %t", user.Session != nil),
+	}
+	if len(user.JID) > 0 && len(user.pushName) > 0 {
+		lines = append(lines, fmt.Sprintf("* Logged in as: +%s (%s)", JIDToPhoneNumber(user.JID), user.pushName))
+	} else if len(user.JID) > 0 {
+		lines = append(lines, fmt.Sprintf("* Logged in as: +%s", JIDToPhoneNumber(user.JID)))
+	}
+	if phone := user.phoneInfo.Phone; len(phone.WhatsAppVersion) > 0 {
+		lines = append(lines, fmt.Sprintf("* Phone: %s %s, OS %s, WhatsApp %s",
+			phone.DeviceManufacturer, phone.DeviceModel, phone.OSVersion, phone.WhatsAppVersion))
+	}
+	if sinceActivity, ok := user.LastActivity(); ok {
+		lines = append(lines, fmt.Sprintf("* Last activity from WhatsApp: %s ago", sinceActivity.Round(time.Second)))
+	} else {
+		lines = append(lines, "* Last activity from WhatsApp: never")
+	}
+	if lastKeepalive := atomic.LoadInt64(&user.lastKeepalive); lastKeepalive > 0 {
+		lines = append(lines, fmt.Sprintf("* Last successful keepalive ping: %s ago", time.Since(time.Unix(lastKeepalive, 0)).Round(time.Second)))
+	}
+	if failures := atomic.LoadInt32(&user.keepaliveFailures); failures > 0 {
+		lines = append(lines, fmt.Sprintf("* Failed keepalive pings in a row: %d/%d", failures, handler.bridge.Config.Bridge.KeepaliveMaxFailures))
+	}
+	if user.LastConnection > 0 {
+		lines = append(lines, fmt.Sprintf("* Last connection: %s ago", time.Since(time.Unix(user.LastConnection, 0)).Round(time.Second)))
 	}
+	ce.Reply(strings.Join(lines, "\n"))
 }
 
 const cmdHelpHelp = `help - Prints this help`
 
 // CommandHelp handles help command
 func (handler *CommandHandler) CommandHelp(ce *CommandEvent) {
+	ce.Reply(handler.renderHelp(ce))
+}
+
+// renderHelp lists all the commands the user is allowed to use along with their usage and descriptions.
+func (handler *CommandHandler) renderHelp(ce *CommandEvent) string {
 	cmdPrefix := ""
 	if ce.User.ManagementRoom != ce.RoomID || ce.User.IsRelaybot {
 		cmdPrefix = handler.bridge.Config.Bridge.CommandPrefix + " "
 	}
 
-	ce.Reply("* " + strings.Join([]string{
-		cmdPrefix + cmdHelpHelp,
-		cmdPrefix + cmdVersionHelp,
-		cmdPrefix + cmdLoginHelp,
-		cmdPrefix + cmdLogoutHelp,
-		cmdPrefix + cmdDeleteSessionHelp,
-		cmdPrefix + cmdReconnectHelp,
-		cmdPrefix + cmdDisconnectHelp,
-		cmdPrefix + cmdDeleteConnectionHelp,
-		cmdPrefix + cmdPingHelp,
-		cmdPrefix + cmdLoginMatrixHelp,
-		cmdPrefix + cmdLogoutMatrixHelp,
-		cmdPrefix + cmdToggleHelp,
-		cmdPrefix + cmdSyncHelp,
-		cmdPrefix + cmdListHelp,
-		cmdPrefix + cmdOpenHelp,
-		cmdPrefix + cmdPMHelp,
-		cmdPrefix + cmdInviteLinkHelp,
-		cmdPrefix + cmdJoinHelp,
-		cmdPrefix + cmdCreateHelp,
-		cmdPrefix + cmdSetPowerLevelHelp,
-		cmdPrefix + cmdDeletePortalHelp,
-		cmdPrefix + cmdDeleteAllPortalsHelp,
-	}, "\n* "))
-}
-
-const cmdSyncHelp = `sync [--create-all] - Synchronize contacts from phone and optionally create portals for group chats.`
+	var output strings.Builder
+	for _, cmd := range commands {
+		if cmd.Hidden || (cmd.Permission == permissionAdmin && !ce.User.Admin) {
+			continue
+		}
+		parts := strings.SplitN(cmd.Help, " - ", 2)
+		if len(parts) == 2 {
+			_, _ = fmt.Fprintf(&output, "* **%s%s** - %s\n", cmdPrefix, parts[0], parts[1])
+		} else {
+			_, _ = fmt.Fprintf(&output, "* **%s%s**\n", cmdPrefix, cmd.Help)
+		}
+	}
+	return output.String()
+}
+
+const cmdBackfillHelp = `backfill <count> - Bridge up to <count> messages older than the oldest bridged message in the current portal.`
 
-// CommandSync handles sync command
-func (handler *CommandHandler) CommandSync(ce *CommandEvent) {
-	user := ce.User
-	create := len(ce.Args) > 0 && ce.Args[0] == "--create-all"
+// backfillProgressInterval is how many messages are backfilled between progress reports in the backfill command.
+const backfillProgressInterval = 200
 
-	ce.Reply("Updating contact and chat list...")
-	handler.log.Debugln("Importing contacts of", user.MXID)
-	_, err := user.Conn.Contacts()
-	if err != nil {
-		user.log.Errorln("Error updating contacts:", err)
-		ce.Reply("Failed to sync contact list (see logs for details)")
+func (handler *CommandHandler) CommandBackfill(ce *CommandEvent) {
+	if ce.Portal == nil {
+		ce.Reply("This is not a portal room")
+		return
+	} else if len(ce.Args) == 0 {
+		ce.Reply("**Usage:** `backfill <count>`")
 		return
 	}
-	handler.log.Debugln("Importing chats of", user.MXID)
-	_, err = user.Conn.Chats()
-	if err != nil {
-		user.log.Errorln("Error updating chats:", err)
-		ce.Reply("Failed to sync chat list (see logs for details)")
+	count, err := strconv.Atoi(ce.Args[0])
+	if err != nil || count <= 0 {
+		ce.Reply("**Usage:** `backfill <count>`")
+		return
+	}
+	portal := ce.Portal
+	if portal.canBatchSend() {
+		ce.Reply("Backfilling up to %d older messages...", count)
+	} else {
+		ce.Reply("Backfilling up to %d older messages. Batch sending isn't enabled, so they'll show up after the newer messages.", count)
+	}
+	go func() {
+		lastReported := 0
+		bridged, err := portal.BackfillOlder(ce.User, count, func(bridged int) {
+			if bridged-lastReported >= backfillProgressInterval && bridged < count {
+				lastReported = bridged
+				ce.Reply("Backfilled %d/%d messages...", bridged, count)
+			}
+		})
+		if errors.Is(err, errBackfillInProgress) {
+			ce.Reply("A backfill is already running in this room")
+		} else if err != nil {
+			ce.Reply("Failed to backfill after %d messages: %v", bridged, err)
+		} else if bridged < count {
+			ce.Reply("Backfilled %d messages, WhatsApp didn't return any older history", bridged)
+		} else {
+			ce.Reply("Finished backfilling %d messages", bridged)
+		}
+	}()
+}
+
+const cmdRedownloadHelp = `redownload - Reply to a media message that failed to bridge with this command to try downloading the media again.`
+
+func (handler *CommandHandler) CommandRedownload(ce *CommandEvent) {
+	if ce.Portal == nil {
+		ce.Reply("This is not a portal room")
+		return
+	} else if len(ce.ReplyTo) == 0 {
+		ce.Reply("**Usage:** reply to a media message with `redownload`")
+		return
+	}
+	err := <-ce.Portal.QueueMediaRedownload(ce.User, ce.ReplyTo)
+	if errors.Is(err, errUnknownMessage) || errors.Is(err, errNotMediaMessage) || errors.Is(err, errMediaNotFailed) {
+		ce.Reply("Can't redownload: %v", err)
+	} else if err != nil {
+		ce.Reply("Failed to redownload media: %v", err)
+	}
+}
+
+const cmdBackfillLimitHelp = `backfill-limit [<count>|default] - View or change the maximum number of missed messages backfilled in the current portal after bridge downtime. 0 disables the backfill.`
+
+func (handler *CommandHandler) CommandBackfillLimit(ce *CommandEvent) {
+	portal := ce.Portal
+	if portal == nil {
+		ce.Reply("This is not a portal room")
+		return
+	} else if len(ce.Args) == 0 {
+		if portal.BackfillLimit >= 0 {
+			ce.Reply("Missed message backfill limit in this portal is %d (config default: %d)", portal.BackfillLimit, handler.bridge.Config.Bridge.Backfill.Missed)
+		} else {
+			ce.Reply("This portal uses the default missed message backfill limit from the config (%d)", handler.bridge.Config.Bridge.Backfill.Missed)
+		}
+		return
+	} else if !ce.User.Admin && (!ce.User.HasSession() || !ce.User.IsInPortal(portal.Key)) {
+		ce.Reply("You must be logged in and in the WhatsApp chat to change the backfill limit")
+		return
+	}
+	if strings.ToLower(ce.Args[0]) == "default" {
+		portal.BackfillLimit = -1
+	} else if limit, err := strconv.Atoi(ce.Args[0]); err != nil || limit < 0 {
+		ce.Reply("**Usage:** `backfill-limit [<count>|default]`")
+		return
+	} else {
+		portal.BackfillLimit = limit
+	}
+	portal.Update()
+	if portal.BackfillLimit < 0 {
+		ce.Reply("Backfill limit reset to the config default (%d)", handler.bridge.Config.Bridge.Backfill.Missed)
+	} else {
+		ce.Reply("Backfill limit set to %d", portal.BackfillLimit)
+	}
+	if handler.bridge.Config.Bridge.Backfill.Disable || !handler.bridge.Config.Bridge.RecoverHistory {
+		ce.Reply("Note that missed message backfilling is disabled in the bridge config")
+	}
+}
+
+const cmdDisappearingHelp = `disappearing [off|24h|7d|90d] - View or change the disappearing message timer of the current private chat.`
+
+// disappearingTimers contains the disappearing message timers WhatsApp allows, in seconds.
+var disappearingTimers = map[string]uint32{
+	"off": 0,
+	"24h": 24 * 60 * 60,
+	"1d":  24 * 60 * 60,
+	"7d":  7 * 24 * 60 * 60,
+	"1w":  7 * 24 * 60 * 60,
+	"90d": 90 * 24 * 60 * 60,
+}
+
+// CommandDisappearing handles disappearing command
+func (handler *CommandHandler) CommandDisappearing(ce *CommandEvent) {
+	portal := ce.Portal
+	if portal == nil {
+		ce.Reply("This is not a portal room")
+		return
+	} else if len(ce.Args) == 0 {
+		if portal.ExpirationTime == 0 {
+			ce.Reply("Disappearing messages are off in this chat")
+		} else {
+			ce.Reply("The disappearing message timer in this chat is %s", formatDisappearingTimer(uint64(portal.ExpirationTime)))
+		}
+		return
+	}
+	seconds, ok := disappearingTimers[strings.ToLower(ce.Args[0])]
+	if !ok {
+		ce.Reply("**Usage:** `disappearing [off|24h|7d|90d]`")
+		return
+	} else if !portal.IsPrivateChat() {
+		ce.Reply("Changing the disappearing message timer is currently only supported in private chats")
+		return
+	} else if portal.Key.Receiver != ce.User.JID {
+		ce.Reply("You can only change the disappearing message timer of your own private chats")
 		return
+	} else if seconds == portal.ExpirationTime {
+		ce.Reply("The disappearing message timer is already set to that")
+		return
+	}
+	err := portal.SetDisappearingTimer(ce.User, seconds)
+	if err != nil {
+		ce.Reply("Failed to change the disappearing message timer: %v", err)
 	}
+}
 
-	ce.Reply("Syncing contacts...")
-	user.syncPuppets(nil)
-	ce.Reply("Syncing chats...")
-	user.syncPortals(nil, create)
+const cmdSyncHelp = `sync [contacts] [groups|chats] [avatars] [--create-all] - Synchronize contacts and chats from phone, optionally limited to the given kinds (groups only syncs group chats, avatars also refetches all contact avatars), and optionally create portals for all chats.`
+
+// CommandSync handles sync command
+func (handler *CommandHandler) CommandSync(ce *CommandEvent) {
+	user := ce.User
+	create := false
+	kinds := make(map[string]bool)
+	for _, arg := range ce.Args {
+		arg = strings.ToLower(arg)
+		switch arg {
+		case "--create-all":
+			create = true
+		case "contacts", "groups", "chats", "avatars":
+			kinds[arg] = true
+		default:
+			ce.Reply("**Usage:** `sync [contacts] [groups|chats] [avatars] [--create-all]`")
+			return
+		}
+	}
+	syncAll := len(kinds) == 0
+	syncContacts := syncAll || kinds["contacts"] || kinds["avatars"]
+	syncAvatars := kinds["avatars"]
+	syncChats := syncAll || kinds["groups"] || kinds["chats"]
+	groupsOnly := kinds["groups"] && !kinds["chats"]
+
+	var puppetsUpdated, portalsCreated int
+	if syncContacts {
+		ce.Reply("Updating contact list...")
+		handler.log.Debugln("Importing contacts of", user.MXID)
+		_, err := user.Conn.Contacts()
+		if err != nil {
+			user.log.Errorln("Error updating contacts:", err)
+			ce.Reply("Failed to sync contact list (see logs for details)")
+			return
+		}
+		ce.Reply("Syncing contacts...")
+		puppetsUpdated = user.syncPuppets(nil, syncAvatars)
+	}
+	if syncChats {
+		ce.Reply("Updating chat list...")
+		handler.log.Debugln("Importing chats of", user.MXID)
+		_, err := user.Conn.Chats()
+		if err != nil {
+			user.log.Errorln("Error updating chats:", err)
+			ce.Reply("Failed to sync chat list (see logs for details)")
+			return
+		}
+		ce.Reply("Syncing chats...")
+		portalsCreated = user.syncPortals(nil, create, groupsOnly)
+	}
 
-	ce.Reply("Sync complete.")
+	ce.Reply("Sync complete: %d puppets updated, %d portals created.", puppetsUpdated, portalsCreated)
 }
 
-const cmdDeletePortalHelp = `delete-portal - Delete the current portal. If the portal is used by other people, this is limited to bridge admins.`
+const cmdDeletePortalHelp = `delete-portal confirm [replacement room ID] - Delete the current portal. If the portal is used by other people, this is limited to bridge admins.`
+
+// parseRoomID checks that the string is a well-formed Matrix room ID: the ! sigil, an opaque localpart and a server name.
+func parseRoomID(str string) (id.RoomID, bool) {
+	if !strings.HasPrefix(str, "!") || strings.ContainsAny(str, " \t\n") {
+		return "", false
+	}
+	colon := strings.IndexRune(str, ':')
+	if colon < 2 || colon == len(str)-1 {
+		return "", false
+	}
+	return id.RoomID(str), true
+}
 
 func (handler *CommandHandler) CommandDeletePortal(ce *CommandEvent) {
 	if ce.Portal == nil {
@@ -677,12 +1332,41 @@ func (handler *CommandHandler) CommandDeletePortal(ce *CommandEvent) {
 		}
 	}
 
+	if len(ce.Args) == 0 || ce.Args[0] != "confirm" {
+		ce.Reply("This will kick everyone from this room and delete all bridged message info of the chat. " +
+			"Use `delete-portal confirm` to confirm, or `delete-portal confirm <room ID>` " +
+			"to also point Matrix clients to a replacement room.")
+		return
+	}
+
+	var replacement id.RoomID
+	if len(ce.Args) > 1 {
+		var ok bool
+		if replacement, ok = parseRoomID(ce.Args[1]); !ok {
+			ce.Reply("`%s` is not a valid room ID. Room IDs look like `!abc123:example.com`.", ce.Args[1])
+			return
+		}
+	}
+
 	ce.Portal.log.Infoln(ce.User.MXID, "requested deletion of portal.")
+	if len(replacement) > 0 {
+		_, err := ce.Portal.MainIntent().SendStateEvent(ce.Portal.MXID, event.StateTombstone, "", &event.TombstoneEventContent{
+			Body:            "This room has been replaced",
+			ReplacementRoom: replacement,
+		})
+		if err != nil {
+			ce.Portal.log.Warnln("Failed to send tombstone before deleting portal:", err)
+		}
+	}
+	ce.Reply("Deleting portal. The chat can be recreated later with `sync` or `open`.")
 	ce.Portal.Delete()
 	ce.Portal.Cleanup(false)
 }
 
-const cmdDeleteAllPortalsHelp = `delete-all-portals - Delete all your portals that aren't used by any other user.'`
+const cmdDeleteAllPortalsHelp = `delete-all-portals --force - Delete all your portals that aren't used by any other user.`
+
+// deleteAllPortalsProgressInterval is how many rooms are cleaned up between progress reports in delete-all-portals.
+const deleteAllPortalsProgressInterval = 10
 
 func (handler *CommandHandler) CommandDeleteAllPortals(ce *CommandEvent) {
 	portals := ce.User.GetPortals()
@@ -693,6 +1377,11 @@ func (handler *CommandHandler) CommandDeleteAllPortals(ce *CommandEvent) {
 			portalsToDelete = append(portalsToDelete, portal)
 		}
 	}
+	if len(ce.Args) == 0 || ce.Args[0] != "--force" {
+		ce.Reply("This will delete %d portals with no other users (%d portals shared with other users will be kept). "+
+			"Type `delete-all-portals --force` to confirm.", len(portalsToDelete), len(portals)-len(portalsToDelete))
+		return
+	}
 	leave := func(portal *Portal) {
 		if len(portal.MXID) > 0 {
 			_, _ = portal.MainIntent().KickUser(portal.MXID, &mautrix.ReqKickUser{
@@ -711,19 +1400,142 @@ func (handler *CommandHandler) CommandDeleteAllPortals(ce *CommandEvent) {
 			}
 		}
 	}
-	ce.Reply("Found %d portals with no other users, deleting...", len(portalsToDelete))
-	for _, portal := range portalsToDelete {
-		portal.Delete()
-		leave(portal)
-	}
-	ce.Reply("Finished deleting portal info. Now cleaning up rooms in background. " +
-		"You may already continue using the bridge. Use `sync` to recreate portals.")
+	ce.Reply("Found %d portals with no other users, deleting in background. "+
+		"You may already continue using the bridge.", len(portalsToDelete))
 
 	go func() {
-		for _, portal := range portalsToDelete {
+		for i, portal := range portalsToDelete {
+			portal.Delete()
+			leave(portal)
 			portal.Cleanup(false)
+			if (i+1)%deleteAllPortalsProgressInterval == 0 && i+1 < len(portalsToDelete) {
+				ce.Reply("Deleted %d/%d portals...", i+1, len(portalsToDelete))
+			}
+		}
+		ce.Reply("Finished deleting %d portals. Use `sync` to recreate portals.", len(portalsToDelete))
+	}()
+}
+
+const cmdPruneMessagesHelp = `prune-messages [<_days_>] - Delete stored messages older than the given number of days (defaults to the configured retention). The latest message in each chat is kept.`
+
+// CommandPruneMessages handles prune-messages command
+func (handler *CommandHandler) CommandPruneMessages(ce *CommandEvent) {
+	maxAge := time.Duration(handler.bridge.Config.Bridge.MessageRetention) * time.Second
+	if len(ce.Args) > 0 {
+		days, err := strconv.Atoi(ce.Args[0])
+		if err != nil || days < 1 {
+			ce.Reply("**Usage:** `prune-messages [<days>]`. The number of days must be at least 1.")
+			return
+		}
+		maxAge = time.Duration(days) * 24 * time.Hour
+	} else if maxAge <= 0 {
+		ce.Reply("Message retention is not configured, so you must specify the number of days to keep. **Usage:** `prune-messages [<days>]`")
+		return
+	}
+	count, err := handler.bridge.PruneMessages(maxAge)
+	if err != nil {
+		ce.Reply("Failed to prune messages: %v", err)
+	} else {
+		ce.Reply("Removed %d messages older than %s", count, formatDisappearingTimer(uint64(maxAge.Seconds())))
+	}
+}
+
+const cmdCleanRoomsHelp = `clean-rooms [--force] - Find portal rooms that are empty or whose WhatsApp chat no longer exists and delete them.`
+
+// cleanRoomsActiveThreshold is how recent the last message in a portal must be for clean-rooms to always keep it.
+const cleanRoomsActiveThreshold = 7 * 24 * time.Hour
+
+type orphanedPortal struct {
+	portal *Portal
+	reason string
+}
+
+// chatExistsFor checks if the JID is in the contact or chat list of any of the given users.
+// The second return value is false if it can't be determined, e.g. because some user isn't connected.
+func (handler *CommandHandler) chatExistsFor(jid whatsapp.JID, userIDs []id.UserID) (exists bool, known bool) {
+	if len(userIDs) == 0 {
+		return false, false
+	}
+	for _, userID := range userIDs {
+		user := handler.bridge.GetUserByMXID(userID)
+		if user == nil || !user.IsConnected() {
+			return false, false
+		}
+		user.Conn.Store.ContactsLock.RLock()
+		_, inContacts := user.Conn.Store.Contacts[jid]
+		contactsLoaded := len(user.Conn.Store.Contacts) > 0
+		user.Conn.Store.ContactsLock.RUnlock()
+		user.Conn.Store.ChatsLock.RLock()
+		_, inChats := user.Conn.Store.Chats[jid]
+		user.Conn.Store.ChatsLock.RUnlock()
+		if inContacts || inChats {
+			return true, true
+		} else if !contactsLoaded {
+			return false, false
+		}
+	}
+	return false, true
+}
+
+// findOrphanedPortals returns portals whose Matrix room has no real users left or whose chat is gone from WhatsApp.
+// Portals that had messages recently or whose state can't be checked reliably are never included.
+func (handler *CommandHandler) findOrphanedPortals() (orphaned []orphanedPortal, checked int) {
+	activeSince := time.Now().Add(-cleanRoomsActiveThreshold).Unix()
+	for _, portal := range handler.bridge.GetAllPortals() {
+		if portal == nil || len(portal.MXID) == 0 || portal.Key.JID == StatusBroadcastJID {
+			continue
+		}
+		checked++
+		if lastMessage := handler.bridge.DB.Message.GetLastInChat(portal.Key); lastMessage != nil && lastMessage.Timestamp >= activeSince {
+			continue
+		}
+		users, err := portal.GetMatrixUsers()
+		if err != nil {
+			portal.log.Warnln("Failed to get Matrix users for clean-rooms:", err)
+			continue
+		} else if len(users) == 0 {
+			orphaned = append(orphaned, orphanedPortal{portal, "room is empty"})
+			continue
+		}
+		exists, known := handler.chatExistsFor(portal.Key.JID, portal.GetUserIDs())
+		if known && !exists {
+			orphaned = append(orphaned, orphanedPortal{portal, "chat no longer exists on WhatsApp"})
+		}
+	}
+	return
+}
+
+func (handler *CommandHandler) CommandCleanRooms(ce *CommandEvent) {
+	force := len(ce.Args) > 0 && ce.Args[0] == "--force"
+	ce.Reply("Looking for orphaned portal rooms...")
+	orphaned, checked := handler.findOrphanedPortals()
+	if len(orphaned) == 0 {
+		ce.Reply("Checked %d portals, didn't find any orphaned rooms.", checked)
+		return
+	} else if !force {
+		lines := make([]string, len(orphaned))
+		for i, item := range orphaned {
+			name := item.portal.Name
+			if len(name) == 0 {
+				name = item.portal.Key.JID
+			}
+			lines[i] = fmt.Sprintf("* [%s](https://matrix.to/#/%s) (`%s`) - %s", name, item.portal.MXID, item.portal.Key.JID, item.reason)
 		}
-		ce.Reply("Finished background cleanup of deleted portal rooms.")
+		ce.Reply("Found %d orphaned portals out of %d:\n\n%s\n\nType `clean-rooms --force` to delete them.",
+			len(orphaned), checked, strings.Join(lines, "\n"))
+		return
+	}
+	ce.Reply("Deleting %d orphaned portals in background.", len(orphaned))
+	go func() {
+		for i, item := range orphaned {
+			item.portal.log.Infofln("Deleting portal requested by %s via clean-rooms (%s)", ce.User.MXID, item.reason)
+			item.portal.Delete()
+			item.portal.Cleanup(false)
+			if (i+1)%deleteAllPortalsProgressInterval == 0 && i+1 < len(orphaned) {
+				ce.Reply("Deleted %d/%d portals...", i+1, len(orphaned))
+			}
+		}
+		ce.Reply("Finished deleting %d orphaned portals.", len(orphaned))
 	}()
 }
 
@@ -731,7 +1543,7 @@ const cmdListHelp = `list <contacts|groups> [page] [items per page] - Get a list
 
 func formatContacts(contacts bool, input map[string]whatsapp.Contact) (result []string) {
 	for jid, contact := range input {
-		if strings.HasSuffix(jid, whatsapp.NewUserSuffix) != contacts {
+		if (GetJIDType(jid) == JIDTypeUser) != contacts {
 			continue
 		}
 
@@ -803,83 +1615,262 @@ func (handler *CommandHandler) CommandList(ce *CommandEvent) {
 	ce.Reply("### %s (page %d of %d)\n\n%s", typeName, page, pages, strings.Join(result, "\n"))
 }
 
-const cmdOpenHelp = `open <_group JID_> - Open a group chat portal.`
+const cmdWhoisHelp = `whois <_Matrix user ID or phone number_> - Show what the bridge knows about a WhatsApp user.`
+
+func (handler *CommandHandler) CommandWhois(ce *CommandEvent) {
+	if len(ce.Args) == 0 {
+		ce.Reply("**Usage:** `whois <Matrix user ID or phone number>`")
+		return
+	}
+	var jid whatsapp.JID
+	var ok bool
+	if strings.HasPrefix(ce.Args[0], "@") {
+		jid, ok = handler.bridge.ParsePuppetMXID(id.UserID(ce.Args[0]))
+		if !ok {
+			ce.Reply("That's not a WhatsApp user on this bridge.")
+			return
+		}
+	} else {
+		jid, ok = ParsePhoneNumberJID(strings.Join(ce.Args, ""))
+		if !ok {
+			ce.Reply("Invalid phone number.")
+			return
+		}
+	}
+
+	lines := []string{
+		fmt.Sprintf("* JID: `%s`", jid),
+		fmt.Sprintf("* Phone number: +%s", JIDToPhoneNumber(jid)),
+	}
+	ce.User.Conn.Store.ContactsLock.RLock()
+	contact, inContacts := ce.User.Conn.Store.Contacts[jid]
+	ce.User.Conn.Store.ContactsLock.RUnlock()
+	if inContacts {
+		lines = append(lines, "* In your contacts: yes")
+		if len(contact.Name) > 0 {
+			lines = append(lines, fmt.Sprintf("* Saved name: %s", contact.Name))
+		}
+		if len(contact.Short) > 0 {
+			lines = append(lines, fmt.Sprintf("* Short name: %s", contact.Short))
+		}
+		if len(contact.Notify) > 0 {
+			lines = append(lines, fmt.Sprintf("* Push name: %s", contact.Notify))
+		}
+	} else {
+		lines = append(lines, "* In your contacts: no")
+	}
+
+	puppet := handler.bridge.GetExistingPuppetByJID(jid)
+	if puppet == nil {
+		lines = append(lines, "* Matrix puppet: not created yet")
+	} else {
+		lines = append(lines, fmt.Sprintf("* Matrix puppet: [%s](https://matrix.to/#/%s)", puppet.Displayname, puppet.MXID))
+		if len(puppet.CustomMXID) > 0 {
+			lines = append(lines, fmt.Sprintf("* Double puppeted as: %s", puppet.CustomMXID))
+		}
+		puppet.typingLock.Lock()
+		presence, presenceAt := puppet.lastPresence, puppet.lastPresenceAt
+		puppet.typingLock.Unlock()
+		if len(presence) > 0 {
+			lines = append(lines, fmt.Sprintf("* Presence: %s (%s ago)", presence,
+				time.Since(time.Unix(presenceAt, 0)).Round(time.Second)))
+		} else {
+			lines = append(lines, "* Presence: unknown")
+		}
+	}
+	if !inContacts && puppet == nil {
+		lines = append(lines, "", "The bridge doesn't know anything else about this user. They may not be on WhatsApp.")
+	}
+	ce.Reply("%s", strings.Join(lines, "\n"))
+}
+
+const cmdSearchHelp = `search <_query_> - Search your contacts and groups by name or phone number.`
+
+const maxSearchResults = 10
+
+func (handler *CommandHandler) CommandSearch(ce *CommandEvent) {
+	if len(ce.Args) == 0 {
+		ce.Reply("**Usage:** `search <query>`")
+		return
+	}
+	ce.User.Conn.Store.ContactsLock.RLock()
+	results := SearchContacts(ce.User.Conn.Store.Contacts, strings.Join(ce.Args, " "), maxSearchResults)
+	ce.User.Conn.Store.ContactsLock.RUnlock()
+	if len(results) == 0 {
+		ce.Reply("No contacts or groups found. Try syncing contacts with `sync` first if they're missing.")
+		return
+	}
+	lines := make([]string, len(results))
+	for i, result := range results {
+		name := result.Name
+		if len(name) == 0 {
+			name = result.Notify
+		}
+		var key database.PortalKey
+		var identifier string
+		if GetJIDType(result.JID) == JIDTypeUser {
+			key = database.NewPortalKey(result.JID, ce.User.JID)
+			identifier = "+" + JIDToPhoneNumber(result.JID)
+		} else {
+			key = database.GroupPortalKey(result.JID)
+			identifier = result.JID
+		}
+		portal := handler.bridge.GetExistingPortalByJID(key)
+		if portal != nil && len(portal.MXID) > 0 {
+			lines[i] = fmt.Sprintf("* [%s](https://matrix.to/#/%s) - `%s`", name, portal.MXID, identifier)
+		} else {
+			lines[i] = fmt.Sprintf("* %s - `%s`", name, identifier)
+		}
+	}
+	ce.Reply("### Search results\n\n%s", strings.Join(lines, "\n"))
+}
+
+const cmdOpenHelp = `open <_JID_> - Open the portal for a WhatsApp group, broadcast list or contact, creating it if necessary.`
 
 func (handler *CommandHandler) CommandOpen(ce *CommandEvent) {
 	if len(ce.Args) == 0 {
-		ce.Reply("**Usage:** `open <group JID>`")
+		ce.Reply("**Usage:** `open <JID>`")
 		return
 	}
 
 	user := ce.User
-	jid := ce.Args[0]
-
-	if strings.HasSuffix(jid, whatsapp.NewUserSuffix) {
-		ce.Reply("That looks like a user JID. Did you mean `pm %s`?", jid[:len(jid)-len(whatsapp.NewUserSuffix)])
+	jid := NormalizeJID(ce.Args[0])
+	if !IsValidJID(jid) {
+		ce.Reply("That doesn't look like a valid WhatsApp JID.")
 		return
 	}
 
 	user.Conn.Store.ContactsLock.RLock()
-	contact, ok := user.Conn.Store.Contacts[jid]
+	contact, inContacts := user.Conn.Store.Contacts[jid]
 	user.Conn.Store.ContactsLock.RUnlock()
-	if !ok {
-		ce.Reply("Group JID not found in contacts. Try syncing contacts with `sync` first.")
-		return
+
+	var portalKey database.PortalKey
+	switch GetJIDType(jid) {
+	case JIDTypeUser:
+		if !inContacts {
+			existingJID, exists, err := checkExists(user, jid)
+			if err != nil {
+				ce.Reply("Failed to check if +%s is on WhatsApp: %v", JIDToPhoneNumber(jid), err)
+				return
+			} else if !exists {
+				ce.Reply("+%s doesn't seem to be on WhatsApp.", JIDToPhoneNumber(jid))
+				return
+			}
+			contact = whatsapp.Contact{JID: existingJID}
+		}
+		user.bridge.GetPuppetByJID(contact.JID).Sync(user, contact, false)
+		portalKey = database.NewPortalKey(contact.JID, user.JID)
+	case JIDTypeGroup:
+		// Check the group with fresh metadata before creating anything, so that there are no leftover rooms on failure
+		metadata, err := user.Conn.GetGroupMetaData(jid)
+		if err != nil {
+			ce.Reply("Failed to get group info: %v", err)
+			return
+		} else if metadata.Status == 401 || metadata.Status == 404 {
+			ce.Reply("That group doesn't exist or you're not a member of it.")
+			return
+		} else if metadata.Status != 0 {
+			ce.Reply("Failed to get group info: status %d", metadata.Status)
+			return
+		}
+		isMember := false
+		for _, participant := range metadata.Participants {
+			if participant.JID == user.JID {
+				isMember = true
+				break
+			}
+		}
+		if !isMember {
+			ce.Reply("You're not a member of that group.")
+			return
+		}
+		if !inContacts {
+			contact = whatsapp.Contact{JID: jid, Name: metadata.Name}
+		}
+		portalKey = database.GroupPortalKey(jid)
+	default:
+		if !inContacts {
+			ce.Reply("JID not found in contacts. Try syncing contacts with `sync` first.")
+			return
+		}
+		portalKey = database.GroupPortalKey(jid)
 	}
+
 	handler.log.Debugln("Importing", jid, "for", user)
-	portal := user.bridge.GetPortalByJID(database.GroupPortalKey(jid))
-	if len(portal.MXID) > 0 {
-		portal.Sync(user, contact)
-		ce.Reply("Portal room synced.")
+	portal := user.bridge.GetPortalByJID(portalKey)
+	existed := len(portal.MXID) > 0
+	if !portal.Sync(user, contact) {
+		ce.Reply("Failed to create portal room. Check the bridge logs for details.")
+	} else if existed {
+		ce.Reply("Portal room [synced](https://matrix.to/#/%s) and invited you to it.", portal.MXID)
 	} else {
-		portal.Sync(user, contact)
-		ce.Reply("Portal room created.")
+		ce.Reply("Portal room [created](https://matrix.to/#/%s) and invited you to it.", portal.MXID)
 	}
-	_, _ = portal.MainIntent().InviteUser(portal.MXID, &mautrix.ReqInviteUser{UserID: user.MXID})
 }
 
-const cmdPMHelp = `pm [--force] <_international phone number_> - Open a private chat with the given phone number.`
+const cmdPMHelp = `pm [--force] <_international phone number or user JID_> - Open a private chat with the given phone number. Numbers that aren't in your contacts are checked to be on WhatsApp unless --force is given.`
 
-func (handler *CommandHandler) CommandPM(ce *CommandEvent) {
-	if len(ce.Args) == 0 {
-		ce.Reply("**Usage:** `pm [--force] <international phone number>`")
-		return
+type existResponse struct {
+	Status int          `json:"status"`
+	JID    whatsapp.JID `json:"jid"`
+}
+
+// checkExists asks WhatsApp whether the given JID is registered and returns the canonical JID if it is.
+func checkExists(user *User, jid whatsapp.JID) (whatsapp.JID, bool, error) {
+	resp, err := user.Conn.Exist(jid)
+	if err != nil {
+		return "", false, err
 	}
+	var parsed existResponse
+	err = json.Unmarshal([]byte(<-resp), &parsed)
+	if err != nil {
+		return "", false, fmt.Errorf("failed to parse response: %w", err)
+	} else if parsed.Status != 200 {
+		return "", false, nil
+	} else if len(parsed.JID) > 0 {
+		jid = NormalizeJID(parsed.JID)
+	}
+	return jid, true, nil
+}
 
-	force := ce.Args[0] == "--force"
+func (handler *CommandHandler) CommandPM(ce *CommandEvent) {
+	force := len(ce.Args) > 0 && ce.Args[0] == "--force"
 	if force {
 		ce.Args = ce.Args[1:]
 	}
+	if len(ce.Args) == 0 {
+		ce.Reply("**Usage:** `pm [--force] <international phone number>`")
+		return
+	}
 
 	user := ce.User
 
-	number := strings.Join(ce.Args, "")
-	if number[0] == '+' {
-		number = number[1:]
-	}
-	for _, char := range number {
-		if char < '0' || char > '9' {
-			ce.Reply("Invalid phone number.")
-			return
-		}
+	jid, ok := ParsePhoneNumberJID(strings.Join(ce.Args, ""))
+	if !ok {
+		ce.Reply("Invalid phone number.")
+		return
 	}
-	jid := number + whatsapp.NewUserSuffix
 
 	handler.log.Debugln("Importing", jid, "for", user)
 
 	user.Conn.Store.ContactsLock.RLock()
 	contact, ok := user.Conn.Store.Contacts[jid]
 	user.Conn.Store.ContactsLock.RUnlock()
-	if !ok {
-		if !force {
-			ce.Reply("Phone number not found in contacts. Try syncing contacts with `sync` first. " +
-				"To create a portal anyway, use `pm --force <number>`.")
+	if !ok && force {
+		contact = whatsapp.Contact{JID: jid}
+	} else if !ok {
+		existingJID, exists, err := checkExists(user, jid)
+		if err != nil {
+			ce.Reply("Failed to check if +%s is on WhatsApp: %v. Use `pm --force <number>` to skip the check.", JIDToPhoneNumber(jid), err)
+			return
+		} else if !exists {
+			ce.Reply("+%s doesn't seem to be on WhatsApp.", JIDToPhoneNumber(jid))
 			return
 		}
-		contact = whatsapp.Contact{JID: jid}
+		contact = whatsapp.Contact{JID: existingJID}
 	}
 	puppet := user.bridge.GetPuppetByJID(contact.JID)
-	puppet.Sync(user, contact)
+	puppet.Sync(user, contact, false)
 	portal := user.bridge.GetPortalByJID(database.NewPortalKey(contact.JID, user.JID))
 	if len(portal.MXID) > 0 {
 		var err error
@@ -899,19 +1890,33 @@ func (handler *CommandHandler) CommandPM(ce *CommandEvent) {
 		ce.Reply("Failed to create portal room: %v", err)
 		return
 	}
-	ce.Reply("Created portal room and invited you to it.")
+	ce.Reply("Created portal room with [%s](https://matrix.to/#/%s) and invited you to it.", puppet.Displayname, portal.MXID)
 }
 
-const cmdLoginMatrixHelp = `login-matrix <_access token_> - Replace your WhatsApp account's Matrix puppet with your real Matrix account.'`
+const cmdLoginMatrixHelp = `login-matrix [_access token_] - Replace your WhatsApp account's Matrix puppet with your real Matrix account. The access token can be omitted if the bridge is configured with a login shared secret.`
 
 func (handler *CommandHandler) CommandLoginMatrix(ce *CommandEvent) {
-	if len(ce.Args) == 0 {
+	var accessToken string
+	if len(ce.Args) > 0 {
+		accessToken = ce.Args[0]
+	} else if handler.bridge.Config.CanDoublePuppet(ce.User.MXID) {
+		puppet := handler.bridge.GetPuppetByJID(ce.User.JID)
+		var err error
+		accessToken, err = puppet.loginWithSharedSecret(ce.User.MXID)
+		if err != nil {
+			ce.Reply("Failed to log in with shared secret: %v", err)
+			return
+		}
+	} else {
 		ce.Reply("**Usage:** `login-matrix <access token>`")
 		return
 	}
 	puppet := handler.bridge.GetPuppetByJID(ce.User.JID)
-	err := puppet.SwitchCustomMXID(ce.Args[0], ce.User.MXID)
-	if err != nil {
+	err := puppet.SwitchCustomMXID(accessToken, ce.User.MXID)
+	if errors.Is(err, ErrMismatchingMXID) {
+		ce.Reply("Failed to switch puppet: the access token doesn't belong to %s", ce.User.MXID)
+		return
+	} else if err != nil {
 		ce.Reply("Failed to switch puppet: %v", err)
 		return
 	}
@@ -0,0 +1,45 @@
+// mautrix-whatsapp - A Matrix-WhatsApp puppeting bridge.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"testing"
+)
+
+func TestParseRoomID(t *testing.T) {
+	tests := []struct {
+		input string
+		valid bool
+	}{
+		{"!abc123:example.com", true},
+		{"!abc:localhost:8448", true},
+		{"abc123:example.com", false},
+		{"#alias:example.com", false},
+		{"!abc123", false},
+		{"!:example.com", false},
+		{"!abc123:", false},
+		{"!abc 123:example.com", false},
+		{"", false},
+	}
+	for _, test := range tests {
+		if roomID, ok := parseRoomID(test.input); ok != test.valid {
+			t.Errorf("parseRoomID(%q) validity = %t, expected %t", test.input, ok, test.valid)
+		} else if ok && string(roomID) != test.input {
+			t.Errorf("parseRoomID(%q) = %q, expected input unchanged", test.input, roomID)
+		}
+	}
+}
@@ -18,6 +18,9 @@ package config
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
+	"regexp"
 	"strconv"
 	"strings"
 	"text/template"
@@ -33,37 +36,55 @@ type BridgeConfig struct {
 	DisplaynameTemplate string `yaml:"displayname_template"`
 	CommunityTemplate   string `yaml:"community_template"`
 
-	ConnectionTimeout     int  `yaml:"connection_timeout"`
-	FetchMessageOnTimeout bool `yaml:"fetch_message_on_timeout"`
-	DeliveryReceipts      bool `yaml:"delivery_receipts"`
-	MaxConnectionAttempts int  `yaml:"max_connection_attempts"`
-	ConnectionRetryDelay  int  `yaml:"connection_retry_delay"`
-	ReportConnectionRetry bool `yaml:"report_connection_retry"`
-	AggressiveReconnect   bool `yaml:"aggressive_reconnect"`
-	ChatListWait          int  `yaml:"chat_list_wait"`
-	PortalSyncWait        int  `yaml:"portal_sync_wait"`
-	UserMessageBuffer     int  `yaml:"user_message_buffer"`
-	PortalMessageBuffer   int  `yaml:"portal_message_buffer"`
+	ConnectionTimeout       int  `yaml:"connection_timeout"`
+	ConnectionDelay         int  `yaml:"connection_delay"`
+	FetchMessageOnTimeout   bool `yaml:"fetch_message_on_timeout"`
+	DeliveryReceipts        bool `yaml:"delivery_receipts"`
+	MaxConnectionAttempts   int  `yaml:"max_connection_attempts"`
+	ConnectionRetryDelay    int  `yaml:"connection_retry_delay"`
+	MaxConnectionRetryDelay int  `yaml:"max_connection_retry_delay"`
+	ReportConnectionRetry   bool `yaml:"report_connection_retry"`
+	AggressiveReconnect     bool `yaml:"aggressive_reconnect"`
+	TakeoverReconnectDelay  int  `yaml:"takeover_reconnect_delay"`
+	MaxTakeoverReconnects   int  `yaml:"max_takeover_reconnects"`
+	ParseErrorReconnect     int  `yaml:"parse_error_reconnect_threshold"`
+	KeepaliveInterval       int  `yaml:"keepalive_interval"`
+	KeepaliveTimeout        int  `yaml:"keepalive_timeout"`
+	KeepaliveMaxFailures    int  `yaml:"keepalive_max_failures"`
+	ChatListWait            int  `yaml:"chat_list_wait"`
+	PortalSyncWait          int  `yaml:"portal_sync_wait"`
+	UserMessageBuffer       int  `yaml:"user_message_buffer"`
+	PortalMessageBuffer     int  `yaml:"portal_message_buffer"`
+	TypingTimeout           int  `yaml:"typing_timeout"`
+	MaxTypingDuration       int  `yaml:"max_typing_duration"`
 
 	CallNotices struct {
-		Start bool `yaml:"start"`
-		End   bool `yaml:"end"`
+		Start  bool `yaml:"start"`
+		End    bool `yaml:"end"`
+		Missed bool `yaml:"missed"`
 	} `yaml:"call_notices"`
 
-	InitialChatSync      int   `yaml:"initial_chat_sync_count"`
-	InitialHistoryFill   int   `yaml:"initial_history_fill_count"`
-	HistoryDisableNotifs bool  `yaml:"initial_history_disable_notifications"`
-	RecoverChatSync      int   `yaml:"recovery_chat_sync_count"`
-	RecoverHistory       bool  `yaml:"recovery_history_backfill"`
-	ChatMetaSync         bool  `yaml:"chat_meta_sync"`
-	UserAvatarSync       bool  `yaml:"user_avatar_sync"`
-	BridgeMatrixLeave    bool  `yaml:"bridge_matrix_leave"`
-	SyncChatMaxAge       int64 `yaml:"sync_max_chat_age"`
+	InitialChatSync       int    `yaml:"initial_chat_sync_count"`
+	InitialHistoryFill    int    `yaml:"initial_history_fill_count"`
+	HistoryDisableNotifs  bool   `yaml:"initial_history_disable_notifications"`
+	RecoverChatSync       int    `yaml:"recovery_chat_sync_count"`
+	RecoverHistory        bool   `yaml:"recovery_history_backfill"`
+	HistoryMethod         string `yaml:"history_backfill_method"`
+	HistoryBatchSize      int    `yaml:"history_batch_size"`
+	ChatMetaSync          bool   `yaml:"chat_meta_sync"`
+	UserAvatarSync        bool   `yaml:"user_avatar_sync"`
+	BridgeMatrixLeave     bool   `yaml:"bridge_matrix_leave"`
+	SyncChatMaxAge        int64  `yaml:"sync_max_chat_age"`
+	ContactResyncInterval int    `yaml:"contact_resync_interval"`
+	MessageRetention      int64  `yaml:"message_retention"`
 
 	SyncWithCustomPuppets bool   `yaml:"sync_with_custom_puppets"`
 	SyncDirectChatList    bool   `yaml:"sync_direct_chat_list"`
 	DefaultBridgeReceipts bool   `yaml:"default_bridge_receipts"`
 	DefaultBridgePresence bool   `yaml:"default_bridge_presence"`
+	DefaultBridgeTyping   bool   `yaml:"default_bridge_typing"`
+	Presence              bool   `yaml:"presence"`
+	TypingNotifications   bool   `yaml:"typing_notifications"`
 	LoginSharedSecret     string `yaml:"login_shared_secret"`
 
 	InviteOwnPuppetForBackfilling bool   `yaml:"invite_own_puppet_for_backfilling"`
@@ -72,15 +93,21 @@ type BridgeConfig struct {
 	ResendBridgeInfo              bool   `yaml:"resend_bridge_info"`
 	MuteBridging                  bool   `yaml:"mute_bridging"`
 	ArchiveTag                    string `yaml:"archive_tag"`
+	ArchiveRemovedGroups          bool   `yaml:"archive_removed_groups"`
 	PinnedTag                     string `yaml:"pinned_tag"`
 	TagOnlyOnCreate               bool   `yaml:"tag_only_on_create"`
 	MarkReadOnlyOnCreate          bool   `yaml:"mark_read_only_on_create"`
 	EnableStatusBroadcast         bool   `yaml:"enable_status_broadcast"`
+	RedactDisappearingMessages    bool   `yaml:"redact_disappearing_messages"`
+	PreserveViewOnce              bool   `yaml:"preserve_view_once"`
 
 	WhatsappThumbnail bool `yaml:"whatsapp_thumbnail"`
 
 	AllowUserInvite bool `yaml:"allow_user_invite"`
 
+	AdminPowerLevel      int `yaml:"group_admin_power_level"`
+	SuperAdminPowerLevel int `yaml:"group_superadmin_power_level"`
+
 	CommandPrefix string `yaml:"command_prefix"`
 
 	Encryption struct {
@@ -98,6 +125,15 @@ type BridgeConfig struct {
 
 	Relaybot RelaybotConfig `yaml:"relaybot"`
 
+	Backfill BackfillConfig `yaml:"backfill"`
+
+	PortalRoom PortalRoomConfig `yaml:"portal_room"`
+
+	Relay struct {
+		Enabled   bool `yaml:"enabled"`
+		AdminOnly bool `yaml:"admin_only"`
+	} `yaml:"relay"`
+
 	usernameTemplate    *template.Template `yaml:"-"`
 	displaynameTemplate *template.Template `yaml:"-"`
 	communityTemplate   *template.Template `yaml:"-"`
@@ -107,37 +143,67 @@ func (bc *BridgeConfig) setDefaults() {
 	bc.ConnectionTimeout = 20
 	bc.FetchMessageOnTimeout = false
 	bc.DeliveryReceipts = false
-	bc.MaxConnectionAttempts = 3
-	bc.ConnectionRetryDelay = -1
+	bc.MaxConnectionAttempts = -1
+	bc.ConnectionRetryDelay = -2
+	bc.MaxConnectionRetryDelay = 300
 	bc.ReportConnectionRetry = true
+	bc.ParseErrorReconnect = 5
+	bc.ConnectionDelay = 200
+	bc.TakeoverReconnectDelay = 60
+	bc.MaxTakeoverReconnects = 3
+	bc.KeepaliveInterval = 30
+	bc.KeepaliveTimeout = 20
+	bc.KeepaliveMaxFailures = 3
 	bc.ChatListWait = 30
 	bc.PortalSyncWait = 600
 	bc.UserMessageBuffer = 1024
 	bc.PortalMessageBuffer = 128
+	bc.TypingTimeout = 15
+	bc.MaxTypingDuration = 300
 
 	bc.CallNotices.Start = true
 	bc.CallNotices.End = true
+	bc.CallNotices.Missed = true
 
 	bc.InitialChatSync = 10
-	bc.InitialHistoryFill = 20
+	bc.InitialHistoryFill = -1
 	bc.RecoverChatSync = -1
 	bc.RecoverHistory = true
+	bc.Backfill.InitialPrivate = 50
+	bc.Backfill.InitialGroup = 50
+	bc.Backfill.InitialStatus = 0
+	bc.Backfill.Missed = 500
+	bc.PortalRoom.Federate = true
+	bc.PortalRoom.JoinRule = "invite"
+	bc.PortalRoom.HistoryVisibility = "shared"
+	bc.HistoryMethod = "massage"
+	bc.HistoryBatchSize = 100
 	bc.ChatMetaSync = true
 	bc.UserAvatarSync = true
 	bc.BridgeMatrixLeave = true
 	bc.SyncChatMaxAge = 259200
+	bc.ContactResyncInterval = 86400
 
 	bc.SyncWithCustomPuppets = true
-	bc.DefaultBridgePresence = true
-	bc.DefaultBridgeReceipts = true
+	bc.DefaultBridgePresence = false
+	bc.AdminPowerLevel = 50
+	bc.SuperAdminPowerLevel = 95
+	bc.Presence = true
+	bc.TypingNotifications = true
+	bc.DefaultBridgeReceipts = false
 	bc.LoginSharedSecret = ""
 
 	bc.InviteOwnPuppetForBackfilling = true
 	bc.PrivateChatPortalMeta = false
 	bc.BridgeNotices = true
-	bc.EnableStatusBroadcast = true
+	bc.EnableStatusBroadcast = false
+
+	bc.Relay.AdminOnly = true
 }
 
+// minMessageRetention is the shortest allowed message retention period in seconds.
+const minMessageRetention = 24 * 60 * 60
+
 type umBridgeConfig BridgeConfig
 
 func (bc *BridgeConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
@@ -150,6 +216,10 @@ func (bc *BridgeConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	if err != nil {
 		return err
 	}
+	err = bc.validateUsernameTemplate()
+	if err != nil {
+		return err
+	}
 
 	bc.displaynameTemplate, err = template.New("displayname").Parse(bc.DisplaynameTemplate)
 	if err != nil {
@@ -163,9 +233,82 @@ func (bc *BridgeConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
 		}
 	}
 
+	if bc.MessageRetention != 0 && bc.MessageRetention < minMessageRetention {
+		// Recent messages are needed for handling revokes, receipts and replies
+		return fmt.Errorf("bridge.message_retention must be 0 (disabled) or at least %d seconds", minMessageRetention)
+	}
+
+	if bc.AdminPowerLevel < 1 || bc.SuperAdminPowerLevel < bc.AdminPowerLevel || bc.SuperAdminPowerLevel >= 100 {
+		// The bridge bot needs to stay above everyone else to be able to manage the room
+		return fmt.Errorf("group admin power levels must satisfy 0 < group_admin_power_level <= group_superadmin_power_level < 100")
+	}
+
+	// The old initial_history_fill_count option overrides the new per-chat-type limits if it's still set
+	if bc.InitialHistoryFill >= 0 {
+		bc.Backfill.InitialPrivate = bc.InitialHistoryFill
+		bc.Backfill.InitialGroup = bc.InitialHistoryFill
+	}
+	err = bc.Backfill.validate()
+	if err != nil {
+		return err
+	}
+	return bc.PortalRoom.validate()
+}
+
+// BackfillConfig contains the message count limits for the different kinds of backfill. Zero disables the backfill.
+type BackfillConfig struct {
+	InitialPrivate int  `yaml:"initial_private"`
+	InitialGroup   int  `yaml:"initial_group"`
+	InitialStatus  int  `yaml:"initial_status"`
+	Missed         int  `yaml:"missed"`
+	Disable        bool `yaml:"disable"`
+}
+
+func (bc BackfillConfig) validate() error {
+	for name, value := range map[string]int{
+		"initial_private": bc.InitialPrivate,
+		"initial_group":   bc.InitialGroup,
+		"initial_status":  bc.InitialStatus,
+		"missed":          bc.Missed,
+	} {
+		if value < 0 {
+			return fmt.Errorf("bridge.backfill.%s must not be negative (use 0 to disable)", name)
+		}
+	}
 	return nil
 }
 
+// PortalRoomConfig contains the settings applied to portal rooms when they're created.
+type PortalRoomConfig struct {
+	Federate                  bool   `yaml:"federate"`
+	JoinRule                  string `yaml:"join_rule"`
+	HistoryVisibility         string `yaml:"history_visibility"`
+	BackfillHistoryVisibility string `yaml:"backfill_history_visibility"`
+}
+
+func (prc PortalRoomConfig) validate() error {
+	switch event.JoinRule(prc.JoinRule) {
+	case event.JoinRuleInvite, event.JoinRuleKnock, event.JoinRulePublic:
+	default:
+		return fmt.Errorf("bridge.portal_room.join_rule must be invite, knock or public")
+	}
+	if !isValidHistoryVisibility(prc.HistoryVisibility) {
+		return fmt.Errorf("bridge.portal_room.history_visibility must be invited, joined, shared or world_readable")
+	} else if len(prc.BackfillHistoryVisibility) > 0 && !isValidHistoryVisibility(prc.BackfillHistoryVisibility) {
+		return fmt.Errorf("bridge.portal_room.backfill_history_visibility must be empty, invited, joined, shared or world_readable")
+	}
+	return nil
+}
+
+func isValidHistoryVisibility(value string) bool {
+	switch event.HistoryVisibility(value) {
+	case event.HistoryVisibilityInvited, event.HistoryVisibilityJoined, event.HistoryVisibilityShared, event.HistoryVisibilityWorldReadable:
+		return true
+	default:
+		return false
+	}
+}
+
 type UsernameTemplateArgs struct {
 	UserID id.UserID
 }
@@ -175,7 +318,13 @@ func (bc BridgeConfig) FormatDisplayname(contact whatsapp.Contact) (string, int8
 	if index := strings.IndexRune(contact.JID, '@'); index > 0 {
 		contact.JID = "+" + contact.JID[:index]
 	}
-	bc.displaynameTemplate.Execute(&buf, contact)
+	err := bc.displaynameTemplate.Execute(&buf, contact)
+	name := buf.String()
+	// Fall back to the phone number if the template fails or only produces whitespace,
+	// e.g. when it only uses fields that are empty for this contact.
+	if err != nil || len(strings.TrimSpace(name)) == 0 {
+		name = contact.JID
+	}
 	var quality int8
 	switch {
 	case len(contact.Notify) > 0:
@@ -187,7 +336,7 @@ func (bc BridgeConfig) FormatDisplayname(contact whatsapp.Contact) (string, int8
 	default:
 		quality = 0
 	}
-	return buf.String(), quality
+	return name, quality
 }
 
 func (bc BridgeConfig) FormatUsername(userID whatsapp.JID) string {
@@ -196,6 +345,33 @@ func (bc BridgeConfig) FormatUsername(userID whatsapp.JID) string {
 	return buf.String()
 }
 
+// usernamePlaceholder is passed to the username template to find where the phone number goes.
+// It can't appear in a valid localpart, so it won't be confused with the literal parts of the template.
+const usernamePlaceholder = "\x00"
+
+// FormatUsernameRegex returns a regex for puppet localparts where the phone number is replaced with
+// the given pattern. The rest of the template is escaped, so e.g. dots in the template only match dots.
+func (bc BridgeConfig) FormatUsernameRegex(numberPattern string) string {
+	return strings.Replace(regexp.QuoteMeta(bc.FormatUsername(usernamePlaceholder)), usernamePlaceholder, numberPattern, 1)
+}
+
+var localpartRegex = regexp.MustCompile("^[a-z0-9._=/-]+$")
+
+// validateUsernameTemplate makes sure the username template produces valid and unique localparts.
+// Two bridges on the same homeserver must use different templates, otherwise their namespaces would overlap.
+func (bc BridgeConfig) validateUsernameTemplate() error {
+	const sampleNumber = "15551234567"
+	sample := bc.FormatUsername(usernamePlaceholder)
+	if strings.Count(sample, usernamePlaceholder) != 1 {
+		return errors.New("username_template must contain {{.}} exactly once")
+	} else if sample == usernamePlaceholder {
+		return errors.New("username_template must contain a prefix or suffix in addition to {{.}} to avoid colliding with real users")
+	} else if localpart := bc.FormatUsername(sampleNumber); !localpartRegex.MatchString(localpart) {
+		return fmt.Errorf("username_template produces invalid localparts (e.g. %s): only a-z, 0-9 and ._=-/ are allowed", localpart)
+	}
+	return nil
+}
+
 type CommunityTemplateArgs struct {
 	Localpart string
 	Server    string
@@ -0,0 +1,62 @@
+// mautrix-whatsapp - A Matrix-WhatsApp puppeting bridge.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package config
+
+import (
+	"testing"
+
+	"gopkg.in/yaml.v2"
+
+	"maunium.net/go/mautrix/event"
+)
+
+const testRelaybotConfig = `
+message_formats:
+    m.text: "<b>{{ .Sender.Displayname }}</b>: {{ .Message }}"
+    m.image: "<img src=\"{{ .Sender.AvatarURL }}\"/> <b>{{ .Sender.Displayname }}</b> sent an image: {{ .Message }}"
+`
+
+func TestRelaybotFormatMessage(t *testing.T) {
+	var rc RelaybotConfig
+	if err := yaml.Unmarshal([]byte(testRelaybotConfig), &rc); err != nil {
+		t.Fatal("Failed to parse relaybot config:", err)
+	}
+	member := &event.MemberEventContent{Displayname: "Alice", AvatarURL: "mxc://example.com/avatar"}
+
+	tests := []struct {
+		name     string
+		content  *event.MessageEventContent
+		expected string
+	}{
+		{"text", &event.MessageEventContent{MsgType: event.MsgText, FormattedBody: "Hello"}, "<b>Alice</b>: Hello"},
+		{
+			"media with caption",
+			&event.MessageEventContent{MsgType: event.MsgImage, FormattedBody: "Look at this"},
+			`<img src="mxc://example.com/avatar"/> <b>Alice</b> sent an image: Look at this`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			output, err := rc.FormatMessage(test.content, "@alice:example.com", member)
+			if err != nil {
+				t.Fatal("Failed to format message:", err)
+			} else if output != test.expected {
+				t.Errorf("FormatMessage() = %q, expected %q", output, test.expected)
+			}
+		})
+	}
+}
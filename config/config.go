@@ -17,7 +17,9 @@
 package config
 
 import (
+	"fmt"
 	"io/ioutil"
+	"regexp"
 
 	"gopkg.in/yaml.v2"
 	"maunium.net/go/mautrix/id"
@@ -107,7 +109,30 @@ func Load(path string) (*Config, error) {
 	var config = &Config{}
 	config.setDefaults()
 	err = yaml.Unmarshal(data, config)
-	return config, err
+	if err != nil {
+		return nil, err
+	}
+	return config, config.validate()
+}
+
+// validate checks options that depend on multiple sections of the config.
+func (config *Config) validate() error {
+	puppetRegex, err := regexp.Compile(fmt.Sprintf("^%s$", config.Bridge.FormatUsernameRegex("[0-9]+")))
+	if err != nil {
+		return fmt.Errorf("failed to compile username_template regex: %w", err)
+	}
+	if puppetRegex.MatchString(config.AppService.Bot.Username) {
+		return fmt.Errorf("bridge bot username %s is inside the puppet namespace defined by username_template", config.AppService.Bot.Username)
+	}
+	switch config.AppService.Database.Type {
+	case "sqlite3", "postgres":
+	default:
+		return fmt.Errorf("unsupported database type %q, must be sqlite3 or postgres", config.AppService.Database.Type)
+	}
+	if config.Bridge.Encryption.Default && !config.Bridge.Encryption.Allow {
+		return fmt.Errorf("bridge.encryption.default requires bridge.encryption.allow to be enabled")
+	}
+	return nil
 }
 
 func (config *Config) Save(path string) error {
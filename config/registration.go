@@ -36,7 +36,7 @@ func (config *Config) NewRegistration() (*appservice.Registration, error) {
 
 	// Workaround for https://github.com/matrix-org/synapse/pull/5758
 	registration.SenderLocalpart = appservice.RandomString(32)
-	botRegex := regexp.MustCompile(fmt.Sprintf("^@%s:%s$", config.AppService.Bot.Username, config.Homeserver.Domain))
+	botRegex := regexp.MustCompile(fmt.Sprintf("^@%s:%s$", regexp.QuoteMeta(config.AppService.Bot.Username), regexp.QuoteMeta(config.Homeserver.Domain)))
 	registration.Namespaces.RegisterUserIDs(botRegex, true)
 
 	return registration, nil
@@ -63,8 +63,8 @@ func (config *Config) copyToRegistration(registration *appservice.Registration)
 	registration.SenderLocalpart = config.AppService.Bot.Username
 
 	userIDRegex, err := regexp.Compile(fmt.Sprintf("^@%s:%s$",
-		config.Bridge.FormatUsername("[0-9]+"),
-		config.Homeserver.Domain))
+		config.Bridge.FormatUsernameRegex("[0-9]+"),
+		regexp.QuoteMeta(config.Homeserver.Domain)))
 	if err != nil {
 		return err
 	}
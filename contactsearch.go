@@ -0,0 +1,118 @@
+// mautrix-whatsapp - A Matrix-WhatsApp puppeting bridge.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/Rhymen/go-whatsapp"
+)
+
+type contactMatchRank int
+
+const (
+	contactMatchExact contactMatchRank = iota
+	contactMatchPrefix
+	contactMatchWordPrefix
+	contactMatchSubstring
+	contactMatchNone
+)
+
+type ContactSearchResult struct {
+	whatsapp.Contact
+	rank contactMatchRank
+}
+
+func matchContactField(field, query string) contactMatchRank {
+	field = strings.ToLower(field)
+	switch {
+	case len(field) == 0:
+		return contactMatchNone
+	case field == query:
+		return contactMatchExact
+	case strings.HasPrefix(field, query):
+		return contactMatchPrefix
+	case strings.Contains(field, " "+query):
+		return contactMatchWordPrefix
+	case strings.Contains(field, query):
+		return contactMatchSubstring
+	default:
+		return contactMatchNone
+	}
+}
+
+func matchContact(contact whatsapp.Contact, query, numberQuery string) contactMatchRank {
+	best := contactMatchNone
+	for _, field := range []string{contact.Name, contact.Notify, contact.Short} {
+		if rank := matchContactField(field, query); rank < best {
+			best = rank
+		}
+	}
+	if len(numberQuery) > 0 && GetJIDType(contact.JID) == JIDTypeUser {
+		if rank := matchContactField(JIDToPhoneNumber(contact.JID), numberQuery); rank < best {
+			best = rank
+		}
+	}
+	return best
+}
+
+// parseNumberQuery returns the digits of the query if it looks like a phone number, i.e. it starts with + or only
+// contains digits and common phone number separators. Otherwise it returns an empty string, so that queries like
+// "Team 1" don't match every phone number that contains a 1.
+func parseNumberQuery(query string) string {
+	var digits strings.Builder
+	for _, char := range query {
+		if char >= '0' && char <= '9' {
+			digits.WriteRune(char)
+		} else if !strings.ContainsRune("+ -().", char) && !strings.HasPrefix(query, "+") {
+			return ""
+		}
+	}
+	return digits.String()
+}
+
+// SearchContacts finds contacts and groups whose name, push name, short name or phone number contain the query.
+// The matching is case-insensitive and results are ordered so that exact and prefix matches come first.
+// At most limit results are returned, or all of them if limit is zero or less.
+func SearchContacts(contacts map[whatsapp.JID]whatsapp.Contact, query string, limit int) []ContactSearchResult {
+	query = strings.ToLower(strings.TrimSpace(query))
+	if len(query) == 0 {
+		return nil
+	}
+	numberQuery := parseNumberQuery(query)
+	var results []ContactSearchResult
+	for jid, contact := range contacts {
+		contact.JID = NormalizeJID(jid)
+		if GetJIDType(contact.JID) == JIDTypeUnknown {
+			continue
+		}
+		if rank := matchContact(contact, query, numberQuery); rank != contactMatchNone {
+			results = append(results, ContactSearchResult{Contact: contact, rank: rank})
+		}
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].rank != results[j].rank {
+			return results[i].rank < results[j].rank
+		}
+		return strings.ToLower(results[i].Name) < strings.ToLower(results[j].Name)
+	})
+	if limit > 0 && len(results) > limit {
+		results = results[:limit]
+	}
+	return results
+}
@@ -0,0 +1,74 @@
+// mautrix-whatsapp - A Matrix-WhatsApp puppeting bridge.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/Rhymen/go-whatsapp"
+)
+
+func TestParseNumberQuery(t *testing.T) {
+	tests := []struct {
+		query    string
+		expected string
+	}{
+		{"15551234567", "15551234567"},
+		{"+1 (555) 123-4567", "15551234567"},
+		{"555.123", "555123"},
+		{"team 1", ""},
+		{"alice", ""},
+	}
+	for _, test := range tests {
+		if numberQuery := parseNumberQuery(test.query); numberQuery != test.expected {
+			t.Errorf("parseNumberQuery(%q) = %q, expected %q", test.query, numberQuery, test.expected)
+		}
+	}
+}
+
+func TestSearchContactsNumberMatching(t *testing.T) {
+	contacts := map[whatsapp.JID]whatsapp.Contact{
+		"15551234567@s.whatsapp.net":  {Name: "Alice"},
+		"15559876543@s.whatsapp.net":  {Name: "Bob"},
+		"15550000000-1600000000@g.us": {Name: "Team 1"},
+	}
+	tests := []struct {
+		query    string
+		expected []string
+	}{
+		{"Team 1", []string{"Team 1"}},
+		{"+1 555 123", []string{"Alice"}},
+		{"555", []string{"Alice", "Bob"}},
+	}
+	for _, test := range tests {
+		results := SearchContacts(contacts, test.query, 0)
+		var names []string
+		for _, result := range results {
+			names = append(names, result.Name)
+		}
+		if len(names) != len(test.expected) {
+			t.Errorf("SearchContacts(%q) = %v, expected %v", test.query, names, test.expected)
+			continue
+		}
+		for i := range names {
+			if names[i] != test.expected[i] {
+				t.Errorf("SearchContacts(%q) = %v, expected %v", test.query, names, test.expected)
+				break
+			}
+		}
+	}
+}
@@ -55,8 +55,6 @@ func (puppet *Puppet) SwitchCustomMXID(accessToken string, mxid id.UserID) error
 	if len(puppet.CustomMXID) > 0 {
 		puppet.bridge.puppetsByCustomMXID[puppet.CustomMXID] = puppet
 	}
-	puppet.EnablePresence = puppet.bridge.Config.Bridge.DefaultBridgePresence
-	puppet.EnableReceipts = puppet.bridge.Config.Bridge.DefaultBridgeReceipts
 	puppet.bridge.AS.StateStore.MarkRegistered(puppet.CustomMXID)
 	puppet.Update()
 	// TODO leave rooms with default puppet
@@ -102,6 +100,21 @@ func (puppet *Puppet) newCustomIntent() (*appservice.IntentAPI, error) {
 	return ia, nil
 }
 
+// disableCustomMXID turns off double puppeting after the access token stopped working,
+// so that the bridge goes back to using the normal puppet instead of failing to send with the custom one.
+func (puppet *Puppet) disableCustomMXID(cause error) {
+	user := puppet.customUser
+	puppet.log.Warnfln("Disabling double puppeting for %s after access token stopped working: %v", puppet.CustomMXID, cause)
+	err := puppet.SwitchCustomMXID("", "")
+	if err != nil {
+		puppet.log.Warnln("Failed to disable double puppeting:", err)
+	}
+	if user != nil {
+		user.sendMarkdownBridgeAlert("Your Matrix access token for double puppeting stopped working, so double puppeting was disabled. " +
+			"Use `login-matrix` to enable it again.")
+	}
+}
+
 func (puppet *Puppet) clearCustomMXID() {
 	puppet.CustomMXID = ""
 	puppet.AccessToken = ""
@@ -176,15 +189,17 @@ func (puppet *Puppet) ProcessResponse(resp *mautrix.RespSync, _ string) error {
 			}
 			switch evt.Type {
 			case event.EphemeralEventReceipt:
-				if puppet.EnableReceipts {
+				if puppet.customUser.BridgeReceipts {
 					go puppet.handleReceiptEvent(portal, evt)
 				}
 			case event.EphemeralEventTyping:
-				go puppet.handleTypingEvent(portal, evt)
+				if puppet.customUser.BridgeTyping {
+					go puppet.handleTypingEvent(portal, evt)
+				}
 			}
 		}
 	}
-	if puppet.EnablePresence {
+	if puppet.customUser.BridgePresence {
 		for _, evt := range resp.Presence.Events {
 			if evt.Sender != puppet.CustomMXID {
 				continue
@@ -222,6 +237,7 @@ func (puppet *Puppet) handleReceiptEvent(portal *Portal, event *event.Event) {
 			// Ignore double puppeted read receipts.
 		} else if message := puppet.bridge.DB.Message.GetByMXID(eventID); message != nil {
 			puppet.customUser.log.Debugfln("Marking %s/%s in %s/%s as read", message.JID, message.MXID, portal.Key.JID, portal.MXID)
+			portal.redactViewedOnce(message.Timestamp)
 			_, err := puppet.customUser.Conn.Read(portal.Key.JID, message.JID)
 			if err != nil {
 				puppet.customUser.log.Warnln("Error marking read:", err)
@@ -269,13 +285,26 @@ func (puppet *Puppet) tryRelogin(cause error, action string) bool {
 	return true
 }
 
+// refreshAccessToken gets a new access token with the login shared secret after the old one stopped working,
+// and stores it so that it's also used after restarting.
+func (puppet *Puppet) refreshAccessToken(cause error, action string) bool {
+	if !puppet.tryRelogin(cause, action) {
+		return false
+	}
+	if puppet.customIntent != nil {
+		puppet.customIntent.AccessToken = puppet.AccessToken
+	}
+	puppet.Update()
+	return true
+}
+
 func (puppet *Puppet) OnFailedSync(_ *mautrix.RespSync, err error) (time.Duration, error) {
 	puppet.log.Warnln("Sync error:", err)
 	if errors.Is(err, mautrix.MUnknownToken) {
-		if !puppet.tryRelogin(err, "syncing") {
+		if !puppet.refreshAccessToken(err, "syncing") {
+			go puppet.disableCustomMXID(err)
 			return 0, err
 		}
-		puppet.customIntent.AccessToken = puppet.AccessToken
 		return 0, nil
 	}
 	return 10 * time.Second, nil
@@ -18,6 +18,7 @@ package database
 
 import (
 	"database/sql"
+	"sync"
 
 	_ "github.com/lib/pq"
 	_ "github.com/mattn/go-sqlite3"
@@ -57,18 +58,9 @@ func New(dbType string, uri string, baseLog log.Logger) (*Database, error) {
 		db:  db,
 		log: db.log.Sub("User"),
 	}
-	db.Portal = &PortalQuery{
-		db:  db,
-		log: db.log.Sub("Portal"),
-	}
-	db.Puppet = &PuppetQuery{
-		db:  db,
-		log: db.log.Sub("Puppet"),
-	}
-	db.Message = &MessageQuery{
-		db:  db,
-		log: db.log.Sub("Message"),
-	}
+	db.Portal = newPortalQuery(db)
+	db.Puppet = newPuppetQuery(db)
+	db.Message = newMessageQuery(db)
 	return db, nil
 }
 
@@ -79,3 +71,25 @@ func (db *Database) Init() error {
 type Scannable interface {
 	Scan(...interface{}) error
 }
+
+// preparedQuery is a query that is prepared the first time it's used and reused after that.
+// If preparing fails, the query is executed without a prepared statement.
+type preparedQuery struct {
+	query string
+	once  sync.Once
+	stmt  *sql.Stmt
+}
+
+func (pq *preparedQuery) QueryRow(db *Database, log log.Logger, args ...interface{}) *sql.Row {
+	pq.once.Do(func() {
+		var err error
+		pq.stmt, err = db.Prepare(pq.query)
+		if err != nil {
+			log.Warnfln("Failed to prepare query %q: %v", pq.query, err)
+		}
+	})
+	if pq.stmt == nil {
+		return db.QueryRow(pq.query, args...)
+	}
+	return pq.stmt.QueryRow(args...)
+}
@@ -0,0 +1,117 @@
+// mautrix-whatsapp - A Matrix-WhatsApp puppeting bridge.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	log "maunium.net/go/maulogger/v2"
+
+	"maunium.net/go/mautrix-whatsapp/database/upgrades"
+)
+
+// postgresTestEnv is the environment variable for a Postgres connection string to run the tests against.
+// The database it points to must be disposable, as the public schema is dropped before and after each test.
+const postgresTestEnv = "MAUTRIX_WHATSAPP_TEST_POSTGRES"
+
+func newSQLiteTestDB(t *testing.T) *Database {
+	db, err := New("sqlite3", filepath.Join(t.TempDir(), "test.db"), log.Sub("Test"))
+	if err != nil {
+		t.Fatal("Failed to open SQLite database:", err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+	return db
+}
+
+func resetPostgresSchema(t *testing.T, db *Database) {
+	_, err := db.Exec("DROP SCHEMA public CASCADE; CREATE SCHEMA public")
+	if err != nil {
+		t.Fatal("Failed to reset Postgres schema:", err)
+	}
+}
+
+func newPostgresTestDB(t *testing.T) *Database {
+	uri := os.Getenv(postgresTestEnv)
+	if len(uri) == 0 {
+		t.Skipf("%s not set", postgresTestEnv)
+	}
+	db, err := New("postgres", uri, log.Sub("Test"))
+	if err != nil {
+		t.Fatal("Failed to open Postgres database:", err)
+	}
+	resetPostgresSchema(t, db)
+	t.Cleanup(func() {
+		resetPostgresSchema(t, db)
+		_ = db.Close()
+	})
+	return db
+}
+
+// forEachDialect runs the test on a freshly upgraded SQLite database, and also on Postgres if postgresTestEnv is set.
+func forEachDialect(t *testing.T, test func(t *testing.T, db *Database)) {
+	dialects := map[string]func(t *testing.T) *Database{
+		"sqlite3":  newSQLiteTestDB,
+		"postgres": newPostgresTestDB,
+	}
+	for name, open := range dialects {
+		open := open
+		t.Run(name, func(t *testing.T) {
+			db := open(t)
+			if err := db.Init(); err != nil {
+				t.Fatal("Failed to upgrade database:", err)
+			}
+			test(t, db)
+		})
+	}
+}
+
+func TestUpgrades(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, db *Database) {
+		version, err := upgrades.GetVersion(db.DB)
+		if err != nil {
+			t.Fatal("Failed to get database version:", err)
+		} else if version != upgrades.NumberOfUpgrades {
+			t.Errorf("Expected database to be on v%d after upgrading, got v%d", upgrades.NumberOfUpgrades, version)
+		}
+
+		// v30-v35 added the disappearing message timer, message timestamp index, relay user, from Matrix flag, content summary
+		// and media failure flag
+		if _, err = db.Exec("SELECT expiration_time, relay_user_id FROM portal"); err != nil {
+			t.Error("Portal table is missing columns:", err)
+		}
+		if _, err = db.Exec("SELECT from_matrix, summary, media_failed FROM message"); err != nil {
+			t.Error("Message table is missing columns:", err)
+		}
+		indexQuery := "SELECT COUNT(*) FROM sqlite_master WHERE type='index' AND name=$1"
+		if db.dialect == "postgres" {
+			indexQuery = "SELECT COUNT(*) FROM pg_indexes WHERE indexname=$1"
+		}
+		var indexCount int
+		if err = db.QueryRow(indexQuery, "message_chat_timestamp_idx").Scan(&indexCount); err != nil {
+			t.Error("Failed to check message timestamp index:", err)
+		} else if indexCount != 1 {
+			t.Error("Message timestamp index wasn't created")
+		}
+
+		// Running the upgrades again on an up-to-date database must be a no-op
+		if err = db.Init(); err != nil {
+			t.Error("Failed to re-run upgrades:", err)
+		}
+	})
+}
@@ -20,6 +20,7 @@ import (
 	"bytes"
 	"database/sql"
 	"encoding/json"
+	"fmt"
 	"strings"
 	"time"
 
@@ -34,6 +35,21 @@ import (
 type MessageQuery struct {
 	db  *Database
 	log log.Logger
+
+	// GetManyByJID isn't prepared, as the number of placeholders depends on the number of message IDs.
+	getByJID  preparedQuery
+	getByMXID preparedQuery
+}
+
+func newMessageQuery(db *Database) *MessageQuery {
+	return &MessageQuery{
+		db:  db,
+		log: db.log.Sub("Message"),
+		getByJID: preparedQuery{query: "SELECT chat_jid, chat_receiver, jid, mxid, sender, timestamp, sent, content, relay_sender, from_matrix, summary, media_failed " +
+			"FROM message WHERE chat_jid=$1 AND chat_receiver=$2 AND jid=$3"},
+		getByMXID: preparedQuery{query: "SELECT chat_jid, chat_receiver, jid, mxid, sender, timestamp, sent, content, relay_sender, from_matrix, summary, media_failed " +
+			"FROM message WHERE mxid=$1"},
+	}
 }
 
 func (mq *MessageQuery) New() *Message {
@@ -44,7 +60,7 @@ func (mq *MessageQuery) New() *Message {
 }
 
 func (mq *MessageQuery) GetAll(chat PortalKey) (messages []*Message) {
-	rows, err := mq.db.Query("SELECT chat_jid, chat_receiver, jid, mxid, sender, timestamp, sent, content FROM message WHERE chat_jid=$1 AND chat_receiver=$2", chat.JID, chat.Receiver)
+	rows, err := mq.db.Query("SELECT chat_jid, chat_receiver, jid, mxid, sender, timestamp, sent, content, relay_sender, from_matrix, summary, media_failed FROM message WHERE chat_jid=$1 AND chat_receiver=$2", chat.JID, chat.Receiver)
 	if err != nil || rows == nil {
 		return nil
 	}
@@ -56,13 +72,48 @@ func (mq *MessageQuery) GetAll(chat PortalKey) (messages []*Message) {
 }
 
 func (mq *MessageQuery) GetByJID(chat PortalKey, jid whatsapp.MessageID) *Message {
-	return mq.get("SELECT chat_jid, chat_receiver, jid, mxid, sender, timestamp, sent, content "+
-		"FROM message WHERE chat_jid=$1 AND chat_receiver=$2 AND jid=$3", chat.JID, chat.Receiver, jid)
+	return mq.New().Scan(mq.getByJID.QueryRow(mq.db, mq.log, chat.JID, chat.Receiver, jid))
+}
+
+// GetManyByJID finds multiple messages in the chat with one query. Messages that aren't in the database are skipped.
+func (mq *MessageQuery) GetManyByJID(chat PortalKey, jids ...whatsapp.MessageID) (messages []*Message) {
+	if len(jids) == 0 {
+		return nil
+	}
+	args := make([]interface{}, len(jids)+2)
+	placeholders := make([]string, len(jids))
+	args[0], args[1] = chat.JID, chat.Receiver
+	for i, jid := range jids {
+		args[i+2] = jid
+		placeholders[i] = fmt.Sprintf("$%d", i+3)
+	}
+	rows, err := mq.db.Query("SELECT chat_jid, chat_receiver, jid, mxid, sender, timestamp, sent, content, relay_sender, from_matrix, summary, media_failed "+
+		"FROM message WHERE chat_jid=$1 AND chat_receiver=$2 AND jid IN ("+strings.Join(placeholders, ", ")+")", args...)
+	if err != nil || rows == nil {
+		if err != nil {
+			mq.log.Warnfln("Failed to get %d messages in %s: %v", len(jids), chat, err)
+		}
+		return nil
+	}
+	defer rows.Close()
+	for rows.Next() {
+		if msg := mq.New().Scan(rows); msg != nil {
+			messages = append(messages, msg)
+		}
+	}
+	return
 }
 
 func (mq *MessageQuery) GetByMXID(mxid id.EventID) *Message {
-	return mq.get("SELECT chat_jid, chat_receiver, jid, mxid, sender, timestamp, sent, content "+
-		"FROM message WHERE mxid=$1", mxid)
+	return mq.New().Scan(mq.getByMXID.QueryRow(mq.db, mq.log, mxid))
+}
+
+// GetBySenderAndTimestamp finds a message in the chat by its sender and exact timestamp (in seconds).
+// It's meant for matching messages when the WhatsApp message ID isn't known, e.g. in quotes without a stanza ID.
+func (mq *MessageQuery) GetBySenderAndTimestamp(chat PortalKey, sender whatsapp.JID, timestamp int64) *Message {
+	return mq.get("SELECT chat_jid, chat_receiver, jid, mxid, sender, timestamp, sent, content, relay_sender, from_matrix, summary, media_failed "+
+		"FROM message WHERE chat_jid=$1 AND chat_receiver=$2 AND sender=$3 AND timestamp=$4 LIMIT 1",
+		chat.JID, chat.Receiver, sender, timestamp)
 }
 
 func (mq *MessageQuery) GetLastInChat(chat PortalKey) *Message {
@@ -70,7 +121,7 @@ func (mq *MessageQuery) GetLastInChat(chat PortalKey) *Message {
 }
 
 func (mq *MessageQuery) GetLastInChatBefore(chat PortalKey, maxTimestamp int64) *Message {
-	msg := mq.get("SELECT chat_jid, chat_receiver, jid, mxid, sender, timestamp, sent, content "+
+	msg := mq.get("SELECT chat_jid, chat_receiver, jid, mxid, sender, timestamp, sent, content, relay_sender, from_matrix, summary, media_failed "+
 		"FROM message WHERE chat_jid=$1 AND chat_receiver=$2 AND timestamp<=$3 AND sent=true ORDER BY timestamp DESC LIMIT 1",
 		chat.JID, chat.Receiver, maxTimestamp)
 	if msg == nil || msg.Timestamp == 0 {
@@ -80,6 +131,51 @@ func (mq *MessageQuery) GetLastInChatBefore(chat PortalKey, maxTimestamp int64)
 	return msg
 }
 
+func (mq *MessageQuery) GetFirstInChat(chat PortalKey) *Message {
+	msg := mq.get("SELECT chat_jid, chat_receiver, jid, mxid, sender, timestamp, sent, content, relay_sender, from_matrix, summary, media_failed "+
+		"FROM message WHERE chat_jid=$1 AND chat_receiver=$2 AND timestamp>0 AND sent=true ORDER BY timestamp ASC LIMIT 1",
+		chat.JID, chat.Receiver)
+	if msg == nil || msg.Timestamp == 0 {
+		return nil
+	}
+	return msg
+}
+
+// DeleteOlderThan deletes messages sent before the given unix timestamp and returns the number of deleted rows.
+// The latest sent message in each chat is always kept, as it's used as the anchor for backfilling.
+func (mq *MessageQuery) DeleteOlderThan(maxTimestamp int64) (int64, error) {
+	res, err := mq.db.Exec(`DELETE FROM message WHERE timestamp<$1 AND EXISTS (
+			SELECT 1 FROM message AS newer
+			WHERE newer.chat_jid=message.chat_jid AND newer.chat_receiver=message.chat_receiver
+				AND newer.timestamp>message.timestamp AND newer.sent=true
+		)`, maxTimestamp)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (mq *MessageQuery) DeleteByMXID(mxid id.EventID) {
+	_, err := mq.db.Exec("DELETE FROM message WHERE mxid=$1", mxid)
+	if err != nil {
+		mq.log.Warnfln("Failed to delete message %s: %v", mxid, err)
+	}
+}
+
+func (mq *MessageQuery) UpdateMXID(oldMXID, newMXID id.EventID) {
+	_, err := mq.db.Exec("UPDATE message SET mxid=$1 WHERE mxid=$2", newMXID, oldMXID)
+	if err != nil {
+		mq.log.Warnfln("Failed to update event ID %s to %s: %v", oldMXID, newMXID, err)
+	}
+}
+
+func (mq *MessageQuery) SetMediaFailed(mxid id.EventID, failed bool) {
+	_, err := mq.db.Exec("UPDATE message SET media_failed=$1 WHERE mxid=$2", failed, mxid)
+	if err != nil {
+		mq.log.Warnfln("Failed to update media failure flag of %s: %v", mxid, err)
+	}
+}
+
 func (mq *MessageQuery) get(query string, args ...interface{}) *Message {
 	row := mq.db.QueryRow(query, args...)
 	if row == nil {
@@ -99,6 +195,14 @@ type Message struct {
 	Timestamp int64
 	Sent      bool
 	Content   *waProto.Message
+
+	RelaySender id.UserID
+	// FromMatrix is true for messages that were sent to WhatsApp through the bridge.
+	FromMatrix bool
+	// Summary is a short description of the content (msgtype and body excerpt). It's empty for old messages.
+	Summary string
+	// MediaFailed is true if the media couldn't be bridged and a failure notice was sent instead.
+	MediaFailed bool
 }
 
 func (msg *Message) IsFakeMXID() bool {
@@ -107,7 +211,8 @@ func (msg *Message) IsFakeMXID() bool {
 
 func (msg *Message) Scan(row Scannable) *Message {
 	var content []byte
-	err := row.Scan(&msg.Chat.JID, &msg.Chat.Receiver, &msg.JID, &msg.MXID, &msg.Sender, &msg.Timestamp, &msg.Sent, &content)
+	var summary sql.NullString
+	err := row.Scan(&msg.Chat.JID, &msg.Chat.Receiver, &msg.JID, &msg.MXID, &msg.Sender, &msg.Timestamp, &msg.Sent, &content, &msg.RelaySender, &msg.FromMatrix, &summary, &msg.MediaFailed)
 	if err != nil {
 		if err != sql.ErrNoRows {
 			msg.log.Errorln("Database scan failed:", err)
@@ -115,6 +220,7 @@ func (msg *Message) Scan(row Scannable) *Message {
 		return nil
 	}
 
+	msg.Summary = summary.String
 	msg.decodeBinaryContent(content)
 
 	return msg
@@ -142,9 +248,9 @@ func (msg *Message) encodeBinaryContent() []byte {
 
 func (msg *Message) Insert() {
 	_, err := msg.db.Exec(`INSERT INTO message
-			(chat_jid, chat_receiver, jid, mxid, sender, timestamp, sent, content)
-			VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
-		msg.Chat.JID, msg.Chat.Receiver, msg.JID, msg.MXID, msg.Sender, msg.Timestamp, msg.Sent, msg.encodeBinaryContent())
+			(chat_jid, chat_receiver, jid, mxid, sender, timestamp, sent, content, relay_sender, from_matrix, summary, media_failed)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)`,
+		msg.Chat.JID, msg.Chat.Receiver, msg.JID, msg.MXID, msg.Sender, msg.Timestamp, msg.Sent, msg.encodeBinaryContent(), msg.RelaySender, msg.FromMatrix, msg.Summary, msg.MediaFailed)
 	if err != nil {
 		msg.log.Warnfln("Failed to insert %s@%s: %v", msg.Chat, msg.JID, err)
 	}
@@ -158,6 +264,17 @@ func (msg *Message) MarkSent() {
 	}
 }
 
+// UpdateContent replaces the stored content of the message, e.g. after it was edited.
+func (msg *Message) UpdateContent(content *waProto.Message, summary string) {
+	msg.Content = content
+	msg.Summary = summary
+	_, err := msg.db.Exec("UPDATE message SET content=$1, summary=$2 WHERE chat_jid=$3 AND chat_receiver=$4 AND jid=$5",
+		msg.encodeBinaryContent(), msg.Summary, msg.Chat.JID, msg.Chat.Receiver, msg.JID)
+	if err != nil {
+		msg.log.Warnfln("Failed to update content of %s@%s: %v", msg.Chat, msg.JID, err)
+	}
+}
+
 func (msg *Message) Delete() {
 	_, err := msg.db.Exec("DELETE FROM message WHERE chat_jid=$1 AND chat_receiver=$2 AND jid=$3", msg.Chat.JID, msg.Chat.Receiver, msg.JID)
 	if err != nil {
@@ -0,0 +1,190 @@
+// mautrix-whatsapp - A Matrix-WhatsApp puppeting bridge.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	waProto "github.com/Rhymen/go-whatsapp/binary/proto"
+
+	log "maunium.net/go/maulogger/v2"
+
+	"maunium.net/go/mautrix/id"
+)
+
+func insertTestMessage(db *Database, chat PortalKey, jid string, mxid id.EventID, timestamp int64) *Message {
+	msg := db.Message.New()
+	msg.Chat = chat
+	msg.JID = jid
+	msg.MXID = mxid
+	msg.Sender = "15551234567@s.whatsapp.net"
+	msg.Timestamp = timestamp
+	msg.Sent = true
+	text := "Hello " + jid
+	msg.Content = &waProto.Message{Conversation: &text}
+	msg.Summary = "m.text: " + text
+	msg.Insert()
+	return msg
+}
+
+func TestMessageQuery(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, db *Database) {
+		chat := GroupPortalKey("15551234567-1600000000@g.us")
+		insertTestPortal(db, chat, "!group:example.com")
+		insertTestMessage(db, chat, "FIRST", "$first", 1000)
+		insertTestMessage(db, chat, "SECOND", "$second", 2000)
+		insertTestMessage(db, chat, "THIRD", "$third", 3000)
+
+		msg := db.Message.GetByJID(chat, "SECOND")
+		if msg == nil {
+			t.Fatal("Inserted message not found by JID")
+		} else if msg.MXID != "$second" || msg.Content.GetConversation() != "Hello SECOND" || msg.Summary != "m.text: Hello SECOND" || msg.FromMatrix {
+			t.Errorf("Message wasn't stored correctly: %+v", msg)
+		}
+		if msg = db.Message.GetByMXID("$third"); msg == nil || msg.JID != "THIRD" {
+			t.Errorf("Expected to find third message by MXID, got %+v", msg)
+		}
+		if msg = db.Message.GetBySenderAndTimestamp(chat, "15551234567@s.whatsapp.net", 1000); msg == nil || msg.JID != "FIRST" {
+			t.Errorf("Expected to find first message by sender and timestamp, got %+v", msg)
+		}
+		if many := db.Message.GetManyByJID(chat, "FIRST", "THIRD", "MISSING"); len(many) != 2 {
+			t.Errorf("Expected GetManyByJID to return 2 messages, got %d", len(many))
+		}
+
+		if msg = db.Message.GetLastInChat(chat); msg == nil || msg.JID != "THIRD" {
+			t.Errorf("Expected last message to be THIRD, got %+v", msg)
+		}
+		if msg = db.Message.GetLastInChatBefore(chat, 2500); msg == nil || msg.JID != "SECOND" {
+			t.Errorf("Expected last message before 2500 to be SECOND, got %+v", msg)
+		}
+		if msg = db.Message.GetFirstInChat(chat); msg == nil || msg.JID != "FIRST" {
+			t.Errorf("Expected first message to be FIRST, got %+v", msg)
+		}
+
+		edited := "Edited"
+		db.Message.GetByJID(chat, "FIRST").UpdateContent(&waProto.Message{Conversation: &edited}, "m.text: Edited")
+		if msg = db.Message.GetByJID(chat, "FIRST"); msg == nil || msg.Content.GetConversation() != "Edited" || msg.Summary != "m.text: Edited" {
+			t.Errorf("Expected content to be updated, got %+v", msg)
+		}
+
+		db.Message.UpdateMXID("$second", "$second-new")
+		if msg = db.Message.GetByJID(chat, "SECOND"); msg == nil || msg.MXID != "$second-new" {
+			t.Errorf("Expected MXID to be updated, got %+v", msg)
+		}
+		db.Message.SetMediaFailed("$second-new", true)
+		if msg = db.Message.GetByMXID("$second-new"); msg == nil || !msg.MediaFailed {
+			t.Errorf("Expected media to be marked as failed, got %+v", msg)
+		} else if msg = db.Message.GetByJID(chat, "FIRST"); msg == nil || msg.MediaFailed {
+			t.Errorf("Expected other messages not to be marked as failed, got %+v", msg)
+		}
+
+		deleted, err := db.Message.DeleteOlderThan(2500)
+		if err != nil {
+			t.Fatal("Failed to delete old messages:", err)
+		} else if deleted != 2 {
+			t.Errorf("Expected 2 old messages to be deleted, got %d", deleted)
+		}
+		if all := db.Message.GetAll(chat); len(all) != 1 || all[0].JID != "THIRD" {
+			t.Errorf("Expected only the latest message to remain, got %+v", all)
+		}
+		// The latest message in a chat is kept even if it's older than the threshold
+		if deleted, _ = db.Message.DeleteOlderThan(5000); deleted != 0 {
+			t.Errorf("Expected the latest message to be kept, but %d messages were deleted", deleted)
+		}
+
+		db.Message.DeleteByMXID("$third")
+		if db.Message.GetByMXID("$third") != nil {
+			t.Error("Message deleted by MXID is still in the database")
+		}
+	})
+}
+
+func TestRelayedMessageReplies(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, db *Database) {
+		chat := GroupPortalKey("15551234567-1600000000@g.us")
+		insertTestPortal(db, chat, "!group:example.com")
+		// Relayed messages are sent through the relay user's connection, but stored with the original Matrix event
+		relayed := db.Message.New()
+		relayed.Chat = chat
+		relayed.JID = "RELAYED"
+		relayed.MXID = "$original"
+		relayed.Sender = "15559876543@s.whatsapp.net"
+		relayed.RelaySender = "@alice:example.com"
+		relayed.Timestamp = 1000
+		relayed.Sent = true
+		relayed.Content = &waProto.Message{}
+		relayed.Insert()
+		insertTestMessage(db, chat, "REPLY", "$reply", 2000)
+
+		// A WhatsApp reply quoting the relayed message must thread back to the original sender's event
+		target := db.Message.GetByJID(chat, "RELAYED")
+		if target == nil {
+			t.Fatal("Relayed reply target not found")
+		} else if target.MXID != "$original" || target.RelaySender != "@alice:example.com" {
+			t.Errorf("Relayed message wasn't stored correctly: %+v", target)
+		}
+		// A Matrix reply to the relayed message must quote it as a message from the relay user
+		if target = db.Message.GetByMXID("$original"); target == nil || target.JID != "RELAYED" || target.Sender != "15559876543@s.whatsapp.net" {
+			t.Errorf("Expected to find relayed message by its Matrix event ID, got %+v", target)
+		}
+	})
+}
+
+func BenchmarkGetManyByJID(b *testing.B) {
+	const messageCount = 100000
+	db, err := New("sqlite3", filepath.Join(b.TempDir(), "bench.db"), log.Sub("Bench"))
+	if err != nil {
+		b.Fatal("Failed to open SQLite database:", err)
+	}
+	defer db.Close()
+	if err = db.Init(); err != nil {
+		b.Fatal("Failed to upgrade database:", err)
+	}
+	chat := GroupPortalKey("15551234567-1600000000@g.us")
+	insertTestPortal(db, chat, "!group:example.com")
+
+	tx, err := db.Begin()
+	if err != nil {
+		b.Fatal(err)
+	}
+	stmt, err := tx.Prepare("INSERT INTO message (chat_jid, chat_receiver, jid, mxid, sender, timestamp, sent, content) VALUES ($1, $2, $3, $4, $5, $6, true, $7)")
+	if err != nil {
+		b.Fatal(err)
+	}
+	for i := 0; i < messageCount; i++ {
+		_, err = stmt.Exec(chat.JID, chat.Receiver, fmt.Sprintf("MSG%d", i), fmt.Sprintf("$event%d", i), "15551234567@s.whatsapp.net", i, []byte("{}"))
+		if err != nil {
+			b.Fatal("Failed to seed messages:", err)
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		b.Fatal(err)
+	}
+
+	jids := make([]string, 50)
+	for i := range jids {
+		jids[i] = fmt.Sprintf("MSG%d", i*(messageCount/len(jids)))
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if messages := db.Message.GetManyByJID(chat, jids...); len(messages) != len(jids) {
+			b.Fatalf("Expected %d messages, got %d", len(jids), len(messages))
+		}
+	}
+}
@@ -92,11 +92,11 @@ func migrateTable(old *Database, new *Database, table string, columns ...string)
 }
 
 func Migrate(old *Database, new *Database) {
-	err := migrateTable(old, new, "portal", "jid", "receiver", "mxid", "name", "topic", "avatar", "avatar_url", "encrypted")
+	err := migrateTable(old, new, "portal", "jid", "receiver", "mxid", "name", "topic", "avatar", "avatar_url", "encrypted", "unbridged", "first_event_id", "next_batch_id", "relay_enabled", "backfill_limit", "expiration_time", "relay_user_id")
 	if err != nil {
 		panic(err)
 	}
-	err = migrateTable(old, new, "user", "mxid", "jid", "management_room", "client_id", "client_token", "server_token", "enc_key", "mac_key", "last_connection")
+	err = migrateTable(old, new, "user", "mxid", "jid", "management_room", "client_id", "client_token", "server_token", "enc_key", "mac_key", "last_connection", "notice_level", "bridge_receipts", "bridge_presence", "bridge_typing", "incoming_presence", "incoming_typing")
 	if err != nil {
 		panic(err)
 	}
@@ -108,7 +108,7 @@ func Migrate(old *Database, new *Database) {
 	if err != nil {
 		panic(err)
 	}
-	err = migrateTable(old, new, "message", "chat_jid", "chat_receiver", "jid", "mxid", "sender", "content", "timestamp")
+	err = migrateTable(old, new, "message", "chat_jid", "chat_receiver", "jid", "mxid", "sender", "content", "timestamp", "sent", "relay_sender", "from_matrix", "summary", "media_failed")
 	if err != nil {
 		panic(err)
 	}
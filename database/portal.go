@@ -59,12 +59,26 @@ func (key PortalKey) String() string {
 type PortalQuery struct {
 	db  *Database
 	log log.Logger
+
+	getByJID  preparedQuery
+	getByMXID preparedQuery
+}
+
+func newPortalQuery(db *Database) *PortalQuery {
+	return &PortalQuery{
+		db:        db,
+		log:       db.log.Sub("Portal"),
+		getByJID:  preparedQuery{query: "SELECT * FROM portal WHERE jid=$1 AND receiver=$2"},
+		getByMXID: preparedQuery{query: "SELECT * FROM portal WHERE mxid=$1"},
+	}
 }
 
 func (pq *PortalQuery) New() *Portal {
 	return &Portal{
 		db:  pq.db,
 		log: pq.log,
+
+		BackfillLimit: -1,
 	}
 }
 
@@ -73,11 +87,11 @@ func (pq *PortalQuery) GetAll() []*Portal {
 }
 
 func (pq *PortalQuery) GetByJID(key PortalKey) *Portal {
-	return pq.get("SELECT * FROM portal WHERE jid=$1 AND receiver=$2", key.JID, key.Receiver)
+	return pq.New().Scan(pq.getByJID.QueryRow(pq.db, pq.log, key.JID, key.Receiver))
 }
 
 func (pq *PortalQuery) GetByMXID(mxid id.RoomID) *Portal {
-	return pq.get("SELECT * FROM portal WHERE mxid=$1", mxid)
+	return pq.New().Scan(pq.getByMXID.QueryRow(pq.db, pq.log, mxid))
 }
 
 func (pq *PortalQuery) GetAllByJID(jid whatsapp.JID) []*Portal {
@@ -120,11 +134,27 @@ type Portal struct {
 	Avatar    string
 	AvatarURL id.ContentURI
 	Encrypted bool
+	// Unbridged is set when the last Matrix user left the portal room without leaving the WhatsApp group.
+	Unbridged bool
+
+	// FirstEventID and NextBatchID are used to insert history before the existing timeline with MSC2716.
+	FirstEventID id.EventID
+	NextBatchID  string
+
+	// RelayEnabled allows Matrix users without their own WhatsApp session to send messages to the chat
+	// through the connection of a logged-in user in the portal.
+	RelayEnabled bool
+	// RelayUserID is the user whose connection is used for relaying. If empty, any connected user in the portal is used.
+	RelayUserID id.UserID
+	// BackfillLimit overrides the missed message backfill limit from the config. -1 means use the config value.
+	BackfillLimit int
+	// ExpirationTime is the disappearing message timer of the chat in seconds. 0 means disappearing messages are off.
+	ExpirationTime uint32
 }
 
 func (portal *Portal) Scan(row Scannable) *Portal {
 	var mxid, avatarURL sql.NullString
-	err := row.Scan(&portal.Key.JID, &portal.Key.Receiver, &mxid, &portal.Name, &portal.Topic, &portal.Avatar, &avatarURL, &portal.Encrypted)
+	err := row.Scan(&portal.Key.JID, &portal.Key.Receiver, &mxid, &portal.Name, &portal.Topic, &portal.Avatar, &avatarURL, &portal.Encrypted, &portal.Unbridged, &portal.FirstEventID, &portal.NextBatchID, &portal.RelayEnabled, &portal.BackfillLimit, &portal.ExpirationTime, &portal.RelayUserID)
 	if err != nil {
 		if err != sql.ErrNoRows {
 			portal.log.Errorln("Database scan failed:", err)
@@ -144,8 +174,8 @@ func (portal *Portal) mxidPtr() *id.RoomID {
 }
 
 func (portal *Portal) Insert() {
-	_, err := portal.db.Exec("INSERT INTO portal (jid, receiver, mxid, name, topic, avatar, avatar_url, encrypted) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)",
-		portal.Key.JID, portal.Key.Receiver, portal.mxidPtr(), portal.Name, portal.Topic, portal.Avatar, portal.AvatarURL.String(), portal.Encrypted)
+	_, err := portal.db.Exec("INSERT INTO portal (jid, receiver, mxid, name, topic, avatar, avatar_url, encrypted, unbridged, first_event_id, next_batch_id, relay_enabled, backfill_limit, expiration_time, relay_user_id) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15)",
+		portal.Key.JID, portal.Key.Receiver, portal.mxidPtr(), portal.Name, portal.Topic, portal.Avatar, portal.AvatarURL.String(), portal.Encrypted, portal.Unbridged, portal.FirstEventID.String(), portal.NextBatchID, portal.RelayEnabled, portal.BackfillLimit, portal.ExpirationTime, portal.RelayUserID)
 	if err != nil {
 		portal.log.Warnfln("Failed to insert %s: %v", portal.Key, err)
 	}
@@ -156,15 +186,20 @@ func (portal *Portal) Update() {
 	if len(portal.MXID) > 0 {
 		mxid = &portal.MXID
 	}
-	_, err := portal.db.Exec("UPDATE portal SET mxid=$1, name=$2, topic=$3, avatar=$4, avatar_url=$5, encrypted=$6 WHERE jid=$7 AND receiver=$8",
-		mxid, portal.Name, portal.Topic, portal.Avatar, portal.AvatarURL.String(), portal.Encrypted, portal.Key.JID, portal.Key.Receiver)
+	_, err := portal.db.Exec("UPDATE portal SET mxid=$1, name=$2, topic=$3, avatar=$4, avatar_url=$5, encrypted=$6, unbridged=$7, first_event_id=$8, next_batch_id=$9, relay_enabled=$10, backfill_limit=$11, expiration_time=$12, relay_user_id=$13 WHERE jid=$14 AND receiver=$15",
+		mxid, portal.Name, portal.Topic, portal.Avatar, portal.AvatarURL.String(), portal.Encrypted, portal.Unbridged, portal.FirstEventID.String(), portal.NextBatchID, portal.RelayEnabled, portal.BackfillLimit, portal.ExpirationTime, portal.RelayUserID, portal.Key.JID, portal.Key.Receiver)
 	if err != nil {
 		portal.log.Warnfln("Failed to update %s: %v", portal.Key, err)
 	}
 }
 
 func (portal *Portal) Delete() {
-	_, err := portal.db.Exec("DELETE FROM portal WHERE jid=$1 AND receiver=$2", portal.Key.JID, portal.Key.Receiver)
+	// Old SQLite databases don't have ON DELETE CASCADE for the message table, so delete messages explicitly.
+	_, err := portal.db.Exec("DELETE FROM message WHERE chat_jid=$1 AND chat_receiver=$2", portal.Key.JID, portal.Key.Receiver)
+	if err != nil {
+		portal.log.Warnfln("Failed to delete messages of %s: %v", portal.Key, err)
+	}
+	_, err = portal.db.Exec("DELETE FROM portal WHERE jid=$1 AND receiver=$2", portal.Key.JID, portal.Key.Receiver)
 	if err != nil {
 		portal.log.Warnfln("Failed to delete %s: %v", portal.Key, err)
 	}
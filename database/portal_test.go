@@ -0,0 +1,75 @@
+// mautrix-whatsapp - A Matrix-WhatsApp puppeting bridge.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"testing"
+
+	"maunium.net/go/mautrix/id"
+)
+
+func insertTestPortal(db *Database, key PortalKey, mxid id.RoomID) *Portal {
+	portal := db.Portal.New()
+	portal.Key = key
+	portal.MXID = mxid
+	portal.Name = "Test chat"
+	portal.Insert()
+	return portal
+}
+
+func TestPortalQuery(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, db *Database) {
+		key := NewPortalKey("15551234567-1600000000@g.us", "15551234567@s.whatsapp.net")
+		if key.Receiver != key.JID {
+			t.Fatalf("Expected group portal key receiver to be the group JID, got %s", key.Receiver)
+		}
+		portal := insertTestPortal(db, key, "!group:example.com")
+		if loaded := db.Portal.GetByJID(key); loaded == nil {
+			t.Fatal("Inserted portal not found by JID")
+		} else if loaded.BackfillLimit != -1 || loaded.ExpirationTime != 0 || len(loaded.RelayUserID) != 0 {
+			t.Errorf("Unexpected defaults in loaded portal: %+v", loaded)
+		}
+
+		portal.Topic = "Topic"
+		portal.RelayEnabled = true
+		portal.RelayUserID = "@relay:example.com"
+		portal.BackfillLimit = 50
+		portal.ExpirationTime = 604800
+		portal.Update()
+		loaded := db.Portal.GetByMXID("!group:example.com")
+		if loaded == nil {
+			t.Fatal("Updated portal not found by MXID")
+		} else if loaded.Topic != "Topic" || !loaded.RelayEnabled || loaded.RelayUserID != portal.RelayUserID ||
+			loaded.BackfillLimit != 50 || loaded.ExpirationTime != 604800 {
+			t.Errorf("Portal update wasn't stored correctly: %+v", loaded)
+		}
+
+		privateKey := NewPortalKey("15559876543@s.whatsapp.net", "15551234567@s.whatsapp.net")
+		insertTestPortal(db, privateKey, "")
+		if private := db.Portal.FindPrivateChats("15551234567@s.whatsapp.net"); len(private) != 1 || private[0].Key != privateKey {
+			t.Errorf("Expected to find exactly the private chat portal, got %+v", private)
+		}
+		if all := db.Portal.GetAll(); len(all) != 2 {
+			t.Errorf("Expected 2 portals, got %d", len(all))
+		}
+
+		portal.Delete()
+		if db.Portal.GetByJID(key) != nil {
+			t.Error("Deleted portal is still in the database")
+		}
+	})
+}
@@ -0,0 +1,51 @@
+// mautrix-whatsapp - A Matrix-WhatsApp puppeting bridge.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"testing"
+)
+
+func TestPuppetQuery(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, db *Database) {
+		puppet := db.Puppet.New()
+		puppet.JID = "15551234567@s.whatsapp.net"
+		puppet.Displayname = "Alice (WA)"
+		puppet.NameQuality = 3
+		puppet.Insert()
+
+		loaded := db.Puppet.Get(puppet.JID)
+		if loaded == nil {
+			t.Fatal("Inserted puppet not found")
+		} else if loaded.Displayname != puppet.Displayname || loaded.NameQuality != 3 || len(loaded.CustomMXID) != 0 {
+			t.Errorf("Puppet wasn't stored correctly: %+v", loaded)
+		}
+		if db.Puppet.Get("15559876543@s.whatsapp.net") != nil {
+			t.Error("Got a puppet for an unknown JID")
+		}
+
+		puppet.CustomMXID = "@alice:example.com"
+		puppet.AccessToken = "token"
+		puppet.Update()
+		if loaded = db.Puppet.GetByCustomMXID("@alice:example.com"); loaded == nil || loaded.AccessToken != "token" {
+			t.Errorf("Puppet update wasn't stored correctly: %+v", loaded)
+		}
+		if custom := db.Puppet.GetAllWithCustomMXID(); len(custom) != 1 {
+			t.Errorf("Expected 1 puppet with custom MXID, got %d", len(custom))
+		}
+	})
+}
@@ -0,0 +1,12 @@
+package upgrades
+
+import (
+	"database/sql"
+)
+
+func init() {
+	upgrades[21] = upgrade{"Add relay sender column for messages", func(tx *sql.Tx, ctx context) error {
+		_, err := tx.Exec(`ALTER TABLE message ADD COLUMN relay_sender VARCHAR(255) NOT NULL DEFAULT ''`)
+		return err
+	}}
+}
@@ -0,0 +1,12 @@
+package upgrades
+
+import (
+	"database/sql"
+)
+
+func init() {
+	upgrades[22] = upgrade{"Add unbridged flag for portals", func(tx *sql.Tx, ctx context) error {
+		_, err := tx.Exec(`ALTER TABLE portal ADD COLUMN unbridged BOOLEAN NOT NULL DEFAULT false`)
+		return err
+	}}
+}
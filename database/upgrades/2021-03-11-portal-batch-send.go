@@ -0,0 +1,16 @@
+package upgrades
+
+import (
+	"database/sql"
+)
+
+func init() {
+	upgrades[23] = upgrade{"Add MSC2716 batch send info for portals", func(tx *sql.Tx, ctx context) error {
+		_, err := tx.Exec(`ALTER TABLE portal ADD COLUMN first_event_id VARCHAR(255) NOT NULL DEFAULT ''`)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(`ALTER TABLE portal ADD COLUMN next_batch_id VARCHAR(255) NOT NULL DEFAULT ''`)
+		return err
+	}}
+}
@@ -0,0 +1,12 @@
+package upgrades
+
+import (
+	"database/sql"
+)
+
+func init() {
+	upgrades[24] = upgrade{"Add notice level for users", func(tx *sql.Tx, ctx context) error {
+		_, err := tx.Exec(`ALTER TABLE "user" ADD COLUMN notice_level VARCHAR(255) NOT NULL DEFAULT ''`)
+		return err
+	}}
+}
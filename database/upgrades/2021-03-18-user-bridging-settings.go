@@ -0,0 +1,23 @@
+package upgrades
+
+import (
+	"database/sql"
+)
+
+func init() {
+	upgrades[25] = upgrade{"Move presence and read receipt bridging settings to users", func(tx *sql.Tx, ctx context) error {
+		_, err := tx.Exec(`ALTER TABLE "user" ADD COLUMN bridge_receipts BOOLEAN NOT NULL DEFAULT true`)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(`ALTER TABLE "user" ADD COLUMN bridge_presence BOOLEAN NOT NULL DEFAULT true`)
+		if err != nil {
+			return err
+		}
+		// Keep the values users had set for their double puppets
+		_, err = tx.Exec(`UPDATE "user" SET
+			bridge_receipts=COALESCE((SELECT enable_receipts FROM puppet WHERE puppet.custom_mxid="user".mxid), bridge_receipts),
+			bridge_presence=COALESCE((SELECT enable_presence FROM puppet WHERE puppet.custom_mxid="user".mxid), bridge_presence)`)
+		return err
+	}}
+}
@@ -0,0 +1,17 @@
+package upgrades
+
+import (
+	"database/sql"
+)
+
+func init() {
+	upgrades[26] = upgrade{"Add per-user typing and incoming presence bridging settings", func(tx *sql.Tx, ctx context) error {
+		for _, column := range []string{"bridge_typing", "incoming_presence", "incoming_typing"} {
+			_, err := tx.Exec(`ALTER TABLE "user" ADD COLUMN ` + column + ` BOOLEAN NOT NULL DEFAULT true`)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}}
+}
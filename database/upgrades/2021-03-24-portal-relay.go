@@ -0,0 +1,12 @@
+package upgrades
+
+import (
+	"database/sql"
+)
+
+func init() {
+	upgrades[27] = upgrade{"Add per-portal relay mode setting", func(tx *sql.Tx, ctx context) error {
+		_, err := tx.Exec(`ALTER TABLE portal ADD COLUMN relay_enabled BOOLEAN NOT NULL DEFAULT false`)
+		return err
+	}}
+}
@@ -0,0 +1,12 @@
+package upgrades
+
+import (
+	"database/sql"
+)
+
+func init() {
+	upgrades[28] = upgrade{"Add per-portal missed message backfill limit", func(tx *sql.Tx, ctx context) error {
+		_, err := tx.Exec(`ALTER TABLE portal ADD COLUMN backfill_limit INTEGER NOT NULL DEFAULT -1`)
+		return err
+	}}
+}
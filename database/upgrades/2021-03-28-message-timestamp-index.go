@@ -0,0 +1,12 @@
+package upgrades
+
+import (
+	"database/sql"
+)
+
+func init() {
+	upgrades[30] = upgrade{"Add index for finding messages in a chat by timestamp", func(tx *sql.Tx, ctx context) error {
+		_, err := tx.Exec(`CREATE INDEX IF NOT EXISTS message_chat_timestamp_idx ON message (chat_jid, chat_receiver, timestamp)`)
+		return err
+	}}
+}
@@ -0,0 +1,12 @@
+package upgrades
+
+import (
+	"database/sql"
+)
+
+func init() {
+	upgrades[31] = upgrade{"Add explicitly designated relay user to portals", func(tx *sql.Tx, ctx context) error {
+		_, err := tx.Exec(`ALTER TABLE portal ADD COLUMN relay_user_id VARCHAR(255) NOT NULL DEFAULT ''`)
+		return err
+	}}
+}
@@ -0,0 +1,12 @@
+package upgrades
+
+import (
+	"database/sql"
+)
+
+func init() {
+	upgrades[32] = upgrade{"Mark messages that were sent from Matrix", func(tx *sql.Tx, ctx context) error {
+		_, err := tx.Exec(`ALTER TABLE message ADD COLUMN from_matrix BOOLEAN NOT NULL DEFAULT false`)
+		return err
+	}}
+}
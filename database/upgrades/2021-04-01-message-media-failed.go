@@ -0,0 +1,12 @@
+package upgrades
+
+import (
+	"database/sql"
+)
+
+func init() {
+	upgrades[34] = upgrade{"Add media failure flag to messages", func(tx *sql.Tx, ctx context) error {
+		_, err := tx.Exec(`ALTER TABLE message ADD COLUMN media_failed BOOLEAN NOT NULL DEFAULT false`)
+		return err
+	}}
+}
@@ -39,7 +39,7 @@ type upgrade struct {
 	fn      upgradeFunc
 }
 
-const NumberOfUpgrades = 21
+const NumberOfUpgrades = 35
 
 var upgrades [NumberOfUpgrades]upgrade
 
@@ -85,28 +85,45 @@ func Run(log log.Logger, dialectName string, db *sql.DB) error {
 	}
 
 	if version > NumberOfUpgrades {
-		return UnsupportedDatabaseVersion
+		// Older versions of the bridge don't know about the newer schema, so downgrading could silently corrupt data.
+		log.Errorfln("The database is on v%d, but this version of the bridge only supports up to v%d. "+
+			"Downgrading the bridge is not supported: update the bridge or restore a database backup.", version, NumberOfUpgrades)
+		return fmt.Errorf("%w: database is on v%d, latest known is v%d", UnsupportedDatabaseVersion, version, NumberOfUpgrades)
+	}
+
+	for i, upgrade := range upgrades {
+		if upgrade.fn == nil {
+			return fmt.Errorf("database upgrade to v%d is not registered", i+1)
+		}
 	}
 
 	log.Infofln("Database currently on v%d, latest: v%d", version, NumberOfUpgrades)
 	for i, upgrade := range upgrades[version:] {
 		log.Infofln("Upgrading database to v%d: %s", version+i+1, upgrade.message)
-		tx, err := db.Begin()
-		if err != nil {
-			return err
-		}
-		err = upgrade.fn(tx, context{dialect, db, log})
+		err = runUpgrade(db, dialect, log, upgrade, version+i+1)
 		if err != nil {
-			return err
-		}
-		err = SetVersion(tx, version+i+1)
-		if err != nil {
-			return err
-		}
-		err = tx.Commit()
-		if err != nil {
-			return err
+			return fmt.Errorf("failed to upgrade database to v%d: %w", version+i+1, err)
 		}
 	}
 	return nil
 }
+
+// runUpgrade runs a single upgrade and bumps the version in the same transaction,
+// so that a crash or error in the middle of an upgrade leaves the database on the previous version.
+func runUpgrade(db *sql.DB, dialect Dialect, log log.Logger, upgrade upgrade, newVersion int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	err = upgrade.fn(tx, context{dialect, db, log})
+	if err == nil {
+		err = SetVersion(tx, newVersion)
+	}
+	if err != nil {
+		if rollbackErr := tx.Rollback(); rollbackErr != nil {
+			log.Warnfln("Failed to roll back failed upgrade to v%d: %v", newVersion, rollbackErr)
+		}
+		return err
+	}
+	return tx.Commit()
+}
@@ -38,11 +38,17 @@ func (uq *UserQuery) New() *User {
 	return &User{
 		db:  uq.db,
 		log: uq.log,
+
+		BridgeReceipts:   true,
+		BridgePresence:   true,
+		BridgeTyping:     true,
+		IncomingPresence: true,
+		IncomingTyping:   true,
 	}
 }
 
 func (uq *UserQuery) GetAll() (users []*User) {
-	rows, err := uq.db.Query(`SELECT mxid, jid, management_room, last_connection, client_id, client_token, server_token, enc_key, mac_key FROM "user"`)
+	rows, err := uq.db.Query(`SELECT mxid, jid, management_room, last_connection, client_id, client_token, server_token, enc_key, mac_key, notice_level, bridge_receipts, bridge_presence, bridge_typing, incoming_presence, incoming_typing FROM "user"`)
 	if err != nil || rows == nil {
 		return nil
 	}
@@ -54,7 +60,7 @@ func (uq *UserQuery) GetAll() (users []*User) {
 }
 
 func (uq *UserQuery) GetByMXID(userID id.UserID) *User {
-	row := uq.db.QueryRow(`SELECT mxid, jid, management_room, last_connection, client_id, client_token, server_token, enc_key, mac_key FROM "user" WHERE mxid=$1`, userID)
+	row := uq.db.QueryRow(`SELECT mxid, jid, management_room, last_connection, client_id, client_token, server_token, enc_key, mac_key, notice_level, bridge_receipts, bridge_presence, bridge_typing, incoming_presence, incoming_typing FROM "user" WHERE mxid=$1`, userID)
 	if row == nil {
 		return nil
 	}
@@ -62,7 +68,7 @@ func (uq *UserQuery) GetByMXID(userID id.UserID) *User {
 }
 
 func (uq *UserQuery) GetByJID(userID whatsapp.JID) *User {
-	row := uq.db.QueryRow(`SELECT mxid, jid, management_room, last_connection, client_id, client_token, server_token, enc_key, mac_key FROM "user" WHERE jid=$1`, stripSuffix(userID))
+	row := uq.db.QueryRow(`SELECT mxid, jid, management_room, last_connection, client_id, client_token, server_token, enc_key, mac_key, notice_level, bridge_receipts, bridge_presence, bridge_typing, incoming_presence, incoming_typing FROM "user" WHERE jid=$1`, stripSuffix(userID))
 	if row == nil {
 		return nil
 	}
@@ -78,12 +84,24 @@ type User struct {
 	ManagementRoom id.RoomID
 	Session        *whatsapp.Session
 	LastConnection int64
+	// NoticeLevel controls which connection status notices are sent to the management room.
+	// An empty value means the default level.
+	NoticeLevel string
+	// BridgeReceipts and BridgePresence control whether the user's read receipts and presence
+	// are bridged from Matrix to WhatsApp when double puppeting is enabled.
+	BridgeReceipts bool
+	BridgePresence bool
+	BridgeTyping   bool
+	// IncomingPresence and IncomingTyping control whether presence and typing notifications
+	// received through this user's connection are bridged from WhatsApp to Matrix.
+	IncomingPresence bool
+	IncomingTyping   bool
 }
 
 func (user *User) Scan(row Scannable) *User {
 	var jid, clientID, clientToken, serverToken sql.NullString
 	var encKey, macKey []byte
-	err := row.Scan(&user.MXID, &jid, &user.ManagementRoom, &user.LastConnection, &clientID, &clientToken, &serverToken, &encKey, &macKey)
+	err := row.Scan(&user.MXID, &jid, &user.ManagementRoom, &user.LastConnection, &clientID, &clientToken, &serverToken, &encKey, &macKey, &user.NoticeLevel, &user.BridgeReceipts, &user.BridgePresence, &user.BridgeTyping, &user.IncomingPresence, &user.IncomingTyping)
 	if err != nil {
 		if err != sql.ErrNoRows {
 			user.log.Errorln("Database scan failed:", err)
@@ -136,10 +154,11 @@ func (user *User) sessionUnptr() (sess whatsapp.Session) {
 
 func (user *User) Insert() {
 	sess := user.sessionUnptr()
-	_, err := user.db.Exec(`INSERT INTO "user" (mxid, jid, management_room, last_connection, client_id, client_token, server_token, enc_key, mac_key) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`,
+	_, err := user.db.Exec(`INSERT INTO "user" (mxid, jid, management_room, last_connection, client_id, client_token, server_token, enc_key, mac_key, notice_level, bridge_receipts, bridge_presence, bridge_typing, incoming_presence, incoming_typing) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15)`,
 		user.MXID, user.jidPtr(),
 		user.ManagementRoom, user.LastConnection,
-		sess.ClientID, sess.ClientToken, sess.ServerToken, sess.EncKey, sess.MacKey)
+		sess.ClientID, sess.ClientToken, sess.ServerToken, sess.EncKey, sess.MacKey,
+		user.NoticeLevel, user.BridgeReceipts, user.BridgePresence, user.BridgeTyping, user.IncomingPresence, user.IncomingTyping)
 	if err != nil {
 		user.log.Warnfln("Failed to insert %s: %v", user.MXID, err)
 	}
@@ -156,10 +175,10 @@ func (user *User) UpdateLastConnection() {
 
 func (user *User) Update() {
 	sess := user.sessionUnptr()
-	_, err := user.db.Exec(`UPDATE "user" SET jid=$1, management_room=$2, last_connection=$3, client_id=$4, client_token=$5, server_token=$6, enc_key=$7, mac_key=$8 WHERE mxid=$9`,
+	_, err := user.db.Exec(`UPDATE "user" SET jid=$1, management_room=$2, last_connection=$3, client_id=$4, client_token=$5, server_token=$6, enc_key=$7, mac_key=$8, notice_level=$9, bridge_receipts=$10, bridge_presence=$11, bridge_typing=$12, incoming_presence=$13, incoming_typing=$14 WHERE mxid=$15`,
 		user.jidPtr(), user.ManagementRoom, user.LastConnection,
 		sess.ClientID, sess.ClientToken, sess.ServerToken, sess.EncKey, sess.MacKey,
-		user.MXID)
+		user.NoticeLevel, user.BridgeReceipts, user.BridgePresence, user.BridgeTyping, user.IncomingPresence, user.IncomingTyping, user.MXID)
 	if err != nil {
 		user.log.Warnfln("Failed to update %s: %v", user.MXID, err)
 	}
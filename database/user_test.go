@@ -0,0 +1,68 @@
+// mautrix-whatsapp - A Matrix-WhatsApp puppeting bridge.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"testing"
+
+	"github.com/Rhymen/go-whatsapp"
+)
+
+func TestUserQuery(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, db *Database) {
+		user := db.User.New()
+		user.MXID = "@alice:example.com"
+		user.ManagementRoom = "!management:example.com"
+		user.Insert()
+
+		loaded := db.User.GetByMXID(user.MXID)
+		if loaded == nil {
+			t.Fatal("Inserted user not found")
+		} else if loaded.Session != nil || len(loaded.JID) != 0 {
+			t.Errorf("Expected logged out user not to have a session, got %+v", loaded)
+		} else if !loaded.IncomingPresence || !loaded.IncomingTyping || !loaded.BridgeReceipts {
+			t.Errorf("User bridging settings weren't stored correctly: %+v", loaded)
+		}
+
+		user.JID = "15551234567@s.whatsapp.net"
+		user.Session = &whatsapp.Session{ClientID: "client", ClientToken: "ctoken", ServerToken: "stoken", EncKey: []byte{1}, MacKey: []byte{2}}
+		user.IncomingTyping = false
+		user.NoticeLevel = "errors"
+		user.Update()
+		loaded = db.User.GetByJID("15551234567@c.us")
+		if loaded == nil {
+			t.Fatal("Logged in user not found by JID")
+		} else if loaded.JID != user.JID || loaded.Session == nil || loaded.Session.ClientToken != "ctoken" {
+			t.Errorf("User session wasn't stored correctly: %+v", loaded)
+		} else if loaded.IncomingTyping || loaded.NoticeLevel != "errors" {
+			t.Errorf("User settings update wasn't stored correctly: %+v", loaded)
+		}
+
+		key := GroupPortalKey("15551234567-1600000000@g.us")
+		insertTestPortal(db, key, "")
+		if err := user.SetPortalKeys([]PortalKeyWithMeta{{PortalKey: key, InCommunity: true}}); err != nil {
+			t.Fatal("Failed to set user portal keys:", err)
+		}
+		if !user.IsInPortal(key) {
+			t.Error("User isn't in the portal after setting portal keys")
+		} else if keys := user.GetPortalKeys(); len(keys) != 1 || keys[0] != key {
+			t.Errorf("Unexpected user portal keys: %+v", keys)
+		} else if !user.GetInCommunityMap()[key] {
+			t.Error("User portal wasn't marked as in community")
+		}
+	})
+}
@@ -0,0 +1,272 @@
+// mautrix-whatsapp - A Matrix-WhatsApp puppeting bridge.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"html"
+	"strings"
+	"time"
+
+	"github.com/Rhymen/go-whatsapp"
+	waProto "github.com/Rhymen/go-whatsapp/binary/proto"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+
+	"maunium.net/go/mautrix/event"
+
+	"maunium.net/go/mautrix-whatsapp/database"
+)
+
+// Field numbers of message edits. Edits are protocol messages with a type that the protobuf definitions in
+// go-whatsapp don't know, so the type and the new content end up in the unknown fields of the protocol message.
+const (
+	editedMessageField protowire.Number = 58
+
+	futureProofMessageField protowire.Number = 1
+	protocolMessageField    protowire.Number = 12
+
+	protocolMessageTypeField          protowire.Number = 2
+	protocolMessageEditedMessageField protowire.Number = 14
+	protocolMessageTimestampMSField   protowire.Number = 15
+
+	protocolMessageTypeMessageEdit = 14
+)
+
+// whatsappEditWindow is how long after sending a message WhatsApp allows editing it.
+const whatsappEditWindow = 15 * time.Minute
+
+// MessageEdit is an edit of the text or caption of an earlier WhatsApp message.
+type MessageEdit struct {
+	Info whatsapp.MessageInfo
+	// TargetID is the ID of the message that was edited.
+	TargetID whatsapp.MessageID
+	// Message is the new content of the edited message.
+	Message *waProto.Message
+}
+
+func (msg MessageEdit) GetInfo() whatsapp.MessageInfo {
+	return msg.Info
+}
+
+// parseMessageEdit returns nil if the message isn't an edit.
+func parseMessageEdit(msg *waProto.WebMessageInfo) *MessageEdit {
+	protoMsg := msg.GetMessage().GetProtocolMessage()
+	if protoMsg == nil {
+		// Newer clients wrap the protocol message in a future proof message
+		parseProtoFields(msg.GetMessage().ProtoReflect().GetUnknown(), func(num protowire.Number, value []byte) bool {
+			if num == editedMessageField {
+				protoMsg = parseWrappedProtocolMessage(value)
+			}
+			return true
+		})
+	}
+	if protoMsg == nil || len(protoMsg.GetKey().GetId()) == 0 {
+		return nil
+	}
+	isEdit := protoMsg.Type != nil && *protoMsg.Type == protocolMessageTypeMessageEdit
+	var edited *waProto.Message
+	if !parseProtoFields(protoMsg.ProtoReflect().GetUnknown(), func(num protowire.Number, value []byte) bool {
+		switch num {
+		case protocolMessageTypeField:
+			msgType, _ := protowire.ConsumeVarint(value)
+			isEdit = msgType == protocolMessageTypeMessageEdit
+		case protocolMessageEditedMessageField:
+			edited = &waProto.Message{}
+			return proto.Unmarshal(value, edited) == nil
+		}
+		return true
+	}) || !isEdit || edited == nil {
+		return nil
+	}
+	return &MessageEdit{
+		Info: whatsapp.MessageInfo{
+			Id:        msg.GetKey().GetId(),
+			RemoteJid: msg.GetKey().GetRemoteJid(),
+			SenderJid: msg.GetParticipant(),
+			FromMe:    msg.GetKey().GetFromMe(),
+			Timestamp: msg.GetMessageTimestamp(),
+			Status:    whatsapp.MessageStatus(msg.GetStatus()),
+			PushName:  msg.GetPushName(),
+			Source:    msg,
+		},
+		TargetID: protoMsg.GetKey().GetId(),
+		Message:  edited,
+	}
+}
+
+// makeEditMessage wraps the new content of a message sent from Matrix in an edit protocol message.
+func makeEditMessage(target *database.Message, edited *waProto.Message, timestamp int64) (*waProto.Message, error) {
+	editedData, err := proto.Marshal(edited)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal edited message: %w", err)
+	}
+	var unknown []byte
+	unknown = protowire.AppendTag(unknown, protocolMessageTypeField, protowire.VarintType)
+	unknown = protowire.AppendVarint(unknown, protocolMessageTypeMessageEdit)
+	unknown = protowire.AppendTag(unknown, protocolMessageEditedMessageField, protowire.BytesType)
+	unknown = protowire.AppendBytes(unknown, editedData)
+	unknown = protowire.AppendTag(unknown, protocolMessageTimestampMSField, protowire.VarintType)
+	unknown = protowire.AppendVarint(unknown, uint64(timestamp))
+	fromMe := true
+	protoMsg := &waProto.ProtocolMessage{
+		Key: &waProto.MessageKey{
+			FromMe:    &fromMe,
+			Id:        &target.JID,
+			RemoteJid: &target.Chat.JID,
+		},
+	}
+	protoMsg.ProtoReflect().SetUnknown(unknown)
+	return &waProto.Message{ProtocolMessage: protoMsg}, nil
+}
+
+func parseWrappedProtocolMessage(data []byte) (protoMsg *waProto.ProtocolMessage) {
+	parseProtoFields(data, func(num protowire.Number, value []byte) bool {
+		if num != futureProofMessageField {
+			return true
+		}
+		return parseProtoFields(value, func(num protowire.Number, value []byte) bool {
+			if num == protocolMessageField {
+				protoMsg = &waProto.ProtocolMessage{}
+				if proto.Unmarshal(value, protoMsg) != nil {
+					protoMsg = nil
+				}
+			}
+			return true
+		})
+	})
+	return
+}
+
+// getEditableText returns the text or caption of a message and the context info with its mentions.
+// ok is false if the message doesn't have text that can be edited.
+func getEditableText(msg *waProto.Message) (text string, ctxInfo *waProto.ContextInfo, isCaption, ok bool) {
+	switch {
+	case msg.Conversation != nil:
+		return msg.GetConversation(), nil, false, true
+	case msg.GetExtendedTextMessage() != nil:
+		return msg.GetExtendedTextMessage().GetText(), msg.GetExtendedTextMessage().GetContextInfo(), false, true
+	case msg.GetImageMessage() != nil:
+		return msg.GetImageMessage().GetCaption(), msg.GetImageMessage().GetContextInfo(), true, true
+	case msg.GetVideoMessage() != nil:
+		return msg.GetVideoMessage().GetCaption(), msg.GetVideoMessage().GetContextInfo(), true, true
+	}
+	return "", nil, false, false
+}
+
+// applyMessageEdit returns a copy of the original message with the text or caption replaced with the edited one.
+func applyMessageEdit(original, edited *waProto.Message) *waProto.Message {
+	text, _, isCaption, _ := getEditableText(edited)
+	if !isCaption || original == nil {
+		return edited
+	}
+	updated := proto.Clone(original).(*waProto.Message)
+	if updated.ImageMessage != nil {
+		updated.ImageMessage.Caption = &text
+	} else if updated.VideoMessage != nil {
+		updated.VideoMessage.Caption = &text
+	}
+	return updated
+}
+
+const editedLabel = "Edited message"
+
+// addEditedLabel marks the content as an edit of a message that doesn't exist on Matrix.
+func addEditedLabel(content *event.MessageEventContent) {
+	if content.Format != event.FormatHTML {
+		content.Format = event.FormatHTML
+		content.FormattedBody = strings.ReplaceAll(html.EscapeString(content.Body), "\n", "<br/>")
+	}
+	content.Body = fmt.Sprintf("[%s]\n%s", editedLabel, content.Body)
+	content.FormattedBody = fmt.Sprintf("<p><em>%s</em></p>%s", editedLabel, content.FormattedBody)
+}
+
+// makeEditContent turns the content into a Matrix edit of the given event, with a fallback for clients that don't
+// support edits.
+func makeEditContent(content *event.MessageEventContent, target *event.RelatesTo) *event.MessageEventContent {
+	newContent := *content
+	content.NewContent = &newContent
+	content.RelatesTo = target
+	content.Body = "* " + content.Body
+	if content.Format == event.FormatHTML {
+		content.FormattedBody = "* " + content.FormattedBody
+	}
+	return content
+}
+
+func (portal *Portal) getMessageSenderJID(source *User, info whatsapp.MessageInfo) whatsapp.JID {
+	if info.FromMe {
+		return source.JID
+	} else if portal.IsPrivateChat() {
+		return portal.Key.JID
+	} else if len(info.SenderJid) > 0 {
+		return NormalizeJID(info.SenderJid)
+	}
+	return NormalizeJID(info.Source.GetKey().GetParticipant())
+}
+
+func (portal *Portal) HandleMessageEdit(source *User, edit MessageEdit) bool {
+	intent := portal.startHandling(source, edit.Info, "edit")
+	if intent == nil {
+		return false
+	}
+
+	text, ctxInfo, isCaption, ok := getEditableText(edit.Message)
+	if !ok {
+		portal.log.Debugfln("Ignoring edit %s of %s: the new content isn't text or a caption", edit.Info.Id, edit.TargetID)
+		return true
+	}
+	content := &event.MessageEventContent{
+		Body:    text,
+		MsgType: event.MsgText,
+	}
+	if isCaption {
+		// Captions are bridged as separate notices after the media
+		content.MsgType = event.MsgNotice
+	}
+	portal.bridge.Formatter.ParseWhatsApp(content, ctxInfo.GetMentionedJid())
+
+	target := portal.bridge.DB.Message.GetByJID(portal.Key, edit.TargetID)
+	if target != nil && NormalizeJID(target.Sender) != portal.getMessageSenderJID(source, edit.Info) {
+		portal.log.Warnfln("Ignoring edit %s of %s: the edit sender didn't send the original message", edit.Info.Id, edit.TargetID)
+		return true
+	}
+	var hasEditableEvent bool
+	if target != nil && !target.IsFakeMXID() {
+		// Media without a caption doesn't have a caption event that could be edited
+		originalText, _, _, _ := getEditableText(target.Content)
+		hasEditableEvent = len(originalText) > 0 || !isCaption
+	}
+	if hasEditableEvent {
+		content = makeEditContent(content, &event.RelatesTo{Type: event.RelReplace, EventID: target.MXID})
+	} else {
+		portal.log.Debugfln("Original message %s of edit %s wasn't bridged, sending edit as new message", edit.TargetID, edit.Info.Id)
+		addEditedLabel(content)
+	}
+
+	resp, err := portal.sendMessage(intent, event.EventMessage, content, int64(edit.Info.Timestamp*1000))
+	if err != nil {
+		portal.log.Errorfln("Failed to handle edit %s of %s: %v", edit.Info.Id, edit.TargetID, err)
+		return true
+	}
+	if target != nil {
+		updated := applyMessageEdit(target.Content, edit.Message)
+		target.UpdateContent(updated, summarizeMessage(updated))
+	}
+	portal.finishHandling(source, edit.Info.Source, resp.EventID)
+	return true
+}
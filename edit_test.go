@@ -0,0 +1,160 @@
+// mautrix-whatsapp - A Matrix-WhatsApp puppeting bridge.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/Rhymen/go-whatsapp"
+	waProto "github.com/Rhymen/go-whatsapp/binary/proto"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+
+	"maunium.net/go/mautrix/event"
+
+	"maunium.net/go/mautrix-whatsapp/database"
+)
+
+func makeTestEditProtocolMessage(t *testing.T, targetID string, msgType uint64, edited *waProto.Message) *waProto.ProtocolMessage {
+	editedData, err := proto.Marshal(edited)
+	if err != nil {
+		t.Fatal("Failed to marshal edited message:", err)
+	}
+	var unknown []byte
+	unknown = protowire.AppendTag(unknown, protocolMessageTypeField, protowire.VarintType)
+	unknown = protowire.AppendVarint(unknown, msgType)
+	unknown = protowire.AppendTag(unknown, protocolMessageEditedMessageField, protowire.BytesType)
+	unknown = protowire.AppendBytes(unknown, editedData)
+	protoMsg := &waProto.ProtocolMessage{Key: &waProto.MessageKey{Id: &targetID}}
+	protoMsg.ProtoReflect().SetUnknown(unknown)
+	return protoMsg
+}
+
+func TestParseMessageEdit(t *testing.T) {
+	text := "Hello, edited world!"
+	editID := "EDITID"
+	edited := &waProto.Message{Conversation: &text}
+
+	direct := &waProto.WebMessageInfo{
+		Key:     &waProto.MessageKey{Id: &editID},
+		Message: &waProto.Message{ProtocolMessage: makeTestEditProtocolMessage(t, "TARGET", protocolMessageTypeMessageEdit, edited)},
+	}
+	if edit := parseMessageEdit(direct); edit == nil {
+		t.Error("Failed to parse edit in protocol message")
+	} else if edit.TargetID != "TARGET" || edit.Info.Id != editID || edit.Message.GetConversation() != text {
+		t.Errorf("Edit in protocol message wasn't parsed correctly: %+v", edit)
+	}
+
+	wrapperData, err := proto.Marshal(&waProto.FutureProofMessage{Message: &waProto.Message{
+		ProtocolMessage: makeTestEditProtocolMessage(t, "TARGET2", protocolMessageTypeMessageEdit, edited),
+	}})
+	if err != nil {
+		t.Fatal("Failed to marshal wrapper:", err)
+	}
+	var unknown []byte
+	unknown = protowire.AppendTag(unknown, editedMessageField, protowire.BytesType)
+	unknown = protowire.AppendBytes(unknown, wrapperData)
+	wrapped := &waProto.Message{}
+	wrapped.ProtoReflect().SetUnknown(unknown)
+	if edit := parseMessageEdit(&waProto.WebMessageInfo{Key: &waProto.MessageKey{Id: &editID}, Message: wrapped}); edit == nil {
+		t.Error("Failed to parse edit in future proof wrapper")
+	} else if edit.TargetID != "TARGET2" || edit.Message.GetConversation() != text {
+		t.Errorf("Edit in future proof wrapper wasn't parsed correctly: %+v", edit)
+	}
+
+	revokeType := waProto.ProtocolMessage_REVOKE
+	target := "TARGET"
+	revoke := &waProto.WebMessageInfo{Message: &waProto.Message{ProtocolMessage: &waProto.ProtocolMessage{
+		Key:  &waProto.MessageKey{Id: &target},
+		Type: &revokeType,
+	}}}
+	if edit := parseMessageEdit(revoke); edit != nil {
+		t.Errorf("Expected revocation not to be parsed as an edit, got %+v", edit)
+	}
+	otherType := &waProto.WebMessageInfo{Message: &waProto.Message{
+		ProtocolMessage: makeTestEditProtocolMessage(t, "TARGET", 99, edited),
+	}}
+	if edit := parseMessageEdit(otherType); edit != nil {
+		t.Errorf("Expected unknown protocol message type not to be parsed as an edit, got %+v", edit)
+	}
+}
+
+func TestApplyMessageEdit(t *testing.T) {
+	oldCaption, newCaption, newText := "Old caption", "New caption", "New text"
+	url := "https://example.com/image"
+	original := &waProto.Message{ImageMessage: &waProto.ImageMessage{Caption: &oldCaption, Url: &url}}
+
+	updated := applyMessageEdit(original, &waProto.Message{ImageMessage: &waProto.ImageMessage{Caption: &newCaption}})
+	if updated.GetImageMessage().GetCaption() != newCaption || updated.GetImageMessage().GetUrl() != url {
+		t.Errorf("Caption edit wasn't applied correctly: %+v", updated)
+	} else if original.GetImageMessage().GetCaption() != oldCaption {
+		t.Error("applyMessageEdit modified the original message")
+	}
+
+	edited := &waProto.Message{Conversation: &newText}
+	if updated = applyMessageEdit(&waProto.Message{Conversation: &oldCaption}, edited); updated.GetConversation() != newText {
+		t.Errorf("Text edit wasn't applied correctly: %+v", updated)
+	}
+}
+
+func TestMakeEditContent(t *testing.T) {
+	content := makeEditContent(&event.MessageEventContent{MsgType: event.MsgText, Body: "new"}, &event.RelatesTo{Type: event.RelReplace, EventID: "$original"})
+	if content.Body != "* new" || content.NewContent == nil || content.NewContent.Body != "new" {
+		t.Errorf("Unexpected edit content: %+v", content)
+	} else if content.RelatesTo.GetReplaceID() != "$original" {
+		t.Errorf("Edit doesn't replace the original event: %+v", content.RelatesTo)
+	}
+}
+
+func TestEditRevocationIsIgnoredOnce(t *testing.T) {
+	user := &User{}
+	user.markEditRevocation("TARGET")
+	revocation := whatsapp.MessageRevocation{Id: "TARGET"}
+	if !user.isEditRevocation(revocation) {
+		t.Error("Expected the revocation dispatched for an edit to be ignored")
+	}
+	if user.isEditRevocation(revocation) {
+		t.Error("Expected later revocations of the same message to be handled normally")
+	}
+}
+
+func TestMakeEditMessageRoundTrip(t *testing.T) {
+	text := "Fixed typo"
+	target := &database.Message{Chat: database.PortalKey{JID: "15551234567@s.whatsapp.net"}, JID: "ORIGINAL"}
+	msg, err := makeEditMessage(target, &waProto.Message{Conversation: &text}, 1617000000000)
+	if err != nil {
+		t.Fatal("Failed to make edit message:", err)
+	}
+	data, err := proto.Marshal(msg)
+	if err != nil {
+		t.Fatal("Failed to marshal edit message:", err)
+	}
+	// Unmarshal like an incoming message to make sure the unknown fields survive the round trip
+	received := &waProto.Message{}
+	if err = proto.Unmarshal(data, received); err != nil {
+		t.Fatal("Failed to unmarshal edit message:", err)
+	}
+	editID := "EDITID"
+	edit := parseMessageEdit(&waProto.WebMessageInfo{Key: &waProto.MessageKey{Id: &editID}, Message: received})
+	if edit == nil {
+		t.Fatal("Edit message sent from Matrix can't be parsed as an edit")
+	} else if edit.TargetID != target.JID || edit.Message.GetConversation() != text {
+		t.Errorf("Edit message wasn't encoded correctly: %+v", edit)
+	} else if key := received.GetProtocolMessage().GetKey(); !key.GetFromMe() || key.GetRemoteJid() != target.Chat.JID {
+		t.Errorf("Edit message has wrong key: %+v", key)
+	}
+}
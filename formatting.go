@@ -57,10 +57,8 @@ func NewFormatter(bridge *Bridge) *Formatter {
 				if mxid[0] == '@' {
 					puppet := bridge.GetPuppetByMXID(id.UserID(mxid))
 					if puppet != nil {
-						jids, ok := ctx[mentionedJIDsContextKey].([]whatsapp.JID)
-						if !ok {
-							ctx[mentionedJIDsContextKey] = []whatsapp.JID{puppet.JID}
-						} else {
+						jids, _ := ctx[mentionedJIDsContextKey].([]whatsapp.JID)
+						if !containsJID(jids, puppet.JID) {
 							ctx[mentionedJIDsContextKey] = append(jids, puppet.JID)
 						}
 						return "@" + puppet.PhoneNumber()
@@ -104,29 +102,63 @@ func NewFormatter(bridge *Bridge) *Formatter {
 	return formatter
 }
 
+func containsJID(jids []whatsapp.JID, jid whatsapp.JID) bool {
+	for _, item := range jids {
+		if item == jid {
+			return true
+		}
+	}
+	return false
+}
+
 func (formatter *Formatter) getMatrixInfoByJID(jid whatsapp.JID) (mxid id.UserID, displayname string) {
 	if user := formatter.bridge.GetUserByJID(jid); user != nil {
 		mxid = user.MXID
 		displayname = string(user.MXID)
-	} else if puppet := formatter.bridge.GetPuppetByJID(jid); puppet != nil {
+	} else if formatter.bridge.DB.Puppet.Get(jid) != nil {
+		puppet := formatter.bridge.GetPuppetByJID(jid)
 		mxid = puppet.MXID
 		displayname = puppet.Displayname
+		if len(displayname) == 0 {
+			displayname = puppet.PhoneNumber()
+		}
 	}
 	return
 }
 
-func (formatter *Formatter) ParseWhatsApp(content *event.MessageEventContent, mentionedJIDs []whatsapp.JID) {
-	output := html.EscapeString(content.Body)
-	for regex, replacement := range formatter.waReplString {
-		output = regex.ReplaceAllString(output, replacement)
+// replaceOutsideCodeBlocks applies the simple WhatsApp formatting replacements to everything except code blocks,
+// as WhatsApp doesn't apply formatting inside code blocks either.
+func (formatter *Formatter) replaceOutsideCodeBlocks(input string) string {
+	var output strings.Builder
+	replace := func(part string) {
+		for regex, replacement := range formatter.waReplString {
+			part = regex.ReplaceAllString(part, replacement)
+		}
+		output.WriteString(part)
+	}
+	lastEnd := 0
+	for _, match := range codeBlockRegex.FindAllStringIndex(input, -1) {
+		replace(input[lastEnd:match[0]])
+		output.WriteString(input[match[0]:match[1]])
+		lastEnd = match[1]
 	}
+	replace(input[lastEnd:])
+	return output.String()
+}
+
+func (formatter *Formatter) ParseWhatsApp(content *event.MessageEventContent, mentionedJIDs []whatsapp.JID) {
+	output := formatter.replaceOutsideCodeBlocks(html.EscapeString(content.Body))
 	for regex, replacer := range formatter.waReplFunc {
 		output = regex.ReplaceAllStringFunc(output, replacer)
 	}
 	for _, jid := range mentionedJIDs {
 		mxid, displayname := formatter.getMatrixInfoByJID(jid)
+		if len(mxid) == 0 {
+			// Leave mentions of unknown users as plain phone numbers
+			continue
+		}
 		number := "@" + strings.Replace(jid, whatsapp.NewUserSuffix, "", 1)
-		output = strings.Replace(output, number, fmt.Sprintf(`<a href="https://matrix.to/#/%s">%s</a>`, mxid, displayname), -1)
+		output = strings.Replace(output, number, fmt.Sprintf(`<a href="https://matrix.to/#/%s">%s</a>`, mxid, html.EscapeString(displayname)), -1)
 		content.Body = strings.Replace(content.Body, number, displayname, -1)
 	}
 	if output != content.Body {
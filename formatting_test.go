@@ -0,0 +1,113 @@
+// mautrix-whatsapp - A Matrix-WhatsApp puppeting bridge.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/Rhymen/go-whatsapp"
+
+	"maunium.net/go/mautrix/event"
+)
+
+const testMentionJID = "15550000002@s.whatsapp.net"
+
+func newTestFormatter(t *testing.T) *Formatter {
+	bridge := newTestBridge(t)
+	connectTestHomeserver(t, bridge)
+	bridge.GetPuppetByJID(testMentionJID).Displayname = "Bob"
+	return NewFormatter(bridge)
+}
+
+func TestParseWhatsApp(t *testing.T) {
+	formatter := newTestFormatter(t)
+	tests := []struct {
+		name         string
+		body         string
+		mentions     []whatsapp.JID
+		expectedBody string
+		expectedHTML string
+	}{
+		{"plain text", "Hello", nil, "Hello", ""},
+		{"bold", "Hello *world*", nil, "Hello *world*", "Hello <strong>world</strong>"},
+		{"italic", "_Hello_ world", nil, "_Hello_ world", "<em>Hello</em> world"},
+		{"strikethrough", "~Hello~", nil, "~Hello~", "<del>Hello</del>"},
+		{"nested", "*_Hello_*", nil, "*_Hello_*", "<strong><em>Hello</em></strong>"},
+		{"underscores inside words", "snake_case_name", nil, "snake_case_name", ""},
+		{"inline code", "Run ```make```", nil, "Run ```make```", "Run <code>make</code>"},
+		{"code block", "```a\nb```", nil, "```a\nb```", "<pre><code>a<br/>b</code></pre>"},
+		{"no formatting in code", "```*not bold*```", nil, "```*not bold*```", "<code>*not bold*</code>"},
+		{"html is escaped", "a < b & *c*", nil, "a < b & *c*", "a &lt; b &amp; <strong>c</strong>"},
+		{"newlines", "*a*\nb", nil, "*a*\nb", "<strong>a</strong><br/>b"},
+		{"mention", "Hi @15550000002", []whatsapp.JID{testMentionJID}, "Hi Bob",
+			`Hi <a href="https://matrix.to/#/@whatsapp_15550000002:example.com">Bob</a>`},
+		{"unknown mention", "Hi @15550000003", []whatsapp.JID{"15550000003@s.whatsapp.net"}, "Hi @15550000003", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			content := &event.MessageEventContent{MsgType: event.MsgText, Body: test.body}
+			formatter.ParseWhatsApp(content, test.mentions)
+			if content.Body != test.expectedBody {
+				t.Errorf("Expected body %q, got %q", test.expectedBody, content.Body)
+			}
+			if len(test.expectedHTML) == 0 {
+				if content.Format != "" || len(content.FormattedBody) != 0 {
+					t.Errorf("Expected no formatted body, got %q", content.FormattedBody)
+				}
+			} else if content.Format != event.FormatHTML || content.FormattedBody != test.expectedHTML {
+				t.Errorf("Expected formatted body %q, got %q (format %q)", test.expectedHTML, content.FormattedBody, content.Format)
+			}
+		})
+	}
+}
+
+func TestParseMatrix(t *testing.T) {
+	formatter := newTestFormatter(t)
+	tests := []struct {
+		name     string
+		html     string
+		expected string
+		mentions []whatsapp.JID
+	}{
+		{"plain text", "Hello", "Hello", nil},
+		{"bold", "Hello <strong>world</strong>", "Hello *world*", nil},
+		{"italic", "<em>Hello</em> world", "_Hello_ world", nil},
+		{"strikethrough", "<del>Hello</del>", "~Hello~", nil},
+		{"inline code", "Run <code>make</code>", "Run ```make```", nil},
+		{"code block", "<pre><code>a\nb</code></pre>", "```a\nb```", nil},
+		{"line breaks", "a<br/>b", "a\nb", nil},
+		{"entities", "a &lt; b &amp; c", "a < b & c", nil},
+		{"puppet mention", `Hi <a href="https://matrix.to/#/@whatsapp_15550000002:example.com">Bob</a>`,
+			"Hi @15550000002", []whatsapp.JID{testMentionJID}},
+		{"repeated mention", `<a href="https://matrix.to/#/@whatsapp_15550000002:example.com">Bob</a> ` +
+			`<a href="https://matrix.to/#/@whatsapp_15550000002:example.com">Bob</a>`,
+			"@15550000002 @15550000002", []whatsapp.JID{testMentionJID}},
+		{"non-puppet mention", `Hi <a href="https://matrix.to/#/@alice:example.com">Alice</a>`, "Hi @alice:example.com", nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			text, mentions := formatter.ParseMatrix(test.html)
+			if text != test.expected {
+				t.Errorf("Expected %q, got %q", test.expected, text)
+			}
+			if !reflect.DeepEqual(mentions, test.mentions) {
+				t.Errorf("Expected mentions %v, got %v", test.mentions, mentions)
+			}
+		})
+	}
+}
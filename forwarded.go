@@ -0,0 +1,55 @@
+// mautrix-whatsapp - A Matrix-WhatsApp puppeting bridge.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"html"
+	"strings"
+
+	"github.com/Rhymen/go-whatsapp"
+
+	"maunium.net/go/mautrix/event"
+)
+
+// frequentlyForwardedScore is the forwarding score at which WhatsApp shows "Forwarded many times" instead of "Forwarded".
+const frequentlyForwardedScore = 5
+
+// getForwardedLabel returns the label to show above a forwarded message, or an empty string if it wasn't forwarded.
+func getForwardedLabel(info whatsapp.MessageInfo) string {
+	contextInfo := getContextInfo(info.Source.GetMessage())
+	if !contextInfo.GetIsForwarded() {
+		return ""
+	} else if contextInfo.GetForwardingScore() >= frequentlyForwardedScore {
+		return "Forwarded many times"
+	}
+	return "Forwarded"
+}
+
+// addForwardedLabel prepends a "Forwarded" label to the body of the message if it was forwarded on WhatsApp.
+func addForwardedLabel(content *event.MessageEventContent, info whatsapp.MessageInfo) {
+	label := getForwardedLabel(info)
+	if len(label) == 0 {
+		return
+	}
+	if content.Format != event.FormatHTML {
+		content.Format = event.FormatHTML
+		content.FormattedBody = strings.ReplaceAll(html.EscapeString(content.Body), "\n", "<br/>")
+	}
+	content.Body = fmt.Sprintf("[%s]\n%s", label, content.Body)
+	content.FormattedBody = fmt.Sprintf("<p><em>%s</em></p>%s", label, content.FormattedBody)
+}
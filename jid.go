@@ -0,0 +1,130 @@
+// mautrix-whatsapp - A Matrix-WhatsApp puppeting bridge.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"strings"
+
+	"github.com/Rhymen/go-whatsapp"
+)
+
+const StatusBroadcastJID = "status" + whatsapp.BroadcastSuffix
+
+type JIDType int
+
+const (
+	JIDTypeUnknown JIDType = iota
+	JIDTypeUser
+	JIDTypeGroup
+	JIDTypeBroadcast
+	JIDTypeStatus
+)
+
+// E.164 numbers are at most 15 digits. Anything shorter than 5 digits can't be a real phone number either.
+const (
+	minPhoneNumberLength = 5
+	maxPhoneNumberLength = 15
+)
+
+func isDigits(str string) bool {
+	return len(str) > 0 && strings.IndexFunc(str, func(char rune) bool { return char < '0' || char > '9' }) == -1
+}
+
+// NormalizeJID converts legacy user JIDs (@c.us) to the current format and trims whitespace.
+// Other JIDs are returned as-is.
+func NormalizeJID(jid whatsapp.JID) whatsapp.JID {
+	jid = strings.TrimSpace(jid)
+	if strings.HasSuffix(jid, whatsapp.OldUserSuffix) {
+		jid = strings.TrimSuffix(jid, whatsapp.OldUserSuffix) + whatsapp.NewUserSuffix
+	}
+	return jid
+}
+
+// GetJIDType classifies a JID. Legacy user JIDs are classified as users.
+func GetJIDType(jid whatsapp.JID) JIDType {
+	jid = NormalizeJID(jid)
+	switch {
+	case jid == StatusBroadcastJID:
+		return JIDTypeStatus
+	case strings.HasSuffix(jid, whatsapp.NewUserSuffix):
+		return JIDTypeUser
+	case strings.HasSuffix(jid, whatsapp.GroupSuffix):
+		return JIDTypeGroup
+	case strings.HasSuffix(jid, whatsapp.BroadcastSuffix):
+		return JIDTypeBroadcast
+	default:
+		return JIDTypeUnknown
+	}
+}
+
+// IsValidJID checks that the part before the server is well-formed for the type of the JID.
+// User JIDs must be phone numbers, group JIDs are either numeric or in the legacy creator-timestamp format.
+func IsValidJID(jid whatsapp.JID) bool {
+	jid = NormalizeJID(jid)
+	switch GetJIDType(jid) {
+	case JIDTypeUser:
+		number := strings.TrimSuffix(jid, whatsapp.NewUserSuffix)
+		return isDigits(number) && len(number) >= minPhoneNumberLength && len(number) <= maxPhoneNumberLength
+	case JIDTypeGroup:
+		parts := strings.Split(strings.TrimSuffix(jid, whatsapp.GroupSuffix), "-")
+		if len(parts) > 2 {
+			return false
+		}
+		for _, part := range parts {
+			if !isDigits(part) {
+				return false
+			}
+		}
+		return true
+	case JIDTypeBroadcast:
+		return isDigits(strings.TrimSuffix(jid, whatsapp.BroadcastSuffix))
+	case JIDTypeStatus:
+		return true
+	default:
+		return false
+	}
+}
+
+// ParsePhoneNumberJID converts user input like "+1 (555) 123-4567", "00 44 20 ...", a bare number
+// or a user JID to a canonical user JID. The number must be in international format.
+func ParsePhoneNumberJID(input string) (whatsapp.JID, bool) {
+	input = NormalizeJID(input)
+	input = strings.TrimSuffix(input, whatsapp.NewUserSuffix)
+	number := strings.Map(func(char rune) rune {
+		switch char {
+		case ' ', '-', '.', '(', ')':
+			return -1
+		default:
+			return char
+		}
+	}, input)
+	if strings.HasPrefix(number, "+") {
+		number = number[1:]
+	} else if strings.HasPrefix(number, "00") {
+		// International call prefix used in most of the world
+		number = number[2:]
+	}
+	if !isDigits(number) || len(number) < minPhoneNumberLength || len(number) > maxPhoneNumberLength {
+		return "", false
+	}
+	return number + whatsapp.NewUserSuffix, true
+}
+
+// JIDToPhoneNumber returns the phone number part of a user JID without the + prefix.
+func JIDToPhoneNumber(jid whatsapp.JID) string {
+	return strings.TrimSuffix(NormalizeJID(jid), whatsapp.NewUserSuffix)
+}
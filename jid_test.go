@@ -0,0 +1,110 @@
+// mautrix-whatsapp - A Matrix-WhatsApp puppeting bridge.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"testing"
+
+	"maunium.net/go/mautrix-whatsapp/database"
+)
+
+func TestNormalizeJID(t *testing.T) {
+	tests := map[string]string{
+		"15551234567@c.us":             "15551234567@s.whatsapp.net",
+		" 15551234567@s.whatsapp.net ": "15551234567@s.whatsapp.net",
+		"15551234567@s.whatsapp.net":   "15551234567@s.whatsapp.net",
+		"15551234567-1600000000@g.us":  "15551234567-1600000000@g.us",
+		"status@broadcast":             "status@broadcast",
+		"120363021234567890@g.us":      "120363021234567890@g.us",
+	}
+	for input, expected := range tests {
+		if output := NormalizeJID(input); output != expected {
+			t.Errorf("NormalizeJID(%q) = %q, expected %q", input, output, expected)
+		}
+	}
+}
+
+func TestParsePhoneNumberJID(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+		ok       bool
+	}{
+		{"+1 (555) 123-4567", "15551234567@s.whatsapp.net", true},
+		{"+44 20 7946 0958", "442079460958@s.whatsapp.net", true},
+		{"0044 20 7946 0958", "442079460958@s.whatsapp.net", true},
+		{"15551234567", "15551234567@s.whatsapp.net", true},
+		{"15551234567@c.us", "15551234567@s.whatsapp.net", true},
+		{"15551234567@s.whatsapp.net", "15551234567@s.whatsapp.net", true},
+		{"+1.555.123.4567", "15551234567@s.whatsapp.net", true},
+		{"1234", "", false},
+		{"+1234567890123456", "", false},
+		{"not a number", "", false},
+		{"", "", false},
+	}
+	for _, test := range tests {
+		output, ok := ParsePhoneNumberJID(test.input)
+		if ok != test.ok || output != test.expected {
+			t.Errorf("ParsePhoneNumberJID(%q) = (%q, %t), expected (%q, %t)", test.input, output, ok, test.expected, test.ok)
+		}
+	}
+}
+
+func TestIsValidJID(t *testing.T) {
+	tests := map[string]bool{
+		"15551234567@s.whatsapp.net":  true,
+		"15551234567@c.us":            true,
+		"1234@s.whatsapp.net":         false,
+		"+15551234567@s.whatsapp.net": false,
+		"15551234567-1600000000@g.us": true,
+		"120363021234567890@g.us":     true,
+		"1-2-3@g.us":                  false,
+		"abc@g.us":                    false,
+		"1600000000@broadcast":        true,
+		"status@broadcast":            true,
+		"15551234567@example.com":     false,
+	}
+	for jid, expected := range tests {
+		if valid := IsValidJID(jid); valid != expected {
+			t.Errorf("IsValidJID(%q) = %t, expected %t", jid, valid, expected)
+		}
+	}
+}
+
+func TestGetJIDType(t *testing.T) {
+	tests := map[string]JIDType{
+		"15551234567@s.whatsapp.net":  JIDTypeUser,
+		"15551234567@c.us":            JIDTypeUser,
+		"15551234567-1600000000@g.us": JIDTypeGroup,
+		"1600000000@broadcast":        JIDTypeBroadcast,
+		"status@broadcast":            JIDTypeStatus,
+		"something@else":              JIDTypeUnknown,
+	}
+	for jid, expected := range tests {
+		if jidType := GetJIDType(jid); jidType != expected {
+			t.Errorf("GetJIDType(%q) = %d, expected %d", jid, jidType, expected)
+		}
+	}
+}
+
+func TestNormalizePortalKey(t *testing.T) {
+	key := normalizePortalKey(database.PortalKey{JID: "15551234567@c.us", Receiver: "15559876543@c.us"})
+	expected := database.NewPortalKey("15551234567@s.whatsapp.net", "15559876543@s.whatsapp.net")
+	if key != expected {
+		t.Errorf("normalizePortalKey returned %+v, expected %+v", key, expected)
+	}
+}
@@ -23,6 +23,7 @@ import (
 	"os/signal"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -160,6 +161,11 @@ type Bridge struct {
 	puppets             map[whatsapp.JID]*Puppet
 	puppetsByCustomMXID map[id.UserID]*Puppet
 	puppetsLock         sync.Mutex
+
+	// batchSendUnsupported is set to 1 when the homeserver rejects the MSC2716 batch send endpoint.
+	batchSendUnsupported int32
+
+	stopOnce sync.Once
 }
 
 type Crypto interface {
@@ -270,13 +276,20 @@ func (bridge *Bridge) Init() {
 	bridge.MatrixHandler = NewMatrixHandler(bridge)
 	bridge.Formatter = NewFormatter(bridge)
 	bridge.Crypto = NewCryptoHelper(bridge)
+	if bridge.Crypto == nil && bridge.Config.Bridge.Encryption.Default {
+		// Creating encrypted portals without being able to encrypt would make them unusable
+		bridge.Log.Warnln("Encryption is enabled by default in the config, but the bridge was built without encryption support. New portals won't be encrypted.")
+		bridge.Config.Bridge.Encryption.Default = false
+	}
 	bridge.Metrics = NewMetricsHandler(bridge.Config.Metrics.Listen, bridge.Log.Sub("Metrics"), bridge.DB)
 }
 
 func (bridge *Bridge) Start() {
 	bridge.Log.Debugln("Running database upgrades")
 	err := bridge.DB.Init()
-	if err != nil && (err != upgrades.UnsupportedDatabaseVersion || !*ignoreUnsupportedDatabase) {
+	if errors.Is(err, upgrades.UnsupportedDatabaseVersion) && *ignoreUnsupportedDatabase {
+		bridge.Log.Warnln("Ignoring unsupported database version as requested, things may break:", err)
+	} else if err != nil {
 		bridge.Log.Fatalln("Failed to initialize database:", err)
 		os.Exit(15)
 	}
@@ -310,6 +323,34 @@ func (bridge *Bridge) Start() {
 	if bridge.Config.Bridge.ResendBridgeInfo {
 		go bridge.ResendBridgeInfo()
 	}
+	if bridge.Config.Bridge.ContactResyncInterval > 0 {
+		go bridge.periodicContactResync()
+	}
+	if bridge.Config.Bridge.MessageRetention > 0 {
+		go bridge.periodicMessagePrune()
+	}
+}
+
+const messagePruneInterval = 1 * time.Hour
+
+// periodicMessagePrune deletes message rows older than the configured retention period.
+func (bridge *Bridge) periodicMessagePrune() {
+	maxAge := time.Duration(bridge.Config.Bridge.MessageRetention) * time.Second
+	for {
+		_, _ = bridge.PruneMessages(maxAge)
+		time.Sleep(messagePruneInterval)
+	}
+}
+
+// PruneMessages deletes message rows older than maxAge, keeping the latest message in each chat.
+func (bridge *Bridge) PruneMessages(maxAge time.Duration) (int64, error) {
+	count, err := bridge.DB.Message.DeleteOlderThan(time.Now().Add(-maxAge).Unix())
+	if err != nil {
+		bridge.Log.Warnln("Failed to prune old messages:", err)
+	} else if count > 0 {
+		bridge.Log.Infofln("Pruned %d messages older than %s", count, maxAge)
+	}
+	return count, err
 }
 
 func (bridge *Bridge) ResendBridgeInfo() {
@@ -370,9 +411,7 @@ func (bridge *Bridge) UpdateBotProfile() {
 
 func (bridge *Bridge) StartUsers() {
 	bridge.Log.Debugln("Starting users")
-	for _, user := range bridge.GetAllUsers() {
-		go user.Connect(false)
-	}
+	go bridge.connectUsers(bridge.GetAllUsers())
 	bridge.Log.Debugln("Starting custom puppets")
 	for _, loopuppet := range bridge.GetAllPuppetsWithCustomMXID() {
 		go func(puppet *Puppet) {
@@ -385,23 +424,118 @@ func (bridge *Bridge) StartUsers() {
 	}
 }
 
+// connectUsers connects all the given users in parallel, with a small delay between starting each connection
+// so that a bridge with lots of users doesn't hammer WhatsApp's servers, and logs a summary once they're done.
+func (bridge *Bridge) connectUsers(users []*User) {
+	delay := time.Duration(bridge.Config.Bridge.ConnectionDelay) * time.Millisecond
+	var wg sync.WaitGroup
+	var connected, failed int32
+	noSession := 0
+	started := false
+	for _, user := range users {
+		if user.Session == nil {
+			noSession++
+			continue
+		}
+		if started && delay > 0 {
+			time.Sleep(delay)
+		}
+		started = true
+		wg.Add(1)
+		go func(user *User) {
+			defer wg.Done()
+			if user.Connect(false) {
+				atomic.AddInt32(&connected, 1)
+			} else {
+				atomic.AddInt32(&failed, 1)
+			}
+		}(user)
+	}
+	wg.Wait()
+	bridge.Log.Infofln("Finished starting users: %d connected, %d failed to connect, %d without a session",
+		connected, failed, noSession)
+}
+
+const ShutdownTimeout = 30 * time.Second
+
 func (bridge *Bridge) Stop() {
+	bridge.stopOnce.Do(func() {
+		done := make(chan struct{})
+		go func() {
+			bridge.stop()
+			close(done)
+		}()
+		select {
+		case <-done:
+			err := bridge.DB.Close()
+			if err != nil {
+				bridge.Log.Errorln("Error closing database:", err)
+			}
+		case <-time.After(ShutdownTimeout):
+			// Disconnecting users may still be writing to the database, so it's left open
+			bridge.Log.Warnfln("Bridge didn't stop within %s, giving up without closing the database", ShutdownTimeout)
+		}
+	})
+}
+
+func (bridge *Bridge) stop() {
 	if bridge.Crypto != nil {
 		bridge.Crypto.Stop()
 	}
 	bridge.AS.Stop()
 	bridge.Metrics.Stop()
 	bridge.EventProcessor.Stop()
+
+	// Send queued room metadata changes while the WhatsApp connections are still open
+	bridge.portalsLock.Lock()
+	portals := make([]*Portal, 0, len(bridge.portalsByJID))
+	for _, portal := range bridge.portalsByJID {
+		portals = append(portals, portal)
+	}
+	bridge.portalsLock.Unlock()
+	for _, portal := range portals {
+		portal.flushPendingMetaChanges()
+	}
+
+	bridge.puppetsLock.Lock()
+	puppets := make([]*Puppet, 0, len(bridge.puppets))
+	for _, puppet := range bridge.puppets {
+		puppets = append(puppets, puppet)
+	}
+	for _, puppet := range bridge.puppetsByCustomMXID {
+		if puppet.customIntent != nil {
+			puppet.stopSyncing()
+		}
+	}
+	bridge.puppetsLock.Unlock()
+	for _, puppet := range puppets {
+		puppet.clearPresence()
+	}
+
+	bridge.usersLock.Lock()
+	var wg sync.WaitGroup
 	for _, user := range bridge.usersByJID {
 		if user.Conn == nil {
 			continue
 		}
-		bridge.Log.Debugln("Disconnecting", user.MXID)
-		err := user.Conn.Disconnect()
-		if err != nil {
-			bridge.Log.Errorfln("Error while disconnecting %s: %v", user.MXID, err)
-		}
+		wg.Add(1)
+		go func(user *User) {
+			defer wg.Done()
+			if user.IsConnected() && user.BridgePresence {
+				_, err := user.Conn.Presence("", whatsapp.PresenceUnavailable)
+				if err != nil {
+					bridge.Log.Warnfln("Failed to set presence of %s to unavailable: %v", user.MXID, err)
+				}
+			}
+			bridge.Log.Debugln("Disconnecting", user.MXID)
+			err := user.Conn.Disconnect()
+			if err != nil {
+				bridge.Log.Errorfln("Error while disconnecting %s: %v", user.MXID, err)
+			}
+		}(user)
 	}
+	bridge.usersLock.Unlock()
+	wg.Wait()
 }
 
 func (bridge *Bridge) Main() {
@@ -418,7 +552,7 @@ func (bridge *Bridge) Main() {
 	bridge.Start()
 	bridge.Log.Infoln("Bridge started!")
 
-	c := make(chan os.Signal)
+	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	<-c
 
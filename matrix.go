@@ -51,10 +51,12 @@ func NewMatrixHandler(bridge *Bridge) *MatrixHandler {
 	bridge.EventProcessor.On(event.EventEncrypted, handler.HandleEncrypted)
 	bridge.EventProcessor.On(event.EventSticker, handler.HandleMessage)
 	bridge.EventProcessor.On(event.EventRedaction, handler.HandleRedaction)
+	bridge.EventProcessor.On(event.EventReaction, handler.HandleReaction)
 	bridge.EventProcessor.On(event.StateMember, handler.HandleMembership)
 	bridge.EventProcessor.On(event.StateRoomName, handler.HandleRoomMetadata)
 	bridge.EventProcessor.On(event.StateRoomAvatar, handler.HandleRoomMetadata)
 	bridge.EventProcessor.On(event.StateTopic, handler.HandleRoomMetadata)
+	bridge.EventProcessor.On(event.StatePowerLevels, handler.HandlePowerLevels)
 	bridge.EventProcessor.On(event.StateEncryption, handler.HandleEncryption)
 	return handler
 }
@@ -136,7 +138,7 @@ func (mx *MatrixHandler) HandleBotInvite(evt *event.Event) {
 
 	if !hasPuppets && (len(user.ManagementRoom) == 0 || evt.Content.AsMember().IsDirect) {
 		user.SetManagementRoom(evt.RoomID)
-		_, _ = intent.SendNotice(user.ManagementRoom, "This room has been registered as your bridge management/status room. Send `help` to get a list of commands.")
+		_, _ = intent.SendNotice(user.ManagementRoom, managementRoomWelcome)
 		mx.log.Debugln(evt.RoomID, "registered as a management room with", evt.Sender)
 	}
 }
@@ -274,7 +276,9 @@ func (mx *MatrixHandler) HandleMembership(evt *event.Event) {
 
 	isSelf := id.UserID(evt.GetStateKey()) == evt.Sender
 
-	if content.Membership == event.MembershipLeave {
+	if content.Membership == event.MembershipBan && !isSelf {
+		portal.HandleMatrixKick(user, evt)
+	} else if content.Membership == event.MembershipLeave {
 		if isSelf {
 			if evt.Unsigned.PrevContent != nil {
 				_ = evt.Unsigned.PrevContent.ParseRaw(evt.Type)
@@ -285,7 +289,7 @@ func (mx *MatrixHandler) HandleMembership(evt *event.Event) {
 					}
 				}
 			}
-		} else {
+		} else if !isUnban(evt) {
 			portal.HandleMatrixKick(user, evt)
 		}
 	} else if content.Membership == event.MembershipInvite && !isSelf {
@@ -293,6 +297,15 @@ func (mx *MatrixHandler) HandleMembership(evt *event.Event) {
 	}
 }
 
+func isUnban(evt *event.Event) bool {
+	if evt.Unsigned.PrevContent == nil {
+		return false
+	}
+	_ = evt.Unsigned.PrevContent.ParseRaw(evt.Type)
+	prevContent, ok := evt.Unsigned.PrevContent.Parsed.(*event.MemberEventContent)
+	return ok && prevContent.Membership == event.MembershipBan
+}
+
 func (mx *MatrixHandler) HandleRoomMetadata(evt *event.Event) {
 	defer mx.bridge.Metrics.TrackMatrixEvent(evt.Type)()
 	if mx.shouldIgnoreEvent(evt) {
@@ -305,13 +318,32 @@ func (mx *MatrixHandler) HandleRoomMetadata(evt *event.Event) {
 	}
 
 	portal := mx.bridge.GetPortalByMXID(evt.RoomID)
-	if portal == nil || portal.IsPrivateChat() {
+	if portal == nil || portal.IsPrivateChat() || portal.IsBroadcastList() {
 		return
 	}
 
 	portal.HandleMatrixMeta(user, evt)
 }
 
+func (mx *MatrixHandler) HandlePowerLevels(evt *event.Event) {
+	defer mx.bridge.Metrics.TrackMatrixEvent(evt.Type)()
+	if mx.shouldIgnoreEvent(evt) {
+		return
+	}
+
+	user := mx.bridge.GetUserByMXID(evt.Sender)
+	if user == nil || !user.Whitelisted || !user.IsConnected() {
+		return
+	}
+
+	portal := mx.bridge.GetPortalByMXID(evt.RoomID)
+	if portal == nil || portal.IsPrivateChat() || portal.IsBroadcastList() {
+		return
+	}
+
+	portal.HandleMatrixPowerLevels(user, evt)
+}
+
 func (mx *MatrixHandler) shouldIgnoreEvent(evt *event.Event) bool {
 	if _, isPuppet := mx.bridge.ParsePuppetMXID(evt.Sender); evt.Sender == mx.bridge.Bot.UserID || isPuppet {
 		return true
@@ -409,22 +441,55 @@ func (mx *MatrixHandler) HandleMessage(evt *event.Event) {
 	content := evt.Content.AsMessage()
 	if user.Whitelisted && content.MsgType == event.MsgText {
 		commandPrefix := mx.bridge.Config.Bridge.CommandPrefix
-		hasCommandPrefix := strings.HasPrefix(content.Body, commandPrefix)
+		// Commands can be sent as replies, e.g. to choose the message the command applies to
+		body := event.TrimReplyFallbackText(content.Body)
+		hasCommandPrefix := strings.HasPrefix(body, commandPrefix)
 		if hasCommandPrefix {
-			content.Body = strings.TrimLeft(content.Body[len(commandPrefix):], " ")
+			body = strings.TrimLeft(body[len(commandPrefix):], " ")
 		}
 		if hasCommandPrefix || evt.RoomID == user.ManagementRoom {
-			mx.cmd.Handle(evt.RoomID, user, content.Body)
+			if len(user.ManagementRoom) == 0 {
+				// First contact from this user, make sure they have somewhere to receive bridge notices
+				go user.GetManagementRoom()
+			}
+			mx.cmd.Handle(evt.RoomID, user, body, content.GetReplyTo())
 			return
 		}
 	}
 
 	portal := mx.bridge.GetPortalByMXID(evt.RoomID)
-	if portal != nil && (user.Whitelisted || portal.HasRelaybot()) {
+	if portal != nil && (user.Whitelisted || portal.HasRelay()) {
 		portal.HandleMatrixMessage(user, evt)
 	}
 }
 
+// HandleReaction retries downloading media when a user reacts to a media bridging failure notice.
+// WhatsApp Web doesn't support reactions, so they're not bridged otherwise.
+func (mx *MatrixHandler) HandleReaction(evt *event.Event) {
+	defer mx.bridge.Metrics.TrackMatrixEvent(evt.Type)()
+	if mx.shouldIgnoreEvent(evt) {
+		return
+	}
+	content := evt.Content.AsReaction()
+	if content.RelatesTo.Type != event.RelAnnotation || content.RelatesTo.Key != redownloadReaction {
+		return
+	}
+	user := mx.bridge.GetUserByMXID(evt.Sender)
+	portal := mx.bridge.GetPortalByMXID(evt.RoomID)
+	if portal == nil || !user.Whitelisted || !user.IsConnected() {
+		return
+	}
+	result := portal.QueueMediaRedownload(user, content.RelatesTo.EventID)
+	go func() {
+		err := <-result
+		// Reactions to anything other than a media failure notice are normal reactions, so they're ignored silently
+		if err != nil && !errors.Is(err, errUnknownMessage) && !errors.Is(err, errNotMediaMessage) && !errors.Is(err, errMediaNotFailed) {
+			portal.log.Warnfln("Failed to redownload media of %s after reaction from %s: %v", content.RelatesTo.EventID, user.MXID, err)
+			_, _ = portal.MainIntent().SendNotice(portal.MXID, fmt.Sprintf("Failed to redownload media: %v", err))
+		}
+	}()
+}
+
 func (mx *MatrixHandler) HandleRedaction(evt *event.Event) {
 	defer mx.bridge.Metrics.TrackMatrixEvent(evt.Type)()
 	if _, isPuppet := mx.bridge.ParsePuppetMXID(evt.Sender); evt.Sender == mx.bridge.Bot.UserID || isPuppet {
@@ -49,6 +49,8 @@ type MetricsHandler struct {
 	whatsappMessageHandling *prometheus.HistogramVec
 	countCollection         prometheus.Histogram
 	disconnections          *prometheus.CounterVec
+	errors                  *prometheus.CounterVec
+	mediaBytes              *prometheus.CounterVec
 	puppetCount             prometheus.Gauge
 	userCount               prometheus.Gauge
 	messageCount            prometheus.Gauge
@@ -99,6 +101,14 @@ func NewMetricsHandler(address string, log log.Logger, db *database.Database) *M
 			Name: "whatsapp_disconnections",
 			Help: "Number of times a Matrix user has been disconnected from WhatsApp",
 		}, []string{"user_id"}),
+		errors: promauto.NewCounterVec(prometheus.CounterOpts{
+			Name: "whatsapp_errors",
+			Help: "Number of errors received from the WhatsApp connection",
+		}, []string{"error_type"}),
+		mediaBytes: promauto.NewCounterVec(prometheus.CounterOpts{
+			Name: "bridge_media_bytes",
+			Help: "Number of bytes of media transferred through the bridge",
+		}, []string{"direction"}),
 		puppetCount: promauto.NewGauge(prometheus.GaugeOpts{
 			Name: "whatsapp_puppets_total",
 			Help: "Number of WhatsApp users bridged into Matrix",
@@ -176,6 +186,20 @@ func (mh *MetricsHandler) TrackDisconnection(userID id.UserID) {
 	mh.disconnections.With(prometheus.Labels{"user_id": string(userID)}).Inc()
 }
 
+func (mh *MetricsHandler) TrackError(errorType string) {
+	if !mh.running {
+		return
+	}
+	mh.errors.With(prometheus.Labels{"error_type": errorType}).Inc()
+}
+
+func (mh *MetricsHandler) TrackMediaBytes(direction string, length int) {
+	if !mh.running {
+		return
+	}
+	mh.mediaBytes.With(prometheus.Labels{"direction": direction}).Add(float64(length))
+}
+
 func (mh *MetricsHandler) TrackLoginState(jid whatsapp.JID, loggedIn bool) {
 	if !mh.running {
 		return
@@ -269,7 +293,7 @@ func (mh *MetricsHandler) updateStats() {
 		mh.encryptedGroupCount.Set(float64(encryptedGroupCount))
 		mh.encryptedPrivateCount.Set(float64(encryptedPrivateCount))
 		mh.unencryptedGroupCount.Set(float64(unencryptedGroupCount))
-		mh.unencryptedPrivateCount.Set(float64(encryptedPrivateCount))
+		mh.unencryptedPrivateCount.Set(float64(unencryptedPrivateCount))
 	}
 	mh.countCollection.Observe(time.Now().Sub(start).Seconds())
 }
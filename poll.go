@@ -0,0 +1,175 @@
+// mautrix-whatsapp - A Matrix-WhatsApp puppeting bridge.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"html"
+	"strings"
+
+	"github.com/Rhymen/go-whatsapp"
+	waProto "github.com/Rhymen/go-whatsapp/binary/proto"
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"maunium.net/go/mautrix/event"
+)
+
+// Field numbers of poll creation messages. The protobuf definitions in go-whatsapp don't include polls,
+// so they end up in the unknown fields of the message and are parsed from there.
+const (
+	pollCreationMessageField   protowire.Number = 49
+	pollCreationMessageV2Field protowire.Number = 60
+	pollCreationMessageV3Field protowire.Number = 64
+
+	pollNameField            protowire.Number = 2
+	pollOptionsField         protowire.Number = 3
+	pollSelectableCountField protowire.Number = 4
+	pollOptionNameField      protowire.Number = 1
+)
+
+// PollMessage is a poll created in a WhatsApp chat. Votes are end-to-end encrypted with a key in the poll
+// creation message and aren't bridged, so only the question and options are sent to Matrix.
+type PollMessage struct {
+	Info            whatsapp.MessageInfo
+	Name            string
+	Options         []string
+	SelectableCount uint64
+}
+
+func (msg PollMessage) GetInfo() whatsapp.MessageInfo {
+	return msg.Info
+}
+
+// parsePollMessage returns nil if the message isn't a poll creation message.
+func parsePollMessage(msg *waProto.WebMessageInfo) *PollMessage {
+	if msg.GetMessage() == nil {
+		return nil
+	}
+	poll := &PollMessage{}
+	if !parseProtoFields(msg.GetMessage().ProtoReflect().GetUnknown(), func(num protowire.Number, value []byte) bool {
+		switch num {
+		case pollCreationMessageField, pollCreationMessageV2Field, pollCreationMessageV3Field:
+			return poll.parseCreation(value)
+		}
+		return true
+	}) || len(poll.Name) == 0 {
+		return nil
+	}
+	poll.Info = whatsapp.MessageInfo{
+		Id:        msg.GetKey().GetId(),
+		RemoteJid: msg.GetKey().GetRemoteJid(),
+		SenderJid: msg.GetParticipant(),
+		FromMe:    msg.GetKey().GetFromMe(),
+		Timestamp: msg.GetMessageTimestamp(),
+		Status:    whatsapp.MessageStatus(msg.GetStatus()),
+		PushName:  msg.GetPushName(),
+		Source:    msg,
+	}
+	return poll
+}
+
+func (msg *PollMessage) parseCreation(data []byte) bool {
+	return parseProtoFields(data, func(num protowire.Number, value []byte) bool {
+		switch num {
+		case pollNameField:
+			msg.Name = string(value)
+		case pollOptionsField:
+			return parseProtoFields(value, func(num protowire.Number, value []byte) bool {
+				if num == pollOptionNameField {
+					msg.Options = append(msg.Options, string(value))
+				}
+				return true
+			})
+		case pollSelectableCountField:
+			var n int
+			msg.SelectableCount, n = protowire.ConsumeVarint(value)
+			return n >= 0
+		}
+		return true
+	})
+}
+
+// parseProtoFields calls the handler with the raw value of every length-delimited or varint field in the data.
+// Other wire types are skipped. Returns false if the data is malformed or the handler returns false.
+func parseProtoFields(data []byte, handler func(num protowire.Number, value []byte) bool) bool {
+	for len(data) > 0 {
+		num, wireType, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return false
+		}
+		data = data[n:]
+		var value []byte
+		switch wireType {
+		case protowire.BytesType:
+			value, n = protowire.ConsumeBytes(data)
+		case protowire.VarintType:
+			_, n = protowire.ConsumeVarint(data)
+			if n >= 0 {
+				value = data[:n]
+			}
+		default:
+			n = protowire.ConsumeFieldValue(num, wireType, data)
+		}
+		if n < 0 {
+			return false
+		}
+		data = data[n:]
+		if value != nil && !handler(num, value) {
+			return false
+		}
+	}
+	return true
+}
+
+func (msg PollMessage) formatContent() *event.MessageEventContent {
+	plain := []string{fmt.Sprintf("Poll: %s", msg.Name)}
+	formatted := []string{fmt.Sprintf("<strong>Poll: %s</strong><ol>", html.EscapeString(msg.Name))}
+	for i, option := range msg.Options {
+		plain = append(plain, fmt.Sprintf("%d. %s", i+1, option))
+		formatted = append(formatted, fmt.Sprintf("<li>%s</li>", html.EscapeString(option)))
+	}
+	formatted = append(formatted, "</ol>")
+	if msg.SelectableCount > 1 {
+		plain = append(plain, fmt.Sprintf("(up to %d answers can be selected)", msg.SelectableCount))
+		formatted = append(formatted, fmt.Sprintf("<p><em>(up to %d answers can be selected)</em></p>", msg.SelectableCount))
+	}
+	plain = append(plain, "Open WhatsApp to vote.")
+	formatted = append(formatted, "<p><em>Open WhatsApp to vote.</em></p>")
+	return &event.MessageEventContent{
+		MsgType:       event.MsgText,
+		Body:          strings.Join(plain, "\n"),
+		Format:        event.FormatHTML,
+		FormattedBody: strings.Join(formatted, ""),
+	}
+}
+
+func (portal *Portal) HandlePollMessage(source *User, msg PollMessage) bool {
+	intent := portal.startHandling(source, msg.Info, "poll")
+	if intent == nil {
+		return false
+	}
+
+	content := msg.formatContent()
+	addForwardedLabel(content, msg.Info)
+	resp, err := portal.sendMessage(intent, event.EventMessage, content, int64(msg.Info.Timestamp*1000))
+	if err != nil {
+		portal.log.Errorfln("Failed to handle message %s: %v", msg.Info.Id, err)
+	} else {
+		portal.finishHandling(source, msg.Info.Source, resp.EventID)
+	}
+	return true
+}
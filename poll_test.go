@@ -0,0 +1,85 @@
+// mautrix-whatsapp - A Matrix-WhatsApp puppeting bridge.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"testing"
+
+	waProto "github.com/Rhymen/go-whatsapp/binary/proto"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func makeTestPoll(field protowire.Number, name string, options ...string) *waProto.WebMessageInfo {
+	var poll []byte
+	poll = protowire.AppendTag(poll, 1, protowire.BytesType)
+	poll = protowire.AppendBytes(poll, []byte("encryption key"))
+	poll = protowire.AppendTag(poll, pollNameField, protowire.BytesType)
+	poll = protowire.AppendString(poll, name)
+	for _, option := range options {
+		var optionData []byte
+		optionData = protowire.AppendTag(optionData, pollOptionNameField, protowire.BytesType)
+		optionData = protowire.AppendString(optionData, option)
+		poll = protowire.AppendTag(poll, pollOptionsField, protowire.BytesType)
+		poll = protowire.AppendBytes(poll, optionData)
+	}
+	poll = protowire.AppendTag(poll, pollSelectableCountField, protowire.VarintType)
+	poll = protowire.AppendVarint(poll, 1)
+
+	var unknown []byte
+	unknown = protowire.AppendTag(unknown, field, protowire.BytesType)
+	unknown = protowire.AppendBytes(unknown, poll)
+	msg := &waProto.Message{}
+	msg.ProtoReflect().SetUnknown(unknown)
+	id := "POLLID"
+	return &waProto.WebMessageInfo{Key: &waProto.MessageKey{Id: &id}, Message: msg}
+}
+
+func TestParsePollMessage(t *testing.T) {
+	for _, field := range []protowire.Number{pollCreationMessageField, pollCreationMessageV2Field, pollCreationMessageV3Field} {
+		poll := parsePollMessage(makeTestPoll(field, "Lunch?", "Pizza", "Sushi"))
+		if poll == nil {
+			t.Fatalf("Failed to parse poll in field %d", field)
+		} else if poll.Name != "Lunch?" || len(poll.Options) != 2 || poll.Options[0] != "Pizza" || poll.Options[1] != "Sushi" {
+			t.Errorf("Poll in field %d wasn't parsed correctly: %+v", field, poll)
+		} else if poll.SelectableCount != 1 || poll.Info.Id != "POLLID" {
+			t.Errorf("Poll metadata in field %d wasn't parsed correctly: %+v", field, poll)
+		}
+	}
+
+	text := "Not a poll"
+	if poll := parsePollMessage(&waProto.WebMessageInfo{Message: &waProto.Message{Conversation: &text}}); poll != nil {
+		t.Errorf("Expected text message not to be parsed as a poll, got %+v", poll)
+	}
+	malformed := &waProto.Message{}
+	malformed.ProtoReflect().SetUnknown([]byte{0xca, 0x03, 0x10})
+	if poll := parsePollMessage(&waProto.WebMessageInfo{Message: malformed}); poll != nil {
+		t.Errorf("Expected malformed poll not to be parsed, got %+v", poll)
+	}
+}
+
+func TestFormatPollContent(t *testing.T) {
+	content := PollMessage{Name: "Lunch?", Options: []string{"Pizza", "<Sushi>"}, SelectableCount: 2}.formatContent()
+	expectedBody := "Poll: Lunch?\n1. Pizza\n2. <Sushi>\n(up to 2 answers can be selected)\nOpen WhatsApp to vote."
+	if content.Body != expectedBody {
+		t.Errorf("Unexpected poll body %q", content.Body)
+	}
+	expectedHTML := "<strong>Poll: Lunch?</strong><ol><li>Pizza</li><li>&lt;Sushi&gt;</li></ol>" +
+		"<p><em>(up to 2 answers can be selected)</em></p><p><em>Open WhatsApp to vote.</em></p>"
+	if content.FormattedBody != expectedHTML {
+		t.Errorf("Unexpected poll HTML %q", content.FormattedBody)
+	}
+}
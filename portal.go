@@ -20,6 +20,7 @@ import (
 	"bytes"
 	"encoding/gob"
 	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"html"
@@ -36,6 +37,7 @@ import (
 	"os/exec"
 	"path/filepath"
 	"reflect"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -43,6 +45,7 @@ import (
 
 	"github.com/Rhymen/go-whatsapp"
 	waProto "github.com/Rhymen/go-whatsapp/binary/proto"
+	"google.golang.org/protobuf/proto"
 
 	log "maunium.net/go/maulogger/v2"
 
@@ -63,6 +66,10 @@ const BroadcastTopic = "WhatsApp broadcast list"
 const UnnamedBroadcastName = "Unnamed broadcast list"
 const PrivateChatTopic = "WhatsApp private chat"
 
+func (portal *Portal) privateChatTopic() string {
+	return fmt.Sprintf("%s with +%s", PrivateChatTopic, JIDToPhoneNumber(portal.Key.JID))
+}
+
 var ErrStatusBroadcastDisabled = errors.New("status bridging is disabled")
 
 func (bridge *Bridge) GetPortalByMXID(mxid id.RoomID) *Portal {
@@ -75,7 +82,13 @@ func (bridge *Bridge) GetPortalByMXID(mxid id.RoomID) *Portal {
 	return portal
 }
 
+// normalizePortalKey normalizes both JIDs in the key, so that legacy JIDs don't create duplicate portals.
+func normalizePortalKey(key database.PortalKey) database.PortalKey {
+	return database.PortalKey{JID: NormalizeJID(key.JID), Receiver: NormalizeJID(key.Receiver)}
+}
+
 func (bridge *Bridge) GetPortalByJID(key database.PortalKey) *Portal {
+	key = normalizePortalKey(key)
 	bridge.portalsLock.Lock()
 	defer bridge.portalsLock.Unlock()
 	portal, ok := bridge.portalsByJID[key]
@@ -85,6 +98,18 @@ func (bridge *Bridge) GetPortalByJID(key database.PortalKey) *Portal {
 	return portal
 }
 
+// GetExistingPortalByJID is like GetPortalByJID, but returns nil instead of creating the portal if it doesn't exist.
+func (bridge *Bridge) GetExistingPortalByJID(key database.PortalKey) *Portal {
+	key = normalizePortalKey(key)
+	bridge.portalsLock.Lock()
+	defer bridge.portalsLock.Unlock()
+	portal, ok := bridge.portalsByJID[key]
+	if !ok {
+		return bridge.loadDBPortal(bridge.DB.Portal.GetByJID(key), nil)
+	}
+	return portal
+}
+
 func (bridge *Bridge) GetAllPortals() []*Portal {
 	return bridge.dbPortalsToPortals(bridge.DB.Portal.GetAll())
 }
@@ -185,8 +210,21 @@ type Portal struct {
 	backfillLock  sync.Mutex
 	backfilling   bool
 	lastMessageTs uint64
+	// backfillingOlder is set while bridging history older than the oldest bridged message,
+	// so that the messages aren't dropped for being older than the last message.
+	backfillingOlder  bool
+	manualBackfilling int32
 
 	privateChatBackfillInvitePuppet func()
+	historyBatch                    *historyBatch
+	historyBatchLock                sync.Mutex
+
+	viewOnceEvents     map[id.EventID]int64
+	viewOnceEventsLock sync.Mutex
+
+	pendingMetaChanges map[event.Type]pendingMetaChange
+	metaChangeTimer    *time.Timer
+	metaChangeLock     sync.Mutex
 
 	messages chan PortalMessage
 
@@ -217,8 +255,17 @@ func (portal *Portal) syncDoublePuppetDetailsAfterCreate(source *User) {
 
 func (portal *Portal) handleMessageLoop() {
 	for msg := range portal.messages {
+		if req, ok := msg.data.(mediaRedownload); ok {
+			portal.backfillLock.Lock()
+			req.result <- portal.RedownloadMedia(msg.source, req.evtID)
+			portal.backfillLock.Unlock()
+			continue
+		}
 		if len(portal.MXID) == 0 {
-			if msg.timestamp+MaxMessageAgeToCreatePortal < uint64(time.Now().Unix()) {
+			if portal.Unbridged {
+				portal.log.Debugln("Not creating portal room for incoming message: portal is unbridged")
+				continue
+			} else if msg.timestamp+MaxMessageAgeToCreatePortal < uint64(time.Now().Unix()) {
 				portal.log.Debugln("Not creating portal room for incoming message: message is too old")
 				continue
 			} else if !portal.shouldCreateRoom(msg) {
@@ -249,10 +296,11 @@ func (portal *Portal) shouldCreateRoom(msg PortalMessage) bool {
 	return true
 }
 
-func (portal *Portal) handleMessage(msg PortalMessage, isBackfill bool) {
+// handleMessage returns false if the message was skipped, e.g. because it was already bridged.
+func (portal *Portal) handleMessage(msg PortalMessage, isBackfill bool) bool {
 	if len(portal.MXID) == 0 {
 		portal.log.Warnln("handleMessage called even though portal.MXID is empty")
-		return
+		return false
 	}
 	var triedToHandle bool
 	var trackMessageCallback func()
@@ -263,39 +311,9 @@ func (portal *Portal) handleMessage(msg PortalMessage, isBackfill bool) {
 	switch data := msg.data.(type) {
 	case whatsapp.TextMessage:
 		triedToHandle = portal.HandleTextMessage(msg.source, data)
-	case whatsapp.ImageMessage:
-		triedToHandle = portal.HandleMediaMessage(msg.source, mediaMessage{
-			base:      base{data.Download, data.Info, data.ContextInfo, data.Type},
-			thumbnail: data.Thumbnail,
-			caption:   data.Caption,
-		})
-	case whatsapp.StickerMessage:
-		triedToHandle = portal.HandleMediaMessage(msg.source, mediaMessage{
-			base:          base{data.Download, data.Info, data.ContextInfo, data.Type},
-			sendAsSticker: true,
-		})
-	case whatsapp.VideoMessage:
-		triedToHandle = portal.HandleMediaMessage(msg.source, mediaMessage{
-			base:      base{data.Download, data.Info, data.ContextInfo, data.Type},
-			thumbnail: data.Thumbnail,
-			caption:   data.Caption,
-			length:    data.Length * 1000,
-		})
-	case whatsapp.AudioMessage:
-		triedToHandle = portal.HandleMediaMessage(msg.source, mediaMessage{
-			base:   base{data.Download, data.Info, data.ContextInfo, data.Type},
-			length: data.Length * 1000,
-		})
-	case whatsapp.DocumentMessage:
-		fileName := data.FileName
-		if len(fileName) == 0 {
-			fileName = data.Title
-		}
-		triedToHandle = portal.HandleMediaMessage(msg.source, mediaMessage{
-			base:      base{data.Download, data.Info, data.ContextInfo, data.Type},
-			thumbnail: data.Thumbnail,
-			fileName:  fileName,
-		})
+	case whatsapp.ImageMessage, whatsapp.StickerMessage, whatsapp.VideoMessage, whatsapp.AudioMessage, whatsapp.DocumentMessage:
+		media, _ := parseMediaMessage(data)
+		triedToHandle = portal.HandleMediaMessage(msg.source, media)
 	case whatsapp.ContactMessage:
 		triedToHandle = portal.HandleContactMessage(msg.source, data)
 	case whatsapp.LocationMessage:
@@ -304,6 +322,12 @@ func (portal *Portal) handleMessage(msg PortalMessage, isBackfill bool) {
 		triedToHandle = portal.HandleStubMessage(msg.source, data, isBackfill)
 	case whatsapp.MessageRevocation:
 		triedToHandle = portal.HandleMessageRevoke(msg.source, data)
+	case ProductMessage:
+		triedToHandle = portal.HandleProductMessage(msg.source, data)
+	case PollMessage:
+		triedToHandle = portal.HandlePollMessage(msg.source, data)
+	case MessageEdit:
+		triedToHandle = portal.HandleMessageEdit(msg.source, data)
 	case FakeMessage:
 		triedToHandle = portal.HandleFakeMessage(msg.source, data)
 	default:
@@ -312,12 +336,17 @@ func (portal *Portal) handleMessage(msg PortalMessage, isBackfill bool) {
 	if triedToHandle && trackMessageCallback != nil {
 		trackMessageCallback()
 	}
+	return triedToHandle
 }
 
+// isRecentlyHandled checks the in-memory ring buffer of handled message IDs. In group portals shared by
+// multiple logged-in users, every user's connection receives the same messages, so this is the fast path
+// that stops the later copies from being bridged again.
 func (portal *Portal) isRecentlyHandled(id whatsapp.MessageID) bool {
-	start := portal.recentlyHandledIndex
-	for i := start; i != start; i = (i - 1) % recentlyHandledLength {
-		if portal.recentlyHandled[i] == id {
+	portal.recentlyHandledLock.Lock()
+	defer portal.recentlyHandledLock.Unlock()
+	for _, handledID := range portal.recentlyHandled {
+		if handledID == id {
 			return true
 		}
 	}
@@ -337,10 +366,15 @@ func init() {
 }
 
 func (portal *Portal) markHandled(source *User, message *waProto.WebMessageInfo, mxid id.EventID, isSent bool) *database.Message {
+	return portal.markHandledRelayed(source, "", message, mxid, isSent)
+}
+
+func (portal *Portal) markHandledRelayed(source *User, relaySender id.UserID, message *waProto.WebMessageInfo, mxid id.EventID, isSent bool) *database.Message {
 	msg := portal.bridge.DB.Message.New()
 	msg.Chat = portal.Key
 	msg.JID = message.GetKey().GetId()
 	msg.MXID = mxid
+	msg.RelaySender = relaySender
 	msg.Timestamp = int64(message.GetMessageTimestamp())
 	if message.GetKey().GetFromMe() {
 		msg.Sender = source.JID
@@ -353,17 +387,75 @@ func (portal *Portal) markHandled(source *User, message *waProto.WebMessageInfo,
 		}
 	}
 	msg.Content = message.Message
+	msg.Summary = summarizeMessage(message.Message)
 	msg.Sent = isSent
+	// Only messages from Matrix are stored before they've been sent to WhatsApp
+	msg.FromMatrix = !isSent
 	msg.Insert()
 
 	portal.recentlyHandledLock.Lock()
-	index := portal.recentlyHandledIndex
+	portal.recentlyHandled[portal.recentlyHandledIndex] = msg.JID
 	portal.recentlyHandledIndex = (portal.recentlyHandledIndex + 1) % recentlyHandledLength
 	portal.recentlyHandledLock.Unlock()
-	portal.recentlyHandled[index] = msg.JID
 	return msg
 }
 
+const messageSummaryBodyLength = 100
+
+// summarizeMessage returns the Matrix msgtype and a body excerpt of the message, e.g. "m.image: caption".
+func summarizeMessage(msg *waProto.Message) string {
+	var msgType event.MessageType
+	var body string
+	switch {
+	case len(msg.GetConversation()) > 0:
+		msgType, body = event.MsgText, msg.GetConversation()
+	case msg.GetExtendedTextMessage() != nil:
+		msgType, body = event.MsgText, msg.GetExtendedTextMessage().GetText()
+	case msg.GetImageMessage() != nil:
+		msgType, body = event.MsgImage, msg.GetImageMessage().GetCaption()
+	case msg.GetStickerMessage() != nil:
+		msgType = "m.sticker"
+	case msg.GetVideoMessage() != nil:
+		msgType, body = event.MsgVideo, msg.GetVideoMessage().GetCaption()
+	case msg.GetAudioMessage() != nil:
+		msgType = event.MsgAudio
+	case msg.GetDocumentMessage() != nil:
+		msgType, body = event.MsgFile, msg.GetDocumentMessage().GetTitle()
+	case msg.GetContactMessage() != nil:
+		msgType, body = event.MsgFile, msg.GetContactMessage().GetDisplayName()
+	case msg.GetLocationMessage() != nil:
+		msgType, body = event.MsgLocation, msg.GetLocationMessage().GetName()
+	case msg.GetLiveLocationMessage() != nil:
+		msgType, body = event.MsgLocation, msg.GetLiveLocationMessage().GetCaption()
+	default:
+		return ""
+	}
+	if runes := []rune(body); len(runes) > messageSummaryBodyLength {
+		body = string(runes[:messageSummaryBodyLength]) + "…"
+	}
+	if len(body) == 0 {
+		return string(msgType)
+	}
+	return fmt.Sprintf("%s: %s", msgType, body)
+}
+
+func (portal *Portal) updateSenderPushName(source *User, info whatsapp.MessageInfo) {
+	// Old messages (e.g. from backfilling) may have outdated push names
+	if info.FromMe || len(info.PushName) == 0 || info.Timestamp+MaxMessageAgeToCreatePortal < uint64(time.Now().Unix()) {
+		return
+	}
+	senderJID := info.SenderJid
+	if portal.IsPrivateChat() {
+		senderJID = portal.Key.JID
+	} else if len(senderJID) == 0 {
+		senderJID = info.Source.GetParticipant()
+	}
+	if GetJIDType(senderJID) != JIDTypeUser {
+		return
+	}
+	go portal.bridge.GetPuppetByJID(senderJID).UpdatePushName(source, info.PushName)
+}
+
 func (portal *Portal) getMessageIntent(user *User, info whatsapp.MessageInfo) *appservice.IntentAPI {
 	if info.FromMe {
 		return portal.bridge.GetPuppetByJID(user.JID).IntentFor(portal)
@@ -372,10 +464,14 @@ func (portal *Portal) getMessageIntent(user *User, info whatsapp.MessageInfo) *a
 	} else if len(info.SenderJid) == 0 {
 		if len(info.Source.GetParticipant()) != 0 {
 			info.SenderJid = info.Source.GetParticipant()
+		} else if len(info.Source.GetKey().GetParticipant()) != 0 {
+			info.SenderJid = info.Source.GetKey().GetParticipant()
 		} else {
 			return nil
 		}
 	}
+	// Some participant JIDs still use the old @c.us suffix, which would create duplicate puppets
+	info.SenderJid = NormalizeJID(info.SenderJid)
 	puppet := portal.bridge.GetPuppetByJID(info.SenderJid)
 	puppet.SyncContactIfNecessary(user)
 	return puppet.IntentFor(portal)
@@ -394,17 +490,20 @@ func (portal *Portal) startHandling(source *User, info whatsapp.MessageInfo, msg
 	// If there are messages slightly older than the last message, it's possible the order is just wrong,
 	// so don't short-circuit and check the database for duplicates.
 	const timestampIgnoreFuzziness = 5 * 60
-	if portal.lastMessageTs > info.Timestamp+timestampIgnoreFuzziness {
+	if !portal.backfillingOlder && portal.lastMessageTs > info.Timestamp+timestampIgnoreFuzziness {
 		portal.log.Debugfln("Not handling %s (%s): message is >5 minutes older (%d) than last bridge message (%d)", info.Id, msgType, info.Timestamp, portal.lastMessageTs)
 	} else if portal.isRecentlyHandled(info.Id) {
 		portal.log.Debugfln("Not handling %s (%s): message was recently handled", info.Id, msgType)
 	} else if portal.isDuplicate(info.Id) {
 		portal.log.Debugfln("Not handling %s (%s): message is duplicate", info.Id, msgType)
 	} else {
-		portal.lastMessageTs = info.Timestamp
+		if !portal.backfillingOlder {
+			portal.lastMessageTs = info.Timestamp
+		}
 		intent := portal.getMessageIntent(source, info)
 		if intent != nil {
 			portal.log.Debugfln("Starting handling of %s (%s, ts: %d)", info.Id, msgType, info.Timestamp)
+			portal.updateSenderPushName(source, info)
 		} else {
 			portal.log.Debugfln("Not handling %s (%s): sender is not known", info.Id, msgType)
 		}
@@ -417,6 +516,238 @@ func (portal *Portal) finishHandling(source *User, message *waProto.WebMessageIn
 	portal.markHandled(source, message, mxid, true)
 	portal.sendDeliveryReceipt(mxid)
 	portal.log.Debugln("Handled message", message.GetKey().GetId(), "->", mxid)
+	if expiration := getContextInfo(message.GetMessage()).GetExpiration(); expiration > 0 && portal.bridge.Config.Bridge.RedactDisappearingMessages {
+		go portal.redactAfterExpiry(mxid, int64(message.GetMessageTimestamp())+int64(expiration))
+	}
+}
+
+func getContextInfo(msg *waProto.Message) *waProto.ContextInfo {
+	for _, ctxInfo := range []*waProto.ContextInfo{
+		msg.GetExtendedTextMessage().GetContextInfo(),
+		msg.GetImageMessage().GetContextInfo(),
+		msg.GetVideoMessage().GetContextInfo(),
+		msg.GetAudioMessage().GetContextInfo(),
+		msg.GetDocumentMessage().GetContextInfo(),
+		msg.GetStickerMessage().GetContextInfo(),
+		msg.GetContactMessage().GetContextInfo(),
+		msg.GetLocationMessage().GetContextInfo(),
+		msg.GetLiveLocationMessage().GetContextInfo(),
+		msg.GetProductMessage().GetContextInfo(),
+	} {
+		if ctxInfo != nil {
+			return ctxInfo
+		}
+	}
+	return nil
+}
+
+// unwrapViewOnce returns a copy of the message with the content of the view-once wrapper as the message,
+// so that it can be parsed like normal media. The view-once flag is set on the inner media in case the sender didn't.
+// Returns nil if the message isn't a view-once message.
+func unwrapViewOnce(msg *waProto.WebMessageInfo) *waProto.WebMessageInfo {
+	if msg.GetMessage().GetViewOnceMessage().GetMessage() == nil {
+		return nil
+	}
+	// The original message is still used by go-whatsapp after the handlers return, so it can't be modified
+	inner := proto.Clone(msg.GetMessage().GetViewOnceMessage().GetMessage()).(*waProto.Message)
+	viewOnce := true
+	if inner.GetImageMessage() != nil {
+		inner.ImageMessage.ViewOnce = &viewOnce
+	} else if inner.GetVideoMessage() != nil {
+		inner.VideoMessage.ViewOnce = &viewOnce
+	}
+	return &waProto.WebMessageInfo{
+		Key:              msg.Key,
+		Message:          inner,
+		MessageTimestamp: msg.MessageTimestamp,
+		Participant:      msg.Participant,
+		PushName:         msg.PushName,
+		Status:           msg.Status,
+	}
+}
+
+func (portal *Portal) trackViewOnce(mxid id.EventID, timestamp int64) {
+	if portal.bridge.Config.Bridge.PreserveViewOnce || len(mxid) == 0 || isPendingEventID(mxid) {
+		return
+	}
+	portal.viewOnceEventsLock.Lock()
+	if portal.viewOnceEvents == nil {
+		portal.viewOnceEvents = make(map[id.EventID]int64)
+	}
+	portal.viewOnceEvents[mxid] = timestamp
+	portal.viewOnceEventsLock.Unlock()
+}
+
+// redactViewedOnce redacts view-once media that was sent at or before the given timestamp,
+// which is called when the user reads a message in the portal.
+func (portal *Portal) redactViewedOnce(readUpTo int64) {
+	portal.viewOnceEventsLock.Lock()
+	var toRedact []id.EventID
+	for mxid, timestamp := range portal.viewOnceEvents {
+		if timestamp <= readUpTo {
+			toRedact = append(toRedact, mxid)
+			delete(portal.viewOnceEvents, mxid)
+		}
+	}
+	portal.viewOnceEventsLock.Unlock()
+	for _, mxid := range toRedact {
+		_, err := portal.MainIntent().RedactEvent(portal.MXID, mxid, mautrix.ReqRedact{Reason: "View-once media was viewed"})
+		if err != nil {
+			portal.log.Warnfln("Failed to redact viewed view-once media %s: %v", mxid, err)
+		} else {
+			portal.log.Debugfln("Redacted viewed view-once media %s", mxid)
+		}
+	}
+}
+
+func (portal *Portal) redactAfterExpiry(mxid id.EventID, expiresAt int64) {
+	time.Sleep(time.Until(time.Unix(expiresAt, 0)))
+	_, err := portal.MainIntent().RedactEvent(portal.MXID, mxid, mautrix.ReqRedact{Reason: "Disappearing message expired"})
+	if err != nil {
+		portal.log.Warnfln("Failed to redact expired disappearing message %s: %v", mxid, err)
+	} else {
+		portal.log.Debugln("Redacted expired disappearing message", mxid)
+		portal.bridge.DB.Message.DeleteByMXID(mxid)
+	}
+}
+
+func formatDisappearingTimer(seconds uint64) string {
+	switch {
+	case seconds%(24*60*60) == 0:
+		return pluralize(seconds/(24*60*60), "day")
+	case seconds%(60*60) == 0:
+		return pluralize(seconds/(60*60), "hour")
+	case seconds%60 == 0:
+		return pluralize(seconds/60, "minute")
+	default:
+		return pluralize(seconds, "second")
+	}
+}
+
+func pluralize(count uint64, unit string) string {
+	if count == 1 {
+		return fmt.Sprintf("1 %s", unit)
+	}
+	return fmt.Sprintf("%d %ss", count, unit)
+}
+
+func disappearingTimerNotice(seconds uint64) *event.MessageEventContent {
+	content := &event.MessageEventContent{MsgType: event.MsgNotice}
+	if seconds == 0 {
+		content.Body = "Turned off disappearing messages"
+	} else {
+		content.Body = fmt.Sprintf("Set the disappearing message timer to %s", formatDisappearingTimer(seconds))
+	}
+	return content
+}
+
+func (portal *Portal) HandleDisappearingTimerChange(intent *appservice.IntentAPI, message whatsapp.StubMessage) id.EventID {
+	seconds, _ := strconv.ParseUint(message.FirstParam, 10, 32)
+	if portal.ExpirationTime != uint32(seconds) {
+		portal.ExpirationTime = uint32(seconds)
+		portal.Update()
+	}
+	resp, err := portal.sendMessage(intent, event.EventMessage, disappearingTimerNotice(seconds), int64(message.Info.Timestamp*1000))
+	if err != nil {
+		portal.log.Errorfln("Failed to send disappearing timer change notice for %s: %v", message.Info.Id, err)
+		return ""
+	}
+	return resp.EventID
+}
+
+// SetDisappearingTimer changes the disappearing message timer of the WhatsApp chat through the given user's connection.
+// The sent message is marked as handled with the notice, so an echo of it doesn't produce a duplicate notice.
+func (portal *Portal) SetDisappearingTimer(sender *User, seconds uint32) error {
+	if !portal.IsPrivateChat() {
+		return errDisappearingGroupUnsupported
+	}
+	ts := uint64(time.Now().Unix())
+	status := waProto.WebMessageInfo_PENDING
+	protoMsgType := waProto.ProtocolMessage_EPHEMERAL_SETTING
+	settingTimestamp := int64(ts)
+	fromMe := true
+	info := &waProto.WebMessageInfo{
+		Key: &waProto.MessageKey{
+			FromMe:    &fromMe,
+			Id:        makeMessageID(),
+			RemoteJid: &portal.Key.JID,
+		},
+		MessageTimestamp: &ts,
+		Message: &waProto.Message{
+			ProtocolMessage: &waProto.ProtocolMessage{
+				Type:                      &protoMsgType,
+				EphemeralExpiration:       &seconds,
+				EphemeralSettingTimestamp: &settingTimestamp,
+			},
+		},
+		Status: &status,
+	}
+	errChan := make(chan error, 1)
+	go sender.Conn.SendRaw(info, errChan)
+
+	var err error
+	select {
+	case err = <-errChan:
+	case <-time.After(time.Duration(portal.bridge.Config.Bridge.ConnectionTimeout) * time.Second):
+		portal.log.Warnfln("Response when changing disappearing message timer is taking long to arrive")
+		err = <-errChan
+	}
+	if err != nil {
+		return err
+	}
+	portal.ExpirationTime = seconds
+	portal.Update()
+	intent := portal.MainIntent()
+	if puppet := portal.bridge.GetPuppetByJID(sender.JID); puppet != nil {
+		intent = puppet.IntentFor(portal)
+	}
+	resp, err := portal.sendMessage(intent, event.EventMessage, disappearingTimerNotice(uint64(seconds)), 0)
+	if err != nil {
+		portal.log.Warnln("Failed to send disappearing timer change notice:", err)
+		return nil
+	}
+	portal.markHandled(sender, info, resp.EventID, true)
+	return nil
+}
+
+func isMissedCallStub(stubType waProto.WebMessageInfo_WebMessageInfoStubType) bool {
+	switch stubType {
+	case waProto.WebMessageInfo_CALL_MISSED_VOICE, waProto.WebMessageInfo_CALL_MISSED_VIDEO,
+		waProto.WebMessageInfo_CALL_MISSED_GROUP_VOICE, waProto.WebMessageInfo_CALL_MISSED_GROUP_VIDEO:
+		return true
+	default:
+		return false
+	}
+}
+
+func (portal *Portal) HandleMissedCall(intent *appservice.IntentAPI, callerJID whatsapp.JID, message whatsapp.StubMessage) id.EventID {
+	callType := "voice call"
+	switch message.Type {
+	case waProto.WebMessageInfo_CALL_MISSED_VIDEO:
+		callType = "video call"
+	case waProto.WebMessageInfo_CALL_MISSED_GROUP_VOICE:
+		callType = "group voice call"
+	case waProto.WebMessageInfo_CALL_MISSED_GROUP_VIDEO:
+		callType = "group video call"
+	}
+	if len(callerJID) == 0 && portal.IsPrivateChat() {
+		callerJID = portal.Key.JID
+	}
+	caller := portal.bridge.GetPuppetByJID(callerJID)
+	callerName := caller.Displayname
+	if len(callerName) == 0 {
+		callerName = "+" + caller.PhoneNumber()
+	}
+	content := &event.MessageEventContent{
+		MsgType: event.MsgNotice,
+		Body:    fmt.Sprintf("Missed %s from %s", callType, callerName),
+	}
+	resp, err := portal.sendMessage(intent, event.EventMessage, content, int64(message.Info.Timestamp*1000))
+	if err != nil {
+		portal.log.Errorfln("Failed to send missed call notice for %s: %v", message.Info.Id, err)
+		return ""
+	}
+	return resp.EventID
 }
 
 func (portal *Portal) kickExtraUsers(participantMap map[whatsapp.JID]bool) {
@@ -444,19 +775,43 @@ func (portal *Portal) kickExtraUsers(participantMap map[whatsapp.JID]bool) {
 
 func (portal *Portal) SyncBroadcastRecipients(source *User, metadata *whatsapp.BroadcastListInfo) {
 	participantMap := make(map[whatsapp.JID]bool)
+	puppets := make([]*Puppet, 0, len(metadata.Recipients))
 	for _, recipient := range metadata.Recipients {
 		participantMap[recipient.JID] = true
-
-		puppet := portal.bridge.GetPuppetByJID(recipient.JID)
-		puppet.SyncContactIfNecessary(source)
-		err := puppet.DefaultIntent().EnsureJoined(portal.MXID)
-		if err != nil {
-			portal.log.Warnfln("Failed to make puppet of %s join %s: %v", recipient.JID, portal.MXID, err)
-		}
+		puppets = append(puppets, portal.bridge.GetPuppetByJID(recipient.JID))
 	}
+	portal.ensurePuppetsJoined(source, puppets, (*Puppet).DefaultIntent)
 	portal.kickExtraUsers(participantMap)
 }
 
+const maxConcurrentPuppetJoins = 16
+
+// ensurePuppetsJoined syncs and joins the given puppets in parallel, as large groups can have hundreds of members.
+func (portal *Portal) ensurePuppetsJoined(source *User, puppets []*Puppet, getIntent func(puppet *Puppet) *appservice.IntentAPI) {
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, maxConcurrentPuppetJoins)
+	for _, puppet := range puppets {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(puppet *Puppet) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			puppet.SyncContactIfNecessary(source)
+			if portal.bridge.StateStore.IsMembership(portal.MXID, puppet.MXID, event.MembershipBan) {
+				portal.log.Debugfln("Not joining %s to %s: puppet is banned", puppet.JID, portal.MXID)
+				return
+			}
+			err := getIntent(puppet).EnsureJoined(portal.MXID)
+			if err != nil {
+				portal.log.Warnfln("Failed to make puppet of %s join %s: %v", puppet.JID, portal.MXID, err)
+			}
+		}(puppet)
+	}
+	wg.Wait()
+}
+
 func (portal *Portal) SyncParticipants(source *User, metadata *whatsapp.GroupInfo) {
 	changed := false
 	levels, err := portal.MainIntent().PowerLevels(portal.MXID)
@@ -465,36 +820,52 @@ func (portal *Portal) SyncParticipants(source *User, metadata *whatsapp.GroupInf
 		changed = true
 	}
 	participantMap := make(map[whatsapp.JID]bool)
+	puppets := make([]*Puppet, 0, len(metadata.Participants))
 	for _, participant := range metadata.Participants {
 		participantMap[participant.JID] = true
 		user := portal.bridge.GetUserByJID(participant.JID)
 		portal.userMXIDAction(user, portal.ensureMXIDInvited)
 
-		puppet := portal.bridge.GetPuppetByJID(participant.JID)
-		puppet.SyncContactIfNecessary(source)
-		err = puppet.IntentFor(portal).EnsureJoined(portal.MXID)
+		puppets = append(puppets, portal.bridge.GetPuppetByJID(participant.JID))
+	}
+	changed = portal.applyGroupAdminLevels(levels, metadata) || changed
+	portal.ensurePuppetsJoined(source, puppets, func(puppet *Puppet) *appservice.IntentAPI {
+		return puppet.IntentFor(portal)
+	})
+	if changed {
+		_, err = portal.MainIntent().SetPowerLevels(portal.MXID, levels)
 		if err != nil {
-			portal.log.Warnfln("Failed to make puppet of %s join %s: %v", participant.JID, portal.MXID, err)
+			portal.log.Errorln("Failed to change power levels:", err)
 		}
+	}
+	portal.kickExtraUsers(participantMap)
+}
 
+func (portal *Portal) applyGroupAdminLevels(levels *event.PowerLevelsEventContent, metadata *whatsapp.GroupInfo) bool {
+	changed := false
+	for _, participant := range metadata.Participants {
 		expectedLevel := 0
 		if participant.IsSuperAdmin {
-			expectedLevel = 95
+			expectedLevel = portal.bridge.Config.Bridge.SuperAdminPowerLevel
 		} else if participant.IsAdmin {
-			expectedLevel = 50
+			expectedLevel = portal.bridge.Config.Bridge.AdminPowerLevel
 		}
-		changed = levels.EnsureUserLevel(puppet.MXID, expectedLevel) || changed
+		changed = portal.ensureParticipantLevel(levels, portal.bridge.FormatPuppetMXID(participant.JID), expectedLevel) || changed
+		user := portal.bridge.GetUserByJID(participant.JID)
 		if user != nil {
-			changed = levels.EnsureUserLevel(user.MXID, expectedLevel) || changed
+			changed = portal.ensureParticipantLevel(levels, user.MXID, expectedLevel) || changed
 		}
 	}
-	if changed {
-		_, err = portal.MainIntent().SetPowerLevels(portal.MXID, levels)
-		if err != nil {
-			portal.log.Errorln("Failed to change power levels:", err)
-		}
+	return changed
+}
+
+// ensureParticipantLevel sets the power level of a group participant, but never touches the bridge bot or
+// the portal's main intent, which must keep their power to manage the room.
+func (portal *Portal) ensureParticipantLevel(levels *event.PowerLevelsEventContent, userID id.UserID, level int) bool {
+	if userID == portal.MainIntent().UserID || userID == portal.bridge.Bot.UserID {
+		return false
 	}
-	portal.kickExtraUsers(participantMap)
+	return levels.EnsureUserLevel(userID, level)
 }
 
 func (portal *Portal) UpdateAvatar(user *User, avatar *whatsapp.ProfilePicInfo, updateInfo bool) bool {
@@ -537,13 +908,14 @@ func (portal *Portal) UpdateAvatar(user *User, avatar *whatsapp.ProfilePicInfo,
 	if len(portal.MXID) > 0 {
 		_, err := portal.MainIntent().SetRoomAvatar(portal.MXID, portal.AvatarURL)
 		if err != nil {
-			portal.log.Warnln("Failed to set room topic:", err)
+			portal.log.Warnln("Failed to set room avatar:", err)
 			return false
 		}
 	}
 	portal.Avatar = avatar.Tag
 	if updateInfo {
 		portal.UpdateBridgeInfo()
+		portal.Update()
 	}
 	return true
 }
@@ -565,6 +937,8 @@ func (portal *Portal) UpdateName(name string, setBy whatsapp.JID, intent *appser
 		if err == nil {
 			if updateInfo {
 				portal.UpdateBridgeInfo()
+				// Live updates aren't followed by a full sync, so the new name has to be saved here
+				portal.Update()
 			}
 			return true
 		} else {
@@ -578,7 +952,11 @@ func (portal *Portal) UpdateName(name string, setBy whatsapp.JID, intent *appser
 func (portal *Portal) UpdateTopic(topic string, setBy whatsapp.JID, intent *appservice.IntentAPI, updateInfo bool) bool {
 	if portal.Topic != topic {
 		portal.log.Debugfln("Updating topic %s -> %s", portal.Topic, topic)
+		prevTopic := portal.Topic
 		portal.Topic = topic
+		if len(portal.MXID) == 0 {
+			return true
+		}
 		if intent == nil {
 			intent = portal.MainIntent()
 			if len(setBy) > 0 {
@@ -589,10 +967,11 @@ func (portal *Portal) UpdateTopic(topic string, setBy whatsapp.JID, intent *apps
 		if err == nil {
 			if updateInfo {
 				portal.UpdateBridgeInfo()
+				portal.Update()
 			}
 			return true
 		} else {
-			portal.Topic = ""
+			portal.Topic = prevTopic
 			portal.log.Warnln("Failed to set room topic:", err)
 		}
 	}
@@ -601,7 +980,7 @@ func (portal *Portal) UpdateTopic(topic string, setBy whatsapp.JID, intent *apps
 
 func (portal *Portal) UpdateMetadata(user *User) bool {
 	if portal.IsPrivateChat() {
-		return false
+		return portal.UpdateTopic(portal.privateChatTopic(), "", nil, false)
 	} else if portal.IsStatusBroadcastList() {
 		update := false
 		update = portal.UpdateName(StatusBroadcastName, "", nil, false) || update
@@ -742,16 +1121,23 @@ func (portal *Portal) ChangeAdminStatus(jids []string, setAdmin bool) id.EventID
 	}
 	newLevel := 0
 	if setAdmin {
-		newLevel = 50
+		newLevel = portal.bridge.Config.Bridge.AdminPowerLevel
 	}
 	changed := false
+	ensureLevel := func(userID id.UserID) {
+		// Don't downgrade superadmins when they're promoted to admin
+		if setAdmin && levels.GetUserLevel(userID) > newLevel {
+			return
+		}
+		changed = portal.ensureParticipantLevel(levels, userID, newLevel) || changed
+	}
 	for _, jid := range jids {
 		puppet := portal.bridge.GetPuppetByJID(jid)
-		changed = levels.EnsureUserLevel(puppet.MXID, newLevel) || changed
+		ensureLevel(puppet.MXID)
 
 		user := portal.bridge.GetUserByJID(jid)
 		if user != nil {
-			changed = levels.EnsureUserLevel(user.MXID, newLevel) || changed
+			ensureLevel(user.MXID)
 		}
 	}
 	if changed {
@@ -773,7 +1159,7 @@ func (portal *Portal) RestrictMessageSending(restrict bool) id.EventID {
 
 	newLevel := 0
 	if restrict {
-		newLevel = 50
+		newLevel = portal.bridge.Config.Bridge.AdminPowerLevel
 	}
 
 	if levels.EventsDefault == newLevel {
@@ -797,7 +1183,7 @@ func (portal *Portal) RestrictMetadataChanges(restrict bool) id.EventID {
 	}
 	newLevel := 0
 	if restrict {
-		newLevel = 50
+		newLevel = portal.bridge.Config.Bridge.AdminPowerLevel
 	}
 	changed := false
 	changed = levels.EnsureEventLevel(event.StateRoomName, newLevel) || changed
@@ -814,8 +1200,35 @@ func (portal *Portal) RestrictMetadataChanges(restrict bool) id.EventID {
 	return ""
 }
 
+// initialBackfillLimit returns the number of messages to fill when creating the portal room.
+func (portal *Portal) initialBackfillLimit() int {
+	cfg := portal.bridge.Config.Bridge.Backfill
+	if cfg.Disable {
+		return 0
+	}
+	switch GetJIDType(portal.Key.JID) {
+	case JIDTypeUser:
+		return cfg.InitialPrivate
+	case JIDTypeStatus:
+		return cfg.InitialStatus
+	default:
+		return cfg.InitialGroup
+	}
+}
+
+// missedBackfillLimit returns the maximum number of messages to backfill after downtime, taking the per-portal override into account.
+func (portal *Portal) missedBackfillLimit() int {
+	if portal.bridge.Config.Bridge.Backfill.Disable || !portal.bridge.Config.Bridge.RecoverHistory {
+		return 0
+	} else if portal.BackfillLimit >= 0 {
+		return portal.BackfillLimit
+	}
+	return portal.bridge.Config.Bridge.Backfill.Missed
+}
+
 func (portal *Portal) BackfillHistory(user *User, lastMessageTime int64) error {
-	if !portal.bridge.Config.Bridge.RecoverHistory {
+	limit := portal.missedBackfillLimit()
+	if limit == 0 {
 		return nil
 	}
 
@@ -833,6 +1246,8 @@ func (portal *Portal) BackfillHistory(user *User, lastMessageTime int64) error {
 
 	lastMessageID := lastMessage.JID
 	lastMessageFromMe := lastMessage.Sender == user.JID
+	var missed []interface{}
+	truncated := false
 	portal.log.Infoln("Backfilling history since", lastMessageID, "for", user.MXID)
 	for len(lastMessageID) > 0 {
 		portal.log.Debugln("Fetching 50 messages of history after", lastMessageID)
@@ -849,15 +1264,51 @@ func (portal *Portal) BackfillHistory(user *User, lastMessageTime int64) error {
 			portal.log.Debugfln("Didn't get more messages to backfill (resp.Content is %T)", resp.Content)
 			break
 		}
-
-		portal.handleHistory(user, messages)
+		missed = append(missed, messages...)
+		if len(missed) > limit {
+			truncated = true
+			break
+		}
 
 		lastMessageProto, ok := messages[len(messages)-1].(*waProto.WebMessageInfo)
-		if ok {
-			lastMessageID = lastMessageProto.GetKey().GetId()
-			lastMessageFromMe = lastMessageProto.GetKey().GetFromMe()
+		if !ok || lastMessageProto.GetKey().GetId() == lastMessageID {
+			break
+		}
+		lastMessageID = lastMessageProto.GetKey().GetId()
+		lastMessageFromMe = lastMessageProto.GetKey().GetFromMe()
+	}
+	if truncated {
+		// Only bridge the newest messages rather than flooding the room with everything from a long outage
+		portal.log.Infofln("More than %d messages were missed, only backfilling the latest %d", limit, limit)
+		resp, err := user.Conn.LoadMessagesBefore(portal.Key.JID, "", true, limit)
+		if err != nil {
+			return err
+		}
+		latest, _ := resp.Content.([]interface{})
+		missed = missed[:0]
+		for _, rawMessage := range latest {
+			if message, ok := rawMessage.(*waProto.WebMessageInfo); ok && int64(message.GetMessageTimestamp()) >= lastMessage.Timestamp {
+				missed = append(missed, message)
+			}
 		}
 	}
+	if len(missed) == 0 {
+		return nil
+	}
+
+	// Missed messages are newer than everything already bridged, so they're sent normally rather than as an
+	// MSC2716 history batch, which would insert them before the first event.
+	if truncated {
+		firstTimestamp := int64(missed[0].(*waProto.WebMessageInfo).GetMessageTimestamp())
+		_, err := portal.sendMessage(portal.MainIntent(), event.EventMessage, &event.MessageEventContent{
+			MsgType: event.MsgNotice,
+			Body:    fmt.Sprintf("Some messages sent while the bridge was offline were not bridged. Only the latest %d messages are shown below.", len(missed)),
+		}, firstTimestamp*1000-1)
+		if err != nil {
+			portal.log.Warnln("Failed to send backfill truncation notice:", err)
+		}
+	}
+	portal.handleHistory(user, missed)
 	portal.log.Infoln("Backfilling finished")
 	return nil
 }
@@ -928,7 +1379,8 @@ func (portal *Portal) enableNotifications(user *User) {
 }
 
 func (portal *Portal) FillInitialHistory(user *User) error {
-	if portal.bridge.Config.Bridge.InitialHistoryFill == 0 {
+	n := portal.initialBackfillLimit()
+	if n == 0 {
 		return nil
 	}
 	endBackfill := portal.beginBackfill()
@@ -937,7 +1389,6 @@ func (portal *Portal) FillInitialHistory(user *User) error {
 		portal.privateChatBackfillInvitePuppet()
 	}
 
-	n := portal.bridge.Config.Bridge.InitialHistoryFill
 	portal.log.Infoln("Filling initial history, maximum", n, "messages")
 	var messages []interface{}
 	before := ""
@@ -951,8 +1402,12 @@ func (portal *Portal) FillInitialHistory(user *User) error {
 		}
 		portal.log.Debugfln("Fetching chunk %d (%d messages / %d cap) before message %s", chunkNum, count, n, before)
 		resp, err := user.Conn.LoadMessagesBefore(portal.Key.JID, before, fromMe, count)
-		if err != nil {
+		if err != nil && len(messages) == 0 {
 			return err
+		} else if err != nil {
+			// Bridge what was already fetched rather than dropping everything
+			portal.log.Warnfln("Failed to fetch chunk %d, only bridging %d already fetched messages: %v", chunkNum, len(messages), err)
+			break
 		}
 		chunk, ok := resp.Content.([]interface{})
 		if !ok || len(chunk) == 0 {
@@ -965,7 +1420,12 @@ func (portal *Portal) FillInitialHistory(user *User) error {
 		portal.log.Debugfln("Fetched chunk and received %d messages", len(chunk))
 
 		n -= len(chunk)
-		key := chunk[0].(*waProto.WebMessageInfo).GetKey()
+		first, ok := chunk[0].(*waProto.WebMessageInfo)
+		if !ok {
+			portal.log.Warnfln("First item in chunk %d is %T instead of a message, starting handling of loaded messages", chunkNum, chunk[0])
+			break
+		}
+		key := first.GetKey()
 		before = key.GetId()
 		fromMe = key.GetFromMe()
 		if len(before) == 0 {
@@ -974,27 +1434,122 @@ func (portal *Portal) FillInitialHistory(user *User) error {
 		}
 	}
 	portal.disableNotifications(user)
+	batching := portal.startHistoryBatch(portal.ensureFirstEventID(), portal.NextBatchID)
 	portal.handleHistory(user, messages)
+	if batching {
+		nextBatchID := portal.endHistoryBatch()
+		if len(nextBatchID) > 0 {
+			portal.NextBatchID = nextBatchID
+			portal.Update()
+		}
+	}
 	portal.enableNotifications(user)
 	portal.log.Infoln("Initial history fill complete")
 	return nil
 }
 
-func (portal *Portal) handleHistory(user *User, messages []interface{}) {
-	portal.log.Infoln("Handling", len(messages), "messages of history")
-	for _, rawMessage := range messages {
-		message, ok := rawMessage.(*waProto.WebMessageInfo)
-		if !ok {
-			portal.log.Warnln("Unexpected non-WebMessageInfo item in history response:", rawMessage)
-			continue
-		}
-		data := whatsapp.ParseProtoMessage(message)
-		if data == nil || data == whatsapp.ErrMessageTypeNotImplemented {
-			st := message.GetMessageStubType()
-			// Ignore some types that are known to fail
-			if st == waProto.WebMessageInfo_CALL_MISSED_VOICE || st == waProto.WebMessageInfo_CALL_MISSED_VIDEO ||
-				st == waProto.WebMessageInfo_CALL_MISSED_GROUP_VOICE || st == waProto.WebMessageInfo_CALL_MISSED_GROUP_VIDEO {
-				continue
+var errBackfillInProgress = errors.New("backfill already in progress")
+
+// backfillOlderChunkSize is how many messages are requested from WhatsApp at a time when backfilling older history.
+const backfillOlderChunkSize = 50
+
+// BackfillOlder bridges up to count messages older than the oldest bridged message in the portal.
+// The progress callback is called after each chunk with the total number of messages bridged so far.
+func (portal *Portal) BackfillOlder(user *User, count int, progress func(bridged int)) (int, error) {
+	if !atomic.CompareAndSwapInt32(&portal.manualBackfilling, 0, 1) {
+		return 0, errBackfillInProgress
+	}
+	defer atomic.StoreInt32(&portal.manualBackfilling, 0)
+
+	var before string
+	fromMe := true
+	if oldest := portal.bridge.DB.Message.GetFirstInChat(portal.Key); oldest != nil {
+		before = oldest.JID
+		fromMe = oldest.Sender == user.JID
+	}
+	portal.log.Infofln("Backfilling up to %d messages before %s for %s", count, before, user.MXID)
+	portal.disableNotifications(user)
+	defer portal.enableNotifications(user)
+	bridged := 0
+	for bridged < count {
+		chunkSize := backfillOlderChunkSize
+		if count-bridged < chunkSize {
+			chunkSize = count - bridged
+		}
+		resp, err := user.Conn.LoadMessagesBefore(portal.Key.JID, before, fromMe, chunkSize)
+		if err != nil {
+			return bridged, err
+		}
+		chunk, ok := resp.Content.([]interface{})
+		if !ok || len(chunk) == 0 {
+			portal.log.Debugln("WhatsApp didn't return more history, stopping backfill")
+			break
+		}
+		first, ok := chunk[0].(*waProto.WebMessageInfo)
+		if !ok {
+			portal.log.Warnfln("First item in history chunk is %T instead of a message, stopping backfill", chunk[0])
+			break
+		}
+		key := first.GetKey()
+		if key.GetId() == before {
+			break
+		}
+		before = key.GetId()
+		fromMe = key.GetFromMe()
+
+		endBackfill := portal.beginBackfill()
+		portal.backfillingOlder = true
+		batching := portal.startHistoryBatch(portal.ensureFirstEventID(), portal.NextBatchID)
+		handled := portal.handleHistory(user, chunk)
+		if batching {
+			if nextBatchID := portal.endHistoryBatch(); len(nextBatchID) > 0 {
+				portal.NextBatchID = nextBatchID
+				portal.Update()
+			}
+		}
+		portal.backfillingOlder = false
+		endBackfill()
+
+		// Duplicates and messages that couldn't be parsed aren't counted
+		bridged += handled
+		if progress != nil {
+			progress(bridged)
+		}
+		if len(before) == 0 {
+			break
+		}
+	}
+	portal.log.Infofln("Finished backfilling %d older messages", bridged)
+	return bridged, nil
+}
+
+// handleHistory bridges the given history messages and returns how many of them were actually handled.
+func (portal *Portal) handleHistory(user *User, messages []interface{}) (handled int) {
+	portal.log.Infoln("Handling", len(messages), "messages of history")
+	for _, rawMessage := range messages {
+		message, ok := rawMessage.(*waProto.WebMessageInfo)
+		if !ok {
+			portal.log.Warnln("Unexpected non-WebMessageInfo item in history response:", rawMessage)
+			continue
+		}
+		if unwrapped := unwrapViewOnce(message); unwrapped != nil {
+			message = unwrapped
+		}
+		var data interface{}
+		if product := parseProductMessage(message); product != nil {
+			data = *product
+		} else if poll := parsePollMessage(message); poll != nil {
+			data = *poll
+		} else if edit := parseMessageEdit(message); edit != nil {
+			// go-whatsapp would parse edits as revocations
+			data = *edit
+		} else {
+			data = whatsapp.ParseProtoMessage(message)
+		}
+		if data == nil || data == whatsapp.ErrMessageTypeNotImplemented {
+			// Ignore some types that are known to fail
+			if isMissedCallStub(message.GetMessageStubType()) {
+				continue
 			}
 			portal.log.Warnln("Message", message.GetKey().GetId(), "failed to parse during backfilling")
 			continue
@@ -1002,8 +1557,11 @@ func (portal *Portal) handleHistory(user *User, messages []interface{}) {
 		if portal.privateChatBackfillInvitePuppet != nil && message.GetKey().GetFromMe() && portal.IsPrivateChat() {
 			portal.privateChatBackfillInvitePuppet()
 		}
-		portal.handleMessage(PortalMessage{portal.Key.JID, user, data, message.GetMessageTimestamp()}, true)
+		if portal.handleMessage(PortalMessage{portal.Key.JID, user, data, message.GetMessageTimestamp()}, true) {
+			handled++
+		}
 	}
+	return
 }
 
 type BridgeInfoSection struct {
@@ -1089,7 +1647,7 @@ func (portal *Portal) CreateMatrixRoom(user *User) error {
 		} else {
 			portal.Name = ""
 		}
-		portal.Topic = PrivateChatTopic
+		portal.Topic = portal.privateChatTopic()
 	} else if portal.IsStatusBroadcastList() {
 		if !portal.bridge.Config.Bridge.EnableStatusBroadcast {
 			portal.log.Debugln("Status bridging is disabled in config, not creating room after all")
@@ -1124,10 +1682,19 @@ func (portal *Portal) CreateMatrixRoom(user *User) error {
 
 	bridgeInfoStateKey, bridgeInfo := portal.getBridgeInfo()
 
+	// Include admin levels in the initial state so that they don't have to be set separately after creating the room
+	powerLevels := portal.GetBasePowerLevels()
+	if metadata != nil {
+		portal.applyGroupAdminLevels(powerLevels, metadata)
+		if metadata.Announce {
+			powerLevels.EventsDefault = portal.bridge.Config.Bridge.AdminPowerLevel
+		}
+	}
+
 	initialState := []*event.Event{{
 		Type: event.StatePowerLevels,
 		Content: event.Content{
-			Parsed: portal.GetBasePowerLevels(),
+			Parsed: powerLevels,
 		},
 	}, {
 		Type:     StateBridgeInfo,
@@ -1148,6 +1715,27 @@ func (portal *Portal) CreateMatrixRoom(user *User) error {
 		})
 	}
 
+	roomConfig := portal.bridge.Config.Bridge.PortalRoom
+	historyVisibility := roomConfig.HistoryVisibility
+	if len(roomConfig.BackfillHistoryVisibility) > 0 && portal.initialBackfillLimit() > 0 {
+		historyVisibility = roomConfig.BackfillHistoryVisibility
+	}
+	initialState = append(initialState, &event.Event{
+		Type: event.StateJoinRules,
+		Content: event.Content{
+			Parsed: event.JoinRulesEventContent{JoinRule: event.JoinRule(roomConfig.JoinRule)},
+		},
+	}, &event.Event{
+		Type: event.StateHistoryVisibility,
+		Content: event.Content{
+			Parsed: event.HistoryVisibilityEventContent{HistoryVisibility: event.HistoryVisibility(historyVisibility)},
+		},
+	})
+	var creationContent map[string]interface{}
+	if !roomConfig.Federate {
+		creationContent = map[string]interface{}{"m.federate": false}
+	}
+
 	invite := []id.UserID{user.MXID}
 	if user.IsRelaybot {
 		invite = portal.bridge.Config.Bridge.Relaybot.InviteUsers
@@ -1167,18 +1755,20 @@ func (portal *Portal) CreateMatrixRoom(user *User) error {
 	}
 
 	resp, err := intent.CreateRoom(&mautrix.ReqCreateRoom{
-		Visibility:   "private",
-		Name:         portal.Name,
-		Topic:        portal.Topic,
-		Invite:       invite,
-		Preset:       "private_chat",
-		IsDirect:     portal.IsPrivateChat(),
-		InitialState: initialState,
+		Visibility:      "private",
+		Name:            portal.Name,
+		Topic:           portal.Topic,
+		Invite:          invite,
+		Preset:          "private_chat",
+		IsDirect:        portal.IsPrivateChat(),
+		InitialState:    initialState,
+		CreationContent: creationContent,
 	})
 	if err != nil {
 		return err
 	}
 	portal.MXID = resp.RoomID
+	portal.Unbridged = false
 	portal.Update()
 	portal.bridge.portalsLock.Lock()
 	portal.bridge.portalsByMXID[portal.MXID] = portal
@@ -1191,9 +1781,6 @@ func (portal *Portal) CreateMatrixRoom(user *User) error {
 
 	if metadata != nil {
 		portal.SyncParticipants(user, metadata)
-		if metadata.Announce {
-			portal.RestrictMessageSending(metadata.Announce)
-		}
 	} else if !user.IsRelaybot {
 		customPuppet := portal.bridge.GetPuppetByCustomMXID(user.MXID)
 		if customPuppet != nil && customPuppet.CustomIntent() != nil {
@@ -1229,7 +1816,7 @@ func (portal *Portal) CreateMatrixRoom(user *User) error {
 
 func (portal *Portal) IsPrivateChat() bool {
 	if portal.isPrivate == nil {
-		val := strings.HasSuffix(portal.Key.JID, whatsapp.NewUserSuffix)
+		val := GetJIDType(portal.Key.JID) == JIDTypeUser
 		portal.isPrivate = &val
 	}
 	return *portal.isPrivate
@@ -1237,14 +1824,15 @@ func (portal *Portal) IsPrivateChat() bool {
 
 func (portal *Portal) IsBroadcastList() bool {
 	if portal.isBroadcast == nil {
-		val := strings.HasSuffix(portal.Key.JID, whatsapp.BroadcastSuffix)
+		jidType := GetJIDType(portal.Key.JID)
+		val := jidType == JIDTypeBroadcast || jidType == JIDTypeStatus
 		portal.isBroadcast = &val
 	}
 	return *portal.isBroadcast
 }
 
 func (portal *Portal) IsStatusBroadcastList() bool {
-	return portal.Key.JID == "status@broadcast"
+	return GetJIDType(portal.Key.JID) == JIDTypeStatus
 }
 
 func (portal *Portal) HasRelaybot() bool {
@@ -1257,6 +1845,33 @@ func (portal *Portal) HasRelaybot() bool {
 	return *portal.hasRelaybot
 }
 
+// GetRelayUser returns a connected user whose WhatsApp connection can relay messages in this portal,
+// or nil if relay mode isn't enabled in the portal. If a relay user has been set explicitly, only that user is used.
+func (portal *Portal) GetRelayUser() *User {
+	if !portal.bridge.Config.Bridge.Relay.Enabled || !portal.RelayEnabled {
+		return nil
+	} else if len(portal.RelayUserID) > 0 {
+		user := portal.bridge.GetUserByMXID(portal.RelayUserID)
+		if user == nil || !user.IsConnected() || !user.IsInPortal(portal.Key) {
+			return nil
+		}
+		return user
+	}
+	for _, userID := range portal.GetUserIDs() {
+		user := portal.bridge.GetUserByMXID(userID)
+		if user != nil && user.IsConnected() && user.IsInPortal(portal.Key) {
+			return user
+		}
+	}
+	return nil
+}
+
+// HasRelay checks if messages from users without WhatsApp sessions can be bridged,
+// either through the global relaybot or the portal's own relay user.
+func (portal *Portal) HasRelay() bool {
+	return portal.HasRelaybot() || portal.GetRelayUser() != nil
+}
+
 func (portal *Portal) MainIntent() *appservice.IntentAPI {
 	if portal.IsPrivateChat() {
 		return portal.bridge.GetPuppetByJID(portal.Key.JID).DefaultIntent()
@@ -1269,27 +1884,60 @@ func (portal *Portal) SetReply(content *event.MessageEventContent, info whatsapp
 		return
 	}
 	message := portal.bridge.DB.Message.GetByJID(portal.Key, info.QuotedMessageID)
-	if message != nil && !message.IsFakeMXID() {
+	if message != nil && !message.IsFakeMXID() && !isPendingEventID(message.MXID) {
 		evt, err := portal.MainIntent().GetEvent(portal.MXID, message.MXID)
 		if err != nil {
-			portal.log.Warnln("Failed to get reply target:", err)
-			return
-		}
-		if evt.Type == event.EventEncrypted {
+			portal.log.Warnln("Failed to get reply target, using stored summary for reply fallback:", err)
+			evt = portal.makeReplyFallbackEvent(message)
+		} else if evt.Type == event.EventEncrypted {
 			_ = evt.Content.ParseRaw(evt.Type)
 			decryptedEvt, err := portal.bridge.Crypto.Decrypt(evt)
 			if err != nil {
-				portal.log.Warnln("Failed to decrypt reply target:", err)
+				portal.log.Warnln("Failed to decrypt reply target, using stored summary for reply fallback:", err)
+				evt = portal.makeReplyFallbackEvent(message)
 			} else {
 				evt = decryptedEvt
 			}
 		}
-		_ = evt.Content.ParseRaw(evt.Type)
+		if evt == nil {
+			return
+		} else if len(evt.Content.VeryRaw) > 0 {
+			_ = evt.Content.ParseRaw(evt.Type)
+		}
 		content.SetReply(evt)
 	}
 	return
 }
 
+// makeReplyFallbackEvent builds a stand-in for a reply target that couldn't be fetched from the homeserver,
+// using the stored sender and content summary of the message. It returns nil if there's no summary.
+func (portal *Portal) makeReplyFallbackEvent(message *database.Message) *event.Event {
+	if len(message.Summary) == 0 {
+		return nil
+	}
+	parts := strings.SplitN(message.Summary, ": ", 2)
+	msgType, body := event.MessageType(parts[0]), parts[0]
+	if len(parts) == 2 {
+		body = parts[1]
+	}
+	sender := message.RelaySender
+	if len(sender) == 0 && message.FromMatrix {
+		if user := portal.bridge.GetUserByJID(message.Sender); user != nil {
+			sender = user.MXID
+		}
+	}
+	if len(sender) == 0 {
+		sender = portal.bridge.FormatPuppetMXID(message.Sender)
+	}
+	return &event.Event{
+		ID:      message.MXID,
+		RoomID:  portal.MXID,
+		Sender:  sender,
+		Type:    event.EventMessage,
+		Content: event.Content{Parsed: &event.MessageEventContent{MsgType: msgType, Body: body}},
+	}
+}
+
 func (portal *Portal) HandleMessageRevoke(user *User, message whatsapp.MessageRevocation) bool {
 	msg := portal.bridge.DB.Message.GetByJID(portal.Key, message.Id)
 	if msg == nil || msg.IsFakeMXID() {
@@ -1365,12 +2013,32 @@ func (portal *Portal) sendMessage(intent *appservice.IntentAPI, eventType event.
 		eventType = event.EventEncrypted
 		wrappedContent.Parsed = encrypted
 	}
+	if timestamp != 0 {
+		if resp := portal.queueHistoryEvent(intent, eventType, &wrappedContent, timestamp); resp != nil {
+			return resp, nil
+		}
+	}
 	_, _ = intent.UserTyping(portal.MXID, false, 0)
-	if timestamp == 0 {
-		return intent.SendMessageEvent(portal.MXID, eventType, &wrappedContent)
-	} else {
+	send := func(intent *appservice.IntentAPI) (*mautrix.RespSendEvent, error) {
+		if timestamp == 0 {
+			return intent.SendMessageEvent(portal.MXID, eventType, &wrappedContent)
+		}
 		return intent.SendMassagedMessageEvent(portal.MXID, eventType, &wrappedContent, timestamp)
 	}
+	resp, err := send(intent)
+	if err != nil && intent.IsCustomPuppet && errors.Is(err, mautrix.MUnknownToken) {
+		if puppet := portal.bridge.GetPuppetByCustomMXID(intent.UserID); puppet != nil {
+			if puppet.refreshAccessToken(err, "sending message") {
+				resp, err = send(intent)
+				if !errors.Is(err, mautrix.MUnknownToken) {
+					return resp, err
+				}
+			}
+			puppet.disableCustomMXID(err)
+			return send(puppet.DefaultIntent())
+		}
+	}
+	return resp, err
 }
 
 func (portal *Portal) HandleTextMessage(source *User, message whatsapp.TextMessage) bool {
@@ -1385,6 +2053,7 @@ func (portal *Portal) HandleTextMessage(source *User, message whatsapp.TextMessa
 	}
 
 	portal.bridge.Formatter.ParseWhatsApp(content, message.ContextInfo.MentionedJID)
+	addForwardedLabel(content, message.Info)
 	portal.SetReply(content, message.ContextInfo)
 
 	resp, err := portal.sendMessage(intent, event.EventMessage, content, int64(message.Info.Timestamp*1000))
@@ -1397,7 +2066,22 @@ func (portal *Portal) HandleTextMessage(source *User, message whatsapp.TextMessa
 }
 
 func (portal *Portal) HandleStubMessage(source *User, message whatsapp.StubMessage, isBackfill bool) bool {
-	if portal.bridge.Config.Bridge.ChatMetaSync && (!portal.IsBroadcastList() || isBackfill) {
+	if message.Type == waProto.WebMessageInfo_REVOKE {
+		// Revoked messages are replaced with a "this message was deleted" placeholder that has the original ID.
+		// If the bridge missed the revoke itself, the placeholder is all that's left, so redact the original if
+		// it was bridged. Unknown or already redacted messages are skipped without sending anything to Matrix.
+		return portal.HandleMessageRevoke(source, whatsapp.MessageRevocation{
+			Id:          message.Info.Id,
+			RemoteJid:   message.Info.RemoteJid,
+			FromMe:      message.Info.FromMe,
+			Participant: message.Info.SenderJid,
+		})
+	}
+	// Disappearing timer changes aren't included in chat metadata, so they're always handled here
+	isTimerChange := message.Type == waProto.WebMessageInfo_CHANGE_EPHEMERAL_SETTING
+	// Missed calls aren't chat metadata at all, so they're also handled here
+	isMissedCall := isMissedCallStub(message.Type)
+	if !isTimerChange && !isMissedCall && portal.bridge.Config.Bridge.ChatMetaSync && (!portal.IsBroadcastList() || isBackfill) {
 		// Chat meta sync is enabled, so we use chat update commands and full-syncs instead of message history
 		// However, broadcast lists don't have update commands, so we handle these if it's not a backfill
 		return false
@@ -1422,9 +2106,19 @@ func (portal *Portal) HandleStubMessage(source *User, message whatsapp.StubMessa
 		portal.UpdateAvatar(source, nil, true)
 	case waProto.WebMessageInfo_GROUP_CHANGE_DESCRIPTION:
 		if isBackfill {
-			// TODO fetch topic from server
+			// The server only has the current description, which may be newer than the one this stub refers to,
+			// so historical changes are skipped instead of fetching metadata for every stub.
+			break
+		}
+		// The stub doesn't contain the new description, so fetch it from the server
+		metadata, err := source.Conn.GetGroupMetaData(portal.Key.JID)
+		if err != nil {
+			portal.log.Warnln("Failed to get group metadata to update description:", err)
+		} else if metadata.Status != 0 {
+			portal.log.Warnln("Failed to get group metadata to update description: status", metadata.Status)
+		} else {
+			portal.UpdateTopic(metadata.Topic, metadata.TopicSetBy, intent, true)
 		}
-		//portal.UpdateTopic(message.FirstParam, "", intent, true)
 	case waProto.WebMessageInfo_GROUP_CHANGE_ANNOUNCE:
 		eventID = portal.RestrictMessageSending(message.FirstParam == "on")
 	case waProto.WebMessageInfo_GROUP_CHANGE_RESTRICT:
@@ -1437,6 +2131,14 @@ func (portal *Portal) HandleStubMessage(source *User, message whatsapp.StubMessa
 		eventID = portal.ChangeAdminStatus(message.Params, true)
 	case waProto.WebMessageInfo_GROUP_PARTICIPANT_DEMOTE:
 		eventID = portal.ChangeAdminStatus(message.Params, false)
+	case waProto.WebMessageInfo_CHANGE_EPHEMERAL_SETTING:
+		eventID = portal.HandleDisappearingTimerChange(intent, message)
+	case waProto.WebMessageInfo_CALL_MISSED_VOICE, waProto.WebMessageInfo_CALL_MISSED_VIDEO,
+		waProto.WebMessageInfo_CALL_MISSED_GROUP_VOICE, waProto.WebMessageInfo_CALL_MISSED_GROUP_VIDEO:
+		if message.Info.FromMe || !portal.bridge.Config.Bridge.CallNotices.Missed {
+			return false
+		}
+		eventID = portal.HandleMissedCall(intent, senderJID, message)
 	default:
 		return false
 	}
@@ -1495,6 +2197,7 @@ func (portal *Portal) HandleLocationMessage(source *User, message whatsapp.Locat
 		}
 	}
 
+	addForwardedLabel(content, message.Info)
 	portal.SetReply(content, message.ContextInfo)
 
 	resp, err := portal.sendMessage(intent, event.EventMessage, content, int64(message.Info.Timestamp*1000))
@@ -1549,19 +2252,139 @@ func (portal *Portal) HandleContactMessage(source *User, message whatsapp.Contac
 	return true
 }
 
-func (portal *Portal) sendMediaBridgeFailure(source *User, intent *appservice.IntentAPI, info whatsapp.MessageInfo, bridgeErr error) {
+var (
+	// errMediaNotAvailable means the media can't be downloaded anymore, usually because it's too old.
+	errMediaNotAvailable = errors.New("media is no longer available")
+	// errMediaUploadFailed means the media was downloaded from WhatsApp, but couldn't be uploaded to the homeserver.
+	errMediaUploadFailed = errors.New("failed to upload media to Matrix")
+)
+
+// describe returns a short human-readable description of the media for failure notices.
+func (msg *mediaMessage) describe() string {
+	if len(msg.fileName) > 0 {
+		return fmt.Sprintf("%s: %s", msg.mimeType, msg.fileName)
+	}
+	return msg.mimeType
+}
+
+func (portal *Portal) sendMediaBridgeFailure(source *User, intent *appservice.IntentAPI, msg mediaMessage, bridgeErr error) {
+	info := msg.info
 	portal.log.Errorfln("Failed to bridge media for %s: %v", info.Id, bridgeErr)
+	body := fmt.Sprintf("Failed to bridge media (%s)", msg.describe())
+	if errors.Is(bridgeErr, errMediaNotAvailable) {
+		body = fmt.Sprintf("Media (%s) is no longer available on WhatsApp", msg.describe())
+	} else if errors.Is(bridgeErr, errMediaUploadFailed) {
+		body = fmt.Sprintf("Failed to upload media (%s) to Matrix", msg.describe())
+	}
+	// The original message is still stored with this notice, so the download can be retried later
+	body = fmt.Sprintf("%s. Reply to this message with `%s redownload` or react with %s to try again.",
+		body, portal.bridge.Config.Bridge.CommandPrefix, redownloadReaction)
 	resp, err := portal.sendMessage(intent, event.EventMessage, &event.MessageEventContent{
 		MsgType: event.MsgNotice,
-		Body:    "Failed to bridge media",
+		Body:    body,
 	}, int64(info.Timestamp*1000))
 	if err != nil {
 		portal.log.Errorfln("Failed to send media download error message for %s: %v", info.Id, err)
 	} else {
 		portal.finishHandling(source, info.Source, resp.EventID)
+		portal.bridge.DB.Message.SetMediaFailed(resp.EventID, true)
 	}
 }
 
+// redownloadReaction is the reaction that can be used on a media bridging failure notice to retry the download.
+const redownloadReaction = "\U0001F504"
+
+var (
+	errUnknownMessage  = errors.New("that message wasn't bridged from WhatsApp")
+	errNotMediaMessage = errors.New("that message doesn't contain any media")
+	errMediaNotFailed  = errors.New("that message's media was already bridged successfully")
+	errNotConnected    = errors.New("you're not connected to WhatsApp")
+
+	errDisappearingGroupUnsupported = errors.New("changing the disappearing message timer is only supported in private chats")
+)
+
+// mediaRedownload is a request to retry bridging media. It's queued through the portal message loop so that it
+// doesn't race with incoming messages.
+type mediaRedownload struct {
+	evtID  id.EventID
+	result chan error
+}
+
+// QueueMediaRedownload queues a RedownloadMedia call in the portal message loop. The returned channel receives the
+// result once the media has been handled.
+func (portal *Portal) QueueMediaRedownload(user *User, evtID id.EventID) <-chan error {
+	result := make(chan error, 1)
+	portal.messages <- PortalMessage{
+		chat:      portal.Key.JID,
+		source:    user,
+		data:      mediaRedownload{evtID: evtID, result: result},
+		timestamp: uint64(time.Now().Unix()),
+	}
+	return result
+}
+
+// RedownloadMedia tries to bridge the media in an already handled message again, e.g. after the original
+// download failed because the media had expired. LoadMediaInfo is used to ask the phone to re-upload the media.
+// On success, the old event (usually a failure notice) is redacted and the message is pointed to the new event.
+func (portal *Portal) RedownloadMedia(user *User, evtID id.EventID) error {
+	msg := portal.bridge.DB.Message.GetByMXID(evtID)
+	if msg == nil || msg.Chat != portal.Key || msg.Content == nil {
+		return errUnknownMessage
+	} else if !msg.MediaFailed {
+		return errMediaNotFailed
+	}
+	fromMe := msg.Sender == user.JID
+	timestamp := uint64(msg.Timestamp)
+	info := &waProto.WebMessageInfo{
+		Key: &waProto.MessageKey{
+			RemoteJid: &portal.Key.JID,
+			Id:        &msg.JID,
+			FromMe:    &fromMe,
+		},
+		MessageTimestamp: &timestamp,
+		Message:          msg.Content,
+	}
+	if !portal.IsPrivateChat() && !fromMe {
+		info.Key.Participant = &msg.Sender
+	}
+	if unwrapped := unwrapViewOnce(info); unwrapped != nil {
+		info = unwrapped
+	}
+	media, ok := parseMediaMessage(whatsapp.ParseProtoMessage(info))
+	if !ok {
+		return errNotMediaMessage
+	}
+	data, err := portal.downloadMedia(user, media)
+	if err == whatsapp.ErrNoURLPresent {
+		return fmt.Errorf("%w: no URL present", errMediaNotAvailable)
+	} else if err != nil {
+		return err
+	}
+	intent := portal.bridge.GetPuppetByJID(msg.Sender).IntentFor(portal)
+	if fromMe {
+		intent = portal.bridge.GetPuppetByJID(user.JID).IntentFor(portal)
+	}
+	content, err := portal.convertMediaMessage(intent, data, media)
+	if err != nil {
+		return err
+	}
+	resp, err := portal.sendMediaMessage(intent, content, media)
+	if err != nil {
+		return fmt.Errorf("failed to send media: %w", err)
+	}
+	portal.bridge.DB.Message.UpdateMXID(evtID, resp.EventID)
+	portal.bridge.DB.Message.SetMediaFailed(resp.EventID, false)
+	_, err = intent.RedactEvent(portal.MXID, evtID, mautrix.ReqRedact{Reason: "Media was redownloaded"})
+	if err != nil {
+		_, err = portal.MainIntent().RedactEvent(portal.MXID, evtID, mautrix.ReqRedact{Reason: "Media was redownloaded"})
+		if err != nil {
+			portal.log.Warnfln("Failed to redact old event %s after redownloading media: %v", evtID, err)
+		}
+	}
+	portal.log.Debugfln("Redownloaded media of %s: %s -> %s", msg.JID, evtID, resp.EventID)
+	return nil
+}
+
 func (portal *Portal) encryptFile(data []byte, mimeType string) ([]byte, string, *event.EncryptedFileInfo) {
 	if !portal.Encrypted {
 		return data, mimeType, nil
@@ -1621,7 +2444,16 @@ func (portal *Portal) HandleWhatsAppKick(source *User, senderJID string, jids []
 				if puppet.CustomMXID == user.MXID {
 					customIntent = puppet.CustomIntent()
 				}
+				if puppet.JID != sender.JID && portal.bridge.Config.Bridge.ArchiveRemovedGroups {
+					// Keep the user in the room so they can still read the history, but get it out of the way
+					go user.updateChatTag(customIntent, portal, portal.bridge.Config.Bridge.ArchiveTag, true)
+					go user.sendBridgeNotice("You were removed from the WhatsApp group %s by %s, the portal room was archived", portal.Name, sender.Displayname)
+					continue
+				}
 				portal.removeUser(puppet.JID == sender.JID, senderIntent, user.MXID, customIntent)
+				if puppet.JID != sender.JID {
+					go user.sendBridgeNotice("You were removed from the WhatsApp group %s by %s", portal.Name, sender.Displayname)
+				}
 			}
 		}
 	}
@@ -1678,6 +2510,50 @@ type mediaMessage struct {
 	fileName      string
 	length        uint32
 	sendAsSticker bool
+	viewOnce      bool
+}
+
+// parseMediaMessage converts the different media message types from go-whatsapp into a mediaMessage.
+func parseMediaMessage(data interface{}) (mediaMessage, bool) {
+	switch data := data.(type) {
+	case whatsapp.ImageMessage:
+		return mediaMessage{
+			base:      base{data.Download, data.Info, data.ContextInfo, data.Type},
+			thumbnail: data.Thumbnail,
+			caption:   data.Caption,
+			viewOnce:  data.Info.Source.GetMessage().GetImageMessage().GetViewOnce(),
+		}, true
+	case whatsapp.StickerMessage:
+		return mediaMessage{
+			base:          base{data.Download, data.Info, data.ContextInfo, data.Type},
+			sendAsSticker: true,
+		}, true
+	case whatsapp.VideoMessage:
+		return mediaMessage{
+			base:      base{data.Download, data.Info, data.ContextInfo, data.Type},
+			thumbnail: data.Thumbnail,
+			caption:   data.Caption,
+			length:    data.Length * 1000,
+			viewOnce:  data.Info.Source.GetMessage().GetVideoMessage().GetViewOnce(),
+		}, true
+	case whatsapp.AudioMessage:
+		return mediaMessage{
+			base:   base{data.Download, data.Info, data.ContextInfo, data.Type},
+			length: data.Length * 1000,
+		}, true
+	case whatsapp.DocumentMessage:
+		fileName := data.FileName
+		if len(fileName) == 0 {
+			fileName = data.Title
+		}
+		return mediaMessage{
+			base:      base{data.Download, data.Info, data.ContextInfo, data.Type},
+			thumbnail: data.Thumbnail,
+			fileName:  fileName,
+		}, true
+	default:
+		return mediaMessage{}, false
+	}
 }
 
 func (portal *Portal) HandleMediaMessage(source *User, msg mediaMessage) bool {
@@ -1686,24 +2562,56 @@ func (portal *Portal) HandleMediaMessage(source *User, msg mediaMessage) bool {
 		return false
 	}
 
+	data, err := portal.downloadMedia(source, msg)
+	if err == whatsapp.ErrNoURLPresent && portal.backfilling {
+		// Old messages won't get another update with the URL, so record them instead of ignoring
+		portal.sendMediaBridgeFailure(source, intent, msg, fmt.Errorf("%w: no URL present", errMediaNotAvailable))
+		return true
+	} else if err == whatsapp.ErrNoURLPresent {
+		portal.log.Debugfln("No URL present error for media message %s, ignoring...", msg.info.Id)
+		return true
+	} else if err != nil {
+		portal.sendMediaBridgeFailure(source, intent, msg, err)
+		return true
+	}
+
+	content, err := portal.convertMediaMessage(intent, data, msg)
+	if err != nil {
+		portal.sendMediaBridgeFailure(source, intent, msg, err)
+		return true
+	}
+	resp, err := portal.sendMediaMessage(intent, content, msg)
+	if err != nil {
+		portal.log.Errorfln("Failed to handle message %s: %v", msg.info.Id, err)
+		return true
+	}
+	portal.finishHandling(source, msg.info.Source, resp.EventID)
+	return true
+}
+
+// downloadMedia downloads the media in a message. If the download fails because the media was removed from
+// the WhatsApp servers, it asks the phone to re-upload the media with LoadMediaInfo and tries again.
+func (portal *Portal) downloadMedia(source *User, msg mediaMessage) ([]byte, error) {
 	data, err := msg.download()
 	if err == whatsapp.ErrMediaDownloadFailedWith404 || err == whatsapp.ErrMediaDownloadFailedWith410 {
 		portal.log.Warnfln("Failed to download media for %s: %v. Calling LoadMediaInfo and retrying download...", msg.info.Id, err)
 		_, err = source.Conn.LoadMediaInfo(msg.info.RemoteJid, msg.info.Id, msg.info.FromMe)
 		if err != nil {
-			portal.sendMediaBridgeFailure(source, intent, msg.info, fmt.Errorf("failed to load media info: %w", err))
-			return true
+			return nil, fmt.Errorf("%w: failed to load media info: %v", errMediaNotAvailable, err)
 		}
 		data, err = msg.download()
+		if err == whatsapp.ErrMediaDownloadFailedWith404 || err == whatsapp.ErrMediaDownloadFailedWith410 {
+			err = fmt.Errorf("%w: %v", errMediaNotAvailable, err)
+		}
 	}
-	if err == whatsapp.ErrNoURLPresent {
-		portal.log.Debugfln("No URL present error for media message %s, ignoring...", msg.info.Id)
-		return true
-	} else if err != nil {
-		portal.sendMediaBridgeFailure(source, intent, msg.info, err)
-		return true
+	if err == nil {
+		portal.bridge.Metrics.TrackMediaBytes("whatsapp_to_matrix", len(data))
 	}
+	return data, err
+}
 
+// convertMediaMessage uploads downloaded media to Matrix and builds the event content for it.
+func (portal *Portal) convertMediaMessage(intent *appservice.IntentAPI, data []byte, msg mediaMessage) (*event.MessageEventContent, error) {
 	var width, height int
 	if strings.HasPrefix(msg.mimeType, "image/") {
 		cfg, _, _ := image.DecodeConfig(bytes.NewReader(data))
@@ -1712,35 +2620,39 @@ func (portal *Portal) HandleMediaMessage(source *User, msg mediaMessage) bool {
 
 	data, uploadMimeType, file := portal.encryptFile(data, msg.mimeType)
 
-	uploaded, err := intent.UploadBytes(data, uploadMimeType)
+	uploaded, err := portal.uploadMedia(intent, data, uploadMimeType, msg.info.Id)
 	if err != nil {
 		if errors.Is(err, mautrix.MTooLarge) {
-			portal.sendMediaBridgeFailure(source, intent, msg.info, errors.New("homeserver rejected too large file"))
+			return nil, fmt.Errorf("%w: homeserver rejected too large file", errMediaUploadFailed)
 		} else if httpErr, ok := err.(mautrix.HTTPError); ok && httpErr.IsStatus(413) {
-			portal.sendMediaBridgeFailure(source, intent, msg.info, errors.New("proxy rejected too large file"))
-		} else {
-			portal.sendMediaBridgeFailure(source, intent, msg.info, fmt.Errorf("failed to upload media: %w", err))
+			return nil, fmt.Errorf("%w: proxy rejected too large file", errMediaUploadFailed)
 		}
-		return true
+		return nil, fmt.Errorf("%w: %v", errMediaUploadFailed, err)
 	}
 
-	if msg.fileName == "" {
+	fileName := msg.fileName
+	if fileName == "" {
 		mimeClass := strings.Split(msg.mimeType, "/")[0]
 		switch mimeClass {
 		case "application":
-			msg.fileName = "file"
+			fileName = "file"
 		default:
-			msg.fileName = mimeClass
+			fileName = mimeClass
 		}
 
 		exts, _ := mime.ExtensionsByType(msg.mimeType)
 		if exts != nil && len(exts) > 0 {
-			msg.fileName += exts[0]
+			fileName += exts[0]
 		}
 	}
 
+	body := fileName
+	if msg.viewOnce {
+		body = fmt.Sprintf("%s (view once)", fileName)
+	}
+
 	content := &event.MessageEventContent{
-		Body: msg.fileName,
+		Body: body,
 		File: file,
 		Info: &event.FileInfo{
 			Size:     len(data),
@@ -1793,16 +2705,62 @@ func (portal *Portal) HandleMediaMessage(source *User, msg mediaMessage) bool {
 	default:
 		content.MsgType = event.MsgFile
 	}
+	return content, nil
+}
+
+// mediaUploadAttempts is the number of times uploading media to the homeserver is tried before giving up.
+const mediaUploadAttempts = 4
+
+// isTransientUploadError checks if a media upload error is worth retrying, i.e. it's a network error,
+// a server error or rate limiting rather than the homeserver rejecting the file.
+func isTransientUploadError(err error) bool {
+	var httpErr mautrix.HTTPError
+	if errors.As(err, &httpErr) && httpErr.Response != nil {
+		return httpErr.Response.StatusCode >= 500 || httpErr.Response.StatusCode == http.StatusTooManyRequests
+	}
+	return true
+}
 
+// mediaUploadRetryDelay is the delay before the first media upload retry. It's doubled after every retry.
+var mediaUploadRetryDelay = 1 * time.Second
+
+// uploadMedia uploads data to the homeserver, retrying transient failures with exponential backoff.
+func (portal *Portal) uploadMedia(intent *appservice.IntentAPI, data []byte, mimeType string, msgID string) (*mautrix.RespMediaUpload, error) {
+	return retryMediaUpload(portal.log, msgID, func() (*mautrix.RespMediaUpload, error) {
+		return intent.UploadBytes(data, mimeType)
+	})
+}
+
+func retryMediaUpload(log log.Logger, msgID string, upload func() (*mautrix.RespMediaUpload, error)) (*mautrix.RespMediaUpload, error) {
+	delay := mediaUploadRetryDelay
+	for attempt := 1; ; attempt++ {
+		resp, err := upload()
+		if err == nil || attempt >= mediaUploadAttempts || !isTransientUploadError(err) {
+			return resp, err
+		}
+		log.Warnfln("Failed to upload media for %s (attempt %d/%d): %v. Retrying in %s", msgID, attempt, mediaUploadAttempts, err, delay)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// sendMediaMessage sends converted media and its caption. The returned event is the last one that was sent.
+func (portal *Portal) sendMediaMessage(intent *appservice.IntentAPI, content *event.MessageEventContent, msg mediaMessage) (*mautrix.RespSendEvent, error) {
 	ts := int64(msg.info.Timestamp * 1000)
 	eventType := event.EventMessage
 	if msg.sendAsSticker {
 		eventType = event.EventSticker
 	}
+	if len(msg.caption) == 0 {
+		// The label goes on the caption event if there is one, otherwise on the media itself
+		addForwardedLabel(content, msg.info)
+	}
 	resp, err := portal.sendMessage(intent, eventType, content, ts)
 	if err != nil {
-		portal.log.Errorfln("Failed to handle message %s: %v", msg.info.Id, err)
-		return true
+		return nil, err
+	}
+	if msg.viewOnce {
+		portal.trackViewOnce(resp.EventID, int64(msg.info.Timestamp))
 	}
 
 	if len(msg.caption) > 0 {
@@ -1812,15 +2770,19 @@ func (portal *Portal) HandleMediaMessage(source *User, msg mediaMessage) bool {
 		}
 
 		portal.bridge.Formatter.ParseWhatsApp(captionContent, msg.context.MentionedJID)
+		addForwardedLabel(captionContent, msg.info)
 
-		resp, err = portal.sendMessage(intent, event.EventMessage, captionContent, ts)
+		captionResp, err := portal.sendMessage(intent, event.EventMessage, captionContent, ts)
 		if err != nil {
 			portal.log.Warnfln("Failed to handle caption of message %s: %v", msg.info.Id, err)
+		} else {
+			resp = captionResp
+			if msg.viewOnce {
+				portal.trackViewOnce(resp.EventID, int64(msg.info.Timestamp))
+			}
 		}
 	}
-
-	portal.finishHandling(source, msg.info.Source, resp.EventID)
-	return true
+	return resp, nil
 }
 
 func makeMessageID() *string {
@@ -1957,6 +2919,7 @@ func (portal *Portal) preprocessMatrixMedia(sender *User, relaybotFormatted bool
 		portal.log.Errorfln("Failed to upload media in %s: %v", eventID, err)
 		return nil
 	}
+	portal.bridge.Metrics.TrackMediaBytes("matrix_to_whatsapp", len(data))
 
 	return &MediaUpload{
 		Caption:       caption,
@@ -2010,11 +2973,34 @@ func (portal *Portal) sendMatrixConnectionError(sender *User, eventID id.EventID
 	return false
 }
 
-func (portal *Portal) addRelaybotFormat(sender *User, content *event.MessageEventContent) bool {
-	member := portal.MainIntent().Member(portal.MXID, sender.MXID)
+// getRelaySenderProfile returns the profile of a relayed sender for the relaybot message formats.
+// Users who haven't set a room-specific displayname or avatar get their global profile instead.
+func (portal *Portal) getRelaySenderProfile(userID id.UserID) *event.MemberEventContent {
+	member := *portal.MainIntent().Member(portal.MXID, userID)
+	if len(member.Displayname) == 0 || len(member.AvatarURL) == 0 {
+		var profile struct {
+			Displayname string              `json:"displayname"`
+			AvatarURL   id.ContentURIString `json:"avatar_url"`
+		}
+		_, err := portal.MainIntent().MakeRequest("GET", portal.MainIntent().BuildURL("profile", userID), nil, &profile)
+		if err != nil {
+			portal.log.Warnfln("Failed to get global profile of relayed sender %s: %v", userID, err)
+		}
+		if len(member.Displayname) == 0 {
+			member.Displayname = profile.Displayname
+		}
+		if len(member.AvatarURL) == 0 {
+			member.AvatarURL = profile.AvatarURL
+		}
+	}
 	if len(member.Displayname) == 0 {
-		member.Displayname = string(sender.MXID)
+		member.Displayname = string(userID)
 	}
+	return &member
+}
+
+func (portal *Portal) addRelaybotFormat(sender *User, content *event.MessageEventContent) bool {
+	member := portal.getRelaySenderProfile(sender.MXID)
 
 	if content.Format != event.FormatHTML {
 		content.FormattedBody = strings.Replace(html.EscapeString(content.Body), "\n", "<br/>", -1)
@@ -2062,8 +3048,28 @@ func (portal *Portal) convertMatrixMessage(sender *User, evt *event.Event) (*waP
 	}
 	ctxInfo := &waProto.ContextInfo{}
 	replyToID := content.GetReplyTo()
-	if len(replyToID) > 0 {
+	var editTarget *database.Message
+	if content.RelatesTo != nil && content.RelatesTo.Type == event.RelReplace && content.NewContent != nil {
+		editTarget = portal.bridge.DB.Message.GetByMXID(content.RelatesTo.EventID)
+		if editTarget == nil || (editTarget.Sender != sender.JID && editTarget.RelaySender != sender.MXID) {
+			portal.log.Debugfln("Ignoring edit %s of a message that wasn't sent by %s through the bridge", evt.ID, sender.MXID)
+			return nil, sender
+		} else if time.Since(time.Unix(editTarget.Timestamp, 0)) > whatsappEditWindow {
+			portal.log.Debugfln("Rejecting edit %s of %s: the message is too old to edit", evt.ID, editTarget.JID)
+			portal.sendErrorMessage(fmt.Sprintf("WhatsApp only allows editing messages for %d minutes after sending them.",
+				int(whatsappEditWindow.Minutes())), true, evt.ID)
+			return nil, sender
+		}
+		content = content.NewContent
+		if content.MsgType != event.MsgText && content.MsgType != event.MsgEmote && content.MsgType != event.MsgNotice {
+			portal.log.Debugfln("Ignoring edit %s of %s: only text can be edited", evt.ID, editTarget.JID)
+			return nil, sender
+		}
+		replyToID = ""
+	} else if len(replyToID) > 0 {
 		content.RemoveReplyFallback()
+	}
+	if len(replyToID) > 0 {
 		msg := portal.bridge.DB.Message.GetByMXID(replyToID)
 		if msg != nil && msg.Content != nil {
 			ctxInfo.StanzaId = &msg.JID
@@ -2073,7 +3079,10 @@ func (portal *Portal) convertMatrixMessage(sender *User, evt *event.Event) (*waP
 	}
 	relaybotFormatted := false
 	if sender.NeedsRelaybot(portal) {
-		if !portal.HasRelaybot() {
+		if relayUser := portal.GetRelayUser(); relayUser != nil {
+			relaybotFormatted = portal.addRelaybotFormat(sender, content)
+			sender = relayUser
+		} else if !portal.HasRelaybot() {
 			if sender.HasSession() {
 				portal.log.Debugln("Database says", sender.MXID, "not in chat and no relaybot, but trying to send anyway")
 			} else {
@@ -2193,6 +3202,14 @@ func (portal *Portal) convertMatrixMessage(sender *User, evt *event.Event) (*waP
 		portal.log.Debugfln("Unhandled Matrix event %s: unknown msgtype %s", evt.ID, content.MsgType)
 		return nil, sender
 	}
+	if editTarget != nil {
+		editMessage, err := makeEditMessage(editTarget, info.Message, evt.Timestamp)
+		if err != nil {
+			portal.log.Errorfln("Failed to convert edit %s: %v", evt.ID, err)
+			return nil, sender
+		}
+		info.Message = editMessage
+	}
 	return info, sender
 }
 
@@ -2207,15 +3224,21 @@ func (portal *Portal) wasMessageSent(sender *User, id string) bool {
 	return true
 }
 
-func (portal *Portal) sendErrorMessage(message string, confirmed bool) id.EventID {
+// sendErrorMessage sends a notice about a Matrix message that failed to bridge as a reply to the message.
+// Confirmed failures are permanent, while unconfirmed ones are usually transient and may have succeeded.
+func (portal *Portal) sendErrorMessage(message string, confirmed bool, replyTo id.EventID) id.EventID {
 	certainty := "may not have been"
 	if confirmed {
 		certainty = "was not"
 	}
-	resp, err := portal.sendMainIntentMessage(event.MessageEventContent{
+	content := &event.MessageEventContent{
 		MsgType: event.MsgNotice,
 		Body:    fmt.Sprintf("\u26a0 Your message %s bridged: %v", certainty, message),
-	})
+	}
+	if len(replyTo) > 0 {
+		content.RelatesTo = &event.RelatesTo{Type: event.RelReply, EventID: replyTo}
+	}
+	resp, err := portal.sendMainIntentMessage(content)
 	if err != nil {
 		portal.log.Warnfln("Failed to send bridging error message:", err)
 		return ""
@@ -2223,8 +3246,18 @@ func (portal *Portal) sendErrorMessage(message string, confirmed bool) id.EventI
 	return resp.EventID
 }
 
+// HandleDeliveryFailure notifies the sender of a message from Matrix that WhatsApp reported it as undeliverable
+// after it had already been accepted by the server.
+func (portal *Portal) HandleDeliveryFailure(msg *database.Message) {
+	if !msg.FromMatrix || msg.IsFakeMXID() {
+		return
+	}
+	portal.log.Warnfln("WhatsApp reported that delivering %s (%s) failed", msg.JID, msg.MXID)
+	portal.sendErrorMessage("WhatsApp reported that delivering it failed.", true, msg.MXID)
+}
+
 func (portal *Portal) sendDeliveryReceipt(eventID id.EventID) {
-	if portal.bridge.Config.Bridge.DeliveryReceipts {
+	if portal.bridge.Config.Bridge.DeliveryReceipts && len(portal.MXID) > 0 {
 		err := portal.bridge.Bot.MarkRead(portal.MXID, eventID)
 		if err != nil {
 			portal.log.Debugfln("Failed to send delivery receipt for %s: %v", eventID, err)
@@ -2233,21 +3266,41 @@ func (portal *Portal) sendDeliveryReceipt(eventID id.EventID) {
 }
 
 func (portal *Portal) HandleMatrixMessage(sender *User, evt *event.Event) {
-	if !portal.HasRelaybot() && (
-		(portal.IsPrivateChat() && sender.JID != portal.Key.Receiver) ||
-			portal.sendMatrixConnectionError(sender, evt.ID)) {
+	if !portal.HasRelay() && ((portal.IsPrivateChat() && sender.JID != portal.Key.Receiver) ||
+		portal.sendMatrixConnectionError(sender, evt.ID)) {
 		return
 	}
 	portal.log.Debugfln("Received event %s", evt.ID)
+	origSender := sender
 	info, sender := portal.convertMatrixMessage(sender, evt)
 	if info == nil {
 		return
 	}
-	dbMsg := portal.markHandled(sender, info, evt.ID, false)
-	portal.sendRaw(sender, evt, info, dbMsg)
+	var relaySender id.UserID
+	if sender != origSender {
+		relaySender = origSender.MXID
+	}
+	dbMsg := portal.markHandledRelayed(sender, relaySender, info, evt.ID, false)
+	if portal.sendRaw(sender, evt, info, dbMsg) {
+		if edit := parseMessageEdit(info); edit != nil {
+			portal.updateEditedMessage(*edit)
+		}
+	}
+}
+
+// updateEditedMessage stores the new content of an edit sent from Matrix on the edited message,
+// so that later replies quote it. It must only be called after WhatsApp accepted the edit.
+func (portal *Portal) updateEditedMessage(edit MessageEdit) {
+	editedMsg := portal.bridge.DB.Message.GetByJID(portal.Key, edit.TargetID)
+	if editedMsg == nil {
+		return
+	}
+	updated := applyMessageEdit(editedMsg.Content, edit.Message)
+	editedMsg.UpdateContent(updated, summarizeMessage(updated))
 }
 
-func (portal *Portal) sendRaw(sender *User, evt *event.Event, info *waProto.WebMessageInfo, dbMsg *database.Message) {
+// sendRaw sends the message to WhatsApp and reports errors to Matrix. Returns true if the message was sent.
+func (portal *Portal) sendRaw(sender *User, evt *event.Event, info *waProto.WebMessageInfo, dbMsg *database.Message) bool {
 	portal.log.Debugln("Sending event", evt.ID, "to WhatsApp", info.Key.GetId())
 	errChan := make(chan error, 1)
 	go sender.Conn.SendRaw(info, errChan)
@@ -2262,7 +3315,7 @@ func (portal *Portal) sendRaw(sender *User, evt *event.Event, info *waProto.WebM
 			portal.sendDeliveryReceipt(evt.ID)
 		} else {
 			portal.log.Warnfln("Response when bridging Matrix event %s is taking long to arrive", evt.ID)
-			errorEventID = portal.sendErrorMessage("message sending timed out", false)
+			errorEventID = portal.sendErrorMessage("message sending timed out", false, evt.ID)
 		}
 		err = <-errChan
 	}
@@ -2275,37 +3328,53 @@ func (portal *Portal) sendRaw(sender *User, evt *event.Event, info *waProto.WebM
 		case 400:
 			portal.log.Errorfln("400 response handling Matrix event %s: %+v", evt.ID, statusErr.Extra)
 			errMsg = "WhatsApp rejected the message (status code 400)."
-			if info.Message.ImageMessage != nil || info.Message.VideoMessage != nil || info.Message.AudioMessage != nil || info.Message.DocumentMessage != nil {
+			if parseMessageEdit(info) != nil {
+				errMsg = "WhatsApp rejected the edit (status code 400). The message may be too old to edit."
+			} else if info.Message.ImageMessage != nil || info.Message.VideoMessage != nil || info.Message.AudioMessage != nil || info.Message.DocumentMessage != nil {
 				errMsg += " The attachment type you sent may be unsupported."
 			}
 			confirmed = true
 		case 599:
-			errMsg = "WhatsApp rate-limited the message (status code 599)."
+			errMsg = "WhatsApp rate-limited the message (status code 599). Try sending it again later."
+			confirmed = true
 		default:
 			portal.log.Errorfln("Error handling Matrix event %s: %v", evt.ID, err)
 			errMsg = err.Error()
 		}
-		portal.sendErrorMessage(errMsg, confirmed)
+		portal.sendErrorMessage(errMsg, confirmed, evt.ID)
 	} else {
 		portal.log.Debugfln("Handled Matrix event %s", evt.ID)
 		portal.sendDeliveryReceipt(evt.ID)
 		dbMsg.MarkSent()
 	}
+	sent := err == nil
 	if errorEventID != "" {
 		_, err = portal.MainIntent().RedactEvent(portal.MXID, errorEventID)
 		if err != nil {
 			portal.log.Warnfln("Failed to redact timeout warning message %s: %v", errorEventID, err)
 		}
 	}
+	return sent
 }
 
 func (portal *Portal) HandleMatrixRedaction(sender *User, evt *event.Event) {
-	if portal.IsPrivateChat() && sender.JID != portal.Key.Receiver {
+	msg := portal.bridge.DB.Message.GetByMXID(evt.Redacts)
+	if msg == nil {
+		return
+	} else if len(msg.RelaySender) > 0 && msg.RelaySender == sender.MXID {
+		// The message was relayed, so it has to be revoked through the connection that sent it.
+		if portal.bridge.Relaybot != nil && msg.Sender == portal.bridge.Relaybot.JID {
+			sender = portal.bridge.Relaybot
+		} else if relayUser := portal.bridge.GetUserByJID(msg.Sender); relayUser != nil && relayUser.IsConnected() {
+			sender = relayUser
+		} else {
+			portal.log.Warnfln("Can't bridge redaction %s of relayed message %s: relay user %s is not connected", evt.ID, msg.JID, msg.Sender)
+			return
+		}
+	} else if portal.IsPrivateChat() && sender.JID != portal.Key.Receiver {
 		return
 	}
-
-	msg := portal.bridge.DB.Message.GetByMXID(evt.Redacts)
-	if msg == nil || msg.Sender != sender.JID {
+	if msg.Sender != sender.JID {
 		return
 	}
 
@@ -2346,6 +3415,7 @@ func (portal *Portal) HandleMatrixRedaction(sender *User, evt *event.Event) {
 		portal.log.Errorfln("Error handling Matrix redaction %s: %v", evt.ID, err)
 	} else {
 		portal.log.Debugln("Handled Matrix redaction %s of %s", evt.ID, evt.Redacts)
+		msg.Delete()
 		portal.sendDeliveryReceipt(evt.ID)
 	}
 }
@@ -2398,6 +3468,13 @@ func (portal *Portal) Cleanup(puppetsOnly bool) {
 		if err != nil {
 			portal.log.Warnln("Failed to leave private chat portal with main intent:", err)
 		}
+		// The bridge bot is only in private chats when encryption is enabled
+		if portal.bridge.AS.StateStore.IsInRoom(portal.MXID, portal.bridge.Bot.UserID) {
+			_, err = portal.bridge.Bot.LeaveRoom(portal.MXID)
+			if err != nil {
+				portal.log.Warnln("Failed to leave private chat portal with bridge bot:", err)
+			}
+		}
 		return
 	}
 	intent := portal.MainIntent()
@@ -2443,57 +3520,413 @@ func (portal *Portal) HandleMatrixLeave(sender *User) {
 			return
 		}
 		portal.log.Infoln("Leave response:", <-resp)
+	} else {
+		portal.unbridgeIfEmpty()
+		return
 	}
 	portal.CleanupIfEmpty()
 }
 
+// unbridgeIfEmpty cleans up the portal room without deleting the portal if there are no Matrix users left,
+// so that the group isn't bridged again until the user explicitly asks for it.
+func (portal *Portal) unbridgeIfEmpty() {
+	users, err := portal.GetMatrixUsers()
+	if err != nil {
+		portal.log.Errorfln("Failed to get Matrix user list to determine if portal needs to be unbridged: %v", err)
+		return
+	} else if len(users) > 0 {
+		return
+	}
+
+	portal.log.Infoln("Last Matrix user left portal room, marking portal as unbridged")
+	portal.Cleanup(false)
+	portal.bridge.portalsLock.Lock()
+	delete(portal.bridge.portalsByMXID, portal.MXID)
+	portal.bridge.portalsLock.Unlock()
+	portal.MXID = ""
+	portal.Unbridged = true
+	portal.Update()
+}
+
+func (portal *Portal) isGroupAdmin(user *User) (bool, error) {
+	_, isAdmin, err := portal.getGroupParticipantStatus(user)
+	return isAdmin, err
+}
+
+func (portal *Portal) getGroupParticipantStatus(user *User) (isParticipant, isAdmin bool, err error) {
+	metadata, err := user.Conn.GetGroupMetaData(portal.Key.JID)
+	if err != nil {
+		return false, false, err
+	} else if metadata.Status != 0 {
+		return false, false, fmt.Errorf("failed to get group metadata: status %d", metadata.Status)
+	}
+	for _, participant := range metadata.Participants {
+		if participant.JID == user.JID {
+			return true, participant.IsAdmin || participant.IsSuperAdmin, nil
+		}
+	}
+	return false, false, nil
+}
+
 func (portal *Portal) HandleMatrixKick(sender *User, evt *event.Event) {
+	if portal.IsPrivateChat() || portal.IsBroadcastList() {
+		return
+	}
 	puppet := portal.bridge.GetPuppetByMXID(id.UserID(evt.GetStateKey()))
 	if puppet != nil {
-		resp, err := sender.Conn.RemoveMember(portal.Key.JID, []string{puppet.JID})
+		isAdmin, err := portal.isGroupAdmin(sender)
+		if err == nil && !isAdmin {
+			err = errors.New("you're not an admin of the group")
+		} else if err == nil {
+			err = parseGroupActionResponse(sender.Conn.RemoveMember(portal.Key.JID, []string{puppet.JID}))
+		}
 		if err != nil {
 			portal.log.Errorfln("Failed to kick %s from group as %s: %v", puppet.JID, sender.MXID, err)
+			portal.revertMatrixKick(puppet, evt.Content.AsMember().Membership == event.MembershipBan)
+			_, _ = portal.sendMainIntentMessage(event.MessageEventContent{
+				MsgType: event.MsgNotice,
+				Body:    fmt.Sprintf("\u26a0 Failed to remove %s from the WhatsApp group: %v", puppet.Displayname, err),
+			})
+			return
+		}
+		portal.log.Infofln("Removed %s from group as %s", puppet.JID, sender.MXID)
+	}
+}
+
+func (portal *Portal) revertMatrixKick(puppet *Puppet, wasBan bool) {
+	if wasBan {
+		_, err := portal.MainIntent().UnbanUser(portal.MXID, &mautrix.ReqUnbanUser{UserID: puppet.MXID})
+		if err != nil {
+			portal.log.Warnfln("Failed to unban %s after failed removal: %v", puppet.MXID, err)
+			return
+		}
+	}
+	err := puppet.DefaultIntent().EnsureJoined(portal.MXID)
+	if err != nil {
+		portal.log.Warnfln("Failed to rejoin %s after failed removal: %v", puppet.MXID, err)
+	}
+}
+
+func (portal *Portal) HandleMatrixPowerLevels(sender *User, evt *event.Event) {
+	if evt.Unsigned.PrevContent == nil {
+		return
+	}
+	_ = evt.Unsigned.PrevContent.ParseRaw(evt.Type)
+	prevContent := evt.Unsigned.PrevContent.AsPowerLevels()
+	content := evt.Content.AsPowerLevels()
+
+	var promote, demote []string
+	checked := make(map[id.UserID]bool)
+	diffUser := func(userID id.UserID) {
+		if checked[userID] {
+			return
+		}
+		checked[userID] = true
+		jid, ok := portal.bridge.ParsePuppetMXID(userID)
+		if !ok {
 			return
 		}
-		portal.log.Infoln("Kick %s response: %s", puppet.JID, <-resp)
+		adminLevel := portal.bridge.Config.Bridge.AdminPowerLevel
+		wasAdmin := prevContent.GetUserLevel(userID) >= adminLevel
+		isAdmin := content.GetUserLevel(userID) >= adminLevel
+		if isAdmin && !wasAdmin {
+			promote = append(promote, jid)
+		} else if wasAdmin && !isAdmin {
+			demote = append(demote, jid)
+		}
+	}
+	for userID := range content.Users {
+		diffUser(userID)
+	}
+	for userID := range prevContent.Users {
+		diffUser(userID)
+	}
+	if len(promote) == 0 && len(demote) == 0 {
+		return
+	}
+
+	isAdmin, err := portal.isGroupAdmin(sender)
+	if err == nil && !isAdmin {
+		err = errors.New("you're not an admin of the group")
+	}
+	if err == nil && len(promote) > 0 {
+		err = parseGroupActionResponse(sender.Conn.SetAdmin(portal.Key.JID, promote))
+	}
+	if err == nil && len(demote) > 0 {
+		err = parseGroupActionResponse(sender.Conn.RemoveAdmin(portal.Key.JID, demote))
+	}
+	if err != nil {
+		portal.log.Errorfln("Failed to bridge power level change %s by %s (promote: %v, demote: %v): %v", evt.ID, sender.MXID, promote, demote, err)
+		_, revertErr := portal.MainIntent().SetPowerLevels(portal.MXID, prevContent)
+		if revertErr != nil {
+			portal.log.Warnln("Failed to revert power levels:", revertErr)
+		}
+		_, _ = portal.sendMainIntentMessage(event.MessageEventContent{
+			MsgType: event.MsgNotice,
+			Body:    fmt.Sprintf("\u26a0 Failed to change admin status on WhatsApp: %v", err),
+		})
+		return
 	}
+	portal.log.Infofln("Changed admin status as %s (promoted: %v, demoted: %v)", sender.MXID, promote, demote)
+}
+
+type groupActionResult struct {
+	Code string `json:"code"`
+}
+
+type groupActionResponse struct {
+	Status       int                                  `json:"status"`
+	Participants []map[whatsapp.JID]groupActionResult `json:"participants"`
+}
+
+func describeGroupActionCode(code string) string {
+	switch code {
+	case "401":
+		return "you're not an admin of the group"
+	case "403":
+		return "the user's privacy settings don't allow that"
+	case "404":
+		return "the user doesn't exist on WhatsApp"
+	case "409":
+		return "the user is already in the group"
+	default:
+		return fmt.Sprintf("status code %s", code)
+	}
+}
+
+// parseGroupActionResponse waits for the response to a group participant action (e.g. add or remove)
+// and returns an error if WhatsApp rejected the action for any of the participants.
+func parseGroupActionResponse(resp <-chan string, err error) error {
+	if err != nil {
+		return err
+	}
+	var parsed groupActionResponse
+	err = json.Unmarshal([]byte(<-resp), &parsed)
+	if err != nil {
+		return fmt.Errorf("failed to parse response: %w", err)
+	} else if parsed.Status != 0 && parsed.Status != 200 {
+		return errors.New(describeGroupActionCode(strconv.Itoa(parsed.Status)))
+	}
+	for _, participant := range parsed.Participants {
+		for _, result := range participant {
+			if len(result.Code) > 0 && result.Code != "200" {
+				return errors.New(describeGroupActionCode(result.Code))
+			}
+		}
+	}
+	return nil
 }
 
 func (portal *Portal) HandleMatrixInvite(sender *User, evt *event.Event) {
+	if portal.IsPrivateChat() || portal.IsBroadcastList() {
+		return
+	}
 	puppet := portal.bridge.GetPuppetByMXID(id.UserID(evt.GetStateKey()))
 	if puppet != nil {
-		resp, err := sender.Conn.AddMember(portal.Key.JID, []string{puppet.JID})
+		err := errNotConnected
+		if sender.IsConnected() {
+			err = parseGroupActionResponse(sender.Conn.AddMember(portal.Key.JID, []string{puppet.JID}))
+		}
 		if err != nil {
 			portal.log.Errorfln("Failed to add %s to group as %s: %v", puppet.JID, sender.MXID, err)
+			_, _ = puppet.DefaultIntent().LeaveRoom(portal.MXID)
+			_, _ = portal.sendMainIntentMessage(event.MessageEventContent{
+				MsgType: event.MsgNotice,
+				Body:    fmt.Sprintf("\u26a0 Failed to add %s to the WhatsApp group: %v", puppet.Displayname, err),
+			})
 			return
 		}
-		portal.log.Infofln("Add %s response: %s", puppet.JID, <-resp)
+		portal.log.Infofln("Added %s to group as %s", puppet.JID, sender.MXID)
+		err = puppet.DefaultIntent().EnsureJoined(portal.MXID)
+		if err != nil {
+			portal.log.Errorfln("Failed to ensure %s is joined: %v", puppet.MXID, err)
+		}
 	}
 }
 
+type pendingMetaChange struct {
+	sender *User
+	evt    *event.Event
+}
+
+// metaChangeDebounce is how long to wait for further changes before sending room metadata changes to WhatsApp.
+const metaChangeDebounce = 2 * time.Second
+
+// HandleMatrixMeta queues a room name, topic or avatar change to be sent to WhatsApp.
+// Rapid changes of the same type are merged so that only the latest one is sent.
 func (portal *Portal) HandleMatrixMeta(sender *User, evt *event.Event) {
-	var resp <-chan string
-	var err error
+	portal.metaChangeLock.Lock()
+	defer portal.metaChangeLock.Unlock()
+	if portal.pendingMetaChanges == nil {
+		portal.pendingMetaChanges = make(map[event.Type]pendingMetaChange)
+	}
+	portal.pendingMetaChanges[evt.Type] = pendingMetaChange{sender, evt}
+	if portal.metaChangeTimer == nil {
+		portal.metaChangeTimer = time.AfterFunc(metaChangeDebounce, portal.flushMetaChanges)
+	} else {
+		portal.metaChangeTimer.Reset(metaChangeDebounce)
+	}
+}
+
+func (portal *Portal) flushMetaChanges() {
+	portal.metaChangeLock.Lock()
+	changes := portal.pendingMetaChanges
+	portal.pendingMetaChanges = nil
+	portal.metaChangeTimer = nil
+	portal.metaChangeLock.Unlock()
+	for _, change := range changes {
+		portal.bridgeMatrixMeta(change.sender, change.evt)
+	}
+}
+
+// flushPendingMetaChanges sends queued metadata changes immediately instead of waiting for the debounce timer.
+func (portal *Portal) flushPendingMetaChanges() {
+	portal.metaChangeLock.Lock()
+	timer := portal.metaChangeTimer
+	portal.metaChangeLock.Unlock()
+	// If the timer already fired, the changes are being sent already
+	if timer != nil && timer.Stop() {
+		portal.flushMetaChanges()
+	}
+}
+
+func (portal *Portal) bridgeMatrixMeta(sender *User, evt *event.Event) {
+	if !sender.IsConnected() {
+		portal.log.Debugfln("Dropping %s change %s: %s is no longer connected", evt.Type.Type, evt.ID, sender.MXID)
+		return
+	}
+	var apply func() error
+	var revert func() error
 	switch content := evt.Content.Parsed.(type) {
 	case *event.RoomNameEventContent:
 		if content.Name == portal.Name {
 			return
 		}
-		portal.Name = content.Name
-		resp, err = sender.Conn.UpdateGroupSubject(content.Name, portal.Key.JID)
+		prevName := portal.Name
+		apply = func() error {
+			// Set the new value before sending so that the echo from WhatsApp is recognized as a no-op
+			portal.Name = content.Name
+			err := parseGroupActionResponse(sender.Conn.UpdateGroupSubject(content.Name, portal.Key.JID))
+			if err != nil {
+				portal.Name = prevName
+			}
+			return err
+		}
+		revert = func() error {
+			_, err := portal.MainIntent().SetRoomName(portal.MXID, prevName)
+			return err
+		}
 	case *event.TopicEventContent:
 		if content.Topic == portal.Topic {
 			return
 		}
-		portal.Topic = content.Topic
-		resp, err = sender.Conn.UpdateGroupDescription(sender.JID, portal.Key.JID, content.Topic)
+		prevTopic := portal.Topic
+		apply = func() error {
+			// Set the new value before sending so that the echo from WhatsApp is recognized as a no-op
+			portal.Topic = content.Topic
+			err := parseGroupActionResponse(sender.Conn.UpdateGroupDescription(sender.JID, portal.Key.JID, content.Topic))
+			if err != nil {
+				portal.Topic = prevTopic
+			}
+			return err
+		}
+		revert = func() error {
+			_, err := portal.MainIntent().SetRoomTopic(portal.MXID, prevTopic)
+			return err
+		}
 	case *event.RoomAvatarEventContent:
+		if content.URL == portal.AvatarURL {
+			return
+		}
+		prevAvatarURL := portal.AvatarURL
+		apply = func() error {
+			return portal.setGroupAvatar(sender, content.URL)
+		}
+		revert = func() error {
+			_, err := portal.MainIntent().SetRoomAvatar(portal.MXID, prevAvatarURL)
+			return err
+		}
+	default:
 		return
 	}
+	isParticipant, _, err := portal.getGroupParticipantStatus(sender)
+	if err == nil && !isParticipant {
+		err = errors.New("you're not a participant of the group")
+	} else if err == nil {
+		err = apply()
+	}
 	if err != nil {
-		portal.log.Errorln("Failed to update metadata:", err)
-	} else {
-		out := <-resp
-		portal.log.Debugln("Successfully updated metadata:", out)
+		portal.log.Errorfln("Failed to bridge %s change %s by %s: %v", evt.Type.Type, evt.ID, sender.MXID, err)
+		revertErr := revert()
+		if revertErr != nil {
+			portal.log.Warnfln("Failed to revert %s change: %v", evt.Type.Type, revertErr)
+		}
+		_, _ = portal.sendMainIntentMessage(event.MessageEventContent{
+			MsgType: event.MsgNotice,
+			Body:    fmt.Sprintf("\u26a0 Failed to update the WhatsApp group info: %v", err),
+		})
+		return
+	}
+	portal.log.Debugfln("Successfully bridged %s change %s by %s", evt.Type.Type, evt.ID, sender.MXID)
+	portal.Update()
+}
+
+// setGroupAvatar uploads the given Matrix image as the WhatsApp group icon and
+// stores the resulting avatar tag, so that the echo from WhatsApp doesn't change the room avatar again.
+func (portal *Portal) setGroupAvatar(sender *User, url id.ContentURI) error {
+	if url.IsEmpty() {
+		return errors.New("removing the group icon is not supported")
+	}
+	data, err := portal.MainIntent().DownloadBytes(url)
+	if err != nil {
+		return fmt.Errorf("failed to download avatar: %w", err)
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("failed to decode avatar: %w", err)
+	}
+	full, err := encodeSquareJPEG(img, 640)
+	if err != nil {
+		return err
+	}
+	preview, err := encodeSquareJPEG(img, 96)
+	if err != nil {
+		return err
+	}
+	err = parseGroupActionResponse(sender.Conn.UploadProfilePic(portal.Key.JID, full, preview))
+	if err != nil {
+		return err
+	}
+	portal.AvatarURL = url
+	avatar, err := sender.Conn.GetProfilePicThumb(portal.Key.JID)
+	if err != nil {
+		portal.log.Warnln("Failed to get new avatar tag after changing group icon:", err)
+	} else if avatar.Status == 0 {
+		portal.Avatar = avatar.Tag
+	}
+	return nil
+}
+
+// encodeSquareJPEG crops the image to a centered square and scales it to size x size pixels,
+// which is the format WhatsApp requires for profile and group pictures.
+func encodeSquareJPEG(img image.Image, size int) ([]byte, error) {
+	bounds := img.Bounds()
+	side := bounds.Dx()
+	if bounds.Dy() < side {
+		side = bounds.Dy()
+	}
+	offsetX := bounds.Min.X + (bounds.Dx()-side)/2
+	offsetY := bounds.Min.Y + (bounds.Dy()-side)/2
+	scaled := image.NewRGBA(image.Rect(0, 0, size, size))
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			scaled.Set(x, y, img.At(offsetX+x*side/size, offsetY+y*side/size))
+		}
+	}
+	var buf bytes.Buffer
+	err := jpeg.Encode(&buf, scaled, &jpeg.Options{Quality: jpeg.DefaultQuality})
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode avatar: %w", err)
 	}
+	return buf.Bytes(), nil
 }
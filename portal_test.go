@@ -0,0 +1,522 @@
+// mautrix-whatsapp - A Matrix-WhatsApp puppeting bridge.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Rhymen/go-whatsapp"
+	waProto "github.com/Rhymen/go-whatsapp/binary/proto"
+
+	log "maunium.net/go/maulogger/v2"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"maunium.net/go/mautrix-whatsapp/database"
+)
+
+func httpStatusError(status int) error {
+	return mautrix.HTTPError{Response: &http.Response{StatusCode: status}, Message: http.StatusText(status)}
+}
+
+func TestIsTransientUploadError(t *testing.T) {
+	tests := []struct {
+		name      string
+		err       error
+		transient bool
+	}{
+		{"bad gateway", httpStatusError(http.StatusBadGateway), true},
+		{"service unavailable", httpStatusError(http.StatusServiceUnavailable), true},
+		{"rate limited", httpStatusError(http.StatusTooManyRequests), true},
+		{"too large", httpStatusError(http.StatusRequestEntityTooLarge), false},
+		{"bad request", httpStatusError(http.StatusBadRequest), false},
+		{"forbidden", httpStatusError(http.StatusForbidden), false},
+		{"network error", errors.New("connection reset by peer"), true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if transient := isTransientUploadError(test.err); transient != test.transient {
+				t.Errorf("isTransientUploadError(%v) = %t, expected %t", test.err, transient, test.transient)
+			}
+		})
+	}
+}
+
+func withoutUploadRetryDelay(t *testing.T) {
+	delay := mediaUploadRetryDelay
+	mediaUploadRetryDelay = 0
+	t.Cleanup(func() { mediaUploadRetryDelay = delay })
+}
+
+func TestRetryMediaUploadGivesUp(t *testing.T) {
+	withoutUploadRetryDelay(t)
+	calls := 0
+	_, err := retryMediaUpload(log.Sub("Test"), "TESTID", func() (*mautrix.RespMediaUpload, error) {
+		calls++
+		return nil, httpStatusError(http.StatusBadGateway)
+	})
+	if err == nil {
+		t.Fatal("expected upload to fail")
+	} else if calls != mediaUploadAttempts {
+		t.Errorf("expected %d upload attempts, got %d", mediaUploadAttempts, calls)
+	}
+}
+
+func TestRetryMediaUploadRecovers(t *testing.T) {
+	withoutUploadRetryDelay(t)
+	calls := 0
+	resp, err := retryMediaUpload(log.Sub("Test"), "TESTID", func() (*mautrix.RespMediaUpload, error) {
+		calls++
+		if calls < 3 {
+			return nil, httpStatusError(http.StatusBadGateway)
+		}
+		return &mautrix.RespMediaUpload{}, nil
+	})
+	if err != nil || resp == nil {
+		t.Fatalf("expected upload to succeed after retrying, got %v", err)
+	} else if calls != 3 {
+		t.Errorf("expected 3 upload attempts, got %d", calls)
+	}
+}
+
+func TestRetryMediaUploadPermanentError(t *testing.T) {
+	withoutUploadRetryDelay(t)
+	calls := 0
+	_, err := retryMediaUpload(log.Sub("Test"), "TESTID", func() (*mautrix.RespMediaUpload, error) {
+		calls++
+		return nil, httpStatusError(http.StatusRequestEntityTooLarge)
+	})
+	if err == nil {
+		t.Fatal("expected upload to fail")
+	} else if calls != 1 {
+		t.Errorf("expected permanent errors not to be retried, got %d attempts", calls)
+	}
+}
+
+func TestSummarizeMessage(t *testing.T) {
+	text := "Hello, World!"
+	long := strings.Repeat("ä", messageSummaryBodyLength+10)
+	tests := []struct {
+		name     string
+		msg      *waProto.Message
+		expected string
+	}{
+		{"text", &waProto.Message{Conversation: &text}, "m.text: Hello, World!"},
+		{"extended text", &waProto.Message{ExtendedTextMessage: &waProto.ExtendedTextMessage{Text: &text}}, "m.text: Hello, World!"},
+		{"image with caption", &waProto.Message{ImageMessage: &waProto.ImageMessage{Caption: &text}}, "m.image: Hello, World!"},
+		{"audio", &waProto.Message{AudioMessage: &waProto.AudioMessage{}}, "m.audio"},
+		{"long text", &waProto.Message{Conversation: &long}, "m.text: " + long[:messageSummaryBodyLength*2] + "…"},
+		{"unknown", &waProto.Message{}, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if summary := summarizeMessage(test.msg); summary != test.expected {
+				t.Errorf("summarizeMessage() = %q, expected %q", summary, test.expected)
+			}
+		})
+	}
+}
+
+func TestUnwrapViewOnceDoesntModifyOriginal(t *testing.T) {
+	image := &waProto.ImageMessage{}
+	original := &waProto.WebMessageInfo{Message: &waProto.Message{
+		ViewOnceMessage: &waProto.FutureProofMessage{Message: &waProto.Message{ImageMessage: image}},
+	}}
+	unwrapped := unwrapViewOnce(original)
+	if unwrapped == nil || !unwrapped.GetMessage().GetImageMessage().GetViewOnce() {
+		t.Fatalf("Expected unwrapped image to be marked as view-once, got %+v", unwrapped)
+	} else if image.ViewOnce != nil {
+		t.Error("unwrapViewOnce modified the original message")
+	}
+}
+
+func TestHistoryBatchOnlyForOlderHistory(t *testing.T) {
+	bridge := newTestBridge(t)
+	bridge.Config.Bridge.HistoryMethod = "batch"
+	dbPortal := bridge.DB.Portal.New()
+	dbPortal.MXID = "!portal:example.com"
+	dbPortal.FirstEventID = "$first"
+	portal := &Portal{Portal: dbPortal, bridge: bridge, log: log.Sub("Test")}
+
+	if portal.queueHistoryEvent(nil, event.EventMessage, &event.Content{}, 1000) != nil {
+		t.Error("Event was queued without a history batch")
+	}
+	// Messages newer than the first event, like missed messages after the last bridged one, must be sent normally
+	if portal.startHistoryBatch("$last-bridged", "") {
+		t.Error("History batch was started after an event other than the first one")
+	}
+	if !portal.startHistoryBatch("$first", "") {
+		t.Fatal("History batch wasn't started before the first event")
+	}
+	if resp := portal.queueHistoryEvent(nil, event.EventMessage, &event.Content{}, 1000); resp == nil || !isPendingEventID(resp.EventID) {
+		t.Errorf("Expected event to be queued with a placeholder ID, got %+v", resp)
+	}
+
+	atomic.StoreInt32(&bridge.batchSendUnsupported, 1)
+	portal.historyBatch = nil
+	if portal.startHistoryBatch("$first", "") {
+		t.Error("History batch was started even though the homeserver doesn't support batch sending")
+	}
+}
+
+func TestHandleHistoryCountsOnlyHandledMessages(t *testing.T) {
+	bridge := newTestBridge(t)
+	dbPortal := bridge.DB.Portal.New()
+	dbPortal.Key = database.GroupPortalKey("15551234567-1600000000@g.us")
+	dbPortal.MXID = "!portal:example.com"
+	dbPortal.Insert()
+	portal := &Portal{Portal: dbPortal, bridge: bridge, log: log.Sub("Test")}
+
+	existing := bridge.DB.Message.New()
+	existing.Chat = portal.Key
+	existing.JID = "ALREADYBRIDGED"
+	existing.MXID = "$bridged"
+	existing.Sent = true
+	existing.Insert()
+
+	chatJID, msgID, sender, text := portal.Key.JID, existing.JID, "15559876543@s.whatsapp.net", "Hello"
+	timestamp := uint64(time.Now().Unix())
+	history := []interface{}{
+		"not a message",
+		&waProto.WebMessageInfo{
+			Key:              &waProto.MessageKey{RemoteJid: &chatJID, Id: &msgID, Participant: &sender},
+			MessageTimestamp: &timestamp,
+			Message:          &waProto.Message{Conversation: &text},
+		},
+	}
+	if handled := portal.handleHistory(nil, history); handled != 0 {
+		t.Errorf("Expected duplicates and non-messages not to be counted, got %d handled messages", handled)
+	}
+}
+
+func TestSyncGroupParticipants(t *testing.T) {
+	const (
+		alice = "15550000001@s.whatsapp.net"
+		bob   = "15550000002@s.whatsapp.net"
+		carol = "15550000003@s.whatsapp.net"
+		dave  = "15550000004@s.whatsapp.net"
+		erin  = "15550000005@s.whatsapp.net"
+	)
+	tests := []struct {
+		name         string
+		participants string
+		// joinedBefore and levelsBefore are the puppets in the room and their power levels before the sync
+		joinedBefore []whatsapp.JID
+		levelsBefore map[whatsapp.JID]int
+		joined       []whatsapp.JID
+		kicked       []whatsapp.JID
+		levels       map[whatsapp.JID]int
+	}{{
+		name: "new group",
+		participants: `[{"id": "` + alice + `", "isAdmin": true, "isSuperAdmin": true}, {"id": "` + bob + `", "isAdmin": true},
+			{"id": "` + carol + `"}, {"id": "` + dave + `"}]`,
+		joined: []whatsapp.JID{alice, bob, carol, dave},
+		levels: map[whatsapp.JID]int{alice: 75, bob: 50, carol: 0, dave: 0},
+	}, {
+		name:         "participant left and admin demoted",
+		participants: `[{"id": "` + alice + `", "isAdmin": true, "isSuperAdmin": true}, {"id": "` + bob + `"}, {"id": "` + dave + `"}]`,
+		joinedBefore: []whatsapp.JID{alice, bob, erin},
+		levelsBefore: map[whatsapp.JID]int{alice: 75, bob: 50, erin: 50},
+		joined:       []whatsapp.JID{alice, bob, dave},
+		kicked:       []whatsapp.JID{erin},
+		levels:       map[whatsapp.JID]int{alice: 75, bob: 0, dave: 0},
+	}, {
+		name:         "admin promoted to superadmin",
+		participants: `[{"id": "` + alice + `", "isAdmin": true}, {"id": "` + bob + `", "isAdmin": true, "isSuperAdmin": true}, {"id": "` + dave + `"}]`,
+		joinedBefore: []whatsapp.JID{alice, bob, dave},
+		levelsBefore: map[whatsapp.JID]int{alice: 75, bob: 50},
+		joined:       []whatsapp.JID{alice, bob, dave},
+		levels:       map[whatsapp.JID]int{alice: 50, bob: 75, dave: 0},
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			bridge := newTestBridge(t)
+			hs := connectTestHomeserver(t, bridge)
+			dbPortal := bridge.DB.Portal.New()
+			dbPortal.Key = database.GroupPortalKey("15550000001-1600000000@g.us")
+			dbPortal.MXID = "!group:example.com"
+			dbPortal.Insert()
+			portal := &Portal{Portal: dbPortal, bridge: bridge, log: log.Sub("Test")}
+
+			dbUser := bridge.DB.User.New()
+			dbUser.MXID = "@dave:example.com"
+			dbUser.JID = dave
+			dbUser.Insert()
+			source := bridge.GetUserByJID(dave)
+			for _, jid := range []whatsapp.JID{alice, bob, carol, dave, erin} {
+				// Puppets with a name don't need to be synced through the WhatsApp connection
+				bridge.GetPuppetByJID(jid).Displayname = jid
+			}
+			hs.joined[bridge.Bot.UserID] = true
+			for _, jid := range test.joinedBefore {
+				hs.joined[bridge.FormatPuppetMXID(jid)] = true
+				bridge.StateStore.SetMembership(portal.MXID, bridge.FormatPuppetMXID(jid), event.MembershipJoin)
+			}
+			if test.levelsBefore != nil {
+				hs.powerLevels = portal.GetBasePowerLevels()
+				for jid, level := range test.levelsBefore {
+					hs.powerLevels.SetUserLevel(bridge.FormatPuppetMXID(jid), level)
+				}
+			}
+
+			var metadata whatsapp.GroupInfo
+			if err := json.Unmarshal([]byte(`{"participants": `+test.participants+`}`), &metadata); err != nil {
+				t.Fatal("Failed to parse participants:", err)
+			}
+			portal.SyncParticipants(source, &metadata)
+
+			var expectedJoined []id.UserID
+			for _, jid := range test.joined {
+				expectedJoined = append(expectedJoined, bridge.FormatPuppetMXID(jid))
+			}
+			expectedJoined = append(expectedJoined, bridge.Bot.UserID)
+			if len(hs.joined) != len(expectedJoined) {
+				t.Errorf("Expected %d room members, got %v", len(expectedJoined), hs.joined)
+			}
+			for _, userID := range expectedJoined {
+				if !hs.joined[userID] {
+					t.Errorf("Expected %s to be in the room", userID)
+				}
+			}
+			for _, jid := range test.kicked {
+				if !hs.kicked[bridge.FormatPuppetMXID(jid)] {
+					t.Errorf("Expected %s to be kicked", jid)
+				}
+			}
+			if !hs.invited[source.MXID] {
+				t.Errorf("Expected the Matrix user of %s to be invited", dave)
+			}
+
+			if hs.powerLevels == nil {
+				t.Fatal("Power levels weren't set")
+			} else if level := hs.powerLevels.GetUserLevel(bridge.Bot.UserID); level != 100 {
+				t.Errorf("Expected bridge bot to keep power level 100, got %d", level)
+			}
+			for jid, expected := range test.levels {
+				if level := hs.powerLevels.GetUserLevel(bridge.FormatPuppetMXID(jid)); level != expected {
+					t.Errorf("Expected puppet of %s to have power level %d, got %d", jid, expected, level)
+				}
+			}
+			if level := hs.powerLevels.GetUserLevel(source.MXID); level != test.levels[dave] {
+				t.Errorf("Expected Matrix user of %s to have the same power level as their puppet, got %d", dave, level)
+			}
+		})
+	}
+}
+
+func TestWhatsAppKickOfBridgeUser(t *testing.T) {
+	const (
+		admin = "15550000001@s.whatsapp.net"
+		dave  = "15550000004@s.whatsapp.net"
+	)
+	for _, archive := range []bool{false, true} {
+		t.Run(fmt.Sprintf("archive=%t", archive), func(t *testing.T) {
+			bridge := newTestBridge(t)
+			hs := connectTestHomeserver(t, bridge)
+			bridge.Config.Bridge.ArchiveRemovedGroups = archive
+			dbPortal := bridge.DB.Portal.New()
+			dbPortal.Key = database.GroupPortalKey("15550000001-1600000000@g.us")
+			dbPortal.MXID = "!group:example.com"
+			dbPortal.Name = "Test group"
+			dbPortal.Insert()
+			portal := &Portal{Portal: dbPortal, bridge: bridge, log: log.Sub("Test")}
+
+			dbUser := bridge.DB.User.New()
+			dbUser.MXID = "@dave:example.com"
+			dbUser.JID = dave
+			dbUser.ManagementRoom = "!management:example.com"
+			dbUser.Insert()
+			user := bridge.GetUserByJID(dave)
+			bridge.GetPuppetByJID(admin).Displayname = "Admin"
+			hs.joined[user.MXID] = true
+
+			portal.HandleWhatsAppKick(nil, admin, []string{dave})
+
+			var notice string
+			for deadline := time.Now().Add(5 * time.Second); len(notice) == 0 && time.Now().Before(deadline); {
+				time.Sleep(10 * time.Millisecond)
+				hs.lock.Lock()
+				for _, evt := range hs.sent {
+					if evt.Sender == bridge.Bot.UserID && evt.Type == event.EventMessage.Type {
+						notice, _ = evt.Content["body"].(string)
+					}
+				}
+				hs.lock.Unlock()
+			}
+			hs.lock.Lock()
+			defer hs.lock.Unlock()
+			if len(notice) == 0 {
+				t.Fatal("Expected the removed user to get a notice")
+			} else if strings.Contains(notice, "archived") != archive {
+				t.Errorf("Unexpected notice for archive=%t: %q", archive, notice)
+			}
+			if !hs.kicked[bridge.FormatPuppetMXID(dave)] {
+				t.Error("Expected the puppet of the removed user to be kicked")
+			}
+			if hs.kicked[user.MXID] == archive {
+				t.Errorf("Expected Matrix user to be kicked: %t, got %t", !archive, hs.kicked[user.MXID])
+			}
+		})
+	}
+}
+
+func TestGroupMessageSenderIntent(t *testing.T) {
+	bridge := newTestBridge(t)
+	connectTestHomeserver(t, bridge)
+	dbPortal := bridge.DB.Portal.New()
+	dbPortal.Key = database.GroupPortalKey("15550000001-1600000000@g.us")
+	dbPortal.MXID = "!group:example.com"
+	portal := &Portal{Portal: dbPortal, bridge: bridge, log: log.Sub("Test")}
+	dbUser := bridge.DB.User.New()
+	dbUser.MXID = "@dave:example.com"
+	dbUser.JID = "15550000004@s.whatsapp.net"
+	source := &User{User: dbUser, bridge: bridge, log: log.Sub("Test")}
+	for _, jid := range []whatsapp.JID{"15550000001@s.whatsapp.net", "15550000002@s.whatsapp.net", "15550000003@s.whatsapp.net", dbUser.JID} {
+		bridge.GetPuppetByJID(jid).Displayname = jid
+	}
+
+	participant := "15550000002@s.whatsapp.net"
+	keyParticipant := "15550000003@c.us"
+	tests := []struct {
+		name     string
+		info     whatsapp.MessageInfo
+		expected id.UserID
+	}{
+		{"sender JID", whatsapp.MessageInfo{SenderJid: "15550000001@s.whatsapp.net", Source: &waProto.WebMessageInfo{}}, "@whatsapp_15550000001:example.com"},
+		{"participant", whatsapp.MessageInfo{Source: &waProto.WebMessageInfo{Participant: &participant}}, "@whatsapp_15550000002:example.com"},
+		{"old suffix in key", whatsapp.MessageInfo{Source: &waProto.WebMessageInfo{Key: &waProto.MessageKey{Participant: &keyParticipant}}}, "@whatsapp_15550000003:example.com"},
+		{"from me", whatsapp.MessageInfo{FromMe: true, Source: &waProto.WebMessageInfo{}}, "@whatsapp_15550000004:example.com"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if intent := portal.getMessageIntent(source, test.info); intent == nil || intent.UserID != test.expected {
+				t.Errorf("Expected message to be sent as %s, got %+v", test.expected, intent)
+			}
+		})
+	}
+	if intent := portal.getMessageIntent(source, whatsapp.MessageInfo{Source: &waProto.WebMessageInfo{}}); intent != nil {
+		t.Errorf("Expected message without a sender to be dropped, got intent for %s", intent.UserID)
+	}
+}
+
+func TestFlushPendingMetaChanges(t *testing.T) {
+	bridge := newTestBridge(t)
+	dbPortal := bridge.DB.Portal.New()
+	dbPortal.Key = database.GroupPortalKey("15550000001-1600000000@g.us")
+	portal := &Portal{Portal: dbPortal, bridge: bridge, log: log.Sub("Test")}
+	// The sender isn't connected, so the change is dropped instead of being sent to WhatsApp
+	sender := &User{User: bridge.DB.User.New(), bridge: bridge, log: log.Sub("Test")}
+	portal.HandleMatrixMeta(sender, &event.Event{ID: "$name", Type: event.StateRoomName, Content: event.Content{
+		Parsed: &event.RoomNameEventContent{Name: "New name"},
+	}})
+
+	portal.flushPendingMetaChanges()
+	portal.metaChangeLock.Lock()
+	defer portal.metaChangeLock.Unlock()
+	if portal.pendingMetaChanges != nil || portal.metaChangeTimer != nil {
+		t.Errorf("Expected pending changes to be flushed immediately, still have %+v", portal.pendingMetaChanges)
+	}
+}
+
+func TestReplyFallbackFromSummary(t *testing.T) {
+	bridge := newTestBridge(t)
+	connectTestHomeserver(t, bridge)
+	dbPortal := bridge.DB.Portal.New()
+	dbPortal.Key = database.GroupPortalKey("15550000001-1600000000@g.us")
+	dbPortal.MXID = "!group:example.com"
+	dbPortal.Insert()
+	portal := &Portal{Portal: dbPortal, bridge: bridge, log: log.Sub("Test")}
+	for _, msg := range []struct {
+		jid, mxid, summary string
+	}{{"WITHSUMMARY", "$with-summary", "m.image: Look at this"}, {"NOSUMMARY", "$no-summary", ""}} {
+		dbMsg := bridge.DB.Message.New()
+		dbMsg.Chat = portal.Key
+		dbMsg.JID = msg.jid
+		dbMsg.MXID = id.EventID(msg.mxid)
+		dbMsg.Sender = "15550000002@s.whatsapp.net"
+		dbMsg.Sent = true
+		dbMsg.Summary = msg.summary
+		dbMsg.Insert()
+	}
+
+	// The fake homeserver can't return events, so the reply fallback must be built from the stored summary
+	content := &event.MessageEventContent{MsgType: event.MsgText, Body: "Nice"}
+	portal.SetReply(content, whatsapp.ContextInfo{QuotedMessageID: "WITHSUMMARY"})
+	if content.GetReplyTo() != "$with-summary" {
+		t.Fatalf("Expected reply to $with-summary, got %+v", content.RelatesTo)
+	} else if expected := "> <@whatsapp_15550000002:example.com> Look at this\n\nNice"; content.Body != expected {
+		t.Errorf("Expected reply fallback %q, got %q", expected, content.Body)
+	}
+
+	// Old messages without a summary are bridged without a reply
+	content = &event.MessageEventContent{MsgType: event.MsgText, Body: "Nice"}
+	portal.SetReply(content, whatsapp.ContextInfo{QuotedMessageID: "NOSUMMARY"})
+	if content.RelatesTo != nil || content.Body != "Nice" {
+		t.Errorf("Expected message without a summary not to get a reply, got %+v", content)
+	}
+}
+
+func TestRedactAfterExpiryDeletesMessage(t *testing.T) {
+	bridge := newTestBridge(t)
+	connectTestHomeserver(t, bridge)
+	dbPortal := bridge.DB.Portal.New()
+	dbPortal.Key = database.NewPortalKey("15550000001@s.whatsapp.net", "15550000009@s.whatsapp.net")
+	dbPortal.MXID = "!disappearing:example.com"
+	dbPortal.Insert()
+	portal := &Portal{Portal: dbPortal, bridge: bridge, log: log.Sub("Test")}
+	dbMsg := bridge.DB.Message.New()
+	dbMsg.Chat = portal.Key
+	dbMsg.JID = "DISAPPEARING"
+	dbMsg.MXID = "$disappearing"
+	dbMsg.Sent = true
+	dbMsg.Insert()
+
+	portal.redactAfterExpiry(dbMsg.MXID, time.Now().Unix()-1)
+	if msg := bridge.DB.Message.GetByMXID(dbMsg.MXID); msg != nil {
+		t.Errorf("Expected expired message to be deleted after redacting it, got %+v", msg)
+	}
+}
+
+func TestMatrixInviteWithoutConnection(t *testing.T) {
+	bridge := newTestBridge(t)
+	hs := connectTestHomeserver(t, bridge)
+	dbPortal := bridge.DB.Portal.New()
+	dbPortal.Key = database.GroupPortalKey("15550000001-1600000000@g.us")
+	dbPortal.MXID = "!group:example.com"
+	dbPortal.Insert()
+	portal := &Portal{Portal: dbPortal, bridge: bridge, log: log.Sub("Test")}
+	sender := bridge.GetUserByMXID("@alice:example.com")
+	puppet := bridge.GetPuppetByJID("15550000002@s.whatsapp.net")
+	puppet.Displayname = "Bob"
+
+	stateKey := string(puppet.MXID)
+	portal.HandleMatrixInvite(sender, &event.Event{StateKey: &stateKey, Sender: sender.MXID})
+	if len(hs.sent) != 1 {
+		t.Fatalf("Expected a failure notice to be sent, got %+v", hs.sent)
+	} else if body, _ := hs.sent[0].Content["body"].(string); !strings.Contains(body, errNotConnected.Error()) {
+		t.Errorf("Expected failure notice to say the user isn't connected, got %q", body)
+	}
+}
@@ -192,6 +192,8 @@ func (prov *ProvisioningAPI) Reconnect(w http.ResponseWriter, r *http.Request) {
 
 	user.log.Debugln("Received /reconnect request, disconnecting")
 	wasConnected := true
+	// A manual reconnect replaces any automatic reconnection attempts
+	user.resetReconnectBackoff()
 	err := user.Conn.Disconnect()
 	if err == whatsapp.ErrNotConnected {
 		wasConnected = false
@@ -425,8 +427,8 @@ func (prov *ProvisioningAPI) Login(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	user.log.Debugln("Successful login as", jid, "via provisioning API")
-	user.ConnectionErrors = 0
-	user.JID = strings.Replace(jid, whatsapp.OldUserSuffix, whatsapp.NewUserSuffix, 1)
+	user.resetReconnectBackoff()
+	user.JID = NormalizeJID(jid)
 	user.addToJIDMap()
 	user.SetSession(&session)
 	_ = c.WriteJSON(map[string]interface{}{
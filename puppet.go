@@ -18,10 +18,12 @@ package main
 
 import (
 	"fmt"
+	"math/rand"
 	"net/http"
 	"regexp"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/Rhymen/go-whatsapp"
 
@@ -37,8 +39,8 @@ var userIDRegex *regexp.Regexp
 func (bridge *Bridge) ParsePuppetMXID(mxid id.UserID) (whatsapp.JID, bool) {
 	if userIDRegex == nil {
 		userIDRegex = regexp.MustCompile(fmt.Sprintf("^@%s:%s$",
-			bridge.Config.Bridge.FormatUsername("([0-9]+)"),
-			bridge.Config.Homeserver.Domain))
+			bridge.Config.Bridge.FormatUsernameRegex("([0-9]+)"),
+			regexp.QuoteMeta(bridge.Config.Homeserver.Domain)))
 	}
 	match := userIDRegex.FindStringSubmatch(string(mxid))
 	if match == nil || len(match) != 2 {
@@ -49,6 +51,15 @@ func (bridge *Bridge) ParsePuppetMXID(mxid id.UserID) (whatsapp.JID, bool) {
 	return jid, true
 }
 
+// isInPuppetNamespace checks that the MXID generated for the given JID is in the appservice's user namespace.
+func (bridge *Bridge) isInPuppetNamespace(jid whatsapp.JID) bool {
+	if GetJIDType(jid) != JIDTypeUser || !IsValidJID(jid) {
+		return false
+	}
+	parsedJID, ok := bridge.ParsePuppetMXID(bridge.FormatPuppetMXID(jid))
+	return ok && parsedJID == jid
+}
+
 func (bridge *Bridge) GetPuppetByMXID(mxid id.UserID) *Puppet {
 	jid, ok := bridge.ParsePuppetMXID(mxid)
 	if !ok {
@@ -58,7 +69,20 @@ func (bridge *Bridge) GetPuppetByMXID(mxid id.UserID) *Puppet {
 	return bridge.GetPuppetByJID(jid)
 }
 
+// GetExistingPuppetByJID is like GetPuppetByJID, but returns nil instead of creating the puppet if it doesn't exist.
+func (bridge *Bridge) GetExistingPuppetByJID(jid whatsapp.JID) *Puppet {
+	jid = NormalizeJID(jid)
+	bridge.puppetsLock.Lock()
+	_, ok := bridge.puppets[jid]
+	bridge.puppetsLock.Unlock()
+	if !ok && bridge.DB.Puppet.Get(jid) == nil {
+		return nil
+	}
+	return bridge.GetPuppetByJID(jid)
+}
+
 func (bridge *Bridge) GetPuppetByJID(jid whatsapp.JID) *Puppet {
+	jid = NormalizeJID(jid)
 	bridge.puppetsLock.Lock()
 	defer bridge.puppetsLock.Unlock()
 	puppet, ok := bridge.puppets[jid]
@@ -67,6 +91,11 @@ func (bridge *Bridge) GetPuppetByJID(jid whatsapp.JID) *Puppet {
 		if dbPuppet == nil {
 			dbPuppet = bridge.DB.Puppet.New()
 			dbPuppet.JID = jid
+			if !bridge.isInPuppetNamespace(jid) {
+				// Don't save puppets that the appservice can't control, they'd only fail later.
+				bridge.Log.Warnfln("Not saving puppet for %s: the JID isn't inside the puppet namespace", jid)
+				return bridge.NewPuppet(dbPuppet)
+			}
 			dbPuppet.Insert()
 		}
 		puppet = bridge.NewPuppet(dbPuppet)
@@ -148,8 +177,22 @@ type Puppet struct {
 	bridge *Bridge
 	log    log.Logger
 
-	typingIn id.RoomID
-	typingAt int64
+	typingIn        id.RoomID
+	typingAt        int64
+	typingStartedAt int64
+	// typingResetTimer clears a typing session that was cut off for lasting too long.
+	typingResetTimer *time.Timer
+	typingLock       sync.Mutex
+
+	lastPushName       string
+	lastPushNameUpdate time.Time
+	pendingPushName    string
+	pushNameTimer      *time.Timer
+	pushNameLock       sync.Mutex
+
+	// lastPresence and lastPresenceAt are protected by typingLock
+	lastPresence   whatsapp.Presence
+	lastPresenceAt int64
 
 	MXID id.UserID
 
@@ -160,8 +203,88 @@ type Puppet struct {
 	syncLock sync.Mutex
 }
 
+func (puppet *Puppet) isTyping() bool {
+	return len(puppet.typingIn) > 0 && puppet.typingAt+int64(puppet.bridge.Config.Bridge.TypingTimeout) > time.Now().Unix()
+}
+
+// stopTyping clears the typing notification of the puppet and returns whether it was still being shown.
+// The caller must hold typingLock.
+func (puppet *Puppet) stopTyping() bool {
+	if len(puppet.typingIn) == 0 {
+		return false
+	}
+	wasTyping := puppet.isTyping()
+	if wasTyping {
+		portal := puppet.bridge.GetPortalByMXID(puppet.typingIn)
+		_, _ = puppet.IntentFor(portal).UserTyping(puppet.typingIn, false, 0)
+	}
+	puppet.typingIn = ""
+	puppet.typingAt = 0
+	puppet.typingStartedAt = 0
+	if puppet.typingResetTimer != nil {
+		puppet.typingResetTimer.Stop()
+		puppet.typingResetTimer = nil
+	}
+	return wasTyping
+}
+
+// clearPresence stops the typing notification of the puppet and sets it offline if it was seen online.
+func (puppet *Puppet) clearPresence() {
+	puppet.typingLock.Lock()
+	defer puppet.typingLock.Unlock()
+	puppet.stopTyping()
+	if len(puppet.lastPresence) > 0 && puppet.lastPresence != whatsapp.PresenceUnavailable {
+		err := puppet.DefaultIntent().SetPresence("offline")
+		if err != nil {
+			puppet.log.Warnln("Failed to set presence to offline:", err)
+		}
+		puppet.lastPresence = whatsapp.PresenceUnavailable
+	}
+}
+
+// startTyping shows or renews the typing notification of the puppet in the given portal.
+// The caller must hold typingLock.
+func (puppet *Puppet) startTyping(portal *Portal) {
+	now := time.Now().Unix()
+	timeout := int64(puppet.bridge.Config.Bridge.TypingTimeout)
+	maxDuration := int64(puppet.bridge.Config.Bridge.MaxTypingDuration)
+	if puppet.typingIn != portal.MXID || (puppet.typingAt != 0 && !puppet.isTyping()) {
+		// New typing session, either in a different room or after the previous notification expired
+		puppet.stopTyping()
+		puppet.typingIn = portal.MXID
+		puppet.typingStartedAt = now
+	} else if maxDuration > 0 && now-puppet.typingStartedAt >= maxDuration {
+		// Don't let a stuck typing notification last forever. typingIn is kept until WhatsApp says the user
+		// stopped typing or the typing timeout passes, so that further composing events don't immediately
+		// restart the notification.
+		if puppet.isTyping() {
+			_, _ = puppet.IntentFor(portal).UserTyping(portal.MXID, false, 0)
+		}
+		puppet.typingAt = 0
+		if puppet.typingResetTimer == nil {
+			startedAt := puppet.typingStartedAt
+			puppet.typingResetTimer = time.AfterFunc(time.Duration(timeout)*time.Second, func() {
+				puppet.typingLock.Lock()
+				defer puppet.typingLock.Unlock()
+				if puppet.typingIn == portal.MXID && puppet.typingStartedAt == startedAt {
+					puppet.stopTyping()
+				}
+			})
+		}
+		return
+	} else if puppet.typingAt != 0 && now-puppet.typingAt < timeout/2 {
+		// Renewed recently enough
+		return
+	}
+	puppet.typingAt = now
+	// Add a bit of jitter so that notifications from many puppets don't all expire at the same time
+	timeoutMS := timeout * 1000
+	timeoutMS += rand.Int63n(timeoutMS/10 + 1)
+	_, _ = puppet.IntentFor(portal).UserTyping(portal.MXID, true, timeoutMS)
+}
+
 func (puppet *Puppet) PhoneNumber() string {
-	return strings.Replace(puppet.JID, whatsapp.NewUserSuffix, "", 1)
+	return JIDToPhoneNumber(puppet.JID)
 }
 
 func (puppet *Puppet) IntentFor(portal *Portal) *appservice.IntentAPI {
@@ -195,6 +318,8 @@ func (puppet *Puppet) UpdateAvatar(source *User, avatar *whatsapp.ProfilePicInfo
 		avatar.Tag = "remove"
 		avatar.Status = 0
 	} else if avatar.Status == 401 && puppet.Avatar != "unauthorized" {
+		// The contact's privacy settings hide the picture from us. Keep whatever avatar the puppet already has
+		// and only remember the state, so that the picture isn't requested again on every sync.
 		puppet.Avatar = "unauthorized"
 		return true
 	}
@@ -206,6 +331,7 @@ func (puppet *Puppet) UpdateAvatar(source *User, avatar *whatsapp.ProfilePicInfo
 		err := puppet.DefaultIntent().SetAvatarURL(id.ContentURI{})
 		if err != nil {
 			puppet.log.Warnln("Failed to remove avatar:", err)
+			return false
 		}
 		puppet.AvatarURL = id.ContentURI{}
 		puppet.Avatar = avatar.Tag
@@ -226,11 +352,13 @@ func (puppet *Puppet) UpdateAvatar(source *User, avatar *whatsapp.ProfilePicInfo
 		return false
 	}
 
-	puppet.AvatarURL = resp.ContentURI
-	err = puppet.DefaultIntent().SetAvatarURL(puppet.AvatarURL)
+	err = puppet.DefaultIntent().SetAvatarURL(resp.ContentURI)
 	if err != nil {
+		// Don't store the tag, so that setting the avatar is retried on the next sync
 		puppet.log.Warnln("Failed to set avatar:", err)
+		return false
 	}
+	puppet.AvatarURL = resp.ContentURI
 	puppet.Avatar = avatar.Tag
 	go puppet.updatePortalAvatar()
 	return true
@@ -253,6 +381,62 @@ func (puppet *Puppet) UpdateName(source *User, contact whatsapp.Contact) bool {
 	return false
 }
 
+// pushNameUpdateInterval is the minimum time between checking push names for the same puppet.
+const pushNameUpdateInterval = 1 * time.Minute
+
+// UpdatePushName updates the puppet's name if the push name in an incoming message differs from the known one.
+// The contact store is updated too, so that the next full sync doesn't revert the name. If the name changes again
+// within pushNameUpdateInterval, the latest name is applied once the interval has passed.
+func (puppet *Puppet) UpdatePushName(source *User, pushName string) {
+	puppet.pushNameLock.Lock()
+	if pushName == puppet.lastPushName {
+		// The name was changed back before a pending update was applied
+		puppet.pendingPushName = ""
+		puppet.pushNameLock.Unlock()
+		return
+	} else if wait := pushNameUpdateInterval - time.Since(puppet.lastPushNameUpdate); wait > 0 {
+		puppet.pendingPushName = pushName
+		if puppet.pushNameTimer == nil {
+			puppet.pushNameTimer = time.AfterFunc(wait, func() {
+				puppet.applyPendingPushName(source)
+			})
+		}
+		puppet.pushNameLock.Unlock()
+		return
+	}
+	puppet.lastPushName = pushName
+	puppet.lastPushNameUpdate = time.Now()
+	puppet.pushNameLock.Unlock()
+
+	if source.Conn == nil {
+		return
+	}
+	source.Conn.Store.ContactsLock.Lock()
+	contact, ok := source.Conn.Store.Contacts[puppet.JID]
+	if !ok {
+		contact = whatsapp.Contact{JID: puppet.JID}
+	}
+	changed := contact.Notify != pushName
+	contact.Notify = pushName
+	source.Conn.Store.Contacts[puppet.JID] = contact
+	source.Conn.Store.ContactsLock.Unlock()
+	if changed {
+		puppet.log.Debugfln("Push name changed to %s, updating name", pushName)
+		puppet.UpdateName(source, contact)
+	}
+}
+
+func (puppet *Puppet) applyPendingPushName(source *User) {
+	puppet.pushNameLock.Lock()
+	pushName := puppet.pendingPushName
+	puppet.pendingPushName = ""
+	puppet.pushNameTimer = nil
+	puppet.pushNameLock.Unlock()
+	if len(pushName) > 0 {
+		puppet.UpdatePushName(source, pushName)
+	}
+}
+
 func (puppet *Puppet) updatePortalMeta(meta func(portal *Portal)) {
 	if puppet.bridge.Config.Bridge.PrivateChatPortalMeta {
 		for _, portal := range puppet.bridge.GetAllPortalsByJID(puppet.JID) {
@@ -303,10 +487,11 @@ func (puppet *Puppet) SyncContactIfNecessary(source *User) {
 	} else {
 		puppet.log.Debugfln("Syncing contact info through %s / %s because puppet has no displayname", source.MXID, source.JID)
 	}
-	puppet.Sync(source, contact)
+	puppet.Sync(source, contact, false)
 }
 
-func (puppet *Puppet) Sync(source *User, contact whatsapp.Contact) {
+// Sync updates the puppet's displayname and avatar from the given contact info and returns whether anything changed.
+func (puppet *Puppet) Sync(source *User, contact whatsapp.Contact, forceAvatar bool) bool {
 	puppet.syncLock.Lock()
 	defer puppet.syncLock.Unlock()
 	err := puppet.DefaultIntent().EnsureRegistered()
@@ -321,10 +506,11 @@ func (puppet *Puppet) Sync(source *User, contact whatsapp.Contact) {
 	update := false
 	update = puppet.UpdateName(source, contact) || update
 	// TODO figure out how to update avatars after being offline
-	if len(puppet.Avatar) == 0 || puppet.bridge.Config.Bridge.UserAvatarSync {
+	if len(puppet.Avatar) == 0 || puppet.bridge.Config.Bridge.UserAvatarSync || forceAvatar {
 		update = puppet.UpdateAvatar(source, nil) || update
 	}
 	if update {
 		puppet.Update()
 	}
+	return update
 }
@@ -21,9 +21,9 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"math/rand"
 	"net/http"
 	"sort"
-	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -64,8 +64,29 @@ type User struct {
 
 	cleanDisconnection  bool
 	batteryWarningsSent int
-	lastReconnection    int64
-	pushName            string
+	// takeoverReconnects is how many times in a row the connection was taken back from another web client,
+	// and reclaimTakeover is whether the bridge decided to take it back after the latest takeover.
+	takeoverReconnects int
+	lastTakeover       time.Time
+	reclaimTakeover    bool
+	lastReconnection   int64
+	pushName           string
+	// phoneInfo is the latest connection info that included details about the phone.
+	phoneInfo whatsapp.ConnInfo
+	// lastActivity is the unix timestamp of the last event received from WhatsApp. Access atomically.
+	lastActivity int64
+	// phoneAsleep is 1 when WhatsApp said the stream is asleep, i.e. the phone isn't reachable, and no events from
+	// the phone have been received since. Access atomically.
+	phoneAsleep int32
+	// parseErrors is the number of consecutive messages from WhatsApp that couldn't be parsed. Access atomically.
+	parseErrors int32
+	// lastKeepalive is the unix timestamp of the last successful keepalive ping. Access atomically.
+	lastKeepalive int64
+	// keepaliveFailures is the number of consecutive failed keepalive pings. Access atomically.
+	keepaliveFailures int32
+	// keepaliveStop is closed to stop the keepalive loop. It's nil when the loop isn't running.
+	keepaliveStop chan struct{}
+	keepaliveLock sync.Mutex
 
 	chatListReceived chan struct{}
 	syncPortalsDone  chan struct{}
@@ -79,8 +100,24 @@ type User struct {
 
 	mgmtCreateLock  sync.Mutex
 	connLock        sync.Mutex
+	reconnectLock   sync.Mutex
+	reconnectCtx    context.Context
 	cancelReconnect func()
 
+	errorNoticesLock sync.Mutex
+	lastErrorNotices map[string]time.Time
+	repeatedErrors   map[string]*repeatedError
+
+	// syncedContacts contains the contact info from the latest contact list updates, so that
+	// updates can be diffed to only sync the contacts that actually changed.
+	syncedContacts     map[whatsapp.JID]whatsapp.Contact
+	syncedContactsLock sync.Mutex
+
+	// editedMessages contains the IDs of messages whose edit was just received. go-whatsapp doesn't know the edit
+	// protocol message type, so it also dispatches every edit as a revocation, which must be ignored.
+	editedMessages     map[whatsapp.MessageID]struct{}
+	editedMessagesLock sync.Mutex
+
 	prevBridgeStatus *BridgeState
 }
 
@@ -147,6 +184,11 @@ func (bridge *Bridge) loadDBUser(dbUser *database.User, mxid *id.UserID) *User {
 		}
 		dbUser = bridge.DB.User.New()
 		dbUser.MXID = *mxid
+		dbUser.BridgeReceipts = bridge.Config.Bridge.DefaultBridgeReceipts
+		dbUser.BridgePresence = bridge.Config.Bridge.DefaultBridgePresence
+		dbUser.BridgeTyping = bridge.Config.Bridge.DefaultBridgeTyping
+		// IncomingPresence and IncomingTyping default to on: the global config switches are checked separately,
+		// so they shouldn't be copied into the users' own preferences.
 		dbUser.Insert()
 	}
 	user := bridge.NewUser(dbUser)
@@ -155,7 +197,9 @@ func (bridge *Bridge) loadDBUser(dbUser *database.User, mxid *id.UserID) *User {
 		bridge.usersByJID[user.JID] = user
 	}
 	if len(user.ManagementRoom) > 0 {
+		bridge.managementRoomsLock.Lock()
 		bridge.managementRooms[user.ManagementRoom] = user
+		bridge.managementRoomsLock.Unlock()
 	}
 	return user
 }
@@ -198,6 +242,9 @@ func (bridge *Bridge) NewUser(dbUser *database.User) *User {
 	return user
 }
 
+const managementRoomWelcome = "This room has been registered as your bridge management/status room. " +
+	"Send `help` to get a list of commands, or `login` to log into WhatsApp."
+
 func (user *User) GetManagementRoom() id.RoomID {
 	if len(user.ManagementRoom) == 0 {
 		user.mgmtCreateLock.Lock()
@@ -208,22 +255,34 @@ func (user *User) GetManagementRoom() id.RoomID {
 		resp, err := user.bridge.Bot.CreateRoom(&mautrix.ReqCreateRoom{
 			Topic:    "WhatsApp bridge notices",
 			IsDirect: true,
+			Invite:   []id.UserID{user.MXID},
 		})
 		if err != nil {
 			user.log.Errorln("Failed to auto-create management room:", err)
 		} else {
+			user.log.Debugln("Auto-created management room", resp.RoomID)
 			user.SetManagementRoom(resp.RoomID)
+			_, err = user.bridge.Bot.SendNotice(resp.RoomID, managementRoomWelcome)
+			if err != nil {
+				user.log.Warnln("Failed to send welcome message to new management room:", err)
+			}
 		}
 	}
 	return user.ManagementRoom
 }
 
 func (user *User) SetManagementRoom(roomID id.RoomID) {
+	user.bridge.managementRoomsLock.Lock()
+	defer user.bridge.managementRoomsLock.Unlock()
+
 	existingUser, ok := user.bridge.managementRooms[roomID]
-	if ok {
+	if ok && existingUser != user {
 		existingUser.ManagementRoom = ""
 		existingUser.Update()
 	}
+	if len(user.ManagementRoom) > 0 && user.ManagementRoom != roomID {
+		delete(user.bridge.managementRooms, user.ManagementRoom)
+	}
 
 	user.ManagementRoom = roomID
 	user.bridge.managementRooms[user.ManagementRoom] = user
@@ -277,6 +336,8 @@ func (user *User) Connect(evenIfNoSession bool) bool {
 }
 
 func (user *User) DeleteConnection() {
+	user.resetReconnectBackoff()
+	user.stopKeepalive()
 	user.connLock.Lock()
 	if user.Conn == nil {
 		user.connLock.Unlock()
@@ -293,6 +354,52 @@ func (user *User) DeleteConnection() {
 	user.connLock.Unlock()
 }
 
+// clearLocalSession forgets the WhatsApp session and closes the connection without sending a logout request,
+// so that the next login starts from a clean state.
+func (user *User) clearLocalSession() {
+	user.removeFromJIDMap()
+	// TODO clearing the JID causes a foreign key violation, which should be fixed
+	//user.JID = ""
+	user.SetSession(nil)
+	user.DeleteConnection()
+}
+
+// isLoggedOutError checks if a session restore error means that the session was definitely invalidated,
+// e.g. because the bridge was unpaired or logged out from the phone. Retrying with the same session is pointless then.
+func isLoggedOutError(err error) bool {
+	var statusResp whatsapp.StatusResponse
+	if errors.As(err, &statusResp) && statusResp.Status == 401 {
+		return true
+	}
+	return errors.Is(err, whatsapp.ErrUnpaired)
+}
+
+// handleLoggedOut forgets the session after WhatsApp invalidated it and tells the user to log in again.
+func (user *User) handleLoggedOut(err error) {
+	user.log.Warnln("Session was invalidated, clearing it:", err)
+	user.clearLocalSession()
+	user.sendMarkdownBridgeAlert("\u26a0 You were logged out of WhatsApp: the session was unpaired or " +
+		"invalidated from your phone. Use the `login` command to scan a new QR code and log in again.")
+	user.sendBridgeState(BridgeState{Error: WANotLoggedIn})
+}
+
+// isBrokenSessionError checks if a session restore error means that the stored session itself is unusable,
+// rather than WhatsApp just being temporarily unreachable.
+func isBrokenSessionError(err error) bool {
+	var statusResp whatsapp.StatusResponse
+	if errors.As(err, &statusResp) {
+		return statusResp.Status == 401 || statusResp.Status == 403
+	}
+	return errors.Is(err, whatsapp.ErrInvalidSession) || errors.Is(err, whatsapp.ErrBadRequest) || errors.Is(err, whatsapp.ErrAccessDenied)
+}
+
+func (user *User) describePushName() string {
+	if len(user.pushName) == 0 {
+		return ""
+	}
+	return fmt.Sprintf(" Logged in as %s.", user.pushName)
+}
+
 func (user *User) RestoreSession() bool {
 	if user.Session != nil {
 		user.Conn.SetSession(*user.Session)
@@ -303,23 +410,22 @@ func (user *User) RestoreSession() bool {
 			return true
 		} else if err != nil {
 			user.log.Errorln("Failed to restore session:", err)
-			if errors.Is(err, whatsapp.ErrUnpaired) {
-				user.sendMarkdownBridgeAlert("\u26a0 Failed to connect to WhatsApp: unpaired from phone. " +
-					"To re-pair your phone, log in again.")
-				user.removeFromJIDMap()
-				//user.JID = ""
-				user.SetSession(nil)
-				user.DeleteConnection()
+			if isLoggedOutError(err) {
+				user.handleLoggedOut(err)
 				return false
-			} else {
-				user.sendBridgeState(BridgeState{Error: WANotConnected})
-				user.sendMarkdownBridgeAlert("\u26a0 Failed to connect to WhatsApp. Make sure WhatsApp " +
-					"on your phone is reachable and use `reconnect` to try connecting again.")
 			}
 			user.log.Debugln("Disconnecting due to failed session restore...")
-			err = user.Conn.Disconnect()
-			if err != nil {
-				user.log.Errorln("Failed to disconnect after failed session restore:", err)
+			disconnectErr := user.Conn.Disconnect()
+			if disconnectErr != nil {
+				user.log.Errorln("Failed to disconnect after failed session restore:", disconnectErr)
+			}
+			if isBrokenSessionError(err) {
+				user.sendBridgeState(BridgeState{Error: WANotConnected})
+				user.sendMarkdownBridgeAlert("\u26a0 Failed to connect to WhatsApp: the stored session was rejected (%v). "+
+					"Use `delete-session` to forget the session and then `login` to log in again.", err)
+			} else {
+				// Network problems and the like are usually temporary, so keep the session and retry
+				go user.tryReconnect(fmt.Sprintf("Failed to connect to WhatsApp (%v)", err))
 			}
 			return false
 		}
@@ -433,8 +539,8 @@ func (user *User) Login(ce *CommandEvent) {
 	// TODO there's a bit of duplication between this and the provisioning API login method
 	//      Also between the two logout methods (commands.go and provisioning.go)
 	user.log.Debugln("Successful login as", jid, "via command")
-	user.ConnectionErrors = 0
-	user.JID = strings.Replace(jid, whatsapp.OldUserSuffix, whatsapp.NewUserSuffix, 1)
+	user.resetReconnectBackoff()
+	user.JID = NormalizeJID(jid)
 	user.addToJIDMap()
 	user.SetSession(&session)
 	ce.Reply("Successfully logged in, synchronizing chats...")
@@ -490,6 +596,7 @@ func (user *User) tryAutomaticDoublePuppeting() {
 		// Custom puppet already enabled
 		return
 	}
+	// The login has to happen after the WhatsApp login, because the puppet that gets the custom MXID depends on the JID
 	accessToken, err := puppet.loginWithSharedSecret(user.MXID)
 	if err != nil {
 		user.log.Warnln("Failed to login with shared secret:", err)
@@ -503,6 +610,42 @@ func (user *User) tryAutomaticDoublePuppeting() {
 	user.log.Infoln("Successfully automatically enabled custom puppet")
 }
 
+type NoticeLevel string
+
+const (
+	// NoticeLevelSilent only sends notices about logouts and other things that require user action.
+	NoticeLevelSilent NoticeLevel = "silent"
+	// NoticeLevelErrors additionally sends notices about connection errors.
+	NoticeLevelErrors NoticeLevel = "errors"
+	// NoticeLevelVerbose sends notices about every connection state change.
+	NoticeLevelVerbose NoticeLevel = "verbose"
+)
+
+func (level NoticeLevel) rank() int {
+	switch level {
+	case NoticeLevelSilent:
+		return 0
+	case NoticeLevelErrors:
+		return 1
+	default:
+		return 2
+	}
+}
+
+func (user *User) GetNoticeLevel() NoticeLevel {
+	switch level := NoticeLevel(user.NoticeLevel); level {
+	case NoticeLevelSilent, NoticeLevelErrors:
+		return level
+	default:
+		return NoticeLevelVerbose
+	}
+}
+
+// wantsNotice returns whether the user's notice level allows notices that require at least the given level.
+func (user *User) wantsNotice(minLevel NoticeLevel) bool {
+	return user.GetNoticeLevel().rank() >= minLevel.rank()
+}
+
 func (user *User) sendBridgeNotice(formatString string, args ...interface{}) {
 	notice := fmt.Sprintf(formatString, args...)
 	_, err := user.bridge.Bot.SendNotice(user.GetManagementRoom(), notice)
@@ -548,10 +691,110 @@ func (user *User) postConnPing() bool {
 	return false
 }
 
+// keepaliveLoop pings the phone when there haven't been any events from WhatsApp for a while and reconnects if
+// enough pings in a row aren't answered. The loop stops when the user logs out or disconnects and is started
+// again by the next login.
+func (user *User) keepaliveLoop() {
+	interval := time.Duration(user.bridge.Config.Bridge.KeepaliveInterval) * time.Second
+	timeout := time.Duration(user.bridge.Config.Bridge.KeepaliveTimeout) * time.Second
+	maxFailures := int32(user.bridge.Config.Bridge.KeepaliveMaxFailures)
+	if interval <= 0 {
+		return
+	}
+	user.keepaliveLock.Lock()
+	if user.keepaliveStop != nil {
+		user.keepaliveLock.Unlock()
+		return
+	}
+	stop := make(chan struct{})
+	user.keepaliveStop = stop
+	user.keepaliveLock.Unlock()
+	defer func() {
+		user.keepaliveLock.Lock()
+		if user.keepaliveStop == stop {
+			user.keepaliveStop = nil
+		}
+		user.keepaliveLock.Unlock()
+	}()
+	atomic.StoreInt32(&user.keepaliveFailures, 0)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			user.log.Debugln("Keepalive loop stopped")
+			return
+		case <-ticker.C:
+		}
+		conn := user.Conn
+		if conn == nil || user.Session == nil {
+			return
+		} else if !conn.IsConnected() || !conn.IsLoggedIn() || atomic.LoadInt32(&user.syncing) == 1 {
+			// Reconnecting is handled elsewhere
+			continue
+		} else if sinceActivity, ok := user.LastActivity(); ok && sinceActivity < interval {
+			atomic.StoreInt32(&user.keepaliveFailures, 0)
+			continue
+		} else if atomic.LoadInt32(&user.phoneAsleep) == 1 {
+			// Pings go through the phone, so they can't succeed while it's offline. The websocket itself is
+			// still checked by go-whatsapp, which reports ErrWebsocketKeepaliveFailed if it dies.
+			continue
+		}
+		user.log.Debugln("No events from WhatsApp in a while, sending keepalive ping")
+		result := make(chan error, 1)
+		go func() {
+			result <- conn.AdminTest()
+		}()
+		var err error
+		select {
+		case err = <-result:
+		case <-time.After(timeout):
+			err = fmt.Errorf("no response in %s", timeout)
+		case <-stop:
+			user.log.Debugln("Keepalive loop stopped")
+			return
+		}
+		if err == nil {
+			now := time.Now().Unix()
+			atomic.StoreInt64(&user.lastActivity, now)
+			atomic.StoreInt64(&user.lastKeepalive, now)
+			atomic.StoreInt32(&user.keepaliveFailures, 0)
+			continue
+		} else if user.Conn != conn {
+			return
+		}
+		failures := atomic.AddInt32(&user.keepaliveFailures, 1)
+		if failures < maxFailures {
+			user.log.Warnfln("Keepalive ping failed (%d/%d): %v", failures, maxFailures, err)
+			continue
+		}
+		user.log.Warnfln("%d keepalive pings failed in a row, reconnecting: %v", failures, err)
+		atomic.StoreInt32(&user.keepaliveFailures, 0)
+		disconnectErr := conn.Disconnect()
+		if disconnectErr != nil && disconnectErr != whatsapp.ErrNotConnected {
+			user.log.Warnln("Failed to disconnect after keepalive ping failed:", disconnectErr)
+		}
+		user.sendBridgeState(BridgeState{Error: WANotConnected})
+		user.bridge.Metrics.TrackDisconnection(user.MXID)
+		go user.tryReconnect(fmt.Sprintf("WhatsApp didn't respond to %d keepalive pings (%v)", failures, err))
+	}
+}
+
+// stopKeepalive stops the keepalive loop if it's running.
+func (user *User) stopKeepalive() {
+	user.keepaliveLock.Lock()
+	if user.keepaliveStop != nil {
+		close(user.keepaliveStop)
+		user.keepaliveStop = nil
+	}
+	user.keepaliveLock.Unlock()
+}
+
 func (user *User) intPostLogin() {
 	defer atomic.StoreInt32(&user.syncing, 0)
 	defer user.syncWait.Done()
 	user.lastReconnection = time.Now().Unix()
+	atomic.StoreInt32(&user.phoneAsleep, 0)
 	user.createCommunity()
 	user.tryAutomaticDoublePuppeting()
 
@@ -569,6 +812,14 @@ func (user *User) intPostLogin() {
 		user.log.Debugln("Post-connection ping failed, unlocking processing of incoming messages.")
 		return
 	}
+	go user.keepaliveLoop()
+	if !user.BridgePresence {
+		// WhatsApp Web sessions are online by default, which would reveal the user's last seen time
+		_, err := user.Conn.Presence("", whatsapp.PresenceUnavailable)
+		if err != nil {
+			user.log.Warnln("Failed to set presence to unavailable after connecting:", err)
+		}
+	}
 
 	user.log.Debugln("Waiting for portal sync complete confirmation")
 	select {
@@ -585,12 +836,29 @@ type NormalMessage interface {
 }
 
 func (user *User) HandleEvent(event interface{}) {
+	atomic.StoreInt64(&user.lastActivity, time.Now().Unix())
+	switch event.(type) {
+	case error, whatsapp.RawJSONMessage:
+		// Errors don't reset the parse error counter and raw JSON messages are checked in HandleJSONMessage
+	default:
+		atomic.StoreInt32(&user.parseErrors, 0)
+	}
+	switch event.(type) {
+	case NormalMessage, whatsapp.MessageRevocation, whatsapp.BatteryMessage, whatsapp.JSONMsgInfo, whatsapp.ConnInfo:
+		// These can only come from the phone
+		user.markPhoneAwake()
+	}
 	switch v := event.(type) {
 	case NormalMessage:
 		info := v.GetInfo()
 		user.messageInput <- PortalMessage{info.RemoteJid, user, v, info.Timestamp}
 	case whatsapp.MessageRevocation:
+		if user.isEditRevocation(v) {
+			user.log.Debugfln("Ignoring revocation of %s that was dispatched for an edit", v.Id)
+			return
+		}
 		user.messageInput <- PortalMessage{v.RemoteJid, user, v, 0}
+	// TODO handle poll votes: they're encrypted with the key from the poll creation message, which isn't stored.
 	case whatsapp.StreamEvent:
 		user.HandleStreamEvent(v)
 	case []whatsapp.Chat:
@@ -638,6 +906,22 @@ func (user *User) HandleEvent(event interface{}) {
 		user.HandleJSONMessage(v)
 	case *waProto.WebMessageInfo:
 		user.updateLastConnectionIfNecessary()
+		if v.GetMessage().GetGroupInviteMessage() != nil {
+			go user.HandleGroupInvite(v)
+		} else if unwrapped := unwrapViewOnce(v); unwrapped != nil {
+			// go-whatsapp can't parse view-once messages, so unwrap and parse them here
+			user.HandleEvent(whatsapp.ParseProtoMessage(unwrapped))
+		} else if product := parseProductMessage(v); product != nil {
+			// Business product messages aren't parsed by go-whatsapp either
+			user.HandleEvent(*product)
+		} else if poll := parsePollMessage(v); poll != nil {
+			// Polls aren't in go-whatsapp's protobuf definitions, so they're parsed from the unknown fields
+			user.HandleEvent(*poll)
+		} else if edit := parseMessageEdit(v); edit != nil {
+			// Edits aren't in the protobuf definitions either
+			user.markEditRevocation(edit.TargetID)
+			user.HandleEvent(*edit)
+		}
 		// TODO trace log
 		//user.log.Debugfln("WebMessageInfo: %+v", v)
 	case *waBinary.Node:
@@ -647,8 +931,18 @@ func (user *User) HandleEvent(event interface{}) {
 	}
 }
 
+// HandleStreamEvent handles stream state changes from the web client connection.
+//
+// A sleeping stream only means the phone isn't currently reachable, the websocket itself is still alive,
+// so it's reported as the phone being offline rather than as a disconnection. Note that the legacy web protocol
+// used by go-whatsapp doesn't support multi-device, so messages can't be sent or received until the phone comes back.
 func (user *User) HandleStreamEvent(evt whatsapp.StreamEvent) {
-	if evt.Type == whatsapp.StreamSleep {
+	switch evt.Type {
+	case whatsapp.StreamSleep:
+		if atomic.CompareAndSwapInt32(&user.phoneAsleep, 0, 1) {
+			user.log.Infoln("Stream went to sleep (phone is probably offline), keeping connection open")
+			user.sendBridgeState(BridgeState{Error: WAPhoneOffline})
+		}
 		if user.lastReconnection+60 > time.Now().Unix() {
 			user.lastReconnection = 0
 			user.log.Infoln("Stream went to sleep soon after reconnection, making new post-connection ping in 20 seconds")
@@ -659,11 +953,36 @@ func (user *User) HandleStreamEvent(evt whatsapp.StreamEvent) {
 				user.postConnPing()
 			}()
 		}
-	} else {
+	case whatsapp.StreamUpdate:
+		if evt.IsOutdated {
+			user.log.Warnfln("WhatsApp says the web client version is outdated (latest: %s)", evt.Version)
+		} else {
+			user.log.Debugfln("Stream update: %+v", evt)
+		}
+		// Stream updates are sent when the stream resumes, so the phone is reachable again
+		user.markPhoneAwake()
+	default:
 		user.log.Infofln("Stream event: %+v", evt)
 	}
 }
 
+// markPhoneAwake is called when there's an event from the phone. If the stream was asleep, the bridge state is
+// restored and the connection is checked with a ping, which reconnects if the phone doesn't respond after all.
+func (user *User) markPhoneAwake() {
+	if !atomic.CompareAndSwapInt32(&user.phoneAsleep, 1, 0) {
+		return
+	}
+	user.log.Infoln("Phone is reachable again after the stream was asleep")
+	if user.Conn == nil {
+		return
+	}
+	go func() {
+		if user.postConnPing() {
+			user.sendBridgeState(BridgeState{OK: true})
+		}
+	}()
+}
+
 func (user *User) HandleChatList(chats []whatsapp.Chat) {
 	user.log.Infoln("Chat list received")
 	chatMap := make(map[string]whatsapp.Chat)
@@ -681,7 +1000,7 @@ func (user *User) HandleChatList(chats []whatsapp.Chat) {
 	default:
 		user.log.Debugln("Failed to send chat list receive confirmation from HandleChatList, channel probably full")
 	}
-	go user.syncPortals(chatMap, false)
+	go user.syncPortals(chatMap, false, false)
 }
 
 func (user *User) updateChatMute(intent *appservice.IntentAPI, portal *Portal, mutedUntil int64) {
@@ -778,6 +1097,10 @@ func (user *User) syncChatDoublePuppetDetails(doublePuppet *Puppet, chat Chat, j
 }
 
 func (user *User) syncPortal(chat Chat) {
+	if chat.Portal.Unbridged {
+		chat.Portal.log.Debugln("Not syncing portal: portal is unbridged")
+		return
+	}
 	// Don't sync unless chat meta sync is enabled or portal doesn't exist
 	if user.bridge.Config.Bridge.ChatMetaSync || len(chat.Portal.MXID) == 0 {
 		failedToCreate := chat.Portal.Sync(user, chat.Contact)
@@ -793,7 +1116,13 @@ func (user *User) syncPortal(chat Chat) {
 
 func (user *User) collectChatList(chatMap map[string]whatsapp.Chat) ChatList {
 	if chatMap == nil {
-		chatMap = user.Conn.Store.Chats
+		// Copy the store's map so that chats being added while syncing don't cause concurrent map access
+		user.Conn.Store.ChatsLock.RLock()
+		chatMap = make(map[string]whatsapp.Chat, len(user.Conn.Store.Chats))
+		for jid, chat := range user.Conn.Store.Chats {
+			chatMap[jid] = chat
+		}
+		user.Conn.Store.ChatsLock.RUnlock()
 	}
 	user.log.Infoln("Reading chat list")
 	chats := make(ChatList, 0, len(chatMap))
@@ -829,7 +1158,9 @@ func (user *User) collectChatList(chatMap map[string]whatsapp.Chat) ChatList {
 	return chats
 }
 
-func (user *User) syncPortals(chatMap map[string]whatsapp.Chat, createAll bool) {
+// syncPortals syncs the chat list to Matrix and returns the number of portal rooms that were created.
+// If groupsOnly is set, private chats and broadcast lists are skipped.
+func (user *User) syncPortals(chatMap map[string]whatsapp.Chat, createAll, groupsOnly bool) (created int) {
 	// TODO use contexts instead of checking if user.Conn is the same?
 	connAtStart := user.Conn
 
@@ -850,12 +1181,18 @@ func (user *User) syncPortals(chatMap map[string]whatsapp.Chat, createAll bool)
 		if chat.LastMessageTime+user.bridge.Config.Bridge.SyncChatMaxAge < now {
 			break
 		}
+		if groupsOnly && GetJIDType(chat.Portal.Key.JID) != JIDTypeGroup {
+			continue
+		}
 		create := (chat.LastMessageTime >= user.LastConnection && user.LastConnection > 0) || i < limit
 		if len(chat.Portal.MXID) > 0 || create || createAll {
 			user.log.Debugfln("Syncing chat %+v", chat.Chat.Source)
 			justCreated := len(chat.Portal.MXID) == 0
 			user.syncPortal(chat)
 			user.syncChatDoublePuppetDetails(doublePuppet, chat, justCreated)
+			if justCreated && len(chat.Portal.MXID) > 0 {
+				created++
+			}
 		}
 	}
 	if user.Conn != connAtStart {
@@ -869,6 +1206,7 @@ func (user *User) syncPortals(chatMap map[string]whatsapp.Chat, createAll bool)
 	case user.syncPortalsDone <- struct{}{}:
 	default:
 	}
+	return
 }
 
 func (user *User) getDirectChats() map[id.UserID][]id.RoomID {
@@ -929,17 +1267,46 @@ func (user *User) UpdateDirectChats(chats map[id.UserID][]id.RoomID) {
 	}
 }
 
+// HandleContactList syncs the contacts in a contact list update. go-whatsapp has already updated its
+// contact store by the time this is called, so the update is diffed against the previous updates instead.
 func (user *User) HandleContactList(contacts []whatsapp.Contact) {
-	contactMap := make(map[whatsapp.JID]whatsapp.Contact)
+	changed := user.filterChangedContacts(contacts)
+	if len(changed) == 0 {
+		user.log.Debugfln("Got contact list update with %d contacts, but none of them changed", len(contacts))
+		return
+	}
+	user.log.Debugfln("Got contact list update with %d contacts, %d of which changed", len(contacts), len(changed))
+	go user.syncPuppets(changed, false)
+}
+
+// filterChangedContacts returns the contacts whose info is different from what was last synced.
+func (user *User) filterChangedContacts(contacts []whatsapp.Contact) map[whatsapp.JID]whatsapp.Contact {
+	user.syncedContactsLock.Lock()
+	defer user.syncedContactsLock.Unlock()
+	if user.syncedContacts == nil {
+		user.syncedContacts = make(map[whatsapp.JID]whatsapp.Contact, len(contacts))
+	}
+	changed := make(map[whatsapp.JID]whatsapp.Contact)
 	for _, contact := range contacts {
-		contactMap[contact.JID] = contact
+		if prev, ok := user.syncedContacts[contact.JID]; !ok || prev != contact {
+			changed[contact.JID] = contact
+			user.syncedContacts[contact.JID] = contact
+		}
 	}
-	go user.syncPuppets(contactMap)
+	return changed
 }
 
-func (user *User) syncPuppets(contacts map[whatsapp.JID]whatsapp.Contact) {
+// syncPuppets syncs contact info to puppets and returns the number of puppets whose info changed.
+// If forceAvatars is true, avatars are fetched for every contact even if avatar sync is disabled.
+func (user *User) syncPuppets(contacts map[whatsapp.JID]whatsapp.Contact, forceAvatars bool) (updated int) {
 	if contacts == nil {
-		contacts = user.Conn.Store.Contacts
+		// Copy the store's map so that contacts being added while syncing don't cause concurrent map access
+		user.Conn.Store.ContactsLock.RLock()
+		contacts = make(map[whatsapp.JID]whatsapp.Contact, len(user.Conn.Store.Contacts))
+		for jid, contact := range user.Conn.Store.Contacts {
+			contacts[jid] = contact
+		}
+		user.Conn.Store.ContactsLock.RUnlock()
 	}
 
 	_, hasSelf := contacts[user.JID]
@@ -953,15 +1320,67 @@ func (user *User) syncPuppets(contacts map[whatsapp.JID]whatsapp.Contact) {
 
 	user.log.Infoln("Syncing puppet info from contacts")
 	for jid, contact := range contacts {
-		if strings.HasSuffix(jid, whatsapp.NewUserSuffix) {
+		switch GetJIDType(jid) {
+		case JIDTypeUser:
 			puppet := user.bridge.GetPuppetByJID(contact.JID)
-			puppet.Sync(user, contact)
-		} else if strings.HasSuffix(jid, whatsapp.BroadcastSuffix) {
+			if puppet.Sync(user, contact, forceAvatars) {
+				updated++
+			}
+		case JIDTypeBroadcast, JIDTypeStatus:
 			portal := user.GetPortalByJID(contact.JID)
-			portal.Sync(user, contact)
+			if !portal.Unbridged {
+				portal.Sync(user, contact)
+			}
 		}
 	}
 	user.log.Infoln("Finished syncing puppet info from contacts")
+	return
+}
+
+// periodicContactResync refetches the contact list of every connected user at the configured interval,
+// so that puppet names and avatars don't drift from WhatsApp over long-running sessions.
+func (bridge *Bridge) periodicContactResync() {
+	interval := time.Duration(bridge.Config.Bridge.ContactResyncInterval) * time.Second
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		bridge.usersLock.Lock()
+		users := make([]*User, 0, len(bridge.usersByJID))
+		for _, user := range bridge.usersByJID {
+			users = append(users, user)
+		}
+		bridge.usersLock.Unlock()
+		for _, user := range users {
+			user.resyncContacts()
+		}
+	}
+}
+
+func (user *User) resyncContacts() {
+	if !user.IsConnected() || atomic.LoadInt32(&user.syncing) == 1 {
+		user.log.Debugln("Skipping periodic contact resync: not connected or a sync is already in progress")
+		return
+	}
+	user.log.Debugln("Fetching contact list for periodic contact resync")
+	_, err := user.Conn.Contacts()
+	if err != nil {
+		user.log.Warnln("Failed to fetch contact list for periodic resync:", err)
+		return
+	}
+	user.Conn.Store.ContactsLock.RLock()
+	contacts := make([]whatsapp.Contact, 0, len(user.Conn.Store.Contacts))
+	for _, contact := range user.Conn.Store.Contacts {
+		contacts = append(contacts, contact)
+	}
+	user.Conn.Store.ContactsLock.RUnlock()
+	changed := user.filterChangedContacts(contacts)
+	if len(changed) == 0 {
+		user.log.Debugln("Periodic contact resync found no changed contacts")
+		return
+	}
+	// The contact list doesn't include avatars, so they're refetched for the contacts that changed
+	updated := user.syncPuppets(changed, true)
+	user.log.Infofln("Periodic contact resync found %d changed contacts and updated %d puppets", len(changed), updated)
 }
 
 func (user *User) updateLastConnectionIfNecessary() {
@@ -970,22 +1389,114 @@ func (user *User) updateLastConnectionIfNecessary() {
 	}
 }
 
+type errorClass int
+
+const (
+	// errorClassHarmless errors are only logged, unless they keep repeating.
+	errorClassHarmless errorClass = iota
+	// errorClassRecoverable errors are handled automatically by reconnecting.
+	errorClassRecoverable
+	// errorClassFatal errors can't be fixed by the bridge and need the user to do something.
+	errorClassFatal
+)
+
+// errorNoticeInterval is the minimum time between two notices about the same error in the management room.
+const errorNoticeInterval = 10 * time.Minute
+
+// persistentErrorThreshold is how many times a harmless error must happen within errorNoticeInterval
+// before the user is told about it.
+const persistentErrorThreshold = 5
+
+type repeatedError struct {
+	count int
+	since time.Time
+}
+
+// classifyWhatsAppError returns the class of the error and, for fatal errors, instructions for the user.
+func classifyWhatsAppError(err error) (errorClass, string) {
+	var closed *whatsapp.ErrConnectionClosed
+	var failed *whatsapp.ErrConnectionFailed
+	switch {
+	case errors.Is(err, whatsapp.ErrUnpaired), errors.Is(err, whatsapp.ErrInvalidSession), errors.Is(err, whatsapp.ErrNotLoggedIn):
+		return errorClassFatal, "Your WhatsApp session has expired or was unpaired from the phone. Please log in again with `login`."
+	case errors.Is(err, whatsapp.ErrAccessDenied):
+		return errorClassFatal, "WhatsApp denied access to your account. Make sure WhatsApp still works on your phone, then log in again with `login`."
+	case errors.Is(err, whatsapp.ErrReplaced):
+		return errorClassFatal, "WhatsApp Web was opened somewhere else, so the bridge was disconnected. Use `reconnect` to take the connection back."
+	case errors.As(err, &closed), errors.As(err, &failed),
+		errors.Is(err, whatsapp.ErrPingFalse), errors.Is(err, whatsapp.ErrWebsocketKeepaliveFailed),
+		errors.Is(err, whatsapp.ErrConnectionTimeout), errors.Is(err, whatsapp.ErrQueryTimeout):
+		return errorClassRecoverable, ""
+	default:
+		return errorClassHarmless, ""
+	}
+}
+
+// sendErrorNotice sends an alert to the management room, unless an alert with the same key was sent recently.
+func (user *User) sendErrorNotice(key, formatString string, args ...interface{}) {
+	if !user.wantsNotice(NoticeLevelErrors) {
+		return
+	}
+	user.errorNoticesLock.Lock()
+	if user.lastErrorNotices == nil {
+		user.lastErrorNotices = make(map[string]time.Time)
+	}
+	if last, ok := user.lastErrorNotices[key]; ok && time.Since(last) < errorNoticeInterval {
+		user.errorNoticesLock.Unlock()
+		user.log.Debugfln("Not sending error notice about %s: a notice was already sent at %s", key, last)
+		return
+	}
+	user.lastErrorNotices[key] = time.Now()
+	user.errorNoticesLock.Unlock()
+	user.sendMarkdownBridgeAlert(formatString, args...)
+}
+
+// countRepeatedError returns how many times the same error has happened within errorNoticeInterval.
+func (user *User) countRepeatedError(key string) int {
+	user.errorNoticesLock.Lock()
+	defer user.errorNoticesLock.Unlock()
+	if user.repeatedErrors == nil {
+		user.repeatedErrors = make(map[string]*repeatedError)
+	}
+	repeated, ok := user.repeatedErrors[key]
+	if !ok || time.Since(repeated.since) > errorNoticeInterval {
+		repeated = &repeatedError{since: time.Now()}
+		user.repeatedErrors[key] = repeated
+	}
+	repeated.count++
+	return repeated.count
+}
+
 func (user *User) HandleError(err error) {
-	if !errors.Is(err, whatsapp.ErrInvalidWsData) {
-		user.log.Errorfln("WhatsApp error: %v", err)
+	user.log.Errorfln("WhatsApp error: %v", err)
+	user.bridge.Metrics.TrackError(fmt.Sprintf("%T", err))
+	switch class, hint := classifyWhatsAppError(err); class {
+	case errorClassFatal:
+		user.sendBridgeState(BridgeState{Error: WANotConnected})
+		user.sendErrorNotice(hint, "\u26a0 %s", hint)
+	case errorClassHarmless:
+		if user.countRepeatedError(err.Error()) >= persistentErrorThreshold {
+			user.sendErrorNotice(err.Error(), "\u26a0 WhatsApp keeps reporting errors: %v. "+
+				"If the bridge isn't working, try `reconnect`.", err)
+		}
 	}
 	if closed, ok := err.(*whatsapp.ErrConnectionClosed); ok {
 		user.bridge.Metrics.TrackDisconnection(user.MXID)
 		if closed.Code == 1000 && user.cleanDisconnection {
 			user.cleanDisconnection = false
-			if !user.bridge.Config.Bridge.AggressiveReconnect {
-				user.sendBridgeState(BridgeState{Error: WANotConnected})
-				user.bridge.Metrics.TrackConnectionState(user.JID, false)
+			user.sendBridgeState(BridgeState{Error: WANotConnected})
+			user.bridge.Metrics.TrackConnectionState(user.JID, false)
+			if !user.reclaimTakeover {
 				user.log.Infoln("Clean disconnection by server")
 				return
-			} else {
-				user.log.Debugln("Clean disconnection by server, but aggressive reconnection is enabled")
 			}
+			delay := time.Duration(user.bridge.Config.Bridge.TakeoverReconnectDelay) * time.Second
+			user.log.Infofln("Connection was taken over by another client, taking it back in %s", delay)
+			go func() {
+				time.Sleep(delay)
+				user.tryReconnect("Your WhatsApp connection was taken over by another client")
+			}()
+			return
 		}
 		go user.tryReconnect(fmt.Sprintf("Your WhatsApp connection was closed with websocket status code %d", closed.Code))
 	} else if failed, ok := err.(*whatsapp.ErrConnectionFailed); ok {
@@ -1008,82 +1519,169 @@ func (user *User) HandleError(err error) {
 	// Otherwise unknown error, probably mostly harmless
 }
 
+// reconnectDelay returns how long to wait before the given reconnection attempt (starting from 1).
+// Negative connection_retry_delay values mean exponential backoff starting from the absolute value,
+// capped at max_connection_retry_delay and with some jitter so that all users don't reconnect at once.
+func (user *User) reconnectDelay(attempt int) time.Duration {
+	baseDelay := user.bridge.Config.Bridge.ConnectionRetryDelay
+	if baseDelay >= 0 {
+		return time.Duration(baseDelay) * time.Second
+	}
+	maxDelay := time.Duration(user.bridge.Config.Bridge.MaxConnectionRetryDelay) * time.Second
+	delay := time.Duration(-baseDelay) * time.Second
+	for i := 1; i < attempt && delay < maxDelay; i++ {
+		delay *= 2
+	}
+	if maxDelay > 0 && delay > maxDelay {
+		delay = maxDelay
+	}
+	return delay + time.Duration(rand.Int63n(int64(delay)/5+1))
+}
+
+func (user *User) canRetryConnection() bool {
+	maxAttempts := user.bridge.Config.Bridge.MaxConnectionAttempts
+	return maxAttempts < 0 || user.ConnectionErrors <= maxAttempts
+}
+
+// resetReconnectBackoff stops any running reconnection loop and resets the failure counter,
+// so that the next disconnection starts from the shortest retry delay again.
+func (user *User) resetReconnectBackoff() {
+	user.reconnectLock.Lock()
+	if user.cancelReconnect != nil {
+		user.cancelReconnect()
+		user.cancelReconnect = nil
+		user.reconnectCtx = nil
+	}
+	user.reconnectLock.Unlock()
+	user.ConnectionErrors = 0
+	user.takeoverReconnects = 0
+}
+
+// takeoverStableDuration is how long the connection must stay up before taking it back from
+// another web client no longer counts towards max_takeover_reconnects.
+const takeoverStableDuration = 1 * time.Hour
+
+// handleTakeover decides whether to take the connection back after another web client replaced it,
+// and tells the user what's going to happen.
+func (user *User) handleTakeover() {
+	cfg := &user.bridge.Config.Bridge
+	if time.Since(user.lastTakeover) > takeoverStableDuration {
+		user.takeoverReconnects = 0
+	}
+	user.lastTakeover = time.Now()
+	user.reclaimTakeover = cfg.AggressiveReconnect && user.takeoverReconnects < cfg.MaxTakeoverReconnects
+	if user.reclaimTakeover {
+		user.takeoverReconnects++
+		go user.sendMarkdownBridgeAlert("\u26a0 Your WhatsApp connection was closed by the server because you opened another WhatsApp Web client.\n\n"+
+			"The bridge will take the connection back in %d seconds (attempt %d/%d). Close the other client to stop this from happening again.",
+			cfg.TakeoverReconnectDelay, user.takeoverReconnects, cfg.MaxTakeoverReconnects)
+	} else if cfg.AggressiveReconnect {
+		go user.sendMarkdownBridgeAlert("\u26a0 Your WhatsApp connection was taken over by another WhatsApp Web client %d times in a row, "+
+			"so the bridge won't take it back automatically anymore.\n\n"+
+			"Close the other client and use the `reconnect` command to resume bridging.", user.takeoverReconnects+1)
+	} else {
+		go user.sendMarkdownBridgeAlert("\u26a0 Your WhatsApp connection was closed by the server because you opened another WhatsApp Web client.\n\n" +
+			"Use the `reconnect` command to disconnect the other client and resume bridging.")
+	}
+}
+
 func (user *User) tryReconnect(msg string) {
 	user.bridge.Metrics.TrackConnectionState(user.JID, false)
-	if user.ConnectionErrors > user.bridge.Config.Bridge.MaxConnectionAttempts {
-		user.sendMarkdownBridgeAlert("%s. Use the `reconnect` command to reconnect.", msg)
+	if user.Session == nil || user.Conn == nil {
+		user.log.Debugln("Not reconnecting: user is logged out")
+		return
+	} else if !user.canRetryConnection() {
+		if user.wantsNotice(NoticeLevelErrors) {
+			user.sendMarkdownBridgeAlert("%s. Use the `reconnect` command to reconnect.", msg)
+		}
 		user.sendBridgeState(BridgeState{Error: WANotConnected})
 		return
 	}
-	if user.bridge.Config.Bridge.ReportConnectionRetry {
-		user.sendBridgeNotice("%s. Reconnecting...", msg)
-		// Don't want the same error to be repeated
-		msg = ""
-	}
-	var tries uint
-	var exponentialBackoff bool
-	baseDelay := time.Duration(user.bridge.Config.Bridge.ConnectionRetryDelay)
-	if baseDelay < 0 {
-		exponentialBackoff = true
-		baseDelay = -baseDelay + 1
-	}
-	delay := baseDelay
+
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
+	user.reconnectLock.Lock()
+	if user.cancelReconnect != nil {
+		user.reconnectLock.Unlock()
+		user.log.Debugln("Not starting another reconnection loop, one is already running")
+		return
+	}
+	user.reconnectCtx = ctx
 	user.cancelReconnect = cancel
-	for user.ConnectionErrors <= user.bridge.Config.Bridge.MaxConnectionAttempts {
-		select {
-		case <-ctx.Done():
-			user.log.Debugln("tryReconnect context cancelled, aborting reconnection attempts")
+	user.reconnectLock.Unlock()
+	defer func() {
+		user.reconnectLock.Lock()
+		if user.reconnectCtx == ctx {
+			user.cancelReconnect = nil
+			user.reconnectCtx = nil
+		}
+		user.reconnectLock.Unlock()
+	}()
+
+	reportRetries := user.bridge.Config.Bridge.ReportConnectionRetry && user.wantsNotice(NoticeLevelVerbose)
+	if reportRetries {
+		// Only one notice is sent for the whole outage, individual attempts are just logged
+		user.sendBridgeNotice("%s. Reconnecting...", msg)
+		msg = ""
+	}
+	var tries int
+	for user.canRetryConnection() {
+		conn := user.Conn
+		if ctx.Err() != nil || conn == nil {
+			user.log.Debugln("tryReconnect context cancelled or connection deleted, aborting reconnection attempts")
 			return
-		default:
 		}
 		user.sendBridgeState(BridgeState{Error: WAConnecting})
-		err := user.Conn.Restore(true, ctx)
+		err := conn.Restore(true, ctx)
 		if err == nil {
 			user.ConnectionErrors = 0
-			if user.bridge.Config.Bridge.ReportConnectionRetry {
+			if reportRetries {
 				user.sendBridgeNotice("Reconnected successfully")
 			}
 			user.PostLogin()
 			return
+		} else if ctx.Err() != nil {
+			user.log.Debugln("Reconnection attempt cancelled:", err)
+			return
 		} else if errors.Is(err, whatsapp.ErrBadRequest) {
 			user.log.Warnln("Got init 400 error when trying to reconnect, resetting connection...")
-			err = user.Conn.Disconnect()
+			err = conn.Disconnect()
 			if err != nil {
 				user.log.Debugln("Error while disconnecting for connection reset:", err)
 			}
-		} else if errors.Is(err, whatsapp.ErrUnpaired) {
+		} else if isLoggedOutError(err) {
 			user.log.Errorln("Got init 401 (unpaired) error when trying to reconnect, not retrying")
-			user.removeFromJIDMap()
-			//user.JID = ""
-			user.SetSession(nil)
-			user.DeleteConnection()
-			user.sendMarkdownBridgeAlert("\u26a0 Failed to reconnect to WhatsApp: unpaired from phone. " +
-				"To re-pair your phone, log in again.")
-			user.sendBridgeState(BridgeState{Error: WANotLoggedIn})
+			user.handleLoggedOut(err)
 			return
 		} else if errors.Is(err, whatsapp.ErrAlreadyLoggedIn) {
 			user.log.Warnln("Reconnection said we're already logged in, not trying anymore")
 			return
+		} else if errors.Is(err, whatsapp.ErrReplaced) {
+			// Retrying would just fight with the other client, the takeover logic decides whether to take it back
+			user.log.Warnln("Reconnection failed because another client is logged in, not retrying")
+			user.sendBridgeState(BridgeState{Error: WANotConnected})
+			return
 		} else {
 			user.log.Errorln("Error while trying to reconnect after disconnection:", err)
 		}
 		tries++
 		user.ConnectionErrors++
-		if user.ConnectionErrors <= user.bridge.Config.Bridge.MaxConnectionAttempts {
-			if exponentialBackoff {
-				delay = (1 << tries) + baseDelay
-			}
-			if user.bridge.Config.Bridge.ReportConnectionRetry {
-				user.sendBridgeNotice("Reconnection attempt failed: %v. Retrying in %d seconds...", err, delay)
+		if user.canRetryConnection() {
+			delay := user.reconnectDelay(tries)
+			user.log.Infofln("Reconnection attempt #%d failed, retrying in %s", tries, delay.Round(time.Millisecond))
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+				user.log.Debugln("tryReconnect context cancelled while waiting, aborting reconnection attempts")
+				return
 			}
-			time.Sleep(delay * time.Second)
 		}
 	}
 
 	user.sendBridgeState(BridgeState{Error: WANotConnected})
-	if user.bridge.Config.Bridge.ReportConnectionRetry {
+	if !user.wantsNotice(NoticeLevelErrors) {
+		return
+	} else if reportRetries {
 		user.sendMarkdownBridgeAlert("%d reconnection attempts failed. Use the `reconnect` command to try to reconnect manually.", tries)
 	} else {
 		user.sendMarkdownBridgeAlert("\u26a0 %s. Additionally, %d reconnection attempts failed. Use the `reconnect` command to try to reconnect.", msg, tries)
@@ -1095,7 +1693,12 @@ func (user *User) PortalKey(jid whatsapp.JID) database.PortalKey {
 }
 
 func (user *User) GetPortalByJID(jid whatsapp.JID) *Portal {
-	return user.bridge.GetPortalByJID(user.PortalKey(jid))
+	return user.bridge.GetPortalByJID(user.PortalKey(NormalizeJID(jid)))
+}
+
+// GetExistingPortalByJID is like GetPortalByJID, but returns nil instead of creating the portal if it doesn't exist.
+func (user *User) GetExistingPortalByJID(jid whatsapp.JID) *Portal {
+	return user.bridge.GetExistingPortalByJID(user.PortalKey(NormalizeJID(jid)))
 }
 
 func (user *User) runMessageRingBuffer() {
@@ -1129,13 +1732,12 @@ func (user *User) handleMessageLoop() {
 
 func (user *User) HandleNewContact(contact whatsapp.Contact) {
 	user.log.Debugfln("Contact message: %+v", contact)
-	if strings.HasSuffix(contact.JID, whatsapp.OldUserSuffix) {
-		contact.JID = strings.Replace(contact.JID, whatsapp.OldUserSuffix, whatsapp.NewUserSuffix, -1)
-	}
-	if strings.HasSuffix(contact.JID, whatsapp.NewUserSuffix) {
+	contact.JID = NormalizeJID(contact.JID)
+	switch GetJIDType(contact.JID) {
+	case JIDTypeUser:
 		puppet := user.bridge.GetPuppetByJID(contact.JID)
 		puppet.UpdateName(user, contact)
-	} else if strings.HasSuffix(contact.JID, whatsapp.BroadcastSuffix) {
+	case JIDTypeBroadcast, JIDTypeStatus:
 		portal := user.GetPortalByJID(contact.JID)
 		portal.UpdateName(contact.Name, "", nil, true)
 	}
@@ -1153,7 +1755,7 @@ func (user *User) HandleBatteryMessage(battery whatsapp.BatteryMessage) {
 	} else if battery.Percentage > 15 || battery.Plugged {
 		user.batteryWarningsSent = 0
 	}
-	if notice != "" {
+	if notice != "" && user.wantsNotice(NoticeLevelVerbose) {
 		go user.sendBridgeNotice("%s", notice)
 	}
 }
@@ -1199,52 +1801,91 @@ func (user *User) HandleCallInfo(info whatsapp.CallInfo) {
 	}
 }
 
+func (user *User) bridgeIncomingPresence() bool {
+	return user.bridge.Config.Bridge.Presence && user.IncomingPresence
+}
+
+func (user *User) bridgeIncomingTyping() bool {
+	return user.bridge.Config.Bridge.TypingNotifications && user.IncomingTyping
+}
+
 func (user *User) HandlePresence(info whatsapp.PresenceEvent) {
+	bridgePresence, bridgeTyping := user.bridgeIncomingPresence(), user.bridgeIncomingTyping()
+	if !bridgePresence && !bridgeTyping {
+		return
+	}
 	puppet := user.bridge.GetPuppetByJID(info.SenderJID)
+	puppet.typingLock.Lock()
+	defer puppet.typingLock.Unlock()
+	puppet.lastPresence = info.Status
+	puppet.lastPresenceAt = time.Now().Unix()
 	switch info.Status {
 	case whatsapp.PresenceUnavailable:
-		_ = puppet.DefaultIntent().SetPresence("offline")
+		puppet.stopTyping()
+		if bridgePresence {
+			_ = puppet.DefaultIntent().SetPresence("offline")
+		}
 	case whatsapp.PresenceAvailable:
-		if len(puppet.typingIn) > 0 && puppet.typingAt+15 > time.Now().Unix() {
-			portal := user.bridge.GetPortalByMXID(puppet.typingIn)
-			_, _ = puppet.IntentFor(portal).UserTyping(puppet.typingIn, false, 0)
-			puppet.typingIn = ""
-			puppet.typingAt = 0
-		} else {
+		// WhatsApp sends an available presence when the user stops typing, which doesn't mean they just came online
+		if !puppet.stopTyping() && bridgePresence {
 			_ = puppet.DefaultIntent().SetPresence("online")
 		}
+	case whatsapp.PresencePaused:
+		puppet.stopTyping()
 	case whatsapp.PresenceComposing:
+		if !bridgeTyping {
+			return
+		}
 		portal := user.GetPortalByJID(info.JID)
-		if len(puppet.typingIn) > 0 && puppet.typingAt+15 > time.Now().Unix() {
-			if puppet.typingIn == portal.MXID {
-				return
-			}
-			_, _ = puppet.IntentFor(portal).UserTyping(puppet.typingIn, false, 0)
+		if portal == nil || len(portal.MXID) == 0 {
+			return
 		}
-		puppet.typingIn = portal.MXID
-		puppet.typingAt = time.Now().Unix()
-		_, _ = puppet.IntentFor(portal).UserTyping(portal.MXID, true, 15*1000)
+		puppet.startTyping(portal)
 	}
 }
 
+// ackMessageFailed is the acknowledgement WhatsApp sends when a message couldn't be delivered.
+const ackMessageFailed whatsapp.Acknowledgement = -1
+
 func (user *User) HandleMsgInfo(info whatsapp.JSONMsgInfo) {
+	if (info.Command == whatsapp.MsgInfoCommandAck || info.Command == whatsapp.MsgInfoCommandAcks) && info.Acknowledgement == ackMessageFailed {
+		portal := user.GetExistingPortalByJID(info.ToJID)
+		if portal == nil || len(portal.MXID) == 0 {
+			return
+		}
+		for _, msg := range user.bridge.DB.Message.GetManyByJID(portal.Key, info.IDs...) {
+			portal.HandleDeliveryFailure(msg)
+		}
+		return
+	}
 	if (info.Command == whatsapp.MsgInfoCommandAck || info.Command == whatsapp.MsgInfoCommandAcks) && info.Acknowledgement == whatsapp.AckMessageRead {
-		portal := user.GetPortalByJID(info.ToJID)
-		if len(portal.MXID) == 0 {
+		if info.SenderJID == user.JID {
+			// Own read receipts are handled in markSelfRead
+			return
+		}
+		// Receipts for chats that were never bridged must not create portals
+		portal := user.GetExistingPortalByJID(info.ToJID)
+		if portal == nil || len(portal.MXID) == 0 {
 			return
 		}
 
-		intent := user.bridge.GetPuppetByJID(info.SenderJID).IntentFor(portal)
-		for _, msgID := range info.IDs {
-			msg := user.bridge.DB.Message.GetByJID(portal.Key, msgID)
-			if msg == nil || msg.IsFakeMXID() {
+		// Read receipts are cumulative on Matrix, so only mark the newest message in the ack as read.
+		var lastMsg *database.Message
+		for _, msg := range user.bridge.DB.Message.GetManyByJID(portal.Key, info.IDs...) {
+			if msg.IsFakeMXID() {
 				continue
+			} else if lastMsg == nil || msg.Timestamp >= lastMsg.Timestamp {
+				lastMsg = msg
 			}
+		}
+		if lastMsg == nil {
+			return
+		}
 
-			err := intent.MarkReadWithContent(portal.MXID, msg.MXID, &CustomReadReceipt{DoublePuppet: intent.IsCustomPuppet})
-			if err != nil {
-				user.log.Warnfln("Failed to mark message %s as read by %s: %v", msg.MXID, info.SenderJID, err)
-			}
+		intent := user.bridge.GetPuppetByJID(info.SenderJID).IntentFor(portal)
+		err := intent.MarkReadWithContent(portal.MXID, lastMsg.MXID, &CustomReadReceipt{DoublePuppet: intent.IsCustomPuppet})
+		if err != nil {
+			user.log.Warnfln("Failed to mark message %s as read by %s: %v", lastMsg.MXID, info.SenderJID, err)
 		}
 	}
 }
@@ -1263,9 +1904,7 @@ func (user *User) HandleReadMessage(read whatsapp.ReadMessage) {
 }
 
 func (user *User) markSelfRead(jid, messageID string) {
-	if strings.HasSuffix(jid, whatsapp.OldUserSuffix) {
-		jid = strings.Replace(jid, whatsapp.OldUserSuffix, whatsapp.NewUserSuffix, -1)
-	}
+	jid = NormalizeJID(jid)
 	puppet := user.bridge.GetPuppetByJID(user.JID)
 	if puppet == nil {
 		return
@@ -1274,14 +1913,14 @@ func (user *User) markSelfRead(jid, messageID string) {
 	if intent == nil {
 		return
 	}
-	portal := user.GetPortalByJID(jid)
-	if portal == nil {
+	portal := user.GetExistingPortalByJID(jid)
+	if portal == nil || len(portal.MXID) == 0 {
 		return
 	}
 	var message *database.Message
 	if messageID == "" {
 		message = user.bridge.DB.Message.GetLastInChat(portal.Key)
-		if message == nil {
+		if message == nil || message.IsFakeMXID() {
 			return
 		}
 		user.log.Debugfln("User read chat %s/%s in WhatsApp mobile (last known event: %s/%s)", portal.Key.JID, portal.MXID, message.JID, message.MXID)
@@ -1296,12 +1935,19 @@ func (user *User) markSelfRead(jid, messageID string) {
 	if err != nil {
 		user.log.Warnfln("Failed to bridge own read receipt in %s: %v", jid, err)
 	}
+	// Read receipts alone don't move the read marker in most clients, so set the fully read marker too
+	_, err = intent.MakeRequest(http.MethodPost, intent.BuildURL("rooms", portal.MXID, "read_markers"), map[string]id.EventID{
+		"m.fully_read": message.MXID,
+	}, nil)
+	if err != nil {
+		user.log.Warnfln("Failed to move fully read marker in %s: %v", jid, err)
+	}
 }
 
 func (user *User) HandleCommand(cmd whatsapp.JSONCommand) {
 	switch cmd.Type {
 	case whatsapp.CommandPicture:
-		if strings.HasSuffix(cmd.JID, whatsapp.NewUserSuffix) {
+		if GetJIDType(cmd.JID) == JIDTypeUser {
 			puppet := user.bridge.GetPuppetByJID(cmd.JID)
 			go puppet.UpdateAvatar(user, cmd.ProfilePicInfo)
 		} else if user.bridge.Config.Bridge.ChatMetaSync {
@@ -1311,12 +1957,13 @@ func (user *User) HandleCommand(cmd whatsapp.JSONCommand) {
 	case whatsapp.CommandDisconnect:
 		if cmd.Kind == "replaced" {
 			user.cleanDisconnection = true
-			go user.sendMarkdownBridgeAlert("\u26a0 Your WhatsApp connection was closed by the server because you opened another WhatsApp Web client.\n\n" +
-				"Use the `reconnect` command to disconnect the other client and resume bridging.")
+			user.handleTakeover()
 		} else {
 			user.log.Warnln("Unknown kind of disconnect:", string(cmd.Raw))
-			go user.sendMarkdownBridgeAlert("\u26a0 Your WhatsApp connection was closed by the server (reason code: %s).\n\n"+
-				"Use the `reconnect` command to reconnect.", cmd.Kind)
+			if user.wantsNotice(NoticeLevelErrors) {
+				go user.sendMarkdownBridgeAlert("\u26a0 Your WhatsApp connection was closed by the server (reason code: %s).\n\n"+
+					"Use the `reconnect` command to reconnect.", cmd.Kind)
+			}
 		}
 	}
 }
@@ -1328,7 +1975,9 @@ func (user *User) HandleChatUpdate(cmd whatsapp.ChatUpdate) {
 
 	portal := user.GetPortalByJID(cmd.JID)
 	if len(portal.MXID) == 0 {
-		if cmd.Data.Action == whatsapp.ChatActionIntroduce || cmd.Data.Action == whatsapp.ChatActionCreate {
+		if portal.Unbridged {
+			return
+		} else if cmd.Data.Action == whatsapp.ChatActionIntroduce || cmd.Data.Action == whatsapp.ChatActionCreate {
 			go func() {
 				err := portal.CreateMatrixRoom(user)
 				if err != nil {
@@ -1394,18 +2043,126 @@ func (user *User) HandleConnInfo(info whatsapp.ConnInfo) {
 		user.Update()
 	}
 	if len(info.PushName) > 0 {
+		if info.PushName != user.pushName && len(user.JID) > 0 {
+			// The JSON connection info is the only place where WhatsApp sends the user's own push name
+			go user.bridge.GetPuppetByJID(user.JID).UpdatePushName(user, info.PushName)
+		}
 		user.pushName = info.PushName
 	}
+	if len(info.Phone.WhatsAppVersion) > 0 {
+		user.phoneInfo = info
+	}
+}
+
+// LastActivity returns how long ago the last event from WhatsApp was received, or false if nothing has been received.
+func (user *User) LastActivity() (time.Duration, bool) {
+	ts := atomic.LoadInt64(&user.lastActivity)
+	if ts == 0 {
+		return 0, false
+	}
+	return time.Since(time.Unix(ts, 0)), true
+}
+
+func (user *User) HandleGroupInvite(info *waProto.WebMessageInfo) {
+	if info.GetKey().GetFromMe() || info.GetMessageTimestamp()+MaxMessageAgeToCreatePortal < uint64(time.Now().Unix()) {
+		return
+	}
+	invite := info.GetMessage().GetGroupInviteMessage()
+	senderJID := info.GetKey().GetRemoteJid()
+	if len(info.GetParticipant()) > 0 {
+		senderJID = info.GetParticipant()
+	}
+	sender := user.bridge.GetPuppetByJID(NormalizeJID(senderJID))
+	user.log.Debugfln("Received invite to %s from %s", invite.GetGroupJid(), sender.JID)
+	user.sendMarkdownBridgeAlert("%s invited you to the WhatsApp group %s. Use `join %s%s` to join the group.",
+		sender.Displayname, invite.GetGroupName(), inviteLinkPrefix, invite.GetInviteCode())
 }
 
 func (user *User) HandleJSONMessage(evt whatsapp.RawJSONMessage) {
-	if !json.Valid(evt.RawMessage) {
+	if !isParseableJSONMessage(evt.RawMessage) {
+		user.HandleJSONParseError(fmt.Errorf("unparseable JSON message with tag %s", evt.Tag))
 		return
 	}
+	atomic.StoreInt32(&user.parseErrors, 0)
 	user.log.Debugfln("JSON message with tag %s: %s", evt.Tag, evt.RawMessage)
 	user.updateLastConnectionIfNecessary()
 }
 
+// isParseableJSONMessage checks that a raw JSON message has the structure go-whatsapp expects.
+// go-whatsapp only logs JSON parse errors and drops the message, but it passes the raw message
+// to handlers regardless, so this is the only place where parse errors can be noticed.
+func isParseableJSONMessage(data json.RawMessage) bool {
+	var msg []json.RawMessage
+	if json.Unmarshal(data, &msg) != nil || len(msg) < 2 {
+		return false
+	}
+	var msgType string
+	return json.Unmarshal(msg[0], &msgType) == nil
+}
+
+// countParseError increments the consecutive parse error counter and returns true (and resets the counter)
+// if the configured reconnect threshold was reached.
+func (user *User) countParseError() (int32, bool) {
+	count := atomic.AddInt32(&user.parseErrors, 1)
+	threshold := user.bridge.Config.Bridge.ParseErrorReconnect
+	if threshold <= 0 || int(count) < threshold {
+		return count, false
+	}
+	return count, atomic.CompareAndSwapInt32(&user.parseErrors, count, 0)
+}
+
+// HandleJSONParseError counts consecutive messages from WhatsApp that couldn't be parsed.
+// Repeated parse errors usually mean the connection is out of sync, which only a reconnect fixes.
+func (user *User) HandleJSONParseError(err error) {
+	count, tripped := user.countParseError()
+	user.log.Warnfln("Failed to parse message from WhatsApp (%d in a row): %v", count, err)
+	if !tripped || user.Conn == nil {
+		return
+	}
+	// This is called from the websocket read loop and Disconnect waits for the loop to exit,
+	// so the connection must be reset in another goroutine.
+	go user.resetConnectionAfterParseErrors(count)
+}
+
+func (user *User) resetConnectionAfterParseErrors(count int32) {
+	conn := user.Conn
+	if conn == nil {
+		return
+	}
+	user.log.Warnfln("Got %d consecutive parse errors, resetting connection", count)
+	disconnectErr := conn.Disconnect()
+	if disconnectErr != nil && disconnectErr != whatsapp.ErrNotConnected {
+		user.log.Warnln("Failed to disconnect after parse errors:", disconnectErr)
+	}
+	user.bridge.Metrics.TrackDisconnection(user.MXID)
+	user.ConnectionErrors++
+	msg := fmt.Sprintf("Received %d unparseable messages from WhatsApp in a row, so the connection was reset", count)
+	if user.wantsNotice(NoticeLevelErrors) && !(user.bridge.Config.Bridge.ReportConnectionRetry && user.wantsNotice(NoticeLevelVerbose)) {
+		// tryReconnect only reports the reason itself when connection retry reporting is enabled
+		user.sendBridgeNotice("%s. Reconnecting...", msg)
+	}
+	user.tryReconnect(msg)
+}
+
+// markEditRevocation remembers that the next revocation of the given message is actually an edit.
+// go-whatsapp dispatches the parsed revocation right after the raw message, so it's only stored briefly.
+func (user *User) markEditRevocation(id whatsapp.MessageID) {
+	user.editedMessagesLock.Lock()
+	if user.editedMessages == nil {
+		user.editedMessages = make(map[whatsapp.MessageID]struct{})
+	}
+	user.editedMessages[id] = struct{}{}
+	user.editedMessagesLock.Unlock()
+}
+
+func (user *User) isEditRevocation(revocation whatsapp.MessageRevocation) bool {
+	user.editedMessagesLock.Lock()
+	defer user.editedMessagesLock.Unlock()
+	_, ok := user.editedMessages[revocation.Id]
+	delete(user.editedMessages, revocation.Id)
+	return ok
+}
+
 func (user *User) NeedsRelaybot(portal *Portal) bool {
 	return !user.HasSession() || !user.IsInPortal(portal.Key)
 }
@@ -0,0 +1,485 @@
+// mautrix-whatsapp - A Matrix-WhatsApp puppeting bridge.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Rhymen/go-whatsapp"
+	waProto "github.com/Rhymen/go-whatsapp/binary/proto"
+	"gopkg.in/yaml.v2"
+
+	log "maunium.net/go/maulogger/v2"
+	"maunium.net/go/mautrix/appservice"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"maunium.net/go/mautrix-whatsapp/config"
+	"maunium.net/go/mautrix-whatsapp/database"
+)
+
+// newTestBridge returns a bridge with a fresh SQLite database and no Matrix connection,
+// so any attempt to send something to Matrix panics unless connectTestHomeserver is used.
+func newTestBridge(t *testing.T) *Bridge {
+	db, err := database.New("sqlite3", filepath.Join(t.TempDir(), "test.db"), log.Sub("Test"))
+	if err != nil {
+		t.Fatal("Failed to open database:", err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+	if err = db.Init(); err != nil {
+		t.Fatal("Failed to upgrade database:", err)
+	}
+	return &Bridge{
+		Config:          &config.Config{},
+		DB:              db,
+		Log:             log.Sub("Test"),
+		usersByMXID:     make(map[id.UserID]*User),
+		usersByJID:      make(map[whatsapp.JID]*User),
+		managementRooms: make(map[id.RoomID]*User),
+		portalsByMXID:   make(map[id.RoomID]*Portal),
+		portalsByJID:    make(map[database.PortalKey]*Portal),
+
+		puppets:             make(map[whatsapp.JID]*Puppet),
+		puppetsByCustomMXID: make(map[id.UserID]*Puppet),
+	}
+}
+
+// testHomeserver is a fake homeserver for a single portal room that keeps track of the room membership,
+// power levels and sent events.
+type testHomeserver struct {
+	lock        sync.Mutex
+	joined      map[id.UserID]bool
+	invited     map[id.UserID]bool
+	kicked      map[id.UserID]bool
+	powerLevels *event.PowerLevelsEventContent
+	sent        []testSentEvent
+	// readBy maps event IDs to the users who sent a read receipt for them
+	readBy   map[id.EventID][]id.UserID
+	presence map[id.UserID]string
+	typing   map[id.UserID]bool
+}
+
+type testSentEvent struct {
+	ID      id.EventID
+	Sender  id.UserID
+	Type    string
+	Content map[string]interface{}
+}
+
+// connectTestHomeserver makes the test bridge talk to a fake homeserver instead of panicking on Matrix requests.
+func connectTestHomeserver(t *testing.T, bridge *Bridge) *testHomeserver {
+	hs := &testHomeserver{
+		joined:   make(map[id.UserID]bool),
+		invited:  make(map[id.UserID]bool),
+		kicked:   make(map[id.UserID]bool),
+		readBy:   make(map[id.EventID][]id.UserID),
+		presence: make(map[id.UserID]string),
+		typing:   make(map[id.UserID]bool),
+	}
+	server := httptest.NewServer(hs)
+	t.Cleanup(server.Close)
+
+	err := yaml.Unmarshal([]byte(`
+username_template: whatsapp_{{.}}
+displayname_template: "{{if .Notify}}{{.Notify}}{{else}}{{.Jid}}{{end}} (WA)"
+group_admin_power_level: 50
+group_superadmin_power_level: 75
+portal_room:
+    join_rule: invite
+    history_visibility: shared
+`), &bridge.Config.Bridge)
+	if err != nil {
+		t.Fatal("Failed to parse test bridge config:", err)
+	}
+	bridge.Config.Homeserver.Domain = "example.com"
+	bridge.StateStore = database.NewSQLStateStore(bridge.DB)
+	bridge.AS = appservice.Create()
+	bridge.AS.HomeserverURL = server.URL
+	bridge.AS.HomeserverDomain = "example.com"
+	bridge.AS.Registration = &appservice.Registration{AppToken: "as_token", SenderLocalpart: "whatsappbot"}
+	bridge.AS.Log = log.Sub("Matrix")
+	bridge.AS.StateStore = bridge.StateStore
+	bridge.Bot = bridge.AS.BotIntent()
+	return hs
+}
+
+func (hs *testHomeserver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	hs.lock.Lock()
+	defer hs.lock.Unlock()
+	userID := id.UserID(r.URL.Query().Get("user_id"))
+	body, _ := ioutil.ReadAll(r.Body)
+	var req map[string]interface{}
+	_ = json.Unmarshal(body, &req)
+	resp := map[string]interface{}{}
+	path := strings.Split(strings.TrimPrefix(r.URL.Path, "/_matrix/client/r0/"), "/")
+	if len(path) == 3 && path[0] == "presence" && path[2] == "status" {
+		hs.presence[id.UserID(path[1])], _ = req["presence"].(string)
+	} else if len(path) >= 3 && path[0] == "rooms" {
+		switch path[2] {
+		case "join":
+			hs.joined[userID] = true
+			resp["room_id"] = path[1]
+		case "invite":
+			hs.invited[id.UserID(req["user_id"].(string))] = true
+		case "kick":
+			target := id.UserID(req["user_id"].(string))
+			delete(hs.joined, target)
+			hs.kicked[target] = true
+		case "joined_members":
+			joined := make(map[id.UserID]interface{})
+			for member := range hs.joined {
+				joined[member] = map[string]interface{}{}
+			}
+			resp["joined"] = joined
+		case "state":
+			if path[3] != event.StatePowerLevels.Type {
+				break
+			} else if r.Method == http.MethodGet && hs.powerLevels == nil {
+				w.WriteHeader(http.StatusNotFound)
+				resp["errcode"] = "M_NOT_FOUND"
+			} else if r.Method == http.MethodGet {
+				_ = json.NewEncoder(w).Encode(hs.powerLevels)
+				return
+			} else {
+				hs.powerLevels = &event.PowerLevelsEventContent{}
+				_ = json.Unmarshal(body, hs.powerLevels)
+				resp["event_id"] = "$power_levels"
+			}
+		case "send":
+			evt := testSentEvent{
+				ID:      id.EventID(fmt.Sprintf("$event%d", len(hs.sent)+1)),
+				Sender:  userID,
+				Type:    path[3],
+				Content: req,
+			}
+			hs.sent = append(hs.sent, evt)
+			resp["event_id"] = evt.ID
+		case "event":
+			// Events aren't stored, so fetching them always fails
+			w.WriteHeader(http.StatusNotFound)
+			resp["errcode"] = "M_NOT_FOUND"
+		case "typing":
+			hs.typing[id.UserID(path[3])], _ = req["typing"].(bool)
+		case "receipt":
+			evtID := id.EventID(path[4])
+			hs.readBy[evtID] = append(hs.readBy[evtID], userID)
+		}
+	}
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+func TestFilterChangedContacts(t *testing.T) {
+	user := &User{}
+	contacts := []whatsapp.Contact{
+		{JID: "11111111111@s.whatsapp.net", Name: "Alice", Notify: "alice"},
+		{JID: "22222222222@s.whatsapp.net", Name: "Bob", Notify: "bob"},
+		{JID: "33333333333@s.whatsapp.net", Name: "Carol", Notify: "carol"},
+	}
+	if changed := user.filterChangedContacts(contacts); len(changed) != len(contacts) {
+		t.Fatalf("expected all %d contacts to be new in the first update, got %d", len(contacts), len(changed))
+	}
+
+	contacts[1].Name = "Robert"
+	changed := user.filterChangedContacts(contacts)
+	if len(changed) != 1 {
+		t.Fatalf("expected exactly one changed contact after renaming one, got %d: %+v", len(changed), changed)
+	} else if contact, ok := changed[contacts[1].JID]; !ok || contact.Name != "Robert" {
+		t.Errorf("expected the renamed contact to be returned, got %+v", changed)
+	}
+
+	if changed = user.filterChangedContacts(contacts); len(changed) != 0 {
+		t.Errorf("expected no changes when the same list is received again, got %+v", changed)
+	}
+}
+
+func TestHandleMsgInfoNeverBridgedChat(t *testing.T) {
+	bridge := newTestBridge(t)
+	dbUser := bridge.DB.User.New()
+	dbUser.MXID = "@alice:example.com"
+	dbUser.JID = "15551234567@s.whatsapp.net"
+	user := &User{User: dbUser, bridge: bridge, log: log.Sub("Test")}
+
+	chatJID := "15559876543@c.us"
+	for _, ack := range []whatsapp.Acknowledgement{whatsapp.AckMessageRead, ackMessageFailed} {
+		user.HandleMsgInfo(whatsapp.JSONMsgInfo{
+			Command:         whatsapp.MsgInfoCommandAck,
+			IDs:             whatsapp.JSONStringOrArray{"MSGID"},
+			Acknowledgement: ack,
+			SenderJID:       chatJID,
+			ToJID:           chatJID,
+		})
+	}
+	if portal := bridge.DB.Portal.GetByJID(user.PortalKey(NormalizeJID(chatJID))); portal != nil {
+		t.Errorf("Receipt for a chat that was never bridged created a portal: %+v", portal.Key)
+	}
+
+	// A portal without a room (e.g. unbridged) with a known message must not get receipts either
+	key := user.PortalKey("15550000000@s.whatsapp.net")
+	portal := bridge.GetPortalByJID(key)
+	msg := bridge.DB.Message.New()
+	msg.Chat = key
+	msg.JID = "KNOWN"
+	msg.MXID = "$known"
+	msg.Sent = true
+	msg.Insert()
+	user.HandleMsgInfo(whatsapp.JSONMsgInfo{
+		Command:         whatsapp.MsgInfoCommandAck,
+		IDs:             whatsapp.JSONStringOrArray{"KNOWN"},
+		Acknowledgement: whatsapp.AckMessageRead,
+		SenderJID:       key.JID,
+		ToJID:           key.JID,
+	})
+	if len(portal.MXID) != 0 {
+		t.Errorf("Portal unexpectedly got a room: %s", portal.MXID)
+	}
+}
+
+func TestParseErrorCounterTrips(t *testing.T) {
+	bridge := newTestBridge(t)
+	bridge.Config.Bridge.ParseErrorReconnect = 3
+	dbUser := bridge.DB.User.New()
+	dbUser.MXID = "@alice:example.com"
+	dbUser.LastConnection = time.Now().Unix()
+	user := &User{User: dbUser, bridge: bridge, log: log.Sub("Test")}
+
+	invalid := whatsapp.RawJSONMessage{RawMessage: json.RawMessage(`{"not": "an array"}`), Tag: "s1"}
+	valid := whatsapp.RawJSONMessage{RawMessage: json.RawMessage(`["Presence",{"id":"123@c.us","type":"available"}]`), Tag: "s2"}
+
+	// A successfully parsed message in between resets the counter
+	user.HandleJSONMessage(invalid)
+	user.HandleJSONMessage(invalid)
+	user.HandleJSONMessage(valid)
+	if count := atomic.LoadInt32(&user.parseErrors); count != 0 {
+		t.Fatalf("Expected a valid message to reset the parse error counter, got %d", count)
+	}
+
+	user.HandleJSONMessage(invalid)
+	user.HandleJSONMessage(invalid)
+	if count, tripped := user.countParseError(); !tripped || count != 3 {
+		t.Fatalf("Expected the third consecutive parse error to trip the counter, got count %d, tripped %t", count, tripped)
+	} else if count = atomic.LoadInt32(&user.parseErrors); count != 0 {
+		t.Errorf("Expected the counter to be reset after tripping, got %d", count)
+	}
+
+	bridge.Config.Bridge.ParseErrorReconnect = 0
+	for i := 0; i < 10; i++ {
+		if _, tripped := user.countParseError(); tripped {
+			t.Fatal("Counter tripped even though reconnecting after parse errors is disabled")
+		}
+	}
+}
+
+func TestIsParseableJSONMessage(t *testing.T) {
+	tests := []struct {
+		data      string
+		parseable bool
+	}{
+		{`["Presence",{"id":"123@c.us"}]`, true},
+		{`["Stream","update",false,"2.2121.6"]`, true},
+		{`["Presence"]`, false},
+		{`[1,{"id":"123@c.us"}]`, false},
+		{`{"status":200}`, false},
+		{`["Presence",{`, false},
+	}
+	for _, test := range tests {
+		if parseable := isParseableJSONMessage(json.RawMessage(test.data)); parseable != test.parseable {
+			t.Errorf("isParseableJSONMessage(%s) = %t, expected %t", test.data, parseable, test.parseable)
+		}
+	}
+}
+
+func TestStreamSleepMarksPhoneOffline(t *testing.T) {
+	bridge := newTestBridge(t)
+	dbUser := bridge.DB.User.New()
+	dbUser.MXID = "@alice:example.com"
+	user := &User{User: dbUser, bridge: bridge, log: log.Sub("Test")}
+
+	user.HandleStreamEvent(whatsapp.StreamEvent{Type: whatsapp.StreamSleep})
+	if atomic.LoadInt32(&user.phoneAsleep) != 1 {
+		t.Fatal("Expected a sleeping stream to mark the phone as asleep")
+	}
+	user.HandleStreamEvent(whatsapp.StreamEvent{Type: whatsapp.StreamSleep})
+	if atomic.LoadInt32(&user.phoneAsleep) != 1 {
+		t.Fatal("Expected a repeated sleep event to keep the phone asleep")
+	}
+	user.HandleStreamEvent(whatsapp.StreamEvent{Type: whatsapp.StreamUpdate, Version: "2.2121.6"})
+	if atomic.LoadInt32(&user.phoneAsleep) != 0 {
+		t.Error("Expected a stream update to mark the phone as awake")
+	}
+}
+
+func TestPrivateChatRoundTrip(t *testing.T) {
+	bridge := newTestBridge(t)
+	hs := connectTestHomeserver(t, bridge)
+	bridge.Formatter = NewFormatter(bridge)
+	const contact = "15550000002@s.whatsapp.net"
+	dbUser := bridge.DB.User.New()
+	dbUser.MXID = "@alice:example.com"
+	dbUser.JID = "15550000001@s.whatsapp.net"
+	dbUser.Session = &whatsapp.Session{}
+	dbUser.Insert()
+	user := &User{User: dbUser, bridge: bridge, log: log.Sub("Test")}
+	bridge.GetPuppetByJID(contact).Displayname = "Bob (WA)"
+	portal := bridge.GetPortalByJID(user.PortalKey(contact))
+	portal.MXID = "!dm:example.com"
+	portal.Update()
+	if err := dbUser.SetPortalKeys([]database.PortalKeyWithMeta{{PortalKey: portal.Key}}); err != nil {
+		t.Fatal("Failed to add portal to user:", err)
+	}
+
+	// Matrix -> WhatsApp: the message is stored with the WhatsApp message ID before it's sent
+	evt := &event.Event{
+		ID:        "$from-matrix",
+		Sender:    user.MXID,
+		RoomID:    portal.MXID,
+		Type:      event.EventMessage,
+		Timestamp: time.Now().UnixNano() / int64(time.Millisecond),
+		Content:   event.Content{Parsed: &event.MessageEventContent{MsgType: event.MsgText, Body: "Hello from Matrix"}},
+	}
+	info, sender := portal.convertMatrixMessage(user, evt)
+	if info == nil {
+		t.Fatal("Matrix message wasn't converted")
+	} else if text, _, _, _ := getEditableText(info.Message); text != "Hello from Matrix" || info.GetKey().GetRemoteJid() != contact {
+		t.Fatalf("Matrix message was converted incorrectly: %+v", info)
+	}
+	portal.markHandledRelayed(sender, "", info, evt.ID, false).MarkSent()
+	sent := bridge.DB.Message.GetByMXID(evt.ID)
+	if sent == nil || sent.JID != info.GetKey().GetId() || sent.Sender != user.JID || !sent.FromMatrix || !sent.Sent {
+		t.Fatalf("Sent Matrix message wasn't stored correctly: %+v", sent)
+	}
+
+	// The read receipt from WhatsApp is bridged from the contact's puppet to the original Matrix event
+	user.HandleMsgInfo(whatsapp.JSONMsgInfo{
+		Command:         whatsapp.MsgInfoCommandAck,
+		IDs:             whatsapp.JSONStringOrArray{sent.JID},
+		Acknowledgement: whatsapp.AckMessageRead,
+		SenderJID:       contact,
+		ToJID:           contact,
+	})
+	if readBy := hs.readBy[evt.ID]; len(readBy) != 1 || readBy[0] != bridge.FormatPuppetMXID(contact) {
+		t.Errorf("Expected the contact's puppet to mark %s as read, got %v", evt.ID, readBy)
+	}
+
+	// WhatsApp -> Matrix: the message is sent from the contact's puppet and stored with the Matrix event ID
+	chatJID, msgID, text := contact, "3EB0FROMWHATSAPP", "Hello from WhatsApp"
+	fromMe := false
+	timestamp := uint64(time.Now().Unix())
+	source := &waProto.WebMessageInfo{
+		Key:              &waProto.MessageKey{RemoteJid: &chatJID, Id: &msgID, FromMe: &fromMe},
+		MessageTimestamp: &timestamp,
+		Message:          &waProto.Message{Conversation: &text},
+	}
+	portal.HandleTextMessage(user, whatsapp.TextMessage{Info: whatsapp.MessageInfo{
+		Id:        msgID,
+		RemoteJid: contact,
+		Timestamp: timestamp,
+		Source:    source,
+	}, Text: text})
+	if len(hs.sent) != 1 {
+		t.Fatalf("Expected one event to be sent to Matrix, got %d", len(hs.sent))
+	}
+	received := hs.sent[0]
+	if received.Sender != bridge.FormatPuppetMXID(contact) || received.Type != event.EventMessage.Type || received.Content["body"] != text {
+		t.Errorf("WhatsApp message was bridged incorrectly: %+v", received)
+	}
+	stored := bridge.DB.Message.GetByJID(portal.Key, msgID)
+	if stored == nil || stored.MXID != received.ID || stored.Sender != contact || stored.FromMatrix || stored.Content.GetConversation() != text {
+		t.Errorf("Received WhatsApp message wasn't stored correctly: %+v", stored)
+	}
+}
+
+func TestShutdownClearsPuppetPresence(t *testing.T) {
+	bridge := newTestBridge(t)
+	hs := connectTestHomeserver(t, bridge)
+	online := bridge.GetPuppetByJID("15550000001@s.whatsapp.net")
+	online.lastPresence = whatsapp.PresenceAvailable
+	offline := bridge.GetPuppetByJID("15550000002@s.whatsapp.net")
+	offline.lastPresence = whatsapp.PresenceUnavailable
+	unknown := bridge.GetPuppetByJID("15550000003@s.whatsapp.net")
+
+	for _, puppet := range []*Puppet{online, offline, unknown} {
+		puppet.clearPresence()
+	}
+	if presence := hs.presence[online.MXID]; presence != "offline" {
+		t.Errorf("Expected online puppet to be set offline, got presence %q", presence)
+	} else if online.lastPresence != whatsapp.PresenceUnavailable {
+		t.Errorf("Expected last presence of online puppet to be cleared, got %q", online.lastPresence)
+	}
+	if len(hs.presence) != 1 {
+		t.Errorf("Expected only the online puppet's presence to be changed, got %v", hs.presence)
+	}
+}
+
+func TestTypingSuppressionExpires(t *testing.T) {
+	bridge := newTestBridge(t)
+	hs := connectTestHomeserver(t, bridge)
+	bridge.Config.Bridge.TypingTimeout = 1
+	bridge.Config.Bridge.MaxTypingDuration = 1
+	portal := &Portal{Portal: bridge.DB.Portal.New(), bridge: bridge, log: log.Sub("Test")}
+	portal.Key = database.NewPortalKey("15550000001@s.whatsapp.net", "15550000009@s.whatsapp.net")
+	portal.MXID = "!typing:example.com"
+	puppet := bridge.GetPuppetByJID("15550000001@s.whatsapp.net")
+
+	isTyping := func() bool {
+		hs.lock.Lock()
+		defer hs.lock.Unlock()
+		return hs.typing[puppet.MXID]
+	}
+	startTyping := func() {
+		puppet.typingLock.Lock()
+		defer puppet.typingLock.Unlock()
+		puppet.startTyping(portal)
+	}
+
+	startTyping()
+	if !isTyping() {
+		t.Fatal("Expected typing notification to be started")
+	}
+	puppet.typingLock.Lock()
+	puppet.typingStartedAt -= 2
+	puppet.typingLock.Unlock()
+	startTyping()
+	if isTyping() {
+		t.Fatal("Expected typing notification to be stopped after the max duration")
+	}
+	startTyping()
+	if isTyping() {
+		t.Fatal("Expected typing notification to stay suppressed before the timeout")
+	}
+
+	time.Sleep(1500 * time.Millisecond)
+	puppet.typingLock.Lock()
+	typingIn := puppet.typingIn
+	puppet.typingLock.Unlock()
+	if len(typingIn) != 0 {
+		t.Fatalf("Expected suppressed typing session to be cleared after the timeout, still in %s", typingIn)
+	}
+	startTyping()
+	if !isTyping() {
+		t.Error("Expected typing notification to be started again after the suppression expired")
+	}
+}